@@ -0,0 +1,59 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sapcc/baremetal_temper/pkg/node"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "compares the node's hardware against its last snapshot, netbox and ironic ports",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := loadNodes(); err != nil {
+			log.Errorf("error loading nodes: %s", err.Error())
+			return
+		}
+		for _, na := range nodes {
+			n, err := node.New(na, cfg)
+			if err != nil {
+				log.Errorf("error node %s: %s", na, err.Error())
+				continue
+			}
+			drift, err := n.Diff()
+			if err != nil {
+				log.Errorf("cannot diff node %s: %s", na, err.Error())
+				continue
+			}
+			b, err := json.MarshalIndent(map[string]interface{}{"node": na, "drift": drift}, "", "  ")
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			fmt.Println(string(b))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,87 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/netbox"
+	"github.com/sapcc/baremetal_temper/pkg/node"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var lintSite string
+var lintRole string
+
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "validates the baremetal.temper config context of all devices of a site",
+	Run: func(cmd *cobra.Command, args []string) {
+		if lintSite == "" {
+			log.Error("missing --site")
+			os.Exit(1)
+		}
+		nc, err := clients.NewNetbox(cfg, log.WithFields(log.Fields{"cmd": "lint"}))
+		if err != nil {
+			log.Errorf("cannot create netbox client: %s", err.Error())
+			os.Exit(1)
+		}
+		devices, err := nc.LoadSiteDevices(lintSite, lintRole)
+		if err != nil {
+			log.Errorf("cannot load devices of site %s: %s", lintSite, err.Error())
+			os.Exit(1)
+		}
+		tasks := node.TaskNames(cfg)
+		invalid := 0
+		for _, d := range devices {
+			name := fmt.Sprintf("%d", d.ID)
+			if d.Name != nil {
+				name = *d.Name
+			}
+			_, err := netbox.ParseTemperContext(d.ConfigContext, cfg, tasks)
+			switch e := err.(type) {
+			case nil:
+				fmt.Printf("%s: ok\n", name)
+			case netbox.ContextErrors:
+				invalid++
+				for _, ce := range e {
+					fmt.Printf("%s: %s\n", name, ce.Error())
+				}
+			default:
+				if err == netbox.ErrNoTemperContext {
+					fmt.Printf("%s: %s\n", name, err.Error())
+					continue
+				}
+				invalid++
+				fmt.Printf("%s: %s\n", name, err.Error())
+			}
+		}
+		fmt.Printf("%d of %d devices have an invalid config context\n", invalid, len(devices))
+		if invalid > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	lintCmd.PersistentFlags().StringVar(&lintSite, "site", "", "netbox site slug of the devices to lint")
+	lintCmd.PersistentFlags().StringVar(&lintRole, "role", "server", "netbox device role of the devices to lint")
+	rootCmd.AddCommand(lintCmd)
+}
@@ -75,11 +75,25 @@ func InitConfig() {
 	viper.BindEnv("redfish.password", "redfish_password")
 	viper.SetDefault("redfish.bootImage", "")
 	viper.BindEnv("redfish.bootImage", "redfish_bootImage")
+	viper.SetDefault("redfish.insecure", true)
+	viper.BindEnv("redfish.insecure", "redfish_insecure")
+	viper.SetDefault("redfish.maxConnections", 2)
+	viper.BindEnv("redfish.maxConnections", "redfish_maxConnections")
+	viper.SetDefault("redfish.bmc.password", "")
+	viper.BindEnv("redfish.bmc.password", "redfish_bmc_password")
 
 	viper.SetDefault("netbox.token", "")
 	viper.BindEnv("netbox.token", "netbox_token")
 	viper.SetDefault("netbox.host", "")
 	viper.BindEnv("netbox.host", "netbox_host")
+	viper.SetDefault("netbox.version", "")
+	viper.BindEnv("netbox.version", "netbox_version")
+	viper.SetDefault("netbox.cacheTTL", "10m")
+	viper.BindEnv("netbox.cacheTTL", "netbox_cacheTTL")
+	viper.SetDefault("netbox.ironicNodeURL", "")
+	viper.BindEnv("netbox.ironicNodeURL", "netbox_ironicNodeURL")
+	viper.SetDefault("netbox.instanceURL", "")
+	viper.BindEnv("netbox.instanceURL", "netbox_instanceURL")
 
 	viper.SetDefault("openstack.user", "")
 	viper.BindEnv("openstack.user", "openstack_user")
@@ -125,6 +139,60 @@ func InitConfig() {
 	viper.SetDefault("deployment.openstack.domainName", "")
 	viper.BindEnv("deployment.openstack.domainName", "deployment_openstack_domainName")
 
+	viper.SetDefault("recorder.mode", "")
+	viper.BindEnv("recorder.mode", "recorder_mode")
+	viper.SetDefault("recorder.path", "")
+	viper.BindEnv("recorder.path", "recorder_path")
+
+	viper.SetDefault("agent.secret", "")
+	viper.BindEnv("agent.secret", "agent_secret")
+	viper.SetDefault("agent.timeout", "15m")
+	viper.BindEnv("agent.timeout", "agent_timeout")
+	viper.SetDefault("agent.listen", "")
+	viper.BindEnv("agent.listen", "agent_listen")
+
+	viper.SetDefault("diagnostics.policy", "")
+	viper.BindEnv("diagnostics.policy", "diagnostics_policy")
+	viper.SetDefault("diagnostics.resultsPath", "")
+	viper.BindEnv("diagnostics.resultsPath", "diagnostics_resultsPath")
+	viper.SetDefault("diagnostics.epsa.runMode", "Extended")
+	viper.BindEnv("diagnostics.epsa.runMode", "diagnostics_epsa_runMode")
+	viper.SetDefault("diagnostics.epsa.rebootType", "GracefulRebootWithForcedShutdown")
+	viper.BindEnv("diagnostics.epsa.rebootType", "diagnostics_epsa_rebootType")
+	viper.SetDefault("diagnostics.epsa.maxRetries", 3)
+	viper.BindEnv("diagnostics.epsa.maxRetries", "diagnostics_epsa_maxRetries")
+	viper.SetDefault("diagnostics.epsa.timeout", "240m")
+	viper.BindEnv("diagnostics.epsa.timeout", "diagnostics_epsa_timeout")
+	viper.SetDefault("diagnostics.maxExtendedPerRack", 0)
+	viper.BindEnv("diagnostics.maxExtendedPerRack", "diagnostics_maxExtendedPerRack")
+	viper.SetDefault("diagnostics.rackSlotField", "temper_rack_slot")
+	viper.BindEnv("diagnostics.rackSlotField", "diagnostics_rackSlotField")
+
+	viper.SetDefault("ipam.primaryRole", "")
+	viper.BindEnv("ipam.primaryRole", "ipam_primaryRole")
+	viper.SetDefault("ipam.bmcRole", "bmc")
+	viper.BindEnv("ipam.bmcRole", "ipam_bmcRole")
+	viper.SetDefault("ipam.primaryInterface", "L1")
+	viper.BindEnv("ipam.primaryInterface", "ipam_primaryInterface")
+	viper.SetDefault("ipam.bmcInterface", "")
+	viper.BindEnv("ipam.bmcInterface", "ipam_bmcInterface")
+	viper.SetDefault("ipam.rackTag", "rack-%s")
+	viper.BindEnv("ipam.rackTag", "ipam_rackTag")
+
+	viper.SetDefault("burnin.image", "")
+	viper.BindEnv("burnin.image", "burnin_image")
+	viper.SetDefault("burnin.timeout", "12h")
+	viper.BindEnv("burnin.timeout", "burnin_timeout")
+	viper.SetDefault("burnin.plan.memtestMinutes", 120)
+	viper.SetDefault("burnin.plan.stressCpuMinutes", 240)
+	viper.SetDefault("burnin.plan.fioMinutes", 60)
+	viper.SetDefault("burnin.plan.iperfSeconds", 300)
+
+	viper.SetDefault("linkCheck.mtu", 0)
+	viper.BindEnv("linkCheck.mtu", "linkCheck_mtu")
+	viper.SetDefault("linkCheck.lacp", true)
+	viper.BindEnv("linkCheck.lacp", "linkCheck_lacp")
+
 	if cfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(cfgFile)
@@ -10,6 +10,7 @@ import (
 
 	"github.com/evalphobia/logrus_sentry"
 	"github.com/sapcc/baremetal_temper/cmd"
+	"github.com/sapcc/baremetal_temper/pkg/clients"
 	"github.com/sapcc/baremetal_temper/pkg/config"
 	"github.com/sapcc/baremetal_temper/pkg/scheduler"
 	"github.com/sirupsen/logrus"
@@ -56,6 +57,7 @@ func main() {
 	go func() {
 		for range c {
 			cancel()
+			clients.LogoutAll()
 			os.Exit(0)
 		}
 	}()
@@ -17,12 +17,15 @@
 package cmd
 
 import (
+	"net/http"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/sapcc/baremetal_temper/pkg/node"
+	"github.com/sapcc/baremetal_temper/pkg/server"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -30,6 +33,7 @@ import (
 var tasks []string
 var workers int
 var flavorPrivateAccess bool
+var approveCableReconcile bool
 
 var runCmd = &cobra.Command{
 	Use:   "run",
@@ -45,11 +49,17 @@ var runCmd = &cobra.Command{
 		if workers == 0 {
 			limiter = nil
 		}
+		if approveCableReconcile {
+			cfg.CableCheck.ApproveReconcile = true
+		}
 		if flavorPrivateAccess {
 			cfg.FlavorAccessType = flavors.PrivateAccess
 		} else {
 			cfg.FlavorAccessType = flavors.PublicAccess
 		}
+		if cfg.Agent.Listen != "" {
+			serveAgent()
+		}
 		for _, na := range nodes {
 			n, err := node.New(na, cfg)
 			if err != nil {
@@ -58,7 +68,7 @@ var runCmd = &cobra.Command{
 			}
 			wg.Add(1)
 			for _, t := range tasks {
-				s := strings.Split(t, ".")
+				s := strings.SplitN(t, ".", 2)
 				if len(s) != 2 {
 					log.Error("wrong task format. It should be [service].[task]")
 					continue
@@ -76,9 +86,27 @@ var runCmd = &cobra.Command{
 	},
 }
 
+// serveAgent receives the boot image agent reports of the cable check and serves the burn-in plans and results during the run
+func serveAgent() {
+	h := server.New(cfg, log.WithFields(log.Fields{"temper": "agent"}), nil)
+	h.RegisterAgentRoute()
+	srv := &http.Server{
+		Addr:         cfg.Agent.Listen,
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		Handler:      h.Router,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			log.Errorf("boot image agent endpoint: %s", err.Error())
+		}
+	}()
+}
+
 func init() {
 	runCmd.PersistentFlags().StringArrayVarP(&tasks, "tasks", "t", []string{}, "array of tasks to run e.g. 'ironic.create'")
 	runCmd.PersistentFlags().IntVarP(&workers, "workers", "w", 0, "number of max worker to execute tasks concurrently. Default is 0: infinite.")
 	runCmd.PersistentFlags().BoolVar(&flavorPrivateAccess, "flavor_private_access", true, "set flavor accessType")
+	runCmd.PersistentFlags().BoolVar(&approveCableReconcile, "approve-cable-reconcile", false, "let 'diagnostics.cablecheck.reconcile' update the netbox cables to the observed lldp topology")
 	rootCmd.AddCommand(runCmd)
 }
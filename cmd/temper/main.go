@@ -26,6 +26,7 @@ import (
 
 	"github.com/evalphobia/logrus_sentry"
 	"github.com/sapcc/baremetal_temper/cmd"
+	"github.com/sapcc/baremetal_temper/pkg/clients"
 	"github.com/sapcc/baremetal_temper/pkg/config"
 	"github.com/sapcc/baremetal_temper/pkg/server"
 	"github.com/sapcc/baremetal_temper/pkg/temper"
@@ -75,6 +76,7 @@ func main() {
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
 	log.Println("shutting down")
+	clients.LogoutAll()
 	os.Exit(0)
 
 }
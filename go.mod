@@ -10,6 +10,7 @@ require (
 	github.com/go-ping/ping v0.0.0-20201115131931-3300c582a663
 	github.com/gophercloud/gophercloud v1.2.0
 	github.com/gorilla/mux v1.8.0
+	github.com/gosnmp/gosnmp v1.32.0
 	github.com/netbox-community/go-netbox/v3 v3.4.5
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/cobra v0.0.3
@@ -0,0 +1,281 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+)
+
+const redacted = "REDACTED"
+
+// headers and json body or query keys whose values are scrubbed before an interaction is written to disk.
+// The password fields of the configured credential sources are scrubbed as well
+var (
+	sensitiveHeaders = []string{"Authorization", "X-Auth-Token", "X-Subject-Token", "Cookie", "Set-Cookie"}
+	sensitiveKeys    = []string{"password", "token", "secret"}
+)
+
+// Cassette records the http interactions of a node's run (recorder.mode: record) or
+// feeds a previously recorded run back to the clients (recorder.mode: replay)
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+
+	mode      string
+	path      string
+	sensitive []string
+	mu        sync.Mutex
+	played    map[string]int
+}
+
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+type cassetteTransport struct {
+	cassette *Cassette
+	base     http.RoundTripper
+}
+
+// NewCassette creates the cassette of a node. Returns nil if recording is disabled.
+// In replay mode the node's cassette is loaded from the recorder path
+func NewCassette(cfg config.Config, node string) (c *Cassette, err error) {
+	switch cfg.Recorder.Mode {
+	case "":
+		return
+	case "record", "replay":
+	default:
+		return c, fmt.Errorf("unknown recorder mode %s", cfg.Recorder.Mode)
+	}
+	sensitive := append([]string{}, sensitiveKeys...)
+	for _, s := range cfg.Redfish.Credentials {
+		if s.PasswordField != "" {
+			sensitive = append(sensitive, strings.ToLower(s.PasswordField))
+		}
+	}
+	c = &Cassette{
+		Interactions: make([]Interaction, 0),
+		mode:         cfg.Recorder.Mode,
+		path:         filepath.Join(cfg.Recorder.Path, node+".json"),
+		sensitive:    sensitive,
+		played:       make(map[string]int),
+	}
+	if c.mode == "record" {
+		return
+	}
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return c, fmt.Errorf("cannot read cassette: %s", err.Error())
+	}
+	if err = json.Unmarshal(b, c); err != nil {
+		return c, fmt.Errorf("cannot parse cassette %s: %s", c.path, err.Error())
+	}
+	return
+}
+
+// Transport wraps the base transport of a client. Requests are passed to base and recorded,
+// or answered from the cassette without reaching base in replay mode
+func (c *Cassette) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &cassetteTransport{cassette: c, base: base}
+}
+
+// Save writes the recorded interactions to the recorder path
+func (c *Cassette) Save() (err error) {
+	if c.mode != "record" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err = os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(c.path, b, 0644)
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	reqBody, err := readBody(req.Body)
+	if err != nil {
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	if t.cassette.mode == "replay" {
+		return t.cassette.replay(req)
+	}
+	if resp, err = t.base.RoundTrip(req); err != nil {
+		return
+	}
+	respBody, err := readBody(resp.Body)
+	if err != nil {
+		return
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	t.cassette.record(Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			URL:    scrubURL(req.URL, t.cassette.sensitive),
+			Header: scrubHeader(req.Header),
+			Body:   scrubBody(reqBody, t.cassette.sensitive),
+		},
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     scrubHeader(resp.Header),
+			Body:       scrubBody(respBody, t.cassette.sensitive),
+		},
+	})
+	return
+}
+
+func (c *Cassette) record(i Interaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, i)
+}
+
+// replay returns the recorded responses of a method and url in the order they were recorded.
+// Once all are played the last one is repeated, e.g. for status polls running longer than recorded.
+// The url is scrubbed like the recorded one before it is matched
+func (c *Cassette) replay(req *http.Request) (resp *http.Response, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := req.Method + " " + scrubURL(req.URL, c.sensitive)
+	matches := make([]Interaction, 0)
+	for _, i := range c.Interactions {
+		if i.Request.Method+" "+i.Request.URL == key {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no recorded interaction for %s", key)
+	}
+	n := c.played[key]
+	if n >= len(matches) {
+		n = len(matches) - 1
+	}
+	c.played[key] = n + 1
+	r := matches[n].Response
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.Header.Clone(),
+		Body:          ioutil.NopCloser(strings.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}, nil
+}
+
+func readBody(body io.ReadCloser) (b []byte, err error) {
+	if body == nil {
+		return
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func scrubHeader(h http.Header) (s http.Header) {
+	s = h.Clone()
+	for _, k := range sensitiveHeaders {
+		if s.Get(k) != "" {
+			s.Set(k, redacted)
+		}
+	}
+	return
+}
+
+// scrubURL replaces the password of the user info and the values of sensitive query parameters
+func scrubURL(u *url.URL, keys []string) string {
+	s := *u
+	if _, ok := s.User.Password(); ok {
+		s.User = url.UserPassword(s.User.Username(), redacted)
+	}
+	q := s.Query()
+	scrubbed := false
+	for k, vs := range q {
+		if !isSensitiveKey(k, keys) {
+			continue
+		}
+		for i := range vs {
+			vs[i] = redacted
+		}
+		scrubbed = true
+	}
+	if scrubbed {
+		s.RawQuery = q.Encode()
+	}
+	return s.String()
+}
+
+// scrubBody replaces string values of sensitive json keys. Non json bodies are kept as is
+func scrubBody(b []byte, keys []string) string {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if len(b) == 0 || d.Decode(&v) != nil {
+		return string(b)
+	}
+	s, err := json.Marshal(scrubValue(v, keys))
+	if err != nil {
+		return string(b)
+	}
+	return string(s)
+}
+
+func scrubValue(v interface{}, keys []string) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if _, ok := val.(string); ok && isSensitiveKey(k, keys) {
+				t[k] = redacted
+				continue
+			}
+			t[k] = scrubValue(val, keys)
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = scrubValue(val, keys)
+		}
+	}
+	return v
+}
+
+func isSensitiveKey(k string, keys []string) bool {
+	k = strings.ToLower(k)
+	for _, s := range keys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
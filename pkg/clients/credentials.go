@@ -0,0 +1,380 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Credential is a bmc user and password and the source it was loaded from
+type Credential struct {
+	User     string `json:"user"`
+	Password string `json:"-"`
+	Source   string `json:"source"`
+}
+
+// CredentialProvider returns the bmc credentials of a node in the order they are tried.
+// The redfish client reports the credential which authenticated, so later steps (e.g. password rotation)
+// know which one is in use. Store writes a new credential to the first vault or netbox source and returns its type
+type CredentialProvider interface {
+	Credentials() ([]Credential, error)
+	Succeeded(c Credential)
+	Current() (c Credential, ok bool)
+	Store(c Credential) (source string, err error)
+}
+
+// CredentialNode identifies the node credentials are loaded for. Name and Serial can be used in path templates.
+// SetCustomFields updates custom fields of the netbox device, it is needed to store credentials in netbox
+type CredentialNode struct {
+	Name            string
+	Serial          string
+	CustomFields    map[string]interface{}
+	SetCustomFields func(fields map[string]interface{}) error
+}
+
+// BmcCredentials chains the configured credential sources
+type BmcCredentials struct {
+	sources []credentialSource
+	node    CredentialNode
+	log     *log.Entry
+
+	mu      sync.Mutex
+	current *Credential
+}
+
+type credentialSource interface {
+	get(node CredentialNode) ([]Credential, error)
+}
+
+// credentialStore is a source the rotated credentials are written back to
+type credentialStore interface {
+	store(node CredentialNode, c Credential) error
+}
+
+// NewCredentialProvider creates the provider of the configured redfish.credentials sources.
+// Without sources the static redfish.user and redfish.password are used
+func NewCredentialProvider(cfg config.Config, node CredentialNode, ctxLogger *log.Entry) (c *BmcCredentials, err error) {
+	c = &BmcCredentials{node: node, log: ctxLogger, sources: make([]credentialSource, 0)}
+	if len(cfg.Redfish.Credentials) == 0 {
+		c.sources = append(c.sources, staticSource{cfg.Redfish})
+		return
+	}
+	for _, s := range cfg.Redfish.Credentials {
+		switch s.Type {
+		case "static":
+			c.sources = append(c.sources, staticSource{cfg.Redfish})
+		case "file":
+			c.sources = append(c.sources, fileSource{s, ctxLogger})
+		case "netbox":
+			c.sources = append(c.sources, netboxSource{s, cfg.Redfish.User})
+		case "vault":
+			c.sources = append(c.sources, vaultSource{s, cfg.Redfish.User})
+		case "factory":
+			c.sources = append(c.sources, factorySource{s})
+		default:
+			return c, fmt.Errorf("unknown bmc credential source %s", s.Type)
+		}
+	}
+	return
+}
+
+func newStaticCredentials(cfg config.Redfish) *BmcCredentials {
+	return &BmcCredentials{sources: []credentialSource{staticSource{cfg}}}
+}
+
+// Credentials returns the credential in use first, followed by the credentials of all sources.
+// A failing source is logged and skipped, the remaining sources can still provide a working credential.
+// The factory defaults are only returned if no other source has credentials of the node
+func (c *BmcCredentials) Credentials() (creds []Credential, err error) {
+	creds = make([]Credential, 0)
+	seen := make(map[string]bool)
+	add := func(cr Credential) {
+		key := cr.User + "\x00" + cr.Password
+		if cr.User == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		creds = append(creds, cr)
+	}
+	if cur, ok := c.Current(); ok {
+		add(cur)
+	}
+	factory := make([]credentialSource, 0)
+	for _, s := range c.sources {
+		if _, ok := s.(factorySource); ok {
+			factory = append(factory, s)
+			continue
+		}
+		cs, err := s.get(c.node)
+		if err != nil {
+			if c.log != nil {
+				c.log.Warnf("cannot load bmc credentials: %s", err.Error())
+			}
+			continue
+		}
+		for _, cr := range cs {
+			add(cr)
+		}
+	}
+	if len(creds) == 0 {
+		for _, s := range factory {
+			cs, _ := s.get(c.node)
+			for _, cr := range cs {
+				add(cr)
+			}
+		}
+	}
+	if len(creds) == 0 {
+		return creds, fmt.Errorf("no bmc credentials found for node %s", c.node.Name)
+	}
+	return
+}
+
+// Succeeded records the credential in use
+func (c *BmcCredentials) Succeeded(cr Credential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = &cr
+}
+
+// Store writes the credential to the first vault or netbox source, so later runs can log in with it
+func (c *BmcCredentials) Store(cr Credential) (source string, err error) {
+	for _, s := range c.sources {
+		st, ok := s.(credentialStore)
+		if !ok {
+			continue
+		}
+		if err = st.store(c.node, cr); err != nil {
+			return
+		}
+		return credentialSourceType(s), nil
+	}
+	return source, fmt.Errorf("no vault or netbox credential source to store the bmc credentials of node %s", c.node.Name)
+}
+
+func credentialSourceType(s credentialSource) string {
+	switch s.(type) {
+	case netboxSource:
+		return "netbox"
+	case vaultSource:
+		return "vault"
+	}
+	return ""
+}
+
+// Current returns the credential in use. ok is false until a credential succeeded
+func (c *BmcCredentials) Current() (cr Credential, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil {
+		return
+	}
+	return *c.current, true
+}
+
+type staticSource struct {
+	cfg config.Redfish
+}
+
+func (s staticSource) get(node CredentialNode) ([]Credential, error) {
+	return []Credential{{User: s.cfg.User, Password: s.cfg.Password, Source: "static"}}, nil
+}
+
+// fileSource reads a yaml file (user, password) per node. A missing file is not an error
+type fileSource struct {
+	cfg config.CredentialSource
+	log *log.Entry
+}
+
+func (s fileSource) get(node CredentialNode) (creds []Credential, err error) {
+	path, err := renderPath(s.cfg.Path, node)
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.log.Debugf("no bmc credentials file %s", path)
+		return creds, nil
+	}
+	if err != nil {
+		return
+	}
+	var c config.BmcCredential
+	if err = yaml.Unmarshal(b, &c); err != nil {
+		return creds, fmt.Errorf("cannot parse bmc credentials file %s: %s", path, err.Error())
+	}
+	return []Credential{{User: c.User, Password: c.Password, Source: "file"}}, nil
+}
+
+// netboxSource reads the credentials from custom fields of the netbox device
+type netboxSource struct {
+	cfg  config.CredentialSource
+	user string
+}
+
+func (s netboxSource) get(node CredentialNode) (creds []Credential, err error) {
+	userField, passwordField := fieldNames(s.cfg, "bmc_user", "bmc_password")
+	password, _ := node.CustomFields[passwordField].(string)
+	if password == "" {
+		return
+	}
+	user, _ := node.CustomFields[userField].(string)
+	if user == "" {
+		user = s.user
+	}
+	return []Credential{{User: user, Password: password, Source: "netbox"}}, nil
+}
+
+func (s netboxSource) store(node CredentialNode, c Credential) (err error) {
+	if node.SetCustomFields == nil {
+		return fmt.Errorf("cannot store bmc credentials in netbox without a netbox device")
+	}
+	userField, passwordField := fieldNames(s.cfg, "bmc_user", "bmc_password")
+	return node.SetCustomFields(map[string]interface{}{userField: c.User, passwordField: c.Password})
+}
+
+// vaultSource reads the credentials from a vault kv (v1 or v2) secret
+type vaultSource struct {
+	cfg  config.CredentialSource
+	user string
+}
+
+func (s vaultSource) get(node CredentialNode) (creds []Credential, err error) {
+	path, err := renderPath(s.cfg.Path, node)
+	if err != nil {
+		return
+	}
+	addr, token := s.vault()
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return creds, fmt.Errorf("cannot read vault secret %s: %d: %s", path, resp.StatusCode, string(b))
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(bytes.NewReader(b)).Decode(&secret); err != nil {
+		return
+	}
+	data := secret.Data
+	// kv v2 nests the secret and its metadata
+	if d, ok := data["data"].(map[string]interface{}); ok {
+		data = d
+	}
+	userField, passwordField := fieldNames(s.cfg, "username", "password")
+	password, _ := data[passwordField].(string)
+	if password == "" {
+		return
+	}
+	user, _ := data[userField].(string)
+	if user == "" {
+		user = s.user
+	}
+	return []Credential{{User: user, Password: password, Source: "vault"}}, nil
+}
+
+// store writes the secret, kv v2 paths (containing /data/) need the secret nested in data
+func (s vaultSource) store(node CredentialNode, c Credential) (err error) {
+	path, err := renderPath(s.cfg.Path, node)
+	if err != nil {
+		return
+	}
+	addr, token := s.vault()
+	userField, passwordField := fieldNames(s.cfg, "username", "password")
+	var secret interface{} = map[string]string{userField: c.User, passwordField: c.Password}
+	if strings.Contains("/"+strings.TrimPrefix(path, "/"), "/data/") {
+		secret = map[string]interface{}{"data": secret}
+	}
+	b, err := json.Marshal(secret)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		rb, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("cannot write vault secret %s: %d: %s", path, resp.StatusCode, string(rb))
+	}
+	return
+}
+
+// vault returns the address and token, defaulting to VAULT_ADDR and VAULT_TOKEN
+func (s vaultSource) vault() (addr, token string) {
+	addr, token = s.cfg.Address, s.cfg.Token
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return
+}
+
+// factorySource returns the vendor factory defaults
+type factorySource struct {
+	cfg config.CredentialSource
+}
+
+func (s factorySource) get(node CredentialNode) (creds []Credential, err error) {
+	for _, c := range s.cfg.Defaults {
+		creds = append(creds, Credential{User: c.User, Password: c.Password, Source: "factory"})
+	}
+	return
+}
+
+func renderPath(path string, node CredentialNode) (p string, err error) {
+	t, err := template.New("path").Parse(path)
+	if err != nil {
+		return p, fmt.Errorf("cannot parse credential path %s: %s", path, err.Error())
+	}
+	var b bytes.Buffer
+	if err = t.Execute(&b, node); err != nil {
+		return
+	}
+	return b.String(), nil
+}
+
+func fieldNames(cfg config.CredentialSource, user, password string) (string, string) {
+	if cfg.UserField != "" {
+		user = cfg.UserField
+	}
+	if cfg.PasswordField != "" {
+		password = cfg.PasswordField
+	}
+	return user, password
+}
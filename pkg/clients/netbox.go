@@ -1,60 +1,293 @@
 package clients
 
 import (
-	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	runtimeclient "github.com/go-openapi/runtime/client"
-	netboxclient "github.com/netbox-community/go-netbox/v3/netbox/client"
-	"github.com/netbox-community/go-netbox/v3/netbox/client/dcim"
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
 	"github.com/sapcc/baremetal_temper/pkg/config"
 	log "github.com/sirupsen/logrus"
 )
 
-// NetboxClient is ..
+// NetboxAPI is the netbox access of temper. NetboxV3 implements it with the go-netbox client of netbox 3.x,
+// NetboxV4 adapts it to the api of netbox 4.x. The go-netbox models are the representation of both.
+// Bodies are the fields of a partial update in the netbox 3.x naming, e.g. device_role
+type NetboxAPI interface {
+	// Version is the netbox version the implementation talks to
+	Version() string
+
+	Devices(f DeviceFilter) ([]*models.DeviceWithConfigContext, error)
+	UpdateDevice(id int64, body map[string]interface{}) (*models.DeviceWithConfigContext, error)
+	Racks(q string) ([]*models.Rack, error)
+
+	Interfaces(device string) ([]*models.Interface, error)
+	CreateInterface(data *models.WritableInterface) (*models.Interface, error)
+	UpdateInterface(id int64, data *models.WritableInterface) (*models.Interface, error)
+	PatchInterface(id int64, body map[string]interface{}) (*models.Interface, error)
+	CreateCable(data *models.WritableCable) (*models.Cable, error)
+	DeleteCable(id int64) error
+
+	IPAddresses(f IPAddressFilter) ([]*models.IPAddress, error)
+	UpdateIPAddress(id int64, body map[string]interface{}) (*models.IPAddress, error)
+	DeleteIPAddress(id int64) error
+	Prefixes(f PrefixFilter) ([]*models.Prefix, error)
+	// CreateAvailableIP creates the next available ip of the prefix with the fields of body
+	CreateAvailableIP(prefixID int64, body map[string]interface{}) (*models.IPAddress, error)
+
+	Tags(slug string) ([]*models.Tag, error)
+	CreateTag(name, slug string) (*models.Tag, error)
+	CreateJournalEntry(data *models.WritableJournalEntry) error
+
+	InventoryItems(deviceID int64) ([]*models.InventoryItem, error)
+	CreateInventoryItem(data *models.WritableInventoryItem) error
+	UpdateInventoryItem(id int64, data *models.WritableInventoryItem) error
+	InventoryItemRoles(slug string) ([]*models.InventoryItemRole, error)
+	Manufacturers(name string) ([]*models.Manufacturer, error)
+	CreateManufacturer(name, slug string) (*models.Manufacturer, error)
+	ModuleBays(deviceID int64) ([]*models.ModuleBay, error)
+	Modules(moduleBayID int64) ([]*models.Module, error)
+	ModuleTypes(partNumber string) ([]*models.ModuleType, error)
+	CreateModule(data *models.WritableModule) error
+	UpdateModule(id int64, data *models.WritableModule) error
+}
+
+// DeviceFilter filters devices, nil fields are not filtered. IDs fetches the devices of the ids in batches.
+// Without Limit all pages are read
+type DeviceFilter struct {
+	IDs    []int64
+	Name   *string
+	Site   *string
+	Role   *string
+	Status *string
+	Region *string
+	RackID *int64
+	Q      *string
+	Limit  *int64
+	Offset *int64
+}
+
+// IPAddressFilter filters ip addresses, nil fields are not filtered. Without Limit all pages are read
+type IPAddressFilter struct {
+	Q       *string
+	DNSName *string
+	Address *string
+	Limit   *int64
+}
+
+// PrefixFilter filters prefixes, nil fields are not filtered. Tag is a tag slug
+type PrefixFilter struct {
+	Role *string
+	Site *string
+	Tag  *string
+}
+
+// Netbox is the netbox client of temper
 type Netbox struct {
-	Client *netboxclient.NetBoxAPI
-	log    *log.Entry
+	API   NetboxAPI
+	log   *log.Entry
+	calls *int64
 }
 
-// NewNetboxClient creates netbox client instance
+// netbox versions by host, probed once per process
+var netboxVersions sync.Map
+
+// netbox caches by host, shared by the node runs of the process
+var netboxCaches sync.Map
+
+// page size of the list queries reading all pages and number of ids per batch of a device query by ids
+var (
+	pageLimit   = int64(1000)
+	idBatchSize = 100
+)
+
+// NewNetbox creates a netbox client for the version of the netbox api. The version is netbox.version
+// or, if empty, probed via /api/status/
 func NewNetbox(cfg config.Config, ctxLogger *log.Entry) (n *Netbox, err error) {
 	tlsClient, err := runtimeclient.TLSClient(runtimeclient.TLSClientOptions{InsecureSkipVerify: true})
 	if err != nil {
 		return
 	}
+	if cfg.Transport != nil {
+		tlsClient.Transport = cfg.Transport(tlsClient.Transport)
+	}
+	calls := new(int64)
+	tlsClient.Transport = countingTransport{next: tlsClient.Transport, calls: calls}
+	version := cfg.Netbox.Version
+	if version == "" {
+		if v, ok := netboxVersions.Load(cfg.Netbox.Host); ok {
+			version = v.(string)
+		} else if version, err = probeNetboxVersion(tlsClient, cfg.Netbox); err != nil {
+			return n, fmt.Errorf("cannot probe netbox version, set netbox.version: %s", err.Error())
+		} else {
+			netboxVersions.Store(cfg.Netbox.Host, version)
+		}
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return n, fmt.Errorf("invalid netbox version %s", version)
+	}
+	v3 := NewNetboxV3(cfg.Netbox, tlsClient, version)
+	var api NetboxAPI = v3
+	if major >= 4 {
+		api = NewNetboxV4(v3, cfg.Netbox, tlsClient)
+	}
+	if cfg.Netbox.CacheTTL > 0 {
+		c, _ := netboxCaches.LoadOrStore(cfg.Netbox.Host, newNetboxCache(cfg.Netbox.CacheTTL))
+		api = &NetboxCache{NetboxAPI: api, cache: c.(*netboxCache)}
+	}
+	ctxLogger.Debugf("using netbox %s api", version)
+	n = NewNetboxWithAPI(api, ctxLogger)
+	n.calls = calls
+	return
+}
+
+// NewNetboxWithAPI creates a netbox client using the api, e.g. a fake in tests
+func NewNetboxWithAPI(api NetboxAPI, ctxLogger *log.Entry) *Netbox {
+	return &Netbox{API: api, log: ctxLogger}
+}
 
-	transport := runtimeclient.NewWithClient(cfg.Netbox.Host, netboxclient.DefaultBasePath, []string{"https"}, tlsClient)
-	transport.DefaultAuthentication = runtimeclient.APIKeyAuth("Authorization", "header", fmt.Sprintf("Token %v", cfg.Netbox.Token))
-	n = &Netbox{
-		Client: netboxclient.New(transport, nil),
-		log:    ctxLogger,
+// Calls returns the number of netbox api requests of the client
+func (n *Netbox) Calls() int64 {
+	if n.calls == nil {
+		return 0
+	}
+	return atomic.LoadInt64(n.calls)
+}
+
+// countingTransport counts the requests of a netbox client
+type countingTransport struct {
+	next  http.RoundTripper
+	calls *int64
+}
+
+func (t countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(t.calls, 1)
+	return t.next.RoundTrip(r)
+}
+
+// listPages calls list with the limit and offset of each page until all objects are read. list returns the number
+// of objects of the page and the total count. With a limit only the page of limit and offset is read
+func listPages(limit, offset *int64, list func(limit, offset *int64) (n int, count *int64, err error)) (err error) {
+	if limit != nil {
+		_, _, err = list(limit, offset)
+		return
+	}
+	o := int64(0)
+	if offset != nil {
+		o = *offset
+	}
+	for {
+		l := pageLimit
+		page := o
+		n, count, err := list(&l, &page)
+		if err != nil {
+			return err
+		}
+		o += int64(n)
+		if int64(n) < l || (count != nil && o >= *count) {
+			return nil
+		}
+	}
+}
+
+// idBatches calls fn with the ids in batches of idBatchSize, formatted as query values. Without ids fn is called once with nil
+func idBatches(ids []int64, fn func(ids []string) error) (err error) {
+	if len(ids) == 0 {
+		return fn(nil)
+	}
+	for i := 0; i < len(ids); i += idBatchSize {
+		end := i + idBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := make([]string, 0, end-i)
+		for _, id := range ids[i:end] {
+			batch = append(batch, strconv.FormatInt(id, 10))
+		}
+		if err = fn(batch); err != nil {
+			return
+		}
 	}
 	return
 }
 
+// probeNetboxVersion returns the netbox-version of /api/status/
+func probeNetboxVersion(c *http.Client, auth config.NetboxAuth) (version string, err error) {
+	req, err := http.NewRequest(http.MethodGet, "https://"+auth.Host+"/api/status/", nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Token "+auth.Token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return version, fmt.Errorf("status api returned %s", resp.Status)
+	}
+	var status struct {
+		Version string `json:"netbox-version"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return
+	}
+	if status.Version == "" {
+		return version, fmt.Errorf("status api returned no netbox version")
+	}
+	return status.Version, nil
+}
+
+// versionAtLeast reports if the netbox version, e.g. 4.2.1, is at least major.minor
+func versionAtLeast(version string, major, minor int) bool {
+	v := strings.SplitN(version, ".", 3)
+	ma, err := strconv.Atoi(v[0])
+	if err != nil || ma != major {
+		return ma > major
+	}
+	mi := 0
+	if len(v) > 1 {
+		mi, _ = strconv.Atoi(v[1])
+	}
+	return mi >= minor
+}
+
 // LoadNodes loads all nodes with role server
 func (n *Netbox) LoadNodes(query, status, region *string) (nodes []string, err error) {
 	nodes = make([]string, 0)
 	role := "server"
 
 	if status == nil {
-		*status = "planned"
+		planned := "planned"
+		status = &planned
 	}
 
-	param := dcim.DcimDevicesListParams{
-		Context: context.Background(),
-		Role:    &role,
-		Status:  status,
-		Region:  region,
-		Q:       query,
-	}
-	l, err := n.Client.Dcim.DcimDevicesList(&param, nil)
+	l, err := n.API.Devices(DeviceFilter{
+		Role:   &role,
+		Status: status,
+		Region: region,
+		Q:      query,
+	})
 	if err != nil {
 		return
 	}
-	for _, n := range l.Payload.Results {
+	for _, n := range l {
 		nodes = append(nodes, *n.Name)
 	}
 	return
 }
+
+// LoadSiteDevices loads all devices of the site with the role, including their config context
+func (n *Netbox) LoadSiteDevices(site, role string) (devices []*models.DeviceWithConfigContext, err error) {
+	return n.API.Devices(DeviceFilter{
+		Site: &site,
+		Role: &role,
+	})
+}
@@ -0,0 +1,96 @@
+package clients
+
+import (
+	"sync"
+	"time"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+)
+
+// NetboxCache is a NetboxAPI caching rarely changing objects for the ttl: the devices queried by ids only (the
+// switches of the node interfaces) and the racks by query (the site of a block). The cache is process wide, it is
+// shared by all node runs against the netbox host, so a run may see a switch or rack up to the ttl older than netbox,
+// e.g. a changed primary ip of a switch. The cached objects must not be modified. The other calls are passed to the api
+type NetboxCache struct {
+	NetboxAPI
+	cache *netboxCache
+}
+
+type netboxCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	devices map[int64]cachedDevice
+	racks   map[string]cachedRacks
+}
+
+type cachedDevice struct {
+	device  *models.DeviceWithConfigContext
+	expires time.Time
+}
+
+type cachedRacks struct {
+	racks   []*models.Rack
+	expires time.Time
+}
+
+// NewNetboxCache creates a cache of the api
+func NewNetboxCache(api NetboxAPI, ttl time.Duration) *NetboxCache {
+	return &NetboxCache{NetboxAPI: api, cache: newNetboxCache(ttl)}
+}
+
+func newNetboxCache(ttl time.Duration) *netboxCache {
+	return &netboxCache{
+		ttl:     ttl,
+		devices: make(map[int64]cachedDevice),
+		racks:   make(map[string]cachedRacks),
+	}
+}
+
+// Devices returns the devices of a query by ids only from the cache and fetches the missing ones in one query
+func (c *NetboxCache) Devices(f DeviceFilter) (d []*models.DeviceWithConfigContext, err error) {
+	if len(f.IDs) == 0 || f.Name != nil || f.Site != nil || f.Role != nil || f.Status != nil || f.Region != nil ||
+		f.RackID != nil || f.Q != nil || f.Limit != nil || f.Offset != nil {
+		return c.NetboxAPI.Devices(f)
+	}
+	now := time.Now()
+	missing := make([]int64, 0)
+	c.cache.mu.Lock()
+	for _, id := range f.IDs {
+		if e, ok := c.cache.devices[id]; ok && now.Before(e.expires) {
+			d = append(d, e.device)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	c.cache.mu.Unlock()
+	if len(missing) == 0 {
+		return
+	}
+	l, err := c.NetboxAPI.Devices(DeviceFilter{IDs: missing})
+	if err != nil {
+		return
+	}
+	c.cache.mu.Lock()
+	for _, dev := range l {
+		c.cache.devices[dev.ID] = cachedDevice{device: dev, expires: now.Add(c.cache.ttl)}
+	}
+	c.cache.mu.Unlock()
+	return append(d, l...), nil
+}
+
+func (c *NetboxCache) Racks(q string) (r []*models.Rack, err error) {
+	now := time.Now()
+	c.cache.mu.Lock()
+	e, ok := c.cache.racks[q]
+	c.cache.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.racks, nil
+	}
+	if r, err = c.NetboxAPI.Racks(q); err != nil {
+		return
+	}
+	c.cache.mu.Lock()
+	c.cache.racks[q] = cachedRacks{racks: r, expires: now.Add(c.cache.ttl)}
+	c.cache.mu.Unlock()
+	return
+}
@@ -0,0 +1,422 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-openapi/runtime"
+	runtimeclient "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
+	netboxclient "github.com/netbox-community/go-netbox/v3/netbox/client"
+	"github.com/netbox-community/go-netbox/v3/netbox/client/dcim"
+	"github.com/netbox-community/go-netbox/v3/netbox/client/extras"
+	"github.com/netbox-community/go-netbox/v3/netbox/client/ipam"
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+)
+
+// NetboxV3 is the NetboxAPI of netbox 3.x
+type NetboxV3 struct {
+	Client  *netboxclient.NetBoxAPI
+	version string
+}
+
+// NewNetboxV3 creates the go-netbox client of the netbox host
+func NewNetboxV3(auth config.NetboxAuth, c *http.Client, version string) *NetboxV3 {
+	transport := runtimeclient.NewWithClient(auth.Host, netboxclient.DefaultBasePath, []string{"https"}, c)
+	transport.DefaultAuthentication = runtimeclient.APIKeyAuth("Authorization", "header", fmt.Sprintf("Token %v", auth.Token))
+	return &NetboxV3{Client: netboxclient.New(transport, nil), version: version}
+}
+
+func (n *NetboxV3) Version() string {
+	return n.version
+}
+
+func (n *NetboxV3) Devices(f DeviceFilter) (d []*models.DeviceWithConfigContext, err error) {
+	var rackID *string
+	if f.RackID != nil {
+		id := strconv.FormatInt(*f.RackID, 10)
+		rackID = &id
+	}
+	err = idBatches(f.IDs, func(ids []string) error {
+		var opts []dcim.ClientOption
+		if ids != nil {
+			opts = append(opts, dcim.ClientOption(withQuery("id", ids)))
+		}
+		return listPages(f.Limit, f.Offset, func(limit, offset *int64) (int, *int64, error) {
+			l, err := n.Client.Dcim.DcimDevicesList(&dcim.DcimDevicesListParams{
+				Name:    f.Name,
+				Site:    f.Site,
+				Role:    f.Role,
+				Status:  f.Status,
+				Region:  f.Region,
+				RackID:  rackID,
+				Q:       f.Q,
+				Limit:   limit,
+				Offset:  offset,
+				Context: context.Background(),
+			}, nil, opts...)
+			if err != nil {
+				return 0, nil, err
+			}
+			d = append(d, l.Payload.Results...)
+			return len(l.Payload.Results), l.Payload.Count, nil
+		})
+	})
+	return
+}
+
+func (n *NetboxV3) UpdateDevice(id int64, body map[string]interface{}) (d *models.DeviceWithConfigContext, err error) {
+	p, err := n.Client.Dcim.DcimDevicesPartialUpdate(&dcim.DcimDevicesPartialUpdateParams{
+		ID:      id,
+		Context: context.Background(),
+	}, nil, dcim.ClientOption(withBody(body)))
+	if err != nil {
+		return
+	}
+	return p.Payload, nil
+}
+
+func (n *NetboxV3) Racks(q string) (r []*models.Rack, err error) {
+	err = listPages(nil, nil, func(limit, offset *int64) (int, *int64, error) {
+		l, err := n.Client.Dcim.DcimRacksList(&dcim.DcimRacksListParams{
+			Q:       &q,
+			Limit:   limit,
+			Offset:  offset,
+			Context: context.Background(),
+		}, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		r = append(r, l.Payload.Results...)
+		return len(l.Payload.Results), l.Payload.Count, nil
+	})
+	return
+}
+
+func (n *NetboxV3) Interfaces(device string) (in []*models.Interface, err error) {
+	err = listPages(nil, nil, func(limit, offset *int64) (int, *int64, error) {
+		l, err := n.Client.Dcim.DcimInterfacesList(&dcim.DcimInterfacesListParams{
+			Device:  &device,
+			Limit:   limit,
+			Offset:  offset,
+			Context: context.Background(),
+		}, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		in = append(in, l.Payload.Results...)
+		return len(l.Payload.Results), l.Payload.Count, nil
+	})
+	return
+}
+
+func (n *NetboxV3) CreateInterface(data *models.WritableInterface) (in *models.Interface, err error) {
+	c, err := n.Client.Dcim.DcimInterfacesCreate(&dcim.DcimInterfacesCreateParams{
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return c.Payload, nil
+}
+
+func (n *NetboxV3) UpdateInterface(id int64, data *models.WritableInterface) (in *models.Interface, err error) {
+	u, err := n.Client.Dcim.DcimInterfacesUpdate(&dcim.DcimInterfacesUpdateParams{
+		ID:      id,
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return u.Payload, nil
+}
+
+func (n *NetboxV3) PatchInterface(id int64, body map[string]interface{}) (in *models.Interface, err error) {
+	p, err := n.Client.Dcim.DcimInterfacesPartialUpdate(&dcim.DcimInterfacesPartialUpdateParams{
+		ID:      id,
+		Context: context.Background(),
+	}, nil, dcim.ClientOption(withBody(body)))
+	if err != nil {
+		return
+	}
+	return p.Payload, nil
+}
+
+func (n *NetboxV3) CreateCable(data *models.WritableCable) (c *models.Cable, err error) {
+	p, err := n.Client.Dcim.DcimCablesCreate(&dcim.DcimCablesCreateParams{
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return p.Payload, nil
+}
+
+func (n *NetboxV3) DeleteCable(id int64) (err error) {
+	_, err = n.Client.Dcim.DcimCablesDelete(&dcim.DcimCablesDeleteParams{
+		ID:      id,
+		Context: context.Background(),
+	}, nil)
+	return
+}
+
+func (n *NetboxV3) IPAddresses(f IPAddressFilter) (a []*models.IPAddress, err error) {
+	err = listPages(f.Limit, nil, func(limit, offset *int64) (int, *int64, error) {
+		l, err := n.Client.Ipam.IpamIPAddressesList(&ipam.IpamIPAddressesListParams{
+			Q:       f.Q,
+			DNSName: f.DNSName,
+			Address: f.Address,
+			Limit:   limit,
+			Offset:  offset,
+			Context: context.Background(),
+		}, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		a = append(a, l.Payload.Results...)
+		return len(l.Payload.Results), l.Payload.Count, nil
+	})
+	return
+}
+
+func (n *NetboxV3) UpdateIPAddress(id int64, body map[string]interface{}) (a *models.IPAddress, err error) {
+	p, err := n.Client.Ipam.IpamIPAddressesPartialUpdate(&ipam.IpamIPAddressesPartialUpdateParams{
+		ID:      id,
+		Context: context.Background(),
+	}, nil, ipam.ClientOption(withBody(body)))
+	if err != nil {
+		return
+	}
+	return p.Payload, nil
+}
+
+func (n *NetboxV3) DeleteIPAddress(id int64) (err error) {
+	_, err = n.Client.Ipam.IpamIPAddressesDelete(&ipam.IpamIPAddressesDeleteParams{
+		ID:      id,
+		Context: context.Background(),
+	}, nil)
+	return
+}
+
+func (n *NetboxV3) Prefixes(f PrefixFilter) (p []*models.Prefix, err error) {
+	err = listPages(nil, nil, func(limit, offset *int64) (int, *int64, error) {
+		l, err := n.Client.Ipam.IpamPrefixesList(&ipam.IpamPrefixesListParams{
+			Role:    f.Role,
+			Site:    f.Site,
+			Tag:     f.Tag,
+			Limit:   limit,
+			Offset:  offset,
+			Context: context.Background(),
+		}, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		p = append(p, l.Payload.Results...)
+		return len(l.Payload.Results), l.Payload.Count, nil
+	})
+	return
+}
+
+func (n *NetboxV3) CreateAvailableIP(prefixID int64, body map[string]interface{}) (a *models.IPAddress, err error) {
+	// the api returns a list for a list body, the go-netbox model expects one
+	c, err := n.Client.Ipam.IpamPrefixesAvailableIpsCreate(&ipam.IpamPrefixesAvailableIpsCreateParams{
+		ID:      prefixID,
+		Context: context.Background(),
+	}, nil, ipam.ClientOption(withBody([]map[string]interface{}{body})))
+	if err != nil {
+		return
+	}
+	if len(c.Payload) == 0 {
+		return a, fmt.Errorf("no ip created in prefix %d", prefixID)
+	}
+	return c.Payload[0], nil
+}
+
+func (n *NetboxV3) Tags(slug string) (t []*models.Tag, err error) {
+	l, err := n.Client.Extras.ExtrasTagsList(&extras.ExtrasTagsListParams{
+		Slug:    &slug,
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return l.Payload.Results, nil
+}
+
+func (n *NetboxV3) CreateTag(name, slug string) (t *models.Tag, err error) {
+	c, err := n.Client.Extras.ExtrasTagsCreate(&extras.ExtrasTagsCreateParams{
+		Data:    &models.Tag{Name: &name, Slug: &slug},
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return c.Payload, nil
+}
+
+func (n *NetboxV3) CreateJournalEntry(data *models.WritableJournalEntry) (err error) {
+	_, err = n.Client.Extras.ExtrasJournalEntriesCreate(&extras.ExtrasJournalEntriesCreateParams{
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	return
+}
+
+func (n *NetboxV3) InventoryItems(deviceID int64) (items []*models.InventoryItem, err error) {
+	id := fmt.Sprintf("%d", deviceID)
+	err = listPages(nil, nil, func(limit, offset *int64) (int, *int64, error) {
+		l, err := n.Client.Dcim.DcimInventoryItemsList(&dcim.DcimInventoryItemsListParams{
+			DeviceID: &id,
+			Limit:    limit,
+			Offset:   offset,
+			Context:  context.Background(),
+		}, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		items = append(items, l.Payload.Results...)
+		return len(l.Payload.Results), l.Payload.Count, nil
+	})
+	return
+}
+
+func (n *NetboxV3) CreateInventoryItem(data *models.WritableInventoryItem) (err error) {
+	_, err = n.Client.Dcim.DcimInventoryItemsCreate(&dcim.DcimInventoryItemsCreateParams{
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	return
+}
+
+func (n *NetboxV3) UpdateInventoryItem(id int64, data *models.WritableInventoryItem) (err error) {
+	_, err = n.Client.Dcim.DcimInventoryItemsPartialUpdate(&dcim.DcimInventoryItemsPartialUpdateParams{
+		ID:      id,
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	return
+}
+
+func (n *NetboxV3) InventoryItemRoles(slug string) (r []*models.InventoryItemRole, err error) {
+	l, err := n.Client.Dcim.DcimInventoryItemRolesList(&dcim.DcimInventoryItemRolesListParams{
+		Slug:    &slug,
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return l.Payload.Results, nil
+}
+
+func (n *NetboxV3) Manufacturers(name string) (m []*models.Manufacturer, err error) {
+	l, err := n.Client.Dcim.DcimManufacturersList(&dcim.DcimManufacturersListParams{
+		Name:    &name,
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return l.Payload.Results, nil
+}
+
+func (n *NetboxV3) CreateManufacturer(name, slug string) (m *models.Manufacturer, err error) {
+	c, err := n.Client.Dcim.DcimManufacturersCreate(&dcim.DcimManufacturersCreateParams{
+		Data:    &models.Manufacturer{Name: &name, Slug: &slug},
+		Context: context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return c.Payload, nil
+}
+
+func (n *NetboxV3) ModuleBays(deviceID int64) (b []*models.ModuleBay, err error) {
+	id := fmt.Sprintf("%d", deviceID)
+	err = listPages(nil, nil, func(limit, offset *int64) (int, *int64, error) {
+		l, err := n.Client.Dcim.DcimModuleBaysList(&dcim.DcimModuleBaysListParams{
+			DeviceID: &id,
+			Limit:    limit,
+			Offset:   offset,
+			Context:  context.Background(),
+		}, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		b = append(b, l.Payload.Results...)
+		return len(l.Payload.Results), l.Payload.Count, nil
+	})
+	return
+}
+
+func (n *NetboxV3) Modules(moduleBayID int64) (m []*models.Module, err error) {
+	id := fmt.Sprintf("%d", moduleBayID)
+	l, err := n.Client.Dcim.DcimModulesList(&dcim.DcimModulesListParams{
+		ModuleBayID: &id,
+		Context:     context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return l.Payload.Results, nil
+}
+
+func (n *NetboxV3) ModuleTypes(partNumber string) (t []*models.ModuleType, err error) {
+	l, err := n.Client.Dcim.DcimModuleTypesList(&dcim.DcimModuleTypesListParams{
+		PartNumber: &partNumber,
+		Context:    context.Background(),
+	}, nil)
+	if err != nil {
+		return
+	}
+	return l.Payload.Results, nil
+}
+
+func (n *NetboxV3) CreateModule(data *models.WritableModule) (err error) {
+	_, err = n.Client.Dcim.DcimModulesCreate(&dcim.DcimModulesCreateParams{
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	return
+}
+
+func (n *NetboxV3) UpdateModule(id int64, data *models.WritableModule) (err error) {
+	_, err = n.Client.Dcim.DcimModulesPartialUpdate(&dcim.DcimModulesPartialUpdateParams{
+		ID:      id,
+		Data:    data,
+		Context: context.Background(),
+	}, nil)
+	return
+}
+
+// withBody replaces the request body of an operation, e.g. to send fields the go-netbox models
+// omit when empty (tags) or which need to be nulled
+func withBody(body interface{}) func(op *runtime.ClientOperation) {
+	return func(op *runtime.ClientOperation) {
+		params := op.Params
+		op.Params = runtime.ClientRequestWriterFunc(func(r runtime.ClientRequest, reg strfmt.Registry) error {
+			if err := params.WriteToRequest(r, reg); err != nil {
+				return err
+			}
+			return r.SetBodyParam(body)
+		})
+	}
+}
+
+// withQuery sets the values of a query parameter, e.g. to filter by a list of ids the go-netbox params take one of
+func withQuery(name string, values []string) func(op *runtime.ClientOperation) {
+	return func(op *runtime.ClientOperation) {
+		params := op.Params
+		op.Params = runtime.ClientRequestWriterFunc(func(r runtime.ClientRequest, reg strfmt.Registry) error {
+			if err := params.WriteToRequest(r, reg); err != nil {
+				return err
+			}
+			return r.SetQueryParam(name, values...)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+)
+
+// NetboxV4 is the NetboxAPI of netbox 4.x. Netbox 4 renamed the device_role of devices to role, which the
+// go-netbox models of 3.x cannot read or write, so devices are requested as json and translated.
+// Since netbox 4.2 the mac_address of interfaces is read only, the mac addresses are objects assigned to the interface
+// and the interface's primary_mac_address is set instead. The other endpoints temper uses did not change
+// and are served by the embedded NetboxV3
+type NetboxV4 struct {
+	*NetboxV3
+	client *http.Client
+	auth   config.NetboxAuth
+}
+
+// NewNetboxV4 creates the netbox 4.x api on top of the go-netbox client
+func NewNetboxV4(v3 *NetboxV3, auth config.NetboxAuth, c *http.Client) *NetboxV4 {
+	return &NetboxV4{NetboxV3: v3, client: c, auth: auth}
+}
+
+// netbox 3.x field names of the fields netbox 4.x renamed
+var v4DeviceFields = map[string]string{
+	"device_role": "role",
+}
+
+func (n *NetboxV4) Devices(f DeviceFilter) (d []*models.DeviceWithConfigContext, err error) {
+	q := url.Values{}
+	for k, v := range map[string]*string{"name": f.Name, "site": f.Site, "role": f.Role, "status": f.Status, "region": f.Region, "q": f.Q} {
+		if v != nil {
+			q.Set(k, *v)
+		}
+	}
+	if f.RackID != nil {
+		q.Set("rack_id", strconv.FormatInt(*f.RackID, 10))
+	}
+	err = idBatches(f.IDs, func(ids []string) error {
+		q["id"] = ids
+		return listPages(f.Limit, f.Offset, func(limit, offset *int64) (int, *int64, error) {
+			q.Set("limit", strconv.FormatInt(*limit, 10))
+			q.Del("offset")
+			if offset != nil {
+				q.Set("offset", strconv.FormatInt(*offset, 10))
+			}
+			var l struct {
+				Count   *int64                   `json:"count"`
+				Results []map[string]interface{} `json:"results"`
+			}
+			if err := n.do(http.MethodGet, "/api/dcim/devices/?"+q.Encode(), nil, &l); err != nil {
+				return 0, nil, err
+			}
+			for _, r := range l.Results {
+				dev, err := toV3Device(r)
+				if err != nil {
+					return 0, nil, err
+				}
+				d = append(d, dev)
+			}
+			return len(l.Results), l.Count, nil
+		})
+	})
+	return
+}
+
+func (n *NetboxV4) UpdateDevice(id int64, body map[string]interface{}) (d *models.DeviceWithConfigContext, err error) {
+	b := make(map[string]interface{}, len(body))
+	for k, v := range body {
+		if v4, ok := v4DeviceFields[k]; ok {
+			k = v4
+		}
+		b[k] = v
+	}
+	var r map[string]interface{}
+	if err = n.do(http.MethodPatch, fmt.Sprintf("/api/dcim/devices/%d/", id), b, &r); err != nil {
+		return
+	}
+	return toV3Device(r)
+}
+
+func (n *NetboxV4) CreateInterface(data *models.WritableInterface) (in *models.Interface, err error) {
+	if !versionAtLeast(n.Version(), 4, 2) {
+		return n.NetboxV3.CreateInterface(data)
+	}
+	d := *data
+	d.MacAddress = nil
+	if in, err = n.NetboxV3.CreateInterface(&d); err != nil {
+		return
+	}
+	return in, n.setPrimaryMac(in, data.MacAddress)
+}
+
+func (n *NetboxV4) UpdateInterface(id int64, data *models.WritableInterface) (in *models.Interface, err error) {
+	if !versionAtLeast(n.Version(), 4, 2) {
+		return n.NetboxV3.UpdateInterface(id, data)
+	}
+	d := *data
+	d.MacAddress = nil
+	if in, err = n.NetboxV3.UpdateInterface(id, &d); err != nil {
+		return
+	}
+	return in, n.setPrimaryMac(in, data.MacAddress)
+}
+
+func (n *NetboxV4) PatchInterface(id int64, body map[string]interface{}) (in *models.Interface, err error) {
+	mac, ok := body["mac_address"].(string)
+	if !ok || !versionAtLeast(n.Version(), 4, 2) {
+		return n.NetboxV3.PatchInterface(id, body)
+	}
+	b := make(map[string]interface{})
+	for k, v := range body {
+		if k != "mac_address" {
+			b[k] = v
+		}
+	}
+	if in, err = n.NetboxV3.PatchInterface(id, b); err != nil {
+		return
+	}
+	return in, n.setPrimaryMac(in, &mac)
+}
+
+// setPrimaryMac sets the primary mac address of the interface, the mac address object is created if the interface has none
+func (n *NetboxV4) setPrimaryMac(in *models.Interface, mac *string) (err error) {
+	if mac == nil || *mac == "" || (in.MacAddress != nil && strings.EqualFold(*in.MacAddress, *mac)) {
+		return
+	}
+	q := url.Values{}
+	q.Set("assigned_object_type", "dcim.interface")
+	q.Set("assigned_object_id", strconv.FormatInt(in.ID, 10))
+	q.Set("mac_address", *mac)
+	var l struct {
+		Results []struct {
+			ID int64 `json:"id"`
+		} `json:"results"`
+	}
+	if err = n.do(http.MethodGet, "/api/dcim/mac-addresses/?"+q.Encode(), nil, &l); err != nil {
+		return
+	}
+	var m struct {
+		ID int64 `json:"id"`
+	}
+	if len(l.Results) > 0 {
+		m.ID = l.Results[0].ID
+	} else if err = n.do(http.MethodPost, "/api/dcim/mac-addresses/", map[string]interface{}{
+		"mac_address":          *mac,
+		"assigned_object_type": "dcim.interface",
+		"assigned_object_id":   in.ID,
+	}, &m); err != nil {
+		return fmt.Errorf("cannot create mac address %s: %s", *mac, err.Error())
+	}
+	var r map[string]interface{}
+	if err = n.do(http.MethodPatch, fmt.Sprintf("/api/dcim/interfaces/%d/", in.ID), map[string]interface{}{"primary_mac_address": m.ID}, &r); err != nil {
+		return fmt.Errorf("cannot set primary mac address %s: %s", *mac, err.Error())
+	}
+	in.MacAddress = mac
+	return
+}
+
+// toV3Device reads a netbox 4.x device into the go-netbox model
+func toV3Device(r map[string]interface{}) (d *models.DeviceWithConfigContext, err error) {
+	for v3, v4 := range v4DeviceFields {
+		if v, ok := r[v4]; ok {
+			r[v3] = v
+			delete(r, v4)
+		}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	d = new(models.DeviceWithConfigContext)
+	if err = json.Unmarshal(b, d); err != nil {
+		return d, fmt.Errorf("cannot read netbox 4 device: %s", err.Error())
+	}
+	return
+}
+
+func (n *NetboxV4) do(method, path string, body, result interface{}) (err error) {
+	var reqBody *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, "https://"+n.auth.Host+path, reqBody)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Token "+n.auth.Token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("[%s %s][%d] %s", method, path, resp.StatusCode, string(b))
+	}
+	return json.Unmarshal(b, result)
+}
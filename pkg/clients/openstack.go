@@ -2,6 +2,7 @@ package clients
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/sapcc/baremetal_temper/pkg/config"
@@ -62,7 +63,7 @@ func (oc *Openstack) GetServiceClient(client string) (c *gophercloud.ServiceClie
 	if ok {
 		return
 	}
-	provider, err := NewProviderClient(oc.cfg.Openstack)
+	provider, err := NewProviderClient(oc.cfg.Openstack, oc.cfg.Transport)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +136,8 @@ func (oc *Openstack) GetServiceClient(client string) (c *gophercloud.ServiceClie
 	return
 }
 
-func NewProviderClient(i config.OpenstackAuth) (pc *gophercloud.ProviderClient, err error) {
+// NewProviderClient creates an authenticated provider client. The optional transport wraps the client's http transport
+func NewProviderClient(i config.OpenstackAuth, transport func(http.RoundTripper) http.RoundTripper) (pc *gophercloud.ProviderClient, err error) {
 	os.Setenv("OS_USERNAME", i.User)
 	os.Setenv("OS_PASSWORD", i.Password)
 	os.Setenv("OS_PROJECT_NAME", i.ProjectName)
@@ -149,10 +151,16 @@ func NewProviderClient(i config.OpenstackAuth) (pc *gophercloud.ProviderClient,
 		DomainName:  os.Getenv("OS_PROJECT_DOMAIN_NAME"),
 	}
 
-	pc, err = openstack.AuthenticatedClient(opts)
+	pc, err = openstack.NewClient(opts.IdentityEndpoint)
 	if err != nil {
 		return pc, err
 	}
+	if transport != nil {
+		pc.HTTPClient = http.Client{Transport: transport(http.DefaultTransport)}
+	}
+	if err = openstack.Authenticate(pc, opts); err != nil {
+		return pc, err
+	}
 
 	pc.UseTokenLock()
 
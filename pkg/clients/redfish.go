@@ -1,7 +1,12 @@
 package clients
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
 
 	"github.com/sapcc/baremetal_temper/pkg/config"
 	log "github.com/sirupsen/logrus"
@@ -13,20 +18,29 @@ type Redfish struct {
 	Client       *gofish.APIClient
 	log          *log.Entry
 	cfg          config.Redfish
+	transport    func(http.RoundTripper) http.RoundTripper
+	session      *session
+	creds        CredentialProvider
+	mu           sync.Mutex
 }
 
-//NewRedfishClient creates redfish client
-func NewRedfish(cfg config.Config, ctxLogger *log.Entry) *Redfish {
+//NewRedfishClient creates redfish client. The bmc credentials are loaded from creds,
+//the static redfish.user and redfish.password are used if creds is nil
+func NewRedfish(cfg config.Config, creds CredentialProvider, ctxLogger *log.Entry) *Redfish {
+	if creds == nil {
+		creds = newStaticCredentials(cfg.Redfish)
+	}
 	return &Redfish{
 		ClientConfig: &gofish.ClientConfig{
-			Endpoint:  fmt.Sprintf("https://%s", "dummy.net"),
-			Username:  cfg.Redfish.User,
-			Password:  cfg.Redfish.Password,
-			Insecure:  true,
-			BasicAuth: true,
+			Endpoint: fmt.Sprintf("https://%s", "dummy.net"),
+			Username: cfg.Redfish.User,
+			Password: cfg.Redfish.Password,
+			Insecure: cfg.Redfish.Insecure,
 		},
-		cfg: cfg.Redfish,
-		log: ctxLogger,
+		cfg:       cfg.Redfish,
+		log:       ctxLogger,
+		transport: cfg.Transport,
+		creds:     creds,
 	}
 }
 
@@ -39,15 +53,92 @@ func (r *Redfish) SetEndpoint(remoteIP string) (err error) {
 	return
 }
 
+// Connect connects to the bmc once. All following calls reuse the client and its redfish session until Logout
 func (r *Redfish) Connect() (err error) {
-	client, err := gofish.Connect(*r.ClientConfig)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Client != nil {
+		return
+	}
+	base, err := r.baseTransport()
 	if err != nil {
 		return
 	}
+	r.session = newSession(r.ClientConfig, r.creds, base, r.cfg.MaxConnections, r.log)
+	r.ClientConfig.HTTPClient = &http.Client{Transport: r.session}
+	client, err := gofish.Connect(r.SessionConfig())
+	if err != nil {
+		r.session.logout()
+		r.session = nil
+		r.ClientConfig.HTTPClient = nil
+		return
+	}
 	r.Client = client
 	return
 }
 
+// SessionConfig returns a gofish config sharing the client's redfish session.
+// The session transport authenticates all requests, gofish must not create its own session
+func (r *Redfish) SessionConfig() (cfg gofish.ClientConfig) {
+	cfg = *r.ClientConfig
+	cfg.Username = ""
+	cfg.Password = ""
+	cfg.BasicAuth = false
+	return
+}
+
+// EnableVerification switches the client to verify the bmc certificate against the configured CA
+func (r *Redfish) EnableVerification() (err error) {
+	r.Logout()
+	r.ClientConfig.Insecure = false
+	if err = r.Connect(); err != nil {
+		return fmt.Errorf("cannot verify bmc certificate: %s", err.Error())
+	}
+	return
+}
+
+// Credentials returns the provider of the bmc credentials
+func (r *Redfish) Credentials() CredentialProvider {
+	return r.creds
+}
+
+// Logout deletes the redfish session. The next Connect creates a new one
 func (r *Redfish) Logout() {
-	r.Client.Logout()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.session != nil {
+		r.session.logout()
+	}
+	r.session = nil
+	r.Client = nil
+	r.ClientConfig.HTTPClient = nil
+}
+
+// baseTransport returns the transport below the session. It verifies the bmc certificate against the
+// configured CA (system roots if none is configured) unless insecure is set
+func (r *Redfish) baseTransport() (rt http.RoundTripper, err error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: r.ClientConfig.Insecure}
+	if !r.ClientConfig.Insecure && r.cfg.Bmc.Certificate.CACertPath != "" {
+		if transport.TLSClientConfig.RootCAs, err = r.caPool(); err != nil {
+			return
+		}
+	}
+	rt = transport
+	if r.transport != nil {
+		rt = r.transport(rt)
+	}
+	return
+}
+
+func (r *Redfish) caPool() (pool *x509.CertPool, err error) {
+	pem, err := ioutil.ReadFile(r.cfg.Bmc.Certificate.CACertPath)
+	if err != nil {
+		return pool, fmt.Errorf("cannot read bmc ca: %s", err.Error())
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return pool, fmt.Errorf("no certificates found in bmc ca %s", r.cfg.Bmc.Certificate.CACertPath)
+	}
+	return
 }
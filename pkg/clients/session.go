@@ -0,0 +1,268 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+)
+
+// defaultMaxConnections is the number of concurrent requests per bmc if redfish.maxConnections is not set
+const defaultMaxConnections = 2
+
+const sessionsPath = "/redfish/v1/SessionService/Sessions"
+
+var (
+	limitersMu sync.Mutex
+	limiters   = make(map[string]chan bool)
+
+	sessionsMu sync.Mutex
+	sessions   = make(map[*session]bool)
+)
+
+// session authenticates all requests of a node run with a single redfish session.
+// It logs in on the first request and again if the bmc answers with 401 (expired or deleted session)
+type session struct {
+	cfg     *gofish.ClientConfig
+	creds   CredentialProvider
+	base    http.RoundTripper
+	limiter chan bool
+	log     *log.Entry
+
+	mu        sync.Mutex
+	token     string
+	location  string
+	basicAuth bool
+}
+
+func newSession(cfg *gofish.ClientConfig, creds CredentialProvider, base http.RoundTripper, maxConnections int, ctxLogger *log.Entry) (s *session) {
+	s = &session{
+		cfg:     cfg,
+		creds:   creds,
+		base:    base,
+		limiter: bmcLimiter(cfg.Endpoint, maxConnections),
+		log:     ctxLogger,
+	}
+	sessionsMu.Lock()
+	sessions[s] = true
+	sessionsMu.Unlock()
+	return
+}
+
+// bmcLimiter returns the limiter shared by all clients of a bmc endpoint
+func bmcLimiter(endpoint string, max int) chan bool {
+	if max <= 0 {
+		max = defaultMaxConnections
+	}
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[endpoint]
+	if !ok {
+		l = make(chan bool, max)
+		limiters[endpoint] = l
+	}
+	return l
+}
+
+// LogoutAll logs out all open redfish sessions, e.g. when temper is shut down during node runs
+func LogoutAll() {
+	sessionsMu.Lock()
+	open := make([]*session, 0, len(sessions))
+	for s := range sessions {
+		open = append(open, s)
+	}
+	sessionsMu.Unlock()
+	for _, s := range open {
+		s.logout()
+	}
+}
+
+// RoundTrip holds a slot of the bmc's limiter until the response body is read, the body is returned buffered.
+// So the connection is reused even if the caller drops the response without closing it, like gofish actions do
+func (s *session) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	s.limiter <- true
+	defer func() {
+		<-s.limiter
+	}()
+	if resp, err = s.send(req); err != nil {
+		return
+	}
+	b, err := readBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return
+}
+
+func (s *session) send(req *http.Request) (resp *http.Response, err error) {
+	body, err := readBody(req.Body)
+	if err != nil {
+		return
+	}
+	token, err := s.login("")
+	if err != nil {
+		return
+	}
+	if resp, err = s.base.RoundTrip(s.authorize(req, body, token)); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusUnauthorized || s.basicAuth {
+		return
+	}
+	resp.Body.Close()
+	s.log.Debugf("redfish session rejected for %s, logging in again", req.URL.Path)
+	if token, err = s.login(token); err != nil {
+		return
+	}
+	return s.base.RoundTrip(s.authorize(req, body, token))
+}
+
+func (s *session) authorize(req *http.Request, body []byte, token string) (r *http.Request) {
+	r = req.Clone(req.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Cookie")
+	if s.basicAuth {
+		r.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+		return
+	}
+	r.Header.Set("X-Auth-Token", token)
+	return
+}
+
+// login creates a new session if there is none or the current one equals the rejected token.
+// The provider's credentials are tried in order, the one that works is reported back to the provider.
+// Returns the token to use
+func (s *session) login(rejected string) (token string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.basicAuth || (s.token != "" && s.token != rejected) {
+		return s.token, nil
+	}
+	creds, err := s.creds.Credentials()
+	if err != nil {
+		return
+	}
+	sources := make([]string, 0)
+	for _, c := range creds {
+		ok, err := s.createSession(c)
+		if err != nil {
+			return token, err
+		}
+		if !ok {
+			s.log.Debugf("bmc rejected credentials of user %s from %s", c.User, c.Source)
+			sources = append(sources, c.Source)
+			continue
+		}
+		if cur, found := s.creds.Current(); !found || cur != c {
+			s.log.Infof("using bmc credentials of user %s from %s", c.User, c.Source)
+		}
+		s.cfg.Username = c.User
+		s.cfg.Password = c.Password
+		s.creds.Succeeded(c)
+		return s.token, nil
+	}
+	return token, fmt.Errorf("bmc rejected all credentials (%s)", strings.Join(sources, ", "))
+}
+
+// createSession returns false if the bmc rejects the credential.
+// BMCs without session support are authenticated with basic auth
+func (s *session) createSession(c Credential) (ok bool, err error) {
+	b, err := json.Marshal(map[string]string{"UserName": c.User, "Password": c.Password})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.Endpoint+sessionsPath, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.base.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		s.log.Infof("bmc does not support redfish sessions (%d), using basic auth", resp.StatusCode)
+		return s.checkBasicAuth(c)
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("cannot create redfish session: %d: %s", resp.StatusCode, string(body))
+	}
+	s.token = resp.Header.Get("X-Auth-Token")
+	if s.token == "" {
+		return false, fmt.Errorf("cannot create redfish session: no X-Auth-Token returned")
+	}
+	s.location = resp.Header.Get("Location")
+	if s.location == "" {
+		var r struct {
+			ODataID string `json:"@odata.id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&r)
+		s.location = r.ODataID
+	}
+	s.log.Debugf("created redfish session %s", s.location)
+	return true, nil
+}
+
+func (s *session) checkBasicAuth(c Credential) (ok bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, s.cfg.Endpoint+"/redfish/v1/Systems", nil)
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth(c.User, c.Password)
+	resp, err := s.base.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return false, nil
+	}
+	s.basicAuth = true
+	return true, nil
+}
+
+// logout deletes the session on the bmc
+func (s *session) logout() {
+	sessionsMu.Lock()
+	delete(sessions, s)
+	sessionsMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == "" || s.location == "" {
+		return
+	}
+	location := s.location
+	if u, err := url.Parse(location); err == nil && u.IsAbs() {
+		location = u.Path
+	}
+	req, err := http.NewRequest(http.MethodDelete, s.cfg.Endpoint+"/"+strings.TrimPrefix(location, "/"), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Auth-Token", s.token)
+	resp, err := s.base.RoundTrip(req)
+	if err != nil {
+		s.log.Debugf("cannot delete redfish session %s: %s", s.location, err.Error())
+		return
+	}
+	resp.Body.Close()
+	s.log.Debugf("deleted redfish session %s", s.location)
+	s.token = ""
+	s.location = ""
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+type BiosProfiles struct {
+	Profiles []BiosProfile `json:"profiles"`
+}
+
+// BiosProfile describes the bios attributes and boot order a node should have.
+// DeviceType and Role are regular expressions matched against the netbox device type and role slug.
+type BiosProfile struct {
+	Name       string                 `json:"name"`
+	DeviceType string                 `json:"deviceType"`
+	Role       string                 `json:"role"`
+	Attributes map[string]interface{} `json:"attributes"`
+	BootOrder  []string               `json:"bootOrder"`
+}
+
+func GetBiosProfiles(path string) (p BiosProfiles, err error) {
+	if path == "" {
+		return p, fmt.Errorf("no bios profiles path configured")
+	}
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, fmt.Errorf("read file file: %s", err.Error())
+	}
+	if err = json.Unmarshal(jsonBytes, &p); err != nil {
+		return p, fmt.Errorf("parse bios profiles: %s", err.Error())
+	}
+	return
+}
+
+// Get returns the profile with the name
+func (b BiosProfiles) Get(name string) (p *BiosProfile, err error) {
+	for i, pr := range b.Profiles {
+		if pr.Name == name {
+			return &b.Profiles[i], nil
+		}
+	}
+	return p, fmt.Errorf("no bios profile %s found", name)
+}
+
+// Match returns the first profile matching the device type and role
+func (b BiosProfiles) Match(deviceType, role string) (p *BiosProfile, err error) {
+	for i, pr := range b.Profiles {
+		ok, err := matchDevice(pr.DeviceType, pr.Role, deviceType, role)
+		if err != nil {
+			return p, fmt.Errorf("invalid bios profile %s: %s", pr.Name, err.Error())
+		}
+		if ok {
+			return &b.Profiles[i], nil
+		}
+	}
+	return p, fmt.Errorf("no bios profile found for device type %s and role %s", deviceType, role)
+}
+
+// matchDevice matches the device type and role regular expressions of a profile against a netbox device
+func matchDevice(deviceTypeRe, roleRe, deviceType, role string) (bool, error) {
+	dt, err := regexp.Compile(`(?i)` + deviceTypeRe)
+	if err != nil {
+		return false, err
+	}
+	r, err := regexp.Compile(`(?i)` + roleRe)
+	if err != nil {
+		return false, err
+	}
+	return dt.MatchString(deviceType) && r.MatchString(role), nil
+}
@@ -3,27 +3,205 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"time"
 
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Openstack        OpenstackAuth `yaml:"openstack"`
-	Inspector        Inspector     `yaml:"inspector"`
-	Redfish          Redfish       `yaml:"redfish"`
-	Netbox           NetboxAuth    `yaml:"netbox"`
-	Arista           AristaAuth    `yaml:"arista"`
-	Aci              AciAuth       `yaml:"aci"`
-	Awx              AwxAuth       `yaml:"awx"`
-	NetboxNodesPath  string        `yaml:"netboxNodesPath"`
-	RulesPath        string        `yaml:"rulesPath"`
-	Region           string        `yaml:"region"`
-	NetboxQuery      *string       `yaml:"netboxQuery"`
-	Domain           string        `yaml:"domain"`
-	NameSpace        string        `yaml:"namespace"`
-	Deployment       Deployment    `yaml:"deployment"`
-	FlavorAccessType flavors.AccessType
+	Openstack          OpenstackAuth `yaml:"openstack"`
+	Inspector          Inspector     `yaml:"inspector"`
+	Redfish            Redfish       `yaml:"redfish"`
+	Netbox             NetboxAuth    `yaml:"netbox"`
+	Arista             AristaAuth    `yaml:"arista"`
+	Aci                AciAuth       `yaml:"aci"`
+	Awx                AwxAuth       `yaml:"awx"`
+	NetboxNodesPath    string        `yaml:"netboxNodesPath"`
+	RulesPath          string        `yaml:"rulesPath"`
+	BiosProfilesPath   string        `yaml:"biosProfilesPath"`
+	StorageLayoutsPath string        `yaml:"storageLayoutsPath"`
+	SnapshotsPath      string        `yaml:"snapshotsPath"`
+	Region             string        `yaml:"region"`
+	NetboxQuery        *string       `yaml:"netboxQuery"`
+	Domain             string        `yaml:"domain"`
+	NameSpace          string        `yaml:"namespace"`
+	Deployment         Deployment    `yaml:"deployment"`
+	Recorder           Recorder      `yaml:"recorder"`
+	Agent              Agent         `yaml:"agent"`
+	CableCheck         CableCheck    `yaml:"cableCheck"`
+	LinkCheck          LinkCheck     `yaml:"linkCheck"`
+	Diagnostics        Diagnostics   `yaml:"diagnostics"`
+	Burnin             Burnin        `yaml:"burnin"`
+	Status             Status        `yaml:"status"`
+	Ipam               Ipam          `yaml:"ipam"`
+	FlavorAccessType   flavors.AccessType
+
+	// Transport wraps the http transports of the redfish, netbox and openstack clients of a node run
+	Transport func(http.RoundTripper) http.RoundTripper `yaml:"-"`
+}
+
+// Recorder records (mode: record) the sanitized http interactions of each node run to <path>/<node>.json
+// or replays them (mode: replay) instead of calling the bmc, netbox and openstack
+type Recorder struct {
+	Mode string `yaml:"mode"`
+	Path string `yaml:"path"`
+}
+
+// Agent is the callback of the boot image agent used by the cable check. Reports are signed with
+// the hmac-sha256 of the shared secret. Listen is the address of the callback endpoint of cli runs,
+// the temper server serves it with its api
+type Agent struct {
+	Secret  string        `yaml:"secret"`
+	Timeout time.Duration `yaml:"timeout"`
+	Listen  string        `yaml:"listen"`
+}
+
+// CableCheck configures the lldp neighbor sources of the cable check. Sources are tried in order for the interfaces
+// whose netbox switch name matches the source's match regex (empty matches all switches), interfaces of switches
+// without a source fail the check.
+// Types: aci, arista (eAPI), nxapi, snmp (LLDP-MIB), redfish (bmc) and agent (boot image).
+// Defaults to the boot image agent and aci for switches named aci
+type CableCheck struct {
+	Sources []NeighborSource `yaml:"sources"`
+	// ApproveReconcile lets the cablecheck.reconcile task update the netbox cables to the observed lldp topology
+	ApproveReconcile bool `yaml:"approveReconcile"`
+}
+
+// Diagnostics configures the evaluation of the hardware and health check results. Policy is the file deciding
+// which warnings are acceptable per component, the results of each node run are persisted to ResultsPath if set.
+// MaxExtendedPerRack limits the nodes of a rack running extended ePSA diagnostics at once (0 is unlimited),
+// the slots are held in the device custom field RackSlotField (type json) shared by all temper processes
+type Diagnostics struct {
+	Policy             string `yaml:"policy"`
+	ResultsPath        string `yaml:"resultsPath"`
+	Epsa               Epsa   `yaml:"epsa"`
+	MaxExtendedPerRack int    `yaml:"maxExtendedPerRack"`
+	RackSlotField      string `yaml:"rackSlotField"`
+}
+
+// Epsa are the options of the Dell ePSA diagnostics, a hardwarecheck task in the netbox config context may override them.
+// RunMode is Express or Extended, RebootType the iDRAC RebootJobType (GracefulRebootWithForcedShutdown,
+// GracefulRebootWithoutForcedShutdown or PowerCycle). MaxRetries restarts a job the iDRAC lost,
+// Timeout is the max duration of a run
+type Epsa struct {
+	RunMode    string        `yaml:"runMode" json:"runMode,omitempty"`
+	RebootType string        `yaml:"rebootType" json:"rebootType,omitempty"`
+	MaxRetries int           `yaml:"maxRetries" json:"maxRetries,omitempty"`
+	Timeout    time.Duration `yaml:"timeout" json:"-"`
+}
+
+// Burnin configures the diagnostics.burnin task. Image is the diagnostics boot image (defaults to redfish.bootImage),
+// its agent fetches the plan and uploads the results to the agent endpoint. Timeout is the max duration of the plan
+type Burnin struct {
+	Image   string        `yaml:"image"`
+	Timeout time.Duration `yaml:"timeout"`
+	Plan    BurninPlan    `yaml:"plan"`
+}
+
+// BurninPlan is the test plan run by the agent of the diagnostics image. Zero durations skip a test,
+// fio runs on every disk and iperf against IperfTarget
+type BurninPlan struct {
+	MemtestMinutes   int    `yaml:"memtestMinutes" json:"memtestMinutes"`
+	StressCPUMinutes int    `yaml:"stressCpuMinutes" json:"stressCpuMinutes"`
+	FioMinutes       int    `yaml:"fioMinutes" json:"fioMinutes"`
+	IperfTarget      string `yaml:"iperfTarget" json:"iperfTarget"`
+	IperfSeconds     int    `yaml:"iperfSeconds" json:"iperfSeconds"`
+}
+
+// Ipam configures the ipam.allocate task. PrimaryRole and BmcRole are the ipam role slugs of the prefixes the primary
+// and bmc (r suffixed) addresses are allocated from, an empty PrimaryRole is the device role. Prefixes of the device's
+// rack, tagged with RackTag (a fmt template of the rack name, e.g. rack-%s, empty uses the site prefixes only), are preferred
+// over the other prefixes of its site. PrimaryInterface and BmcInterface are the interfaces the addresses are assigned to,
+// an empty BmcInterface is the management only interface of the device
+type Ipam struct {
+	PrimaryRole      string `yaml:"primaryRole"`
+	BmcRole          string `yaml:"bmcRole"`
+	PrimaryInterface string `yaml:"primaryInterface"`
+	BmcInterface     string `yaml:"bmcInterface"`
+	RackTag          string `yaml:"rackTag"`
+}
+
+// Status maps the phases of a temper run to netbox device statuses. The workflow whose Trigger is the status of the
+// device when the run starts and whose Source started the run applies: Tempering is set at the start (empty keeps the
+// status), Success or Failed at the end. Source restricts what starts a workflow: webhook, scheduler or empty for both.
+// Tags are set on the device for its failed steps and removed once they pass. Defaults to DefaultStatusWorkflows and DefaultStatusTags
+type Status struct {
+	Workflows []StatusWorkflow `yaml:"workflows"`
+	Tags      []StatusTag      `yaml:"tags"`
+}
+
+type StatusWorkflow struct {
+	Name      string `yaml:"name"`
+	Trigger   string `yaml:"trigger"`
+	Source    string `yaml:"source"`
+	Tempering string `yaml:"tempering"`
+	Success   string `yaml:"success"`
+	Failed    string `yaml:"failed"`
+}
+
+// StatusTag is the netbox tag of the failed steps starting with Step, the longest matching Step wins
+type StatusTag struct {
+	Step string `yaml:"step"`
+	Tag  string `yaml:"tag"`
+}
+
+// DefaultStatusWorkflows temper the devices in inventory (webhook) and planned (scheduler) status
+var DefaultStatusWorkflows = []StatusWorkflow{
+	{Name: "inventory", Trigger: "inventory", Source: "webhook", Success: "staged", Failed: "failed"},
+	{Name: "planned", Trigger: "planned", Source: "scheduler", Success: "staged", Failed: "failed"},
+}
+
+var DefaultStatusTags = []StatusTag{
+	{Step: "diagnostics", Tag: "temper:diagnostics-failed"},
+	{Step: "diagnostics.cablecheck", Tag: "temper:cable-mismatch"},
+	{Step: "diagnostics.linkcheck", Tag: "temper:link-mismatch"},
+}
+
+// GetWorkflows returns the configured workflows, DefaultStatusWorkflows if there are none
+func (s Status) GetWorkflows() []StatusWorkflow {
+	if len(s.Workflows) == 0 {
+		return DefaultStatusWorkflows
+	}
+	return s.Workflows
+}
+
+// GetTags returns the configured tags, DefaultStatusTags if there are none
+func (s Status) GetTags() []StatusTag {
+	if len(s.Tags) == 0 {
+		return DefaultStatusTags
+	}
+	return s.Tags
+}
+
+// Triggers returns the trigger statuses of the workflows started by the source
+func (s Status) Triggers(source string) (triggers []string) {
+	triggers = make([]string, 0)
+	for _, w := range s.GetWorkflows() {
+		if w.Source == "" || w.Source == source {
+			triggers = append(triggers, w.Trigger)
+		}
+	}
+	return
+}
+
+// LinkCheck configures the link check of the switch ports cabled to the node. MTU is the min mtu of the ports (0 skips the check).
+// Lacp checks the port-channel membership of the ports, as temper bonds them into an 802.3ad ironic port group
+type LinkCheck struct {
+	MTU  int  `yaml:"mtu"`
+	Lacp bool `yaml:"lacp"`
+}
+
+type NeighborSource struct {
+	Type      string `yaml:"type"`
+	Match     string `yaml:"match"`
+	User      string `yaml:"user"`
+	Password  string `yaml:"password"`
+	Community string `yaml:"community"`
+	Port      int    `yaml:"port"`
+	// Insecure skips the verification of the switch certificate (nxapi)
+	Insecure bool `yaml:"insecure"`
 }
 
 type Inspector struct {
@@ -34,6 +212,61 @@ type Redfish struct {
 	User      string  `yaml:"user"`
 	Password  string  `yaml:"password"`
 	BootImage *string `yaml:"bootImage"`
+	Insecure  bool    `yaml:"insecure"`
+	Bmc       Bmc     `yaml:"bmc"`
+	// MaxConnections limits the concurrent requests per bmc
+	MaxConnections int `yaml:"maxConnections"`
+	// Credentials are the sources of the bmc credentials, tried in order. Defaults to user and password
+	Credentials []CredentialSource `yaml:"credentials"`
+}
+
+// CredentialSource is a source of bmc credentials:
+// static (user/password), file (yaml per node), netbox (device custom fields), vault (kv secret) or factory (defaults list).
+// The factory defaults are only tried for nodes without credentials in the other sources.
+// A rotated bmc password is stored in the first netbox or vault source.
+// Path is a template of the node's Name and Serial, e.g. secret/data/bmc/{{.Name}}
+type CredentialSource struct {
+	Type          string          `yaml:"type"`
+	Path          string          `yaml:"path"`
+	UserField     string          `yaml:"userField"`
+	PasswordField string          `yaml:"passwordField"`
+	Address       string          `yaml:"address"`
+	Token         string          `yaml:"token"`
+	Defaults      []BmcCredential `yaml:"defaults"`
+}
+
+type BmcCredential struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// Bmc is the baseline configuration applied by the bmc.configure task
+type Bmc struct {
+	Password          string         `yaml:"password"`
+	Accounts          []BmcAccount   `yaml:"accounts"`
+	NTPServers        []string       `yaml:"ntpServers"`
+	SyslogServers     []string       `yaml:"syslogServers"`
+	DisabledProtocols []string       `yaml:"disabledProtocols"`
+	Certificate       BmcCertificate `yaml:"certificate"`
+}
+
+type BmcAccount struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+}
+
+// BmcCertificate configures the CA used to sign the certificate signing request of the BMC, the certificate covers
+// its dns name and ip.
+// The CA certificate is also used to verify the BMC's certificate if redfish.insecure is false
+type BmcCertificate struct {
+	CACertPath   string `yaml:"caCertPath"`
+	CAKeyPath    string `yaml:"caKeyPath"`
+	ValidityDays int    `yaml:"validityDays"`
+	Organization string `yaml:"organization"`
+	Country      string `yaml:"country"`
+	State        string `yaml:"state"`
+	City         string `yaml:"city"`
 }
 
 type OpenstackAuth struct {
@@ -45,9 +278,17 @@ type OpenstackAuth struct {
 	ProjectDomainName string `yaml:"projectDomainName"`
 }
 
+// NetboxAuth is the netbox api. IronicNodeURL and InstanceURL are fmt templates of the uuid linked
+// in the journal entry of a run, e.g. https://dashboard.example.com/admin/ironic/%s. Version is the netbox version
+// (e.g. 3 or 4.1), empty probes it via /api/status/. CacheTTL is how long switch devices and racks are cached
+// for all node runs of the process, changes in netbox are seen by the runs after at most CacheTTL. 0 disables the cache
 type NetboxAuth struct {
-	Host  string `yaml:"host"`
-	Token string `yaml:"token"`
+	Host          string        `yaml:"host"`
+	Token         string        `yaml:"token"`
+	Version       string        `yaml:"version"`
+	CacheTTL      time.Duration `yaml:"cacheTTL"`
+	IronicNodeURL string        `yaml:"ironicNodeURL"`
+	InstanceURL   string        `yaml:"instanceURL"`
 }
 
 type AristaAuth struct {
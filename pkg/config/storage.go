@@ -0,0 +1,81 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+type StorageLayouts struct {
+	Layouts []StorageLayout `json:"layouts"`
+}
+
+// StorageLayout describes the volumes a node should have.
+// DeviceType and Role are regular expressions matched against the netbox device type and role slug.
+// If Jbod is set, all drives which are not part of a volume are converted to non raid drives, which is only supported for Dell.
+type StorageLayout struct {
+	Name       string         `json:"name"`
+	DeviceType string         `json:"deviceType"`
+	Role       string         `json:"role"`
+	Volumes    []VolumeLayout `json:"volumes"`
+	Jbod       bool           `json:"jbod"`
+}
+
+// VolumeLayout describes a single volume. Controller and Drives are regular expressions
+// matched against the redfish storage id and the drive name or model.
+type VolumeLayout struct {
+	Name       string `json:"name"`
+	RAIDType   string `json:"raidType"`
+	Controller string `json:"controller"`
+	Drives     string `json:"drives"`
+	DriveCount int    `json:"driveCount"`
+	Root       bool   `json:"root"`
+}
+
+func GetStorageLayouts(path string) (l StorageLayouts, err error) {
+	if path == "" {
+		return l, fmt.Errorf("no storage layouts path configured")
+	}
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return l, fmt.Errorf("read file file: %s", err.Error())
+	}
+	if err = json.Unmarshal(jsonBytes, &l); err != nil {
+		return l, fmt.Errorf("parse storage layouts: %s", err.Error())
+	}
+	return
+}
+
+// Match returns the first layout matching the device type and role
+func (s StorageLayouts) Match(deviceType, role string) (l *StorageLayout, err error) {
+	for i, sl := range s.Layouts {
+		ok, err := matchDevice(sl.DeviceType, sl.Role, deviceType, role)
+		if err != nil {
+			return l, fmt.Errorf("invalid storage layout %s: %s", sl.Name, err.Error())
+		}
+		if ok {
+			return &s.Layouts[i], nil
+		}
+	}
+	return l, fmt.Errorf("no storage layout found for device type %s and role %s", deviceType, role)
+}
+
+// Get returns the layout with the name
+func (s StorageLayouts) Get(name string) (l *StorageLayout, err error) {
+	for i, sl := range s.Layouts {
+		if sl.Name == name {
+			return &s.Layouts[i], nil
+		}
+	}
+	return l, fmt.Errorf("no storage layout %s found", name)
+}
+
+// RootVolume returns the volume layout flagged as root device
+func (l StorageLayout) RootVolume() (v *VolumeLayout, err error) {
+	for i, vl := range l.Volumes {
+		if vl.Root {
+			return &l.Volumes[i], nil
+		}
+	}
+	return v, fmt.Errorf("storage layout %s has no root volume", l.Name)
+}
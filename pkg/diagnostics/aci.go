@@ -1,7 +1,10 @@
 package diagnostics
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,10 +16,11 @@ import (
 )
 
 type ACIClient struct {
-	Cfg config.Config
-	Log *log.Entry
-	c   map[string]*client.Client
-	co  map[string]*container.Container
+	Cfg  config.Config
+	Log  *log.Entry
+	c    map[string]*client.Client
+	co   map[string]*container.Container
+	phys map[string]*container.Container
 }
 
 type Lldp struct {
@@ -28,6 +32,29 @@ type LldpIf struct {
 	LldpIfChildren   []LldpIfChildren `json:"children"`
 }
 
+type PhysIf struct {
+	L1PhysIf L1PhysIf `json:"l1PhysIf"`
+}
+
+type L1PhysIf struct {
+	Attributes struct {
+		ID  string `json:"id"`
+		Mtu string `json:"mtu"`
+	} `json:"attributes"`
+	Children []struct {
+		EthpmPhysIf struct {
+			Attributes EthpmPhysIfAttributes `json:"attributes"`
+		} `json:"ethpmPhysIf"`
+	} `json:"children"`
+}
+
+type EthpmPhysIfAttributes struct {
+	OperSt      string `json:"operSt"`
+	OperSpeed   string `json:"operSpeed"`
+	OperDuplex  string `json:"operDuplex"`
+	BundleIndex string `json:"bundleIndex"`
+}
+
 type LldpIfAttributes struct {
 	ID       string `json:"id"`
 	Mac      string `json:"mac"`
@@ -54,10 +81,11 @@ type LldpAdjEpAttributes struct {
 
 func NewACI(cfg config.Config, log *log.Entry) (c *ACIClient) {
 	return &ACIClient{
-		Cfg: cfg,
-		Log: log,
-		c:   make(map[string]*client.Client, 0),
-		co:  make(map[string]*container.Container, 0),
+		Cfg:  cfg,
+		Log:  log,
+		c:    make(map[string]*client.Client, 0),
+		co:   make(map[string]*container.Container, 0),
+		phys: make(map[string]*container.Container, 0),
 	}
 }
 
@@ -72,14 +100,23 @@ func (a ACIClient) GetClient(host string) (c *client.Client) {
 }
 
 func (a ACIClient) GetContainer(host string) (co *container.Container, err error) {
-	co, ok := a.co[host]
+	return a.getClass(host, "/api/node/class/lldpIf.json?rsp-subtree=children&rsp-subtree-class=lldpAdjEp&rsp-subtree-include=required&order-by=lldpIf.id", a.co)
+}
+
+// GetPhysContainer returns the physical interfaces of the switch with their operational state
+func (a ACIClient) GetPhysContainer(host string) (co *container.Container, err error) {
+	return a.getClass(host, "/api/node/class/l1PhysIf.json?rsp-subtree=children&rsp-subtree-class=ethpmPhysIf&order-by=l1PhysIf.id", a.phys)
+}
+
+func (a ACIClient) getClass(host, path string, cache map[string]*container.Container) (co *container.Container, err error) {
+	co, ok := cache[host]
 	if ok {
 		return
 	}
 	c := a.GetClient(host)
 	request := wait.ConditionFunc(func() (bool, error) {
 		var resp *http.Response
-		url := c.BaseURL.String() + "/api/node/class/lldpIf.json?rsp-subtree=children&rsp-subtree-class=lldpAdjEp&rsp-subtree-include=required&order-by=lldpIf.id"
+		url := c.BaseURL.String() + path
 		req, err := c.MakeRestRequest("GET", url, nil, true)
 		if err != nil && strings.Contains(err.Error(), "invalid character '<'") {
 			return false, nil
@@ -103,6 +140,89 @@ func (a ACIClient) GetContainer(host string) (co *container.Container, err error
 	if err = wait.Poll(5*time.Second, 2*time.Minute, request); err != nil {
 		return
 	}
-	a.co[host] = co
+	cache[host] = co
 	return
 }
+
+func (a ACIClient) Name() string {
+	return "aci"
+}
+
+// Neighbors returns the lldp neighbors of all ports of the interface's aci switch
+func (a ACIClient) Neighbors(intf CableInterface) (nbs []Neighbor, err error) {
+	if intf.SwitchIP == "" {
+		return nbs, fmt.Errorf("no_aci_ip")
+	}
+	co, err := a.GetContainer(intf.SwitchIP)
+	if err != nil {
+		return
+	}
+	l, _ := co.Search("imdata").Children()
+	nbs = make([]Neighbor, 0)
+	for _, c := range l {
+		var l Lldp
+		if err = json.Unmarshal(c.Bytes(), &l); err != nil {
+			a.Log.Errorf("cannot unmarshal aci lldp: %s", err.Error())
+			continue
+		}
+		for _, ch := range l.LldpIf.LldpIfChildren {
+			nbs = append(nbs, Neighbor{
+				Mac:    ch.LldpAdjEp.LldpAdjEpAttributes.PortIdV,
+				Switch: intf.Switch,
+				Port:   l.LldpIf.LldpIfAttributes.ID,
+			})
+		}
+	}
+	return nbs, nil
+}
+
+// PortStatus returns the operational speed, duplex, mtu and port-channel of the interface's aci switch port
+func (a ACIClient) PortStatus(intf CableInterface) (ps PortStatus, err error) {
+	if intf.SwitchIP == "" {
+		return ps, fmt.Errorf("no_aci_ip")
+	}
+	co, err := a.GetPhysContainer(intf.SwitchIP)
+	if err != nil {
+		return
+	}
+	l, _ := co.Search("imdata").Children()
+	for _, c := range l {
+		var p PhysIf
+		if err = json.Unmarshal(c.Bytes(), &p); err != nil {
+			return ps, fmt.Errorf("cannot unmarshal aci l1PhysIf: %s", err.Error())
+		}
+		if !PortMatches(p.L1PhysIf.Attributes.ID, intf.Port) {
+			continue
+		}
+		// mtu is "inherit" for the fabric default
+		ps.MTU, _ = strconv.Atoi(p.L1PhysIf.Attributes.Mtu)
+		for _, ch := range p.L1PhysIf.Children {
+			attr := ch.EthpmPhysIf.Attributes
+			ps.SpeedMbps = parseSpeed(attr.OperSpeed)
+			ps.Duplex = attr.OperDuplex
+			if attr.BundleIndex != "" && attr.BundleIndex != "unspecified" {
+				ps.PortChannel = attr.BundleIndex
+			}
+		}
+		return ps, nil
+	}
+	return ps, fmt.Errorf("port %s not found on %s", intf.Port, intf.Switch)
+}
+
+// parseSpeed returns the Mbps of an aci speed, e.g. 100M, 25G or 100G
+func parseSpeed(s string) int {
+	s = strings.ToUpper(s)
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "G"):
+		mult = 1000
+	case strings.HasSuffix(s, "M"):
+	default:
+		return 0
+	}
+	f, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0
+	}
+	return int(f * float64(mult))
+}
@@ -0,0 +1,150 @@
+package diagnostics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// AgentSignatureHeader carries the hex hmac-sha256 of the report body, signed with agent.secret
+const AgentSignatureHeader = "X-Temper-Signature"
+
+// maxAgentClockSkew is the max age of a report's timestamp, older reports are rejected as replays
+const maxAgentClockSkew = 5 * time.Minute
+
+// poll interval of WaitAgentReport. Tests shorten it
+var agentPollInterval = 5 * time.Second
+
+var (
+	agentReportsMu sync.Mutex
+	agentReports   = make(map[string]AgentReport)
+)
+
+// AgentReport is sent by the agent of the boot image once the live system is up.
+// The node is identified by its serial number, the name is optional
+type AgentReport struct {
+	Node      string      `json:"node"`
+	Serial    string      `json:"serial"`
+	Timestamp time.Time   `json:"timestamp"`
+	Links     []AgentLink `json:"links"`
+	Health    AgentHealth `json:"health"`
+
+	received time.Time
+}
+
+// AgentLink is the state of a node interface and the lldp neighbors seen on it
+type AgentLink struct {
+	Mac       string          `json:"mac"`
+	Name      string          `json:"name"`
+	State     string          `json:"state"`
+	Speed     int             `json:"speed"`
+	Neighbors []AgentNeighbor `json:"neighbors"`
+}
+
+type AgentNeighbor struct {
+	ChassisID   string `json:"chassisId"`
+	SysName     string `json:"sysName"`
+	PortID      string `json:"portId"`
+	PortDescr   string `json:"portDescr"`
+	MgmtAddress string `json:"mgmtAddress"`
+}
+
+type AgentHealth struct {
+	Uptime   int64    `json:"uptime"`
+	CPUs     int      `json:"cpus"`
+	MemoryMB int      `json:"memoryMB"`
+	Disks    int      `json:"disks"`
+	Errors   []string `json:"errors"`
+}
+
+// SignAgentReport returns the signature of a report body
+func SignAgentReport(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAgentReport checks the signature and age of a report and parses it
+func VerifyAgentReport(body []byte, signature, secret string) (r AgentReport, err error) {
+	if err = VerifyAgentSignature(body, signature, secret); err != nil {
+		return
+	}
+	if err = json.Unmarshal(body, &r); err != nil {
+		return r, fmt.Errorf("cannot parse agent report: %s", err.Error())
+	}
+	if r.Serial == "" {
+		return r, fmt.Errorf("agent report without serial number")
+	}
+	err = checkAgentTimestamp(r.Timestamp)
+	return
+}
+
+// VerifyAgentSignature checks the signature of a request of the boot image agent
+func VerifyAgentSignature(body []byte, signature, secret string) (err error) {
+	if secret == "" {
+		return fmt.Errorf("no agent secret configured")
+	}
+	expected, err := hex.DecodeString(SignAgentReport(body, secret))
+	if err != nil {
+		return
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !hmac.Equal(sig, expected) {
+		return fmt.Errorf("invalid agent signature")
+	}
+	return
+}
+
+func checkAgentTimestamp(ts time.Time) error {
+	if age := time.Since(ts); age > maxAgentClockSkew || age < -maxAgentClockSkew {
+		return fmt.Errorf("agent timestamp %s out of range", ts.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// AddAgentReport stores the latest report of a node
+func AddAgentReport(r AgentReport) {
+	agentReportsMu.Lock()
+	defer agentReportsMu.Unlock()
+	r.received = time.Now()
+	agentReports[strings.ToUpper(r.Serial)] = r
+}
+
+// WaitAgentReport waits for the report of the node with the serial number received after since
+func WaitAgentReport(serial string, since time.Time, timeout time.Duration) (r AgentReport, err error) {
+	cf := wait.ConditionFunc(func() (bool, error) {
+		agentReportsMu.Lock()
+		defer agentReportsMu.Unlock()
+		report, ok := agentReports[strings.ToUpper(serial)]
+		if !ok || report.received.Before(since) {
+			return false, nil
+		}
+		r = report
+		return true, nil
+	})
+	if err = wait.Poll(agentPollInterval, timeout, cf); err != nil {
+		return r, fmt.Errorf("no boot image agent report for serial %s: %s", serial, err.Error())
+	}
+	return
+}
+
+// Link returns the link of the interface with the mac address
+func (r AgentReport) Link(mac string) (l AgentLink, ok bool) {
+	for _, l := range r.Links {
+		if normalizeMac(l.Mac) == normalizeMac(mac) {
+			return l, true
+		}
+	}
+	return
+}
+
+func normalizeMac(m string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(m))
+}
@@ -0,0 +1,113 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diagnostics
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/redfish/mock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentReport(t *testing.T) {
+	agentPollInterval = 10 * time.Millisecond
+	secret := "agent-secret"
+	since := time.Now()
+	b, err := json.Marshal(AgentReport{
+		Serial:    "abc123",
+		Timestamp: time.Now(),
+		Links: []AgentLink{{Mac: "24:4A:97:9A:B7:6B", State: "up", Neighbors: []AgentNeighbor{
+			{SysName: "aci-leaf-101.example.com", PortID: "Eth1/10"},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = VerifyAgentReport(b, SignAgentReport(b, "wrong"), secret)
+	assert.Error(t, err)
+	_, err = VerifyAgentReport(b, SignAgentReport(b, secret), "")
+	assert.Error(t, err)
+
+	r, err := VerifyAgentReport(b, "sha256="+SignAgentReport(b, secret), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = WaitAgentReport("ABC123", since, 50*time.Millisecond)
+	assert.Error(t, err)
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		AddAgentReport(r)
+	}()
+	r, err = WaitAgentReport("ABC123", since, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := r.Link("24:4a:97:9a:b7:6b")
+	assert.True(t, ok)
+	assert.Equal(t, "Eth1/10", l.Neighbors[0].PortID)
+
+	_, err = WaitAgentReport("ABC123", time.Now(), 50*time.Millisecond)
+	assert.Error(t, err, "reports of an earlier boot are ignored")
+
+	old, _ := json.Marshal(AgentReport{Serial: "abc123", Timestamp: time.Now().Add(-time.Hour)})
+	_, err = VerifyAgentReport(old, SignAgentReport(old, secret), secret)
+	assert.Error(t, err)
+}
+
+func TestBurnin(t *testing.T) {
+	burninPollInterval = 10 * time.Millisecond
+	secret := "agent-secret"
+	s, cfg := newTestServer(t, mock.R640)
+	AddBurninPlan("abc123", config.BurninPlan{MemtestMinutes: 10})
+	p, ok := GetBurninPlan("ABC123")
+	assert.True(t, ok)
+	assert.Equal(t, 10, p.MemtestMinutes)
+
+	m := NewSensorMonitor(cfg, log.WithFields(log.Fields{"node": "test"}))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	b, _ := json.Marshal(BurninResult{Serial: "abc123", Timestamp: time.Now(), Results: []Result{{Component: "drive", Test: "fio sda", Severity: SeverityOK, Value: "1200MB/s"}}})
+	r, err := VerifyBurninResult(b, SignAgentReport(b, secret), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		AddBurninResult(r)
+	}()
+	r, err = WaitBurninResult("ABC123", time.Now(), time.Second, m.Check)
+	assert.NoError(t, err)
+	assert.Equal(t, "1200MB/s", r.Results[0].Value)
+	assert.Contains(t, m.Results(), Result{Component: "thermal", Test: "CPU1 Temp", Severity: SeverityOK, Value: "40C"})
+
+	sel := "/redfish/v1/Managers/iDRAC.Embedded.1/LogServices/Sel/Entries"
+	entries := s.Resource(sel)
+	entries["Members"] = append(entries["Members"].([]interface{}), map[string]interface{}{"@odata.id": sel + "/1"})
+	entries["Members@odata.count"] = 1
+	s.SetResource(sel, entries)
+	s.SetResource(sel+"/1", map[string]interface{}{"@odata.id": sel + "/1", "Id": "1", "Severity": "Critical", "Message": "Correctable memory error rate exceeded for DIMM_A1."})
+	_, err = WaitBurninResult("ABC123", time.Now(), time.Second, m.Check)
+	assert.EqualError(t, err, "burn-in of serial ABC123 not successful: burn-in failed: Correctable memory error rate exceeded for DIMM_A1.")
+}
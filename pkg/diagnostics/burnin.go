@@ -0,0 +1,299 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// poll interval of WaitBurninResult, the sensors are checked on each poll. Tests shorten it
+var burninPollInterval = 60 * time.Second
+
+var (
+	burninMu      sync.Mutex
+	burninPlans   = make(map[string]config.BurninPlan)
+	burninResults = make(map[string]BurninResult)
+)
+
+// bmc log entries failing a burn-in
+var burninLogChecks = []struct {
+	re        *regexp.Regexp
+	component string
+	test      string
+}{
+	{regexp.MustCompile(`(?i)\becc\b|correctable (memory )?error|uncorrectable`), "memory", "ecc"},
+	{regexp.MustCompile(`(?i)throttl`), "thermal", "throttling"},
+	{regexp.MustCompile(`(?i)i/o error|\bio error|pcie.*(error|fatal)|bus (fatal )?error`), "pci", "io"},
+}
+
+// BurninResult is uploaded by the agent of the diagnostics image once the test plan completed
+type BurninResult struct {
+	Serial    string    `json:"serial"`
+	Timestamp time.Time `json:"timestamp"`
+	Results   []Result  `json:"results"`
+
+	received time.Time
+}
+
+// AddBurninPlan offers the plan to the agent of the node with the serial number
+func AddBurninPlan(serial string, p config.BurninPlan) {
+	burninMu.Lock()
+	defer burninMu.Unlock()
+	burninPlans[strings.ToUpper(serial)] = p
+}
+
+// RemoveBurninPlan withdraws the plan once the burn-in ended
+func RemoveBurninPlan(serial string) {
+	burninMu.Lock()
+	defer burninMu.Unlock()
+	delete(burninPlans, strings.ToUpper(serial))
+}
+
+// GetBurninPlan returns the plan of a node in burn-in
+func GetBurninPlan(serial string) (p config.BurninPlan, ok bool) {
+	burninMu.Lock()
+	defer burninMu.Unlock()
+	p, ok = burninPlans[strings.ToUpper(serial)]
+	return
+}
+
+// VerifyBurninResult checks the signature and age of an uploaded result and parses it
+func VerifyBurninResult(body []byte, signature, secret string) (r BurninResult, err error) {
+	if err = VerifyAgentSignature(body, signature, secret); err != nil {
+		return
+	}
+	if err = json.Unmarshal(body, &r); err != nil {
+		return r, fmt.Errorf("cannot parse burn-in result: %s", err.Error())
+	}
+	if r.Serial == "" {
+		return r, fmt.Errorf("burn-in result without serial number")
+	}
+	err = checkAgentTimestamp(r.Timestamp)
+	return
+}
+
+// AddBurninResult stores the latest result of a node
+func AddBurninResult(r BurninResult) {
+	burninMu.Lock()
+	defer burninMu.Unlock()
+	r.received = time.Now()
+	burninResults[strings.ToUpper(r.Serial)] = r
+}
+
+// WaitBurninResult waits for the result of the node with the serial number received after since.
+// check is called on each poll, the wait is aborted if it fails
+func WaitBurninResult(serial string, since time.Time, timeout time.Duration, check func() error) (r BurninResult, err error) {
+	cf := wait.ConditionFunc(func() (bool, error) {
+		if err := check(); err != nil {
+			return false, err
+		}
+		burninMu.Lock()
+		defer burninMu.Unlock()
+		res, ok := burninResults[strings.ToUpper(serial)]
+		if !ok || res.received.Before(since) {
+			return false, nil
+		}
+		r = res
+		return true, nil
+	})
+	if err = wait.Poll(burninPollInterval, timeout, cf); err != nil {
+		return r, fmt.Errorf("burn-in of serial %s not successful: %s", serial, err.Error())
+	}
+	return
+}
+
+// SensorMonitor watches the redfish thermal and power sensors and the new bmc log entries during a burn-in.
+// Critical temperatures, ecc errors, thermal throttling and io errors fail the burn-in
+type SensorMonitor struct {
+	client  *gofish.APIClient
+	gCfg    gofish.ClientConfig
+	log     *log.Entry
+	seen    map[string]bool
+	results map[string]*Result
+	keys    []string
+}
+
+func NewSensorMonitor(gCfg gofish.ClientConfig, log *log.Entry) (m *SensorMonitor) {
+	return &SensorMonitor{
+		gCfg:    gCfg,
+		log:     log,
+		seen:    make(map[string]bool),
+		results: make(map[string]*Result),
+		keys:    make([]string, 0),
+	}
+}
+
+// Start connects to the bmc and skips the log entries written before the burn-in
+func (m *SensorMonitor) Start() (err error) {
+	if m.client, err = gofish.Connect(m.gCfg); err != nil {
+		return
+	}
+	es, err := m.logEntries()
+	if err != nil {
+		return
+	}
+	for _, e := range es {
+		m.seen[e.ODataID] = true
+	}
+	return
+}
+
+func (m *SensorMonitor) Stop() {
+	if m.client != nil {
+		m.client.Logout()
+	}
+}
+
+// Check reads the sensors and new log entries once. Returns an error on a critical finding
+func (m *SensorMonitor) Check() (err error) {
+	ch, err := m.client.Service.Chassis()
+	if err != nil {
+		m.log.Debugf("cannot load chassis: %s", err.Error())
+		return nil
+	}
+	for _, c := range ch {
+		if t, err := c.Thermal(); err == nil && t != nil {
+			for _, tp := range t.Temperatures {
+				m.checkTemperature(tp)
+			}
+		}
+		if p, err := c.Power(); err == nil && p != nil {
+			for _, pc := range p.PowerControl {
+				m.maxValue("power", pc.Name, pc.PowerConsumedWatts, "W")
+			}
+			for _, ps := range p.PowerSupplies {
+				if ps.Status.Health == common.CriticalHealth {
+					m.fail("powersupply", ps.Name, "", fmt.Sprintf("%s health critical", ps.Name), "")
+				}
+			}
+		}
+	}
+	es, err := m.logEntries()
+	if err != nil {
+		m.log.Debugf("cannot load log entries: %s", err.Error())
+		return nil
+	}
+	for _, e := range es {
+		if m.seen[e.ODataID] {
+			continue
+		}
+		m.seen[e.ODataID] = true
+		for _, c := range burninLogChecks {
+			if c.re.MatchString(e.Message) {
+				m.fail(c.component, c.test, "", e.Message, e.ODataID)
+			}
+		}
+	}
+	failed := make([]string, 0)
+	for _, k := range m.keys {
+		if r := m.results[k]; r.Severity == SeverityCritical {
+			failed = append(failed, r.Message)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("burn-in failed: %s", strings.Join(failed, ", "))
+	}
+	return
+}
+
+// Results returns the max sensor readings and the failures seen during the burn-in
+func (m *SensorMonitor) Results() (rs []Result) {
+	rs = make([]Result, 0)
+	for _, k := range m.keys {
+		rs = append(rs, *m.results[k])
+	}
+	return
+}
+
+func (m *SensorMonitor) checkTemperature(tp redfish.Temperature) {
+	if tp.Status.State == common.AbsentState {
+		return
+	}
+	r := m.maxValue("thermal", tp.Name, tp.ReadingCelsius, "C")
+	if (tp.UpperThresholdCritical > 0 && tp.ReadingCelsius >= tp.UpperThresholdCritical) || tp.Status.Health == common.CriticalHealth {
+		r.Severity = SeverityCritical
+		r.Message = fmt.Sprintf("%s critical temperature %.0fC", tp.Name, tp.ReadingCelsius)
+	}
+}
+
+// maxValue records the max reading of a sensor
+func (m *SensorMonitor) maxValue(component, name string, v float32, unit string) (r *Result) {
+	r = m.result(component, name)
+	var max float32
+	fmt.Sscanf(r.Value, "%f", &max)
+	if r.Value == "" || v > max {
+		r.Value = fmt.Sprintf("%.0f%s", v, unit)
+	}
+	return
+}
+
+func (m *SensorMonitor) fail(component, test, value, msg, ref string) {
+	r := m.result(component, test)
+	r.Severity = SeverityCritical
+	r.Message = msg
+	r.LogRef = ref
+	if value != "" {
+		r.Value = value
+	}
+}
+
+func (m *SensorMonitor) result(component, test string) (r *Result) {
+	key := component + "/" + test
+	r, ok := m.results[key]
+	if !ok {
+		r = &Result{Component: component, Test: test, Severity: SeverityOK}
+		m.results[key] = r
+		m.keys = append(m.keys, key)
+	}
+	return
+}
+
+// logEntries returns the entries of the system and manager log services, except the audit logs
+func (m *SensorMonitor) logEntries() (es []*redfish.LogEntry, err error) {
+	es = make([]*redfish.LogEntry, 0)
+	ss, err := m.client.Service.Systems()
+	if err != nil {
+		return
+	}
+	ls := make([]*redfish.LogService, 0)
+	for _, s := range ss {
+		sls, err := s.LogServices()
+		if err != nil {
+			return es, err
+		}
+		ls = append(ls, sls...)
+	}
+	mg, err := m.client.Service.Managers()
+	if err != nil {
+		return
+	}
+	for _, mgr := range mg {
+		mls, err := mgr.LogServices()
+		if err != nil {
+			return es, err
+		}
+		ls = append(ls, mls...)
+	}
+	for _, l := range ls {
+		if strings.Contains(strings.ToLower(l.ID), "audit") {
+			continue
+		}
+		les, err := l.Entries()
+		if err != nil {
+			m.log.Debugf("cannot load log entries of %s: %s", l.ID, err.Error())
+			continue
+		}
+		es = append(es, les...)
+	}
+	return
+}
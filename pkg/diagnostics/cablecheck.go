@@ -0,0 +1,261 @@
+package diagnostics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CableInterface is a node interface and the switch port it is cabled to in netbox
+type CableInterface struct {
+	Name     string
+	Mac      string
+	Switch   string
+	SwitchIP string
+	Port     string
+}
+
+// Neighbor is a node mac address seen on a switch port. Switch can be empty if the source does not know the switch name
+type Neighbor struct {
+	Mac    string
+	Switch string
+	Port   string
+}
+
+// NeighborSource returns the lldp neighbors relevant for an interface:
+// switch sources the neighbor table of the cabled switch, node sources what the node's interfaces see
+type NeighborSource interface {
+	Name() string
+	Neighbors(intf CableInterface) ([]Neighbor, error)
+}
+
+// CableCheck verifies the cabling of node interfaces with the lldp neighbors of the configured sources
+type CableCheck struct {
+	sources []cableSource
+	log     *log.Entry
+}
+
+type cableSource struct {
+	match  *regexp.Regexp
+	source NeighborSource
+}
+
+func NewCableCheck(log *log.Entry) *CableCheck {
+	return &CableCheck{sources: make([]cableSource, 0), log: log}
+}
+
+// AddSource adds a neighbor source for interfaces whose switch name matches the regex. An empty regex matches all switches
+func (c *CableCheck) AddSource(match string, s NeighborSource) (err error) {
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return fmt.Errorf("invalid cable check match %s: %s", match, err.Error())
+	}
+	c.sources = append(c.sources, cableSource{match: re, source: s})
+	return
+}
+
+// CableResult is the outcome of the check of an interface: the switch port it is cabled to in netbox
+// and the one the mac was seen on. Observed is empty if no source saw the mac
+type CableResult struct {
+	Interface      string `json:"interface"`
+	ExpectedSwitch string `json:"expectedSwitch"`
+	ExpectedPort   string `json:"expectedPort"`
+	ObservedSwitch string `json:"observedSwitch,omitempty"`
+	ObservedPort   string `json:"observedPort,omitempty"`
+	Source         string `json:"source,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// Mismatch reports if the mac was seen on a known switch port other than the cabled one
+func (r CableResult) Mismatch() bool {
+	return r.Reason != "" && r.ObservedSwitch != "" && r.ObservedPort != ""
+}
+
+// Check verifies that the mac of each interface is seen on exactly the cabled switch and port.
+// The sources matching the switch are tried in order until one sees the mac. Switch sources only see the neighbors
+// of a single switch, so a mac missing on the cabled switch is looked up on the other switches of the interfaces.
+// Reason is set if the check failed, also for interfaces of switches without a source
+func (c *CableCheck) Check(intfs []CableInterface) (rs []CableResult) {
+	type key struct {
+		source int
+		sw     string
+	}
+	cache := make(map[key][]Neighbor)
+	neighbors := func(i int, intf CableInterface) (nbs []Neighbor, err error) {
+		k := key{i, intf.Switch}
+		if nbs, ok := cache[k]; ok {
+			return nbs, nil
+		}
+		if nbs, err = c.sources[i].source.Neighbors(intf); err == nil {
+			cache[k] = nbs
+		}
+		return
+	}
+	rs = make([]CableResult, 0, len(intfs))
+	for _, intf := range intfs {
+		rs = append(rs, c.check(intf, intfs, neighbors))
+	}
+	return
+}
+
+func (c *CableCheck) check(intf CableInterface, intfs []CableInterface, neighbors func(int, CableInterface) ([]Neighbor, error)) (r CableResult) {
+	r = CableResult{Interface: intf.Name, ExpectedSwitch: intf.Switch, ExpectedPort: intf.Port}
+	reasons := make([]string, 0)
+	for i, s := range c.sources {
+		if !s.match.MatchString(intf.Switch) {
+			continue
+		}
+		nbs, err := neighbors(i, intf)
+		if err != nil {
+			c.log.Debugf("%s neighbors of %s: %s", s.source.Name(), intf.Name, err.Error())
+			reasons = append(reasons, s.source.Name()+": "+err.Error())
+			continue
+		}
+		seen := macNeighbors(nbs, intf.Mac)
+		if len(seen) == 0 {
+			if other, nb, ok := c.otherSwitch(i, intf, intfs, neighbors); ok {
+				r.Source = s.source.Name()
+				r.ObservedSwitch = other
+				r.ObservedPort = nb.Port
+				r.Reason = fmt.Sprintf("wrong switch: %s", other)
+				return
+			}
+			reasons = append(reasons, s.source.Name()+": lldp_missing")
+			continue
+		}
+		r.Source = s.source.Name()
+		for _, nb := range seen {
+			c.log.Debugf("%s lldp: %s seen on %s %s", s.source.Name(), intf.Mac, nb.Switch, nb.Port)
+			// node sources not knowing the switch name leave the observed switch empty
+			r.ObservedPort = nb.Port
+			r.ObservedSwitch = ""
+			if nb.Switch != "" {
+				r.ObservedSwitch = intf.Switch
+			}
+			if nb.Switch != "" && !SwitchMatches(nb.Switch, intf.Switch) {
+				// the netbox device name of the switch, without domain
+				r.ObservedSwitch = strings.Split(nb.Switch, ".")[0]
+				r.Reason = fmt.Sprintf("wrong switch: %s", nb.Switch)
+				return
+			}
+			if !PortMatches(nb.Port, intf.Port) {
+				r.Reason = fmt.Sprintf("wrong switch port: %s", nb.Port)
+				return
+			}
+		}
+		c.log.Debugf("found %s lldp neighbor: %s", s.source.Name(), intf.Mac)
+		return
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, fmt.Sprintf("no lldp neighbor source for switch %s", intf.Switch))
+	}
+	r.Reason = strings.Join(reasons, ", ")
+	return
+}
+
+// otherSwitch looks up the mac with the source on the other switches of the interfaces the source matches.
+// Node sources return the same neighbors for all switches, so they never find a mac they missed
+func (c *CableCheck) otherSwitch(source int, intf CableInterface, intfs []CableInterface, neighbors func(int, CableInterface) ([]Neighbor, error)) (sw string, nb Neighbor, ok bool) {
+	for _, o := range intfs {
+		if o.Switch == intf.Switch || !c.sources[source].match.MatchString(o.Switch) {
+			continue
+		}
+		nbs, err := neighbors(source, o)
+		if err != nil {
+			c.log.Debugf("%s neighbors of %s: %s", c.sources[source].source.Name(), o.Switch, err.Error())
+			continue
+		}
+		if seen := macNeighbors(nbs, intf.Mac); len(seen) > 0 {
+			return o.Switch, seen[0], true
+		}
+	}
+	return
+}
+
+func macNeighbors(nbs []Neighbor, mac string) (seen []Neighbor) {
+	seen = make([]Neighbor, 0)
+	for _, nb := range nbs {
+		if normalizeMac(nb.Mac) == normalizeMac(mac) {
+			seen = append(seen, nb)
+		}
+	}
+	return
+}
+
+// SwitchMatches compares a switch name, which can be a fqdn, with the netbox device name
+func SwitchMatches(name, device string) bool {
+	name = strings.ToLower(name)
+	device = strings.ToLower(device)
+	return name == device || strings.HasPrefix(name, device+".")
+}
+
+// PortMatches compares a switch port with the netbox interface name.
+// Switches report e.g. Ethernet1/10, Eth1/10, Et1/10 or an aci path ending with [eth1/10] for the same port
+func PortMatches(port, netboxPort string) bool {
+	port = strings.ToLower(port)
+	if i := strings.LastIndex(port, "["); i >= 0 && strings.HasSuffix(port, "]") {
+		port = port[i+1 : len(port)-1]
+	}
+	return normalizePort(port) == normalizePort(netboxPort)
+}
+
+func normalizePort(p string) string {
+	p = strings.ToLower(p)
+	for _, prefix := range []string{"ethernet", "eth", "et"} {
+		if strings.HasPrefix(p, prefix) {
+			return strings.TrimPrefix(p, prefix)
+		}
+	}
+	return p
+}
+
+// NodeNeighbors is a node side neighbor source, e.g. the lldp data of the bmc or the boot image agent.
+// The neighbors are loaded once for all interfaces
+type NodeNeighbors struct {
+	name      string
+	load      func() ([]Neighbor, error)
+	neighbors []Neighbor
+}
+
+func NewNodeNeighbors(name string, load func() ([]Neighbor, error)) *NodeNeighbors {
+	return &NodeNeighbors{name: name, load: load}
+}
+
+func (n *NodeNeighbors) Name() string {
+	return n.name
+}
+
+func (n *NodeNeighbors) Neighbors(intf CableInterface) (nbs []Neighbor, err error) {
+	if n.neighbors == nil {
+		if nbs, err = n.load(); err != nil {
+			return
+		}
+		n.neighbors = nbs
+	}
+	return n.neighbors, nil
+}
+
+// AgentNeighbors returns the neighbors of up links reported by the boot image agent
+func AgentNeighbors(r *AgentReport) func() ([]Neighbor, error) {
+	return func() (nbs []Neighbor, err error) {
+		if r == nil {
+			return nbs, fmt.Errorf("no boot image agent report")
+		}
+		nbs = make([]Neighbor, 0)
+		for _, l := range r.Links {
+			if !strings.EqualFold(l.State, "up") {
+				continue
+			}
+			for _, nb := range l.Neighbors {
+				port := nb.PortID
+				if port == "" || strings.HasSuffix(nb.PortDescr, "]") {
+					port = nb.PortDescr
+				}
+				nbs = append(nbs, Neighbor{Mac: l.Mac, Switch: nb.SysName, Port: port})
+			}
+		}
+		return
+	}
+}
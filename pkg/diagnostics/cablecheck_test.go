@@ -0,0 +1,277 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diagnostics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// snmpAgent answers GetBulk requests from a table of oids, values are octet strings ([]byte) or integers (int)
+func snmpAgent(t *testing.T, table map[string]interface{}) (addr string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	oids := make([]string, 0, len(table))
+	for oid := range table {
+		oids = append(oids, oid)
+	}
+	sort.Slice(oids, func(i, j int) bool { return compareOID(oids[i], oids[j]) < 0 })
+	go func() {
+		buf := make([]byte, 65535)
+		dec := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := dec.SnmpDecodePacket(buf[:n])
+			if err != nil || len(req.Variables) == 0 {
+				continue
+			}
+			start := req.Variables[0].Name
+			// gosnmp does not decode the max repetitions of requests
+			maxRep := int(req.MaxRepetitions)
+			if maxRep == 0 {
+				maxRep = 5
+			}
+			vars := make([]gosnmp.SnmpPDU, 0)
+			for _, o := range oids {
+				if compareOID(o, start) <= 0 {
+					continue
+				}
+				if len(vars) == maxRep {
+					break
+				}
+				pdu := gosnmp.SnmpPDU{Name: o, Type: gosnmp.OctetString, Value: table[o]}
+				if _, ok := table[o].(int); ok {
+					pdu.Type = gosnmp.Integer
+				}
+				vars = append(vars, pdu)
+			}
+			if len(vars) == 0 {
+				vars = append(vars, gosnmp.SnmpPDU{Name: start, Type: gosnmp.EndOfMibView})
+			}
+			resp := &gosnmp.SnmpPacket{Version: gosnmp.Version2c, Community: req.Community, PDUType: gosnmp.GetResponse, RequestID: req.RequestID, Variables: vars}
+			b, err := resp.MarshalMsg()
+			if err != nil {
+				t.Errorf("cannot marshal snmp response: %s", err.Error())
+				return
+			}
+			conn.WriteTo(b, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func compareOID(a, b string) int {
+	pa, pb := strings.Split(strings.TrimPrefix(a, "."), "."), strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, _ := strconv.Atoi(pa[i])
+		y, _ := strconv.Atoi(pb[i])
+		if x != y {
+			return x - y
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+func TestSnmpCableCheck(t *testing.T) {
+	addr := snmpAgent(t, map[string]interface{}{
+		lldpLocPortID + ".10":            []byte("Ethernet1/10"),
+		lldpLocPortID + ".11":            []byte("Ethernet1/11"),
+		lldpRemPortIDSubtype + ".0.10.1": lldpPortIDMac,
+		lldpRemPortID + ".0.10.1":        []byte{0x24, 0x4a, 0x97, 0x9a, 0xb7, 0x6b},
+		lldpRemPortIDSubtype + ".0.11.2": lldpPortIDMac,
+		lldpRemPortID + ".0.11.2":        []byte{0x24, 0x4a, 0x97, 0x9a, 0xb7, 0x6c},
+		".1.3.6.1.2.1.1.1.0":             []byte("after the lldp tables"),
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	c := NewCableCheck(log.WithFields(log.Fields{"node": "test"}))
+	assert.NoError(t, c.AddSource("^sw", NewSnmpSource(config.NeighborSource{Type: "snmp", Community: "public", Port: p}, "")))
+
+	intf := CableInterface{Name: "L1", Mac: "24:4A:97:9A:B7:6B", Switch: "sw1234a", SwitchIP: host, Port: "Eth1/10"}
+	assert.Equal(t, "", checkOne(c, intf).Reason)
+	intf.Port = "Eth1/11"
+	r := checkOne(c, intf)
+	assert.Equal(t, "wrong switch port: Ethernet1/10", r.Reason)
+	assert.True(t, r.Mismatch())
+	assert.Equal(t, "sw1234a", r.ObservedSwitch)
+	intf.Mac = "24:4a:97:9a:b7:00"
+	assert.Equal(t, "snmp: lldp_missing", checkOne(c, intf).Reason)
+	assert.False(t, checkOne(c, intf).Mismatch())
+
+	r = checkOne(c, CableInterface{Name: "PCI1P1", Mac: "24:4a:97:9a:b7:6b", Switch: "aci-leaf-101", Port: "eth1/10"})
+	assert.Equal(t, "no lldp neighbor source for switch aci-leaf-101", r.Reason, "expects interfaces without source to fail")
+}
+
+func checkOne(c *CableCheck, intf CableInterface) CableResult {
+	return c.Check([]CableInterface{intf})[0]
+}
+
+// switchNeighbors is a switch source with the neighbor tables of the switches
+type switchNeighbors map[string][]Neighbor
+
+func (s switchNeighbors) Name() string {
+	return "switch"
+}
+
+func (s switchNeighbors) Neighbors(intf CableInterface) (nbs []Neighbor, err error) {
+	nbs, ok := s[intf.Switch]
+	if !ok {
+		err = fmt.Errorf("unknown switch %s", intf.Switch)
+	}
+	return
+}
+
+func TestCableCheckWrongSwitch(t *testing.T) {
+	c := NewCableCheck(log.WithFields(log.Fields{"node": "test"}))
+	assert.NoError(t, c.AddSource("^sw", switchNeighbors{
+		"sw1234a": {{Mac: "24:4a:97:9a:b7:6b", Switch: "sw1234a", Port: "Ethernet1/10"}},
+		"sw1234b": {{Mac: "24:4a:97:9a:b7:6c", Switch: "sw1234b", Port: "Ethernet1/10"}, {Mac: "24:4a:97:9a:b7:6d", Switch: "sw1234b", Port: "Ethernet1/11"}},
+	}))
+	rs := c.Check([]CableInterface{
+		{Name: "L1", Mac: "24:4a:97:9a:b7:6b", Switch: "sw1234a", Port: "Eth1/10"},
+		{Name: "L2", Mac: "24:4a:97:9a:b7:6c", Switch: "sw1234b", Port: "Eth1/10"},
+		{Name: "PCI1P1", Mac: "24:4a:97:9a:b7:6d", Switch: "sw1234a", Port: "Eth1/11"},
+		{Name: "PCI1P2", Mac: "24:4a:97:9a:b7:6e", Switch: "sw1234b", Port: "Eth1/11"},
+	})
+	assert.Equal(t, "", rs[0].Reason)
+	assert.Equal(t, "", rs[1].Reason)
+	assert.Equal(t, CableResult{
+		Interface:      "PCI1P1",
+		ExpectedSwitch: "sw1234a",
+		ExpectedPort:   "Eth1/11",
+		ObservedSwitch: "sw1234b",
+		ObservedPort:   "Ethernet1/11",
+		Source:         "switch",
+		Reason:         "wrong switch: sw1234b",
+	}, rs[2], "expects the mac missing on the cabled switch to be found on the other switch")
+	assert.True(t, rs[2].Mismatch())
+	assert.Equal(t, "switch: lldp_missing", rs[3].Reason)
+}
+
+func TestNxapiInsecure(t *testing.T) {
+	nxapi := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ins_api": {"outputs": {"output": {"code": "200", "msg": "Success", "body": {"TABLE_nbor_detail": {"ROW_nbor_detail": {"l_port_id": "Eth1/10", "port_id": "244a.979a.b76b", "sys_name": "node001"}}}}}}}`)
+	}))
+	t.Cleanup(nxapi.Close)
+	u, _ := url.Parse(nxapi.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	intf := CableInterface{Name: "L1", Mac: "24:4a:97:9a:b7:6b", Switch: "sw1234a", SwitchIP: host, Port: "Eth1/10"}
+
+	_, err := NewNxapiSource(config.NeighborSource{Type: "nxapi", Port: p}, "").Neighbors(intf)
+	assert.Error(t, err, "expects the self signed certificate to be rejected")
+
+	c := NewCableCheck(log.WithFields(log.Fields{"node": "test"}))
+	assert.NoError(t, c.AddSource("", NewNxapiSource(config.NeighborSource{Type: "nxapi", Port: p, Insecure: true}, "")))
+	assert.Equal(t, "", checkOne(c, intf).Reason)
+}
+
+func TestCableCheckSources(t *testing.T) {
+	c := NewCableCheck(log.WithFields(log.Fields{"node": "test"}))
+	agent := &AgentReport{Links: []AgentLink{
+		{Mac: "24:4a:97:9a:b7:6b", State: "up", Neighbors: []AgentNeighbor{{SysName: "aci-leaf-101.example.com", PortDescr: "topology/pod-1/paths-101/pathep-[eth1/10]"}}},
+		{Mac: "24:4a:97:9a:b7:6c", State: "up", Neighbors: []AgentNeighbor{{SysName: "aci-leaf-102", PortID: "Eth1/10"}}},
+	}}
+	assert.NoError(t, c.AddSource("", NewNodeNeighbors("agent", AgentNeighbors(agent))))
+	assert.NoError(t, c.AddSource("aci", NewNodeNeighbors("redfish", func() ([]Neighbor, error) {
+		return []Neighbor{{Mac: "24:4a:97:9a:b7:6d", Port: "Ethernet1/12"}}, nil
+	})))
+
+	assert.Equal(t, "", checkOne(c, CableInterface{Mac: "24:4a:97:9a:b7:6b", Switch: "aci-leaf-101", Port: "eth1/10"}).Reason)
+	r := checkOne(c, CableInterface{Name: "PCI1P1", Mac: "24:4a:97:9a:b7:6c", Switch: "aci-leaf-101", Port: "eth1/10"})
+	assert.Equal(t, CableResult{
+		Interface:      "PCI1P1",
+		ExpectedSwitch: "aci-leaf-101",
+		ExpectedPort:   "eth1/10",
+		ObservedSwitch: "aci-leaf-102",
+		ObservedPort:   "Eth1/10",
+		Source:         "agent",
+		Reason:         "wrong switch: aci-leaf-102",
+	}, r)
+	// the agent did not see the mac, the next source did
+	assert.Equal(t, "", checkOne(c, CableInterface{Mac: "24:4a:97:9a:b7:6d", Switch: "aci-leaf-101", Port: "eth1/12"}).Reason)
+	// the bmc does not know the switch
+	r = checkOne(c, CableInterface{Mac: "24:4a:97:9a:b7:6d", Switch: "aci-leaf-101", Port: "eth1/13"})
+	assert.Equal(t, "wrong switch port: Ethernet1/12", r.Reason)
+	assert.False(t, r.Mismatch())
+
+	c = NewCableCheck(log.WithFields(log.Fields{"node": "test"}))
+	assert.NoError(t, c.AddSource("", NewNodeNeighbors("agent", AgentNeighbors(nil))))
+	assert.Equal(t, "agent: no boot image agent report", checkOne(c, CableInterface{Mac: "24:4a:97:9a:b7:6b", Switch: "aci-leaf-101", Port: "eth1/10"}).Reason)
+}
+
+type fakePorts map[string]PortStatus
+
+func (f fakePorts) Name() string {
+	return "fake"
+}
+
+func (f fakePorts) PortStatus(intf CableInterface) (ps PortStatus, err error) {
+	ps, ok := f[intf.Port]
+	if !ok {
+		err = fmt.Errorf("port %s not found", intf.Port)
+	}
+	return
+}
+
+func TestLinkCheck(t *testing.T) {
+	for typ, mbps := range map[string]int{"1000base-t": 1000, "2.5gbase-t": 2500, "25gbase-x-sfp28": 25000, "100gbase-x-qsfp28": 100000} {
+		s, ok := ExpectedSpeed(typ)
+		assert.True(t, ok)
+		assert.Equal(t, mbps, s)
+	}
+	_, ok := ExpectedSpeed("virtual")
+	assert.False(t, ok)
+
+	c := NewLinkCheck(9000, true, log.WithFields(log.Fields{"node": "test"}))
+	assert.NoError(t, c.AddSource("aci", fakePorts{
+		"eth1/10": {SpeedMbps: 25000, Duplex: "full", MTU: 9216, PortChannel: "po10"},
+		"eth1/11": {SpeedMbps: 10000, Duplex: "full", MTU: 1500, PortChannel: "po11"},
+		"eth1/12": {SpeedMbps: 25000, Duplex: "half"},
+	}))
+	intf := func(name, port string) LinkInterface {
+		return LinkInterface{CableInterface: CableInterface{Name: name, Switch: "aci-leaf-101", Port: port}, Type: "25gbase-x-sfp28", SpeedMbps: 25000}
+	}
+	rs := c.Check([]LinkInterface{intf("PCI1-port1", "eth1/10"), intf("PCI1-port2", "eth1/11"), intf("PCI2-port1", "eth1/12"), intf("PCI2-port2", "eth1/13")})
+	assert.Len(t, rs, 4)
+	assert.Empty(t, rs[0].Reasons)
+	assert.Equal(t, "po10", rs[0].PortChannel)
+	assert.Equal(t, []string{"switch speed 10000 Mbps, expected 25000 Mbps", "mtu 1500, expected 9000", "port-channel po11, other ports are in po10"}, rs[1].Reasons)
+	assert.Equal(t, []string{"duplex half", "port not in a port-channel"}, rs[2].Reasons)
+	assert.Equal(t, []string{"fake: port eth1/13 not found"}, rs[3].Reasons)
+
+	rs = c.Check([]LinkInterface{{CableInterface: CableInterface{Name: "L1", Switch: "sw1234a", Port: "Ethernet1"}, Type: "1000base-t", SpeedMbps: 100}})
+	assert.Equal(t, []string{"node speed 100 Mbps, expected 1000 Mbps", "no port status source for switch sw1234a"}, rs[0].Reasons)
+}
@@ -9,14 +9,29 @@ import (
 	"strings"
 	"time"
 
+	"github.com/sapcc/baremetal_temper/pkg/config"
 	log "github.com/sirupsen/logrus"
 	"github.com/stmcginnis/gofish"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
+// poll intervals of the iDRAC api. Tests against the redfish mock shorten them
+var (
+	jobPollInterval   = 60 * time.Second
+	retryInterval     = 10 * time.Second
+	postRetryInterval = 15 * time.Second
+)
+
+// ePSA run modes. Extended runs the full test suite and takes hours, Express the quick tests
+const (
+	EpsaExpress  = "Express"
+	EpsaExtended = "Extended"
+)
+
 type DellClient struct {
 	client *gofish.APIClient
 	gCfg   gofish.ClientConfig
+	opts   config.Epsa
 	log    *log.Entry
 }
 
@@ -53,19 +68,61 @@ type iDRACJobMember struct {
 	URL string `json:"@odata.id"`
 }
 
-func NewDellClient(gCfg gofish.ClientConfig, log *log.Entry) (c *DellClient) {
+// NewDellClient returns an ePSA client. Empty options default to an extended run with a graceful reboot
+// forcing the shutdown, which may take up to 4 hours
+func NewDellClient(gCfg gofish.ClientConfig, opts config.Epsa, log *log.Entry) (c *DellClient) {
+	if opts.RunMode == "" {
+		opts.RunMode = EpsaExtended
+	}
+	if opts.RebootType == "" {
+		opts.RebootType = "GracefulRebootWithForcedShutdown"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 240 * time.Minute
+	}
 	return &DellClient{
 		gCfg: gCfg,
+		opts: opts,
 		log:  log,
 	}
 }
 
-func (d DellClient) Run() (err error) {
+// Run runs the ePSA diagnostics and parses the exported result.
+// A job the iDRAC lost (empty job state) is restarted up to MaxRetries times
+func (d DellClient) Run() (rs []Result, err error) {
+	if d.opts.RunMode != EpsaExpress && d.opts.RunMode != EpsaExtended {
+		return rs, fmt.Errorf("invalid ePSA run mode %s, expected %s or %s", d.opts.RunMode, EpsaExpress, EpsaExtended)
+	}
 	if err = d.connect(); err != nil {
 		return
 	}
 	defer d.client.Logout()
-	payload := iDracDiagnostics{RebootJobType: "GracefulRebootWithForcedShutdown", RunMode: "Extended"} //Express
+	for retry := 0; ; retry++ {
+		lost, err := d.runJob()
+		if err != nil {
+			return rs, err
+		}
+		if !lost {
+			break
+		}
+		if retry >= d.opts.MaxRetries {
+			return rs, fmt.Errorf("ePSA diagnostics job lost, giving up after %d retries", retry)
+		}
+		d.log.Infof("ePSA diagnostics job lost, retry %d of %d", retry+1, d.opts.MaxRetries)
+	}
+
+	if rs, err = d.getDiagnosticsResult(); err != nil {
+		return
+	}
+	err = checkResults(rs, d.log)
+	return
+}
+
+// runJob starts the ePSA job, or attaches to a running one, and waits for its completion.
+// lost is set if the job state became unavailable
+func (d DellClient) runJob() (lost bool, err error) {
+	d.log.Debugf("running %s ePSA diagnostics, reboot type %s", d.opts.RunMode, d.opts.RebootType)
+	payload := iDracDiagnostics{RebootJobType: d.opts.RebootType, RunMode: d.opts.RunMode}
 	resp, err := d.requestPostRetry("/redfish/v1/Dell/Managers/iDRAC.Embedded.1/DellLCService/Actions/DellLCService.RunePSADiagnostics", payload)
 	var jobID string
 	if err != nil {
@@ -77,21 +134,20 @@ func (d DellClient) Run() (err error) {
 			d.log.Errorf("remote diags already running")
 			job, err := d.findDiagnosticJob()
 			if err != nil {
-				return err
+				return lost, err
 			}
 			jobID = job.ID
 		} else {
-			return fmt.Errorf(idracErr.Error.Message[0].Message)
+			return lost, fmt.Errorf(idracErr.Error.Message[0].Message)
 		}
 
 	} else if resp.StatusCode != 202 {
-		return fmt.Errorf("run remote diags not successful")
+		return lost, fmt.Errorf("run remote diags not successful")
 	} else {
 		loc := resp.Header.Get("Location")
 		locs := strings.Split(loc, "/")
 		jobID = locs[len(locs)-1]
 	}
-	jobStartFailed := false
 	cf := wait.ConditionFunc(func() (bool, error) {
 		j, err := d.getJobByID(jobID)
 		if err != nil {
@@ -104,32 +160,13 @@ func (d DellClient) Run() (err error) {
 		}
 		if j.JobState == "" {
 			d.log.Debug("waiting for diagnostics job to be completed. state: unavailable")
-			jobStartFailed = true
+			lost = true
 			return true, nil
 		}
 		d.log.Debugf("waiting for diagnostics job to be completed. state: %s", j.JobState)
 		return false, nil
 	})
-
-	if err = wait.Poll(60*time.Second, 240*time.Minute, cf); err != nil {
-		return err
-	}
-
-	if jobStartFailed {
-		return d.Run()
-	}
-
-	res, err := d.getDiagnosticsResult()
-	passed := true
-	for r, i := range res {
-		if i < 1 {
-			d.log.Errorf("diagnostic test did not pass: %s", r)
-			passed = false
-		}
-	}
-	if !passed {
-		return fmt.Errorf("diagnostic tests did not pass")
-	}
+	err = wait.Poll(jobPollInterval, d.opts.Timeout, cf)
 	return
 }
 
@@ -177,10 +214,10 @@ func (d DellClient) findDiagnosticJob() (j iDRACJob, err error) {
 	return
 }
 
-func (d DellClient) getDiagnosticsResult() (results map[string]int, err error) {
+// getDiagnosticsResult parses the tests of the ePSA export. The log reference of the results is the export's location
+func (d DellClient) getDiagnosticsResult() (results []Result, err error) {
 	var rgx = regexp.MustCompile(`\*\*(.*?)\*\*`)
-	var test string
-	results = make(map[string]int)
+	results = make([]Result, 0)
 
 	payload := iDracDiagnostics{ShareType: "Local"}
 	resp, err := d.requestPostRetry("/redfish/v1/Dell/Managers/iDRAC.Embedded.1/DellLCService/Actions/DellLCService.ExportePSADiagnosticsResult", payload)
@@ -188,31 +225,46 @@ func (d DellClient) getDiagnosticsResult() (results map[string]int, err error) {
 		return
 	}
 
-	resp, err = d.client.Get(resp.Header.Get("Location"))
+	loc := resp.Header.Get("Location")
+	resp, err = d.client.Get(loc)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
 	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
+	for line := 1; scanner.Scan(); line++ {
 		if strings.Contains(scanner.Text(), "**") {
 			rs := rgx.FindStringSubmatch(scanner.Text())
-			test = rs[1]
-			results[rs[1]] = 0
+			test := strings.TrimSpace(rs[1])
+			// tests without a result line did not pass
+			results = append(results, Result{
+				Component: Component(test),
+				Test:      test,
+				Severity:  SeverityCritical,
+				LogRef:    fmt.Sprintf("%s#L%d", loc, line),
+			})
+			continue
 		}
-
-		if strings.Contains(scanner.Text(), "Test Results :") {
-			r := strings.Split(scanner.Text(), " : ")
-
-			if _, ok := results[test]; ok {
-				switch r[1] {
-				case "Pass":
-					results[test] = 2
-				case "Warning":
-					results[test] = 1
-				default:
-					results[test] = 0
-				}
+		kv := strings.SplitN(scanner.Text(), " : ", 2)
+		if len(kv) != 2 || len(results) == 0 {
+			continue
+		}
+		r := &results[len(results)-1]
+		if strings.TrimSpace(kv[0]) != "Test Results" {
+			// e.g. Error Code : 2000-0142
+			if r.Value != "" {
+				r.Value += ", "
 			}
+			r.Value += strings.TrimSpace(kv[0]) + "=" + strings.TrimSpace(kv[1])
+			continue
+		}
+		switch strings.TrimSpace(kv[1]) {
+		case "Pass":
+			r.Severity = SeverityOK
+		case "Warning":
+			r.Severity = SeverityWarning
+		default:
+			r.Severity = SeverityCritical
 		}
 	}
 
@@ -232,7 +284,7 @@ func (d DellClient) requestRetry(url string, statusCode int) (*http.Response, er
 		}
 		return true, nil
 	})
-	if errWait := wait.Poll(10*time.Second, 5*time.Minute, cf); errWait != nil {
+	if errWait := wait.Poll(retryInterval, 5*time.Minute, cf); errWait != nil {
 		return resp, err
 	}
 	return resp, err
@@ -259,7 +311,7 @@ func (d DellClient) requestPostRetry(url string, payload interface{}) (*http.Res
 		}
 		return true, nil
 	})
-	if errWait := wait.Poll(15*time.Second, 10*time.Minute, cf); errWait != nil {
+	if errWait := wait.Poll(postRetryInterval, 10*time.Minute, cf); errWait != nil {
 		return resp, err
 	}
 	return resp, err
@@ -0,0 +1,85 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diagnostics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/redfish/mock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T, model string) (s *mock.Server, cfg gofish.ClientConfig) {
+	job, retry, post := jobPollInterval, retryInterval, postRetryInterval
+	t.Cleanup(func() {
+		jobPollInterval, retryInterval, postRetryInterval = job, retry, post
+	})
+	jobPollInterval = 10 * time.Millisecond
+	retryInterval = 10 * time.Millisecond
+	postRetryInterval = 10 * time.Millisecond
+	s, err := mock.New(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s, gofish.ClientConfig{Endpoint: s.URL, Username: s.Username, Password: s.Password, Insecure: true, BasicAuth: true}
+}
+
+func TestDellDiagnostics(t *testing.T) {
+	s, cfg := newTestServer(t, mock.R640)
+	c := NewDellClient(cfg, config.Epsa{}, log.WithFields(log.Fields{"node": "test"}))
+
+	rs, err := c.Run()
+	assert.NoError(t, err)
+	assert.Len(t, rs, 3)
+	assert.Equal(t, Result{Component: "drive", Test: "Hard Drive Test", Severity: SeverityOK, LogRef: "/redfish/v1/Dell/Managers/iDRAC.Embedded.1/DellLCService/ePSAResult#L3"}, rs[1])
+	assert.Contains(t, s.Requests(), "POST /redfish/v1/Dell/Managers/iDRAC.Embedded.1/DellLCService/Actions/DellLCService.RunePSADiagnostics")
+}
+
+func TestDellDiagnosticsFailed(t *testing.T) {
+	s, cfg := newTestServer(t, mock.R640)
+	s.EPSAResult = "** Memory Test **\nError Code : 2000-0123\nTest Results : Fail\n"
+	c := NewDellClient(cfg, config.Epsa{}, log.WithFields(log.Fields{"node": "test"}))
+
+	rs, err := c.Run()
+	assert.EqualError(t, err, "diagnostic tests did not pass: Memory Test")
+	assert.Equal(t, "Error Code=2000-0123", rs[0].Value)
+}
+
+func TestDellDiagnosticsRetries(t *testing.T) {
+	s, cfg := newTestServer(t, mock.R640)
+	s.JobState = ""
+	c := NewDellClient(cfg, config.Epsa{RunMode: EpsaExpress, MaxRetries: 2}, log.WithFields(log.Fields{"node": "test"}))
+
+	_, err := c.Run()
+	assert.EqualError(t, err, "ePSA diagnostics job lost, giving up after 2 retries")
+	runs := 0
+	for _, r := range s.Requests() {
+		if r == "POST /redfish/v1/Dell/Managers/iDRAC.Embedded.1/DellLCService/Actions/DellLCService.RunePSADiagnostics" {
+			runs++
+		}
+	}
+	assert.Equal(t, 3, runs)
+
+	c = NewDellClient(cfg, config.Epsa{RunMode: "Quick"}, log.WithFields(log.Fields{"node": "test"}))
+	_, err = c.Run()
+	assert.EqualError(t, err, "invalid ePSA run mode Quick, expected Express or Extended")
+}
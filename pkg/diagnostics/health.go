@@ -0,0 +1,267 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// HealthClient checks the redfish health status of the node's components and collects
+// the bmc event logs (SEL, Lifecycle log, IML, ...). It works for all vendors
+type HealthClient struct {
+	client   *gofish.APIClient
+	gCfg     gofish.ClientConfig
+	runStart time.Time
+	log      *log.Entry
+}
+
+type Health struct {
+	Components []ComponentHealth `json:"components"`
+	Logs       []LogEntry        `json:"logs"`
+	Since      string            `json:"since,omitempty"`
+}
+
+type ComponentHealth struct {
+	Type   string        `json:"type"`
+	Name   string        `json:"name"`
+	Health common.Health `json:"health"`
+}
+
+type LogEntry struct {
+	Ref      string                `json:"ref,omitempty"`
+	Source   string                `json:"source"`
+	Created  string                `json:"created"`
+	Severity redfish.EventSeverity `json:"severity"`
+	Message  string                `json:"message"`
+}
+
+// NewHealthClient creates the health check of a run started at runStart
+func NewHealthClient(gCfg gofish.ClientConfig, runStart time.Time, log *log.Entry) (c *HealthClient) {
+	return &HealthClient{
+		gCfg:     gCfg,
+		runStart: runStart,
+		log:      log,
+	}
+}
+
+// Run collects the component health and the log entries since the last power on, or since the run started
+// if the system does not report it. Returns an error if any component or log entry is critical
+func (h *HealthClient) Run() (health Health, err error) {
+	if h.client, err = gofish.Connect(h.gCfg); err != nil {
+		return
+	}
+	defer h.client.Logout()
+	health = Health{Components: make([]ComponentHealth, 0), Logs: make([]LogEntry, 0)}
+	s, err := h.client.Service.Systems()
+	if err != nil || len(s) == 0 {
+		return health, fmt.Errorf("cannot load system")
+	}
+	if err = h.systemHealth(s[0], &health); err != nil {
+		return
+	}
+	if err = h.chassisHealth(&health); err != nil {
+		return
+	}
+	since := h.lastPowerOn(s[0])
+	if since.IsZero() {
+		h.log.Debug("system does not report last reset time, collecting the log entries of the run")
+		since = h.runStart
+	}
+	if !since.IsZero() {
+		health.Since = since.Format(time.RFC3339)
+	}
+	if err = h.collectLogs(s[0], since, &health); err != nil {
+		return
+	}
+
+	critical := make([]string, 0)
+	for _, c := range health.Components {
+		if c.Health == common.CriticalHealth {
+			critical = append(critical, c.Type+" "+c.Name)
+		}
+	}
+	for _, l := range health.Logs {
+		if l.Severity == redfish.CriticalEventSeverity {
+			critical = append(critical, l.Source+": "+l.Message)
+		}
+	}
+	if len(critical) > 0 {
+		return health, fmt.Errorf("critical health status: %s", strings.Join(critical, ", "))
+	}
+	return
+}
+
+// Results returns the component health and the log entries with a severity other than ok as diagnostics results
+func (health Health) Results() (rs []Result) {
+	rs = make([]Result, 0)
+	for _, c := range health.Components {
+		rs = append(rs, Result{Component: c.Type, Test: c.Name, Severity: severity(string(c.Health))})
+	}
+	for _, l := range health.Logs {
+		if l.Severity == redfish.OKEventSeverity || l.Severity == "" {
+			continue
+		}
+		c, ok := matchComponent(l.Message)
+		if !ok {
+			c = "log"
+		}
+		rs = append(rs, Result{
+			Component: c,
+			Test:      l.Source,
+			Severity:  severity(string(l.Severity)),
+			Message:   l.Message,
+			LogRef:    l.Ref,
+		})
+	}
+	return
+}
+
+// severity maps a redfish health or event severity
+func severity(s string) string {
+	switch s {
+	case string(common.CriticalHealth):
+		return SeverityCritical
+	case string(common.WarningHealth):
+		return SeverityWarning
+	}
+	return SeverityOK
+}
+
+func (h *HealthClient) systemHealth(s *redfish.ComputerSystem, health *Health) (err error) {
+	ps, err := s.Processors()
+	if err != nil {
+		return
+	}
+	for _, p := range ps {
+		h.addComponent(health, "processor", p.Name, p.Status)
+	}
+	ms, err := s.Memory()
+	if err != nil {
+		return
+	}
+	for _, m := range ms {
+		h.addComponent(health, "memory", m.Name, m.Status)
+	}
+	st, err := s.Storage()
+	if err != nil {
+		return
+	}
+	for _, ctrl := range st {
+		ds, err := ctrl.Drives()
+		if err != nil {
+			return err
+		}
+		for _, d := range ds {
+			h.addComponent(health, "drive", d.Name, d.Status)
+		}
+	}
+	return
+}
+
+func (h *HealthClient) chassisHealth(health *Health) (err error) {
+	ch, err := h.client.Service.Chassis()
+	if err != nil {
+		return
+	}
+	for _, c := range ch {
+		t, err := c.Thermal()
+		if err != nil {
+			return err
+		}
+		if t != nil {
+			for _, f := range t.Fans {
+				h.addComponent(health, "fan", f.Name, f.Status)
+			}
+			for _, tp := range t.Temperatures {
+				h.addComponent(health, "thermal", tp.Name, tp.Status)
+			}
+		}
+		p, err := c.Power()
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			for _, ps := range p.PowerSupplies {
+				h.addComponent(health, "powersupply", ps.Name, ps.Status)
+			}
+		}
+	}
+	return
+}
+
+func (h *HealthClient) addComponent(health *Health, t, name string, st common.Status) {
+	// absent components (e.g. empty dimm slots) do not report a health
+	if st.State == common.AbsentState || st.Health == "" {
+		return
+	}
+	if st.Health != common.OKHealth {
+		h.log.Warnf("%s %s health: %s", t, name, st.Health)
+	}
+	health.Components = append(health.Components, ComponentHealth{Type: t, Name: name, Health: st.Health})
+}
+
+// lastPowerOn returns the LastResetTime of the system. gofish does not expose the property, zero if unsupported
+func (h *HealthClient) lastPowerOn(s *redfish.ComputerSystem) (t time.Time) {
+	resp, err := h.client.Get(s.ODataID)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var sys struct {
+		LastResetTime string
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&sys); err != nil || sys.LastResetTime == "" {
+		return
+	}
+	t, err = time.Parse(time.RFC3339, sys.LastResetTime)
+	if err != nil {
+		h.log.Debugf("cannot parse last reset time: %s", err.Error())
+	}
+	return
+}
+
+// collectLogs loads the manager (SEL, Lifecycle, IEL) and system (IML) log entries created after since
+func (h *HealthClient) collectLogs(s *redfish.ComputerSystem, since time.Time, health *Health) (err error) {
+	ls, err := s.LogServices()
+	if err != nil {
+		return
+	}
+	m, err := h.client.Service.Managers()
+	if err != nil {
+		return
+	}
+	for _, mg := range m {
+		mls, err := mg.LogServices()
+		if err != nil {
+			return err
+		}
+		ls = append(ls, mls...)
+	}
+	for _, l := range ls {
+		// audit logs only contain bmc logins and config changes
+		if strings.Contains(strings.ToLower(l.ID), "audit") {
+			continue
+		}
+		es, err := l.Entries()
+		if err != nil {
+			h.log.Debugf("cannot load log entries of %s: %s", l.ID, err.Error())
+			continue
+		}
+		for _, e := range es {
+			if !since.IsZero() {
+				created, err := time.Parse(time.RFC3339, e.Created)
+				if err == nil && created.Before(since) {
+					continue
+				}
+			}
+			health.Logs = append(health.Logs, LogEntry{Ref: e.ODataID, Source: l.ID, Created: e.Created, Severity: e.Severity, Message: e.Message})
+		}
+	}
+	return
+}
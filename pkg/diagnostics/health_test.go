@@ -0,0 +1,91 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diagnostics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/redfish/mock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck(t *testing.T) {
+	for _, model := range []string{mock.R640, mock.DL360, mock.SR650} {
+		_, cfg := newTestServer(t, model)
+		c := NewHealthClient(cfg, time.Time{}, log.WithFields(log.Fields{"node": model}))
+		h, err := c.Run()
+		assert.NoError(t, err, model)
+		assert.NotEmpty(t, h.Components, model)
+	}
+}
+
+func TestHealthCheckCritical(t *testing.T) {
+	s, cfg := newTestServer(t, mock.R640)
+	psu := s.Resource("/redfish/v1/Chassis/System.Embedded.1/Power")
+	psu["PowerSupplies"].([]interface{})[1].(map[string]interface{})["Status"] = map[string]interface{}{"Health": "Critical", "State": "Enabled"}
+	s.SetResource("/redfish/v1/Chassis/System.Embedded.1/Power", psu)
+	c := NewHealthClient(cfg, time.Time{}, log.WithFields(log.Fields{"node": "test"}))
+
+	_, err := c.Run()
+	assert.EqualError(t, err, "critical health status: powersupply PS2 Status")
+}
+
+func TestHealthCheckRunStart(t *testing.T) {
+	s, cfg := newTestServer(t, mock.R640)
+	sel := "/redfish/v1/Managers/iDRAC.Embedded.1/LogServices/Sel/Entries"
+	runStart := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	entries := s.Resource(sel)
+	members := make([]interface{}, 0)
+	for i, e := range []struct {
+		created  time.Time
+		severity string
+		message  string
+	}{
+		{runStart.Add(-time.Hour), "Critical", "The system board fail-safe voltage is outside of range."},
+		{runStart.Add(time.Minute), "Warning", "Correctable memory error rate exceeded for DIMM_A1."},
+	} {
+		path := fmt.Sprintf("%s/%d", sel, i+1)
+		s.SetResource(path, map[string]interface{}{
+			"@odata.id":   path,
+			"@odata.type": "#LogEntry.v1_6_1.LogEntry",
+			"Id":          fmt.Sprint(i + 1),
+			"Created":     e.created.Format(time.RFC3339),
+			"Severity":    e.severity,
+			"Message":     e.message,
+		})
+		members = append(members, map[string]interface{}{"@odata.id": path})
+	}
+	entries["Members"] = members
+	entries["Members@odata.count"] = len(members)
+	s.SetResource(sel, entries)
+
+	// the system reports no last reset time, the critical entry before the run is ignored
+	c := NewHealthClient(cfg, runStart, log.WithFields(log.Fields{"node": "test"}))
+	h, err := c.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, "2021-06-01T10:00:00Z", h.Since)
+	if assert.Len(t, h.Logs, 1) {
+		assert.Equal(t, "Correctable memory error rate exceeded for DIMM_A1.", h.Logs[0].Message)
+	}
+
+	c = NewHealthClient(cfg, time.Time{}, log.WithFields(log.Fields{"node": "test"}))
+	_, err = c.Run()
+	assert.EqualError(t, err, "critical health status: Sel: The system board fail-safe voltage is outside of range.")
+}
@@ -0,0 +1,171 @@
+package diagnostics
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// netbox interface types start with the speed, e.g. 1000base-t, 2.5gbase-t or 25gbase-x-sfp28
+var interfaceTypeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)(g?)base-`)
+
+// LinkInterface is a cabled node interface with its netbox interface type and the speed the bmc reports
+type LinkInterface struct {
+	CableInterface
+	Type      string
+	SpeedMbps int
+}
+
+// PortStatus is the negotiated state of a switch port. MTU is 0 if unknown, PortChannel is empty if the port is not bundled
+type PortStatus struct {
+	SpeedMbps   int
+	Duplex      string
+	MTU         int
+	PortChannel string
+}
+
+// PortStatusSource returns the state of the switch port an interface is cabled to
+type PortStatusSource interface {
+	Name() string
+	PortStatus(intf CableInterface) (PortStatus, error)
+}
+
+// LinkCheck compares the negotiated speed and duplex of node interfaces and their switch ports with the
+// netbox interface type, and checks the mtu and port-channel membership of the switch ports
+type LinkCheck struct {
+	sources []linkSource
+	mtu     int
+	lacp    bool
+	log     *log.Entry
+}
+
+type linkSource struct {
+	match  *regexp.Regexp
+	source PortStatusSource
+}
+
+// LinkResult is the outcome of the check of an interface. Reasons is empty if the link is as expected
+type LinkResult struct {
+	Interface     string   `json:"interface"`
+	Type          string   `json:"type"`
+	ExpectedSpeed int      `json:"expectedSpeed"`
+	NodeSpeed     int      `json:"nodeSpeed"`
+	SwitchSpeed   int      `json:"switchSpeed"`
+	Duplex        string   `json:"duplex,omitempty"`
+	MTU           int      `json:"mtu,omitempty"`
+	PortChannel   string   `json:"portChannel,omitempty"`
+	Source        string   `json:"source,omitempty"`
+	Reasons       []string `json:"reasons,omitempty"`
+}
+
+func NewLinkCheck(mtu int, lacp bool, log *log.Entry) *LinkCheck {
+	return &LinkCheck{sources: make([]linkSource, 0), mtu: mtu, lacp: lacp, log: log}
+}
+
+// AddSource adds a port status source for interfaces whose switch name matches the regex. An empty regex matches all switches
+func (c *LinkCheck) AddSource(match string, s PortStatusSource) (err error) {
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return fmt.Errorf("invalid link check match %s: %s", match, err.Error())
+	}
+	c.sources = append(c.sources, linkSource{match: re, source: s})
+	return
+}
+
+// HasSource reports if a port status source is configured for the switch
+func (c *LinkCheck) HasSource(sw string) bool {
+	for _, s := range c.sources {
+		if s.match.MatchString(sw) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks the links of all interfaces. The lacp check needs all interfaces of a node:
+// the ports cabled to the same switch have to be members of the same port-channel
+func (c *LinkCheck) Check(intfs []LinkInterface) (rs []LinkResult) {
+	rs = make([]LinkResult, 0)
+	channels := make(map[string]string)
+	for _, intf := range intfs {
+		r := LinkResult{Interface: intf.Name, Type: intf.Type, NodeSpeed: intf.SpeedMbps}
+		expected, ok := ExpectedSpeed(intf.Type)
+		if !ok {
+			c.log.Debugf("no speed for netbox interface type %s of %s", intf.Type, intf.Name)
+		}
+		r.ExpectedSpeed = expected
+		if ok && intf.SpeedMbps != 0 && intf.SpeedMbps != expected {
+			r.Reasons = append(r.Reasons, fmt.Sprintf("node speed %d Mbps, expected %d Mbps", intf.SpeedMbps, expected))
+		}
+		ps, src, err := c.portStatus(intf.CableInterface)
+		if err != nil {
+			r.Reasons = append(r.Reasons, err.Error())
+			rs = append(rs, r)
+			continue
+		}
+		r.Source = src
+		r.SwitchSpeed, r.Duplex, r.MTU, r.PortChannel = ps.SpeedMbps, ps.Duplex, ps.MTU, ps.PortChannel
+		if ok && ps.SpeedMbps != expected {
+			r.Reasons = append(r.Reasons, fmt.Sprintf("switch speed %d Mbps, expected %d Mbps", ps.SpeedMbps, expected))
+		}
+		if ps.Duplex != "" && !strings.EqualFold(ps.Duplex, "full") {
+			r.Reasons = append(r.Reasons, fmt.Sprintf("duplex %s", ps.Duplex))
+		}
+		if c.mtu != 0 && ps.MTU != 0 && ps.MTU < c.mtu {
+			r.Reasons = append(r.Reasons, fmt.Sprintf("mtu %d, expected %d", ps.MTU, c.mtu))
+		}
+		if c.lacp {
+			sw := strings.ToLower(intf.Switch)
+			switch pc, seen := channels[sw]; {
+			case ps.PortChannel == "":
+				r.Reasons = append(r.Reasons, "port not in a port-channel")
+			case seen && pc != ps.PortChannel:
+				r.Reasons = append(r.Reasons, fmt.Sprintf("port-channel %s, other ports are in %s", ps.PortChannel, pc))
+			case !seen:
+				channels[sw] = ps.PortChannel
+			}
+		}
+		rs = append(rs, r)
+	}
+	return
+}
+
+// portStatus returns the status of the first source matching the switch which knows the port
+func (c *LinkCheck) portStatus(intf CableInterface) (ps PortStatus, src string, err error) {
+	reasons := make([]string, 0)
+	for _, s := range c.sources {
+		if !s.match.MatchString(intf.Switch) {
+			continue
+		}
+		ps, err = s.source.PortStatus(intf)
+		if err != nil {
+			c.log.Debugf("%s port status of %s: %s", s.source.Name(), intf.Name, err.Error())
+			reasons = append(reasons, s.source.Name()+": "+err.Error())
+			continue
+		}
+		return ps, s.source.Name(), nil
+	}
+	if len(reasons) == 0 {
+		return ps, src, fmt.Errorf("no port status source for switch %s", intf.Switch)
+	}
+	return ps, src, fmt.Errorf("%s", strings.Join(reasons, ", "))
+}
+
+// ExpectedSpeed returns the speed in Mbps of a netbox interface type
+func ExpectedSpeed(netboxType string) (mbps int, ok bool) {
+	m := interfaceTypeRe.FindStringSubmatch(strings.ToLower(netboxType))
+	if m == nil {
+		return
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return
+	}
+	if m[2] == "g" {
+		f *= 1000
+	}
+	return int(f), true
+}
@@ -0,0 +1,233 @@
+package diagnostics
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aristanetworks/goeapi"
+	"github.com/aristanetworks/goeapi/module"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+)
+
+// AristaSource reads the lldp neighbors of arista switches via eAPI
+type AristaSource struct {
+	cfg    config.AristaAuth
+	domain string
+}
+
+func NewAristaSource(cfg config.AristaAuth, domain string) *AristaSource {
+	return &AristaSource{cfg: cfg, domain: domain}
+}
+
+func (a *AristaSource) Name() string {
+	return "arista"
+}
+
+// aristaInterface is the output of show interfaces for a single port, which module.ShowInterface lacks the duplex of
+type aristaInterface struct {
+	port       string
+	Interfaces map[string]struct {
+		Bandwidth           int64  `json:"bandwidth"`
+		Duplex              string `json:"duplex"`
+		Mtu                 int    `json:"mtu"`
+		InterfaceMembership string `json:"interfaceMembership"`
+	} `json:"interfaces"`
+}
+
+func (i *aristaInterface) GetCmd() string {
+	return "show interfaces " + i.port
+}
+
+func (a *AristaSource) Neighbors(intf CableInterface) (nbs []Neighbor, err error) {
+	var lldp module.ShowLLDPNeighbors
+	if err = a.call(intf, &lldp); err != nil {
+		return
+	}
+	nbs = make([]Neighbor, 0)
+	for _, ln := range lldp.LLDPNeighbors {
+		//244a.979a.b76b
+		nbs = append(nbs, Neighbor{Mac: ln.NeighborPort, Switch: intf.Switch, Port: ln.Port})
+	}
+	return
+}
+
+// PortStatus returns the speed, duplex, mtu and port-channel membership of the interface's switch port
+func (a *AristaSource) PortStatus(intf CableInterface) (ps PortStatus, err error) {
+	i := aristaInterface{port: intf.Port}
+	if err = a.call(intf, &i); err != nil {
+		return
+	}
+	for _, p := range i.Interfaces {
+		ps.SpeedMbps = int(p.Bandwidth / 1000000)
+		ps.Duplex = strings.ToLower(strings.TrimPrefix(p.Duplex, "duplex"))
+		ps.MTU = p.Mtu
+		// Member of Port-Channel10
+		if m := strings.TrimPrefix(p.InterfaceMembership, "Member of "); m != p.InterfaceMembership {
+			ps.PortChannel = m
+		}
+		return ps, nil
+	}
+	return ps, fmt.Errorf("port %s not found on %s", intf.Port, intf.Switch)
+}
+
+func (a *AristaSource) call(intf CableInterface, cmd goeapi.EapiCommand) (err error) {
+	c, err := goeapi.Connect(a.cfg.Transport, switchHost(intf, a.domain), a.cfg.User, a.cfg.Password, a.cfg.Port)
+	if err != nil {
+		return
+	}
+	handle, err := c.GetHandle("json")
+	if err != nil {
+		return
+	}
+	defer handle.Close()
+	if err = handle.AddCommand(cmd); err != nil {
+		return
+	}
+	return handle.Call()
+}
+
+// NxapiSource reads the lldp neighbors of cisco nx-os switches via NX-API.
+// The switch certificate is verified unless the source is insecure
+type NxapiSource struct {
+	cfg    config.NeighborSource
+	domain string
+	client *http.Client
+}
+
+type nxapiResponse struct {
+	InsAPI struct {
+		Outputs struct {
+			Output struct {
+				Code string `json:"code"`
+				Msg  string `json:"msg"`
+				Body struct {
+					TableNborDetail struct {
+						RowNborDetail json.RawMessage `json:"ROW_nbor_detail"`
+					} `json:"TABLE_nbor_detail"`
+				} `json:"body"`
+			} `json:"output"`
+		} `json:"outputs"`
+	} `json:"ins_api"`
+}
+
+type nxapiNeighbor struct {
+	LocalPort string `json:"l_port_id"`
+	PortID    string `json:"port_id"`
+	SysName   string `json:"sys_name"`
+}
+
+func NewNxapiSource(cfg config.NeighborSource, domain string) *NxapiSource {
+	return &NxapiSource{
+		cfg:    cfg,
+		domain: domain,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.Insecure}},
+		},
+	}
+}
+
+func (n *NxapiSource) Name() string {
+	return "nxapi"
+}
+
+func (n *NxapiSource) Neighbors(intf CableInterface) (nbs []Neighbor, err error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"ins_api": map[string]string{
+			"version":       "1.0",
+			"type":          "cli_show",
+			"chunk":         "0",
+			"sid":           "1",
+			"input":         "show lldp neighbors detail",
+			"output_format": "json",
+		},
+	})
+	if err != nil {
+		return
+	}
+	url := fmt.Sprintf("https://%s/ins", switchHost(intf, n.domain))
+	if n.cfg.Port != 0 {
+		url = fmt.Sprintf("https://%s:%d/ins", switchHost(intf, n.domain), n.cfg.Port)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(n.cfg.User, n.cfg.Password)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nbs, fmt.Errorf("nxapi request failed: %d: %s", resp.StatusCode, string(body))
+	}
+	var r nxapiResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return
+	}
+	out := r.InsAPI.Outputs.Output
+	if out.Code != "200" {
+		return nbs, fmt.Errorf("nxapi command failed: %s %s", out.Code, out.Msg)
+	}
+	// nx-api returns an object instead of a list for a single row
+	rows := make([]nxapiNeighbor, 0)
+	raw := out.Body.TableNborDetail.RowNborDetail
+	if len(raw) > 0 && raw[0] == '{' {
+		var row nxapiNeighbor
+		if err = json.Unmarshal(raw, &row); err != nil {
+			return
+		}
+		rows = append(rows, row)
+	} else if len(raw) > 0 {
+		if err = json.Unmarshal(raw, &rows); err != nil {
+			return
+		}
+	}
+	nbs = make([]Neighbor, 0)
+	for _, row := range rows {
+		nbs = append(nbs, Neighbor{Mac: row.PortID, Switch: intf.Switch, Port: row.LocalPort})
+	}
+	return
+}
+
+// SnmpSource reads the lldp neighbors of any switch supporting the LLDP-MIB via snmp v2c
+type SnmpSource struct {
+	cfg    config.NeighborSource
+	domain string
+}
+
+func NewSnmpSource(cfg config.NeighborSource, domain string) *SnmpSource {
+	return &SnmpSource{cfg: cfg, domain: domain}
+}
+
+func (s *SnmpSource) Name() string {
+	return "snmp"
+}
+
+func (s *SnmpSource) Neighbors(intf CableInterface) (nbs []Neighbor, err error) {
+	port := s.cfg.Port
+	if port == 0 {
+		port = 161
+	}
+	return snmpLldpNeighbors(switchHost(intf, s.domain), uint16(port), s.cfg.Community, intf.Switch)
+}
+
+// switchHost returns the fqdn of the switch, or its netbox ip without a domain
+func switchHost(intf CableInterface, domain string) string {
+	if domain == "" && intf.SwitchIP != "" {
+		return intf.SwitchIP
+	}
+	return fmt.Sprintf("%s.%s", intf.Switch, domain)
+}
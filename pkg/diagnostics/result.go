@@ -0,0 +1,169 @@
+package diagnostics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// severity of a diagnostics result
+const (
+	SeverityOK       = "ok"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Diagnostics runs the remote hardware diagnostics of a vendor (Dell ePSA),
+// waits for completion and returns the result of each test. Returns an error if a test failed
+type Diagnostics interface {
+	Run() ([]Result, error)
+}
+
+// Result is the outcome of a diagnostics test of a component. Value is the measured value if the test reports one,
+// LogRef references the raw log (export or bmc log entry) the result was parsed from.
+// Accepted is set for warnings the policy accepts
+type Result struct {
+	Component string `json:"component"`
+	Test      string `json:"test"`
+	Severity  string `json:"severity"`
+	Value     string `json:"value,omitempty"`
+	Message   string `json:"message,omitempty"`
+	LogRef    string `json:"logRef,omitempty"`
+	Accepted  bool   `json:"accepted,omitempty"`
+}
+
+// components by the keywords of the vendor test names
+var componentKeywords = []struct {
+	keyword   string
+	component string
+}{
+	{"memory", "memory"},
+	{"dimm", "memory"},
+	{"processor", "processor"},
+	{"cpu", "processor"},
+	{"drive", "drive"},
+	{"disk", "drive"},
+	{"storage", "drive"},
+	{"network", "network"},
+	{"nic", "network"},
+	{"power supply", "powersupply"},
+	{"psu", "powersupply"},
+	{"fan", "fan"},
+	{"thermal", "thermal"},
+	{"temperature", "thermal"},
+	{"pci", "pci"},
+}
+
+// Component returns the component a vendor test belongs to, the lower case test name if unknown
+func Component(test string) string {
+	if c, ok := matchComponent(test); ok {
+		return c
+	}
+	return strings.TrimSuffix(strings.ToLower(test), " test")
+}
+
+func matchComponent(text string) (string, bool) {
+	t := strings.ToLower(text)
+	for _, k := range componentKeywords {
+		if strings.Contains(t, k.keyword) {
+			return k.component, true
+		}
+	}
+	return "", false
+}
+
+// checkResults logs the warnings and returns an error with the critical results
+func checkResults(rs []Result, log *log.Entry) (err error) {
+	failed := make([]string, 0)
+	for _, r := range rs {
+		msg := r.Test
+		if r.Message != "" {
+			msg = r.Message
+		}
+		switch r.Severity {
+		case SeverityWarning:
+			log.Warnf("diagnostic test warning: %s", msg)
+		case SeverityCritical:
+			log.Errorf("diagnostic test did not pass: %s", msg)
+			failed = append(failed, r.Test)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("diagnostic tests did not pass: %s", strings.Join(failed, ", "))
+	}
+	return
+}
+
+// Policy decides which warnings are acceptable. The first rule matching the component and test of a warning
+// decides, warnings without a matching rule are acceptable if AcceptWarnings is set
+type Policy struct {
+	AcceptWarnings bool         `yaml:"acceptWarnings"`
+	Rules          []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule matches warnings by component and test regex (case insensitive), empty matches all
+type PolicyRule struct {
+	Component string `yaml:"component"`
+	Test      string `yaml:"test"`
+	Accept    bool   `yaml:"accept"`
+}
+
+// DefaultPolicy accepts all warnings
+var DefaultPolicy = Policy{AcceptWarnings: true}
+
+// LoadPolicy reads the policy file, DefaultPolicy without a file
+func LoadPolicy(path string) (p Policy, err error) {
+	if path == "" {
+		return DefaultPolicy, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, fmt.Errorf("cannot read diagnostics policy: %s", err.Error())
+	}
+	if err = yaml.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("cannot parse diagnostics policy %s: %s", path, err.Error())
+	}
+	for _, r := range p.Rules {
+		for _, re := range []string{r.Component, r.Test} {
+			if _, err = regexp.Compile(re); err != nil {
+				return p, fmt.Errorf("invalid diagnostics policy rule %s: %s", re, err.Error())
+			}
+		}
+	}
+	return
+}
+
+// Apply marks the accepted warnings and returns an error with the critical results and the warnings not accepted
+func (p Policy) Apply(rs []Result) (err error) {
+	failed := make([]string, 0)
+	for i, r := range rs {
+		switch r.Severity {
+		case SeverityCritical:
+			failed = append(failed, r.Component+" "+r.Test)
+		case SeverityWarning:
+			rs[i].Accepted = p.accepts(r)
+			if !rs[i].Accepted {
+				failed = append(failed, r.Component+" "+r.Test+" (warning)")
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("diagnostic tests did not pass: %s", strings.Join(failed, ", "))
+	}
+	return
+}
+
+func (p Policy) accepts(r Result) bool {
+	for _, rule := range p.Rules {
+		c, _ := regexp.MatchString("(?i)"+rule.Component, r.Component)
+		t, _ := regexp.MatchString("(?i)"+rule.Test, r.Test)
+		if c && t {
+			return rule.Accept
+		}
+	}
+	return p.AcceptWarnings
+}
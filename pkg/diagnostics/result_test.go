@@ -0,0 +1,81 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diagnostics
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := `
+acceptWarnings: false
+rules:
+- component: powersupply
+  test: PS2
+  accept: true
+- component: fan
+  accept: true
+`
+	assert.NoError(t, ioutil.WriteFile(path, []byte(policy), 0644))
+	p, err := LoadPolicy(path)
+	assert.NoError(t, err)
+
+	rs := []Result{
+		{Component: "powersupply", Test: "PS2 Status", Severity: SeverityWarning},
+		{Component: "fan", Test: "Fan 1", Severity: SeverityWarning},
+		{Component: "memory", Test: "DIMM A1", Severity: SeverityOK},
+	}
+	assert.NoError(t, p.Apply(rs))
+	assert.True(t, rs[0].Accepted)
+	assert.False(t, rs[2].Accepted)
+
+	rs = append(rs, Result{Component: "powersupply", Test: "PS1 Status", Severity: SeverityWarning}, Result{Component: "drive", Test: "Disk 0", Severity: SeverityCritical})
+	assert.EqualError(t, p.Apply(rs), "diagnostic tests did not pass: powersupply PS1 Status (warning), drive Disk 0")
+	assert.NoError(t, DefaultPolicy.Apply(rs[:4]))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("rules:\n- component: \"(\"\n"), 0644))
+	_, err = LoadPolicy(path)
+	assert.Error(t, err)
+}
+
+func TestTrends(t *testing.T) {
+	path := t.TempDir()
+	now := time.Now()
+	psu := Result{Component: "powersupply", Test: "PS2 Status", Severity: SeverityWarning}
+	ok := Result{Component: "powersupply", Test: "PS2 Status", Severity: SeverityOK}
+	for _, r := range []Run{
+		{Node: "node001-bb091", Rack: "bb091", Task: "healthcheck", Time: now.Add(-time.Hour), Results: []Result{psu}},
+		{Node: "node002-bb091", Rack: "bb091", Task: "healthcheck", Time: now, Results: []Result{psu}},
+		{Node: "node003-bb091", Rack: "bb091", Task: "healthcheck", Time: now.Add(-time.Hour), Results: []Result{psu}},
+		// the latest run of node003 is ok again
+		{Node: "node003-bb091", Rack: "bb091", Task: "healthcheck", Time: now, Results: []Result{ok}},
+		{Node: "node001-bb092", Rack: "bb092", Task: "healthcheck", Time: now, Results: []Result{psu}},
+	} {
+		assert.NoError(t, SaveRun(path, r))
+	}
+	runs, err := LoadRuns(path)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 5)
+	assert.Equal(t, []Trend{{Rack: "bb091", Component: "powersupply", Test: "PS2 Status", Nodes: []string{"node001-bb091", "node002-bb091"}}}, Trends(runs, 2))
+	assert.Len(t, Trends(runs, 1), 2)
+}
@@ -0,0 +1,109 @@
+package diagnostics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// LLDP-MIB objects used by the snmp neighbor source
+const (
+	lldpRemPortIDSubtype = ".1.0.8802.1.1.2.1.4.1.1.6"
+	lldpRemPortID        = ".1.0.8802.1.1.2.1.4.1.1.7"
+	lldpLocPortID        = ".1.0.8802.1.1.2.1.3.7.1.3"
+	lldpLocPortDesc      = ".1.0.8802.1.1.2.1.3.7.1.4"
+)
+
+// port id subtype macAddress of the LLDP-MIB
+const lldpPortIDMac = 3
+
+var (
+	snmpTimeout = 5 * time.Second
+	snmpRetries = 2
+)
+
+// snmpLldpNeighbors returns the remote port ids of the lldp neighbors of the switch and the local port they are seen on
+func snmpLldpNeighbors(host string, port uint16, community, sw string) (nbs []Neighbor, err error) {
+	c := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      port,
+		Community: community,
+		Version:   gosnmp.Version2c,
+		Timeout:   snmpTimeout,
+		Retries:   snmpRetries,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	if err = c.Connect(); err != nil {
+		return
+	}
+	defer c.Conn.Close()
+	subtypes, err := snmpWalk(c, lldpRemPortIDSubtype)
+	if err != nil {
+		return
+	}
+	portIDs, err := snmpWalk(c, lldpRemPortID)
+	if err != nil {
+		return
+	}
+	localIDs, err := snmpWalk(c, lldpLocPortID)
+	if err != nil {
+		return
+	}
+	localDescs, err := snmpWalk(c, lldpLocPortDesc)
+	if err != nil {
+		return
+	}
+	nbs = make([]Neighbor, 0)
+	for idx, pdu := range portIDs {
+		// index: timeMark.localPortNum.remIndex
+		parts := strings.Split(idx, ".")
+		if len(parts) != 3 {
+			continue
+		}
+		b, _ := pdu.Value.([]byte)
+		mac := string(b)
+		if st, ok := subtypes[idx]; (ok && gosnmp.ToBigInt(st.Value).Int64() == lldpPortIDMac) || len(b) == 6 {
+			mac = formatMac(b)
+		}
+		port := printable(localIDs[parts[1]])
+		if port == "" {
+			port = printable(localDescs[parts[1]])
+		}
+		nbs = append(nbs, Neighbor{Mac: mac, Switch: sw, Port: port})
+	}
+	return
+}
+
+// snmpWalk returns the values of the table column by the index suffix of their oid
+func snmpWalk(c *gosnmp.GoSNMP, root string) (pdus map[string]gosnmp.SnmpPDU, err error) {
+	pdus = make(map[string]gosnmp.SnmpPDU)
+	err = c.BulkWalk(root, func(pdu gosnmp.SnmpPDU) error {
+		pdus[strings.TrimPrefix(pdu.Name, root+".")] = pdu
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("snmp walk of %s failed: %s", root, err.Error())
+	}
+	return
+}
+
+func formatMac(b []byte) string {
+	s := make([]string, len(b))
+	for i, c := range b {
+		s[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(s, ":")
+}
+
+// printable returns an octet string value, which is empty if it is not printable
+func printable(pdu gosnmp.SnmpPDU) string {
+	b, _ := pdu.Value.([]byte)
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return ""
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,114 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Run are the results of a diagnostics task of a node run
+type Run struct {
+	Node    string    `json:"node"`
+	Rack    string    `json:"rack,omitempty"`
+	Site    string    `json:"site,omitempty"`
+	Task    string    `json:"task"`
+	Time    time.Time `json:"time"`
+	Results []Result  `json:"results"`
+}
+
+// Trend is a component test with warnings or failures on several nodes of a rack
+type Trend struct {
+	Rack      string   `json:"rack"`
+	Component string   `json:"component"`
+	Test      string   `json:"test"`
+	Nodes     []string `json:"nodes"`
+}
+
+// SaveRun persists the results of a run as <path>/<node>/<task>-<time>.json
+func SaveRun(path string, r Run) (err error) {
+	dir := filepath.Join(path, r.Node)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create diagnostics results dir: %s", err.Error())
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return
+	}
+	name := fmt.Sprintf("%s-%s.json", r.Task, r.Time.UTC().Format("20060102T150405Z"))
+	return ioutil.WriteFile(filepath.Join(dir, name), b, 0644)
+}
+
+// LoadRuns returns the persisted runs of all nodes, ordered by time
+func LoadRuns(path string) (runs []Run, err error) {
+	runs = make([]Run, 0)
+	files, err := filepath.Glob(filepath.Join(path, "*", "*.json"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return runs, err
+		}
+		var r Run
+		if err = json.Unmarshal(b, &r); err != nil {
+			return runs, fmt.Errorf("cannot parse diagnostics results %s: %s", f, err.Error())
+		}
+		runs = append(runs, r)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Time.Before(runs[j].Time)
+	})
+	return
+}
+
+// Trends returns the component tests that warned or failed in the latest run of a task on at least
+// minNodes nodes of the same rack, e.g. the same psu warning on every node of a rack
+func Trends(runs []Run, minNodes int) (trends []Trend) {
+	trends = make([]Trend, 0)
+	latest := make(map[string]Run)
+	for _, r := range runs {
+		latest[r.Node+"/"+r.Task] = r
+	}
+	byTest := make(map[string]*Trend)
+	keys := make([]string, 0)
+	for _, r := range latest {
+		for _, res := range r.Results {
+			if res.Severity == SeverityOK {
+				continue
+			}
+			key := strings.Join([]string{r.Rack, res.Component, res.Test}, "/")
+			t, ok := byTest[key]
+			if !ok {
+				t = &Trend{Rack: r.Rack, Component: res.Component, Test: res.Test, Nodes: make([]string, 0)}
+				byTest[key] = t
+				keys = append(keys, key)
+			}
+			if !contains(t.Nodes, r.Node) {
+				t.Nodes = append(t.Nodes, r.Node)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if t := byTest[k]; len(t.Nodes) >= minNodes {
+			sort.Strings(t.Nodes)
+			trends = append(trends, *t)
+		}
+	}
+	return
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"fmt"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/diagnostics"
+)
+
+const interfaceType = "dcim.interface"
+
+// ReconcileCable replaces the netbox cable of the node interface with a cable to the switch port
+// the interface was observed on. A cable of another node interface on that switch port is removed,
+// it is replaced by the reconciliation of the other interface
+func (n *Netbox) ReconcileCable(r diagnostics.CableResult) (err error) {
+	if !r.Mismatch() {
+		return fmt.Errorf("no observed switch port for interface %s", r.Interface)
+	}
+	intfs, err := n.getInterfaces()
+	if err != nil {
+		return
+	}
+	var nodeIntf *models.Interface
+	for _, in := range intfs {
+		if *in.Name == r.Interface {
+			nodeIntf = in
+		}
+	}
+	if nodeIntf == nil {
+		return fmt.Errorf("no netbox interface %s", r.Interface)
+	}
+	swIntf, err := n.getSwitchInterface(r.ObservedSwitch, r.ObservedPort)
+	if err != nil {
+		return
+	}
+	if swIntf.Cable != nil {
+		if len(swIntf.ConnectedEndpoints) == 0 || swIntf.ConnectedEndpoints[0].Device == nil ||
+			int64(swIntf.ConnectedEndpoints[0].Device.ID) != n.Data.Device.ID {
+			return fmt.Errorf("switch port %s %s is cabled to another device", r.ObservedSwitch, *swIntf.Name)
+		}
+	}
+	// netbox does not create a cable on a cabled interface: the old cables are deleted first
+	// and restored if the new cable cannot be created
+	deleted := make([]*models.WritableCable, 0)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, c := range deleted {
+			if _, rerr := n.client.API.CreateCable(c); rerr != nil {
+				n.log.Errorf("cannot restore cable of interface %d: %s", *c.ATerminations[0].ObjectID, rerr.Error())
+			}
+		}
+	}()
+	for _, in := range []*models.Interface{swIntf, nodeIntf} {
+		if in.Cable == nil || (in == nodeIntf && swIntf.Cable != nil && nodeIntf.Cable.ID == swIntf.Cable.ID) {
+			continue
+		}
+		old, err := restorableCable(in)
+		if err != nil {
+			return err
+		}
+		if err = n.deleteCable(in.Cable.ID); err != nil {
+			return err
+		}
+		deleted = append(deleted, old)
+	}
+	t := interfaceType
+	_, err = n.client.API.CreateCable(&models.WritableCable{
+		ATerminations: []*models.GenericObject{{ObjectType: &t, ObjectID: &nodeIntf.ID}},
+		BTerminations: []*models.GenericObject{{ObjectType: &t, ObjectID: &swIntf.ID}},
+		Status:        "connected",
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create cable %s -> %s %s: %s", r.Interface, r.ObservedSwitch, *swIntf.Name, err.Error())
+	}
+	n.log.Infof("reconciled cable %s: %s %s -> %s %s", r.Interface, r.ExpectedSwitch, r.ExpectedPort, r.ObservedSwitch, *swIntf.Name)
+	return
+}
+
+// AddJournalEntry writes a journal entry (kind: info, success, warning or danger) on the node's device
+func (n *Netbox) AddJournalEntry(kind, comments string) (err error) {
+	t := "dcim.device"
+	return n.client.API.CreateJournalEntry(&models.WritableJournalEntry{
+		AssignedObjectType: &t,
+		AssignedObjectID:   &n.Data.Device.ID,
+		Kind:               kind,
+		Comments:           &comments,
+	})
+}
+
+func (n *Netbox) getSwitchInterface(sw, port string) (in *models.Interface, err error) {
+	l, err := n.client.API.Interfaces(sw)
+	if err != nil {
+		return
+	}
+	for _, in := range l {
+		if diagnostics.PortMatches(port, *in.Name) {
+			return in, nil
+		}
+	}
+	return in, fmt.Errorf("no netbox interface %s on switch %s", port, sw)
+}
+
+// restorableCable returns the cable of the interface to its connected endpoint, so it can be recreated after deletion
+func restorableCable(in *models.Interface) (c *models.WritableCable, err error) {
+	if len(in.ConnectedEndpoints) == 0 || in.ConnectedEndpoints[0].ID == 0 {
+		return c, fmt.Errorf("cable %d of interface %s has no connected endpoint", in.Cable.ID, *in.Name)
+	}
+	t := interfaceType
+	peer := int64(in.ConnectedEndpoints[0].ID)
+	return &models.WritableCable{
+		ATerminations: []*models.GenericObject{{ObjectType: &t, ObjectID: &in.ID}},
+		BTerminations: []*models.GenericObject{{ObjectType: &t, ObjectID: &peer}},
+		Label:         in.Cable.Label,
+		Status:        "connected",
+	}, nil
+}
+
+func (n *Netbox) deleteCable(id int64) (err error) {
+	if err = n.client.API.DeleteCable(id); err != nil {
+		return fmt.Errorf("cannot delete cable %d: %s", id, err.Error())
+	}
+	return
+}
@@ -0,0 +1,103 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/diagnostics"
+	"github.com/sapcc/baremetal_temper/pkg/netbox/mock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingCreate fails the first cable creation
+type failingCreate struct {
+	*mock.Netbox
+	failed bool
+}
+
+func (f *failingCreate) CreateCable(data *models.WritableCable) (*models.Cable, error) {
+	if !f.failed {
+		f.failed = true
+		return nil, fmt.Errorf("netbox unavailable")
+	}
+	return f.Netbox.CreateCable(data)
+}
+
+// newCabledNetbox seeds the node interfaces PCI1-P1 and PCI1-P2 cabled to Ethernet1/1 and Ethernet1/2 of sw1-bb091.
+// The observed topology of the result is PCI1-P1 on Ethernet1/2
+func newCabledNetbox(t *testing.T, api clients.NetboxAPI, m *mock.Netbox) (*Netbox, diagnostics.CableResult) {
+	dev := &models.DeviceWithConfigContext{Name: strPtr(testNode), Display: testNode}
+	sw := &models.DeviceWithConfigContext{Name: strPtr("sw1-bb091"), Display: "sw1-bb091"}
+	m.Add(dev, sw)
+	nd := &models.NestedDevice{ID: dev.ID, Name: dev.Name, Display: testNode}
+	sd := &models.NestedDevice{ID: sw.ID, Name: sw.Name, Display: "sw1-bb091"}
+	t1 := interfaceType
+	for i := int64(1); i <= 2; i++ {
+		nodeIntf := &models.Interface{ID: i, Device: nd, Name: strPtr(fmt.Sprintf("PCI1-P%d", i))}
+		swIntf := &models.Interface{ID: 10 + i, Device: sd, Name: strPtr(fmt.Sprintf("Ethernet1/%d", i))}
+		cable := &models.WritableCable{ID: 20 + i, Label: fmt.Sprintf("c%d", i), Status: "connected",
+			ATerminations: []*models.GenericObject{{ObjectType: &t1, ObjectID: &nodeIntf.ID}},
+			BTerminations: []*models.GenericObject{{ObjectType: &t1, ObjectID: &swIntf.ID}},
+		}
+		nodeIntf.Cable = &models.NestedCable{ID: cable.ID, Label: cable.Label}
+		nodeIntf.ConnectedEndpoints = []*models.ConnectedEndpoint{{ID: int(swIntf.ID), Device: &models.ConnectedEndpointDevice{ID: int(sw.ID)}, Name: *swIntf.Name}}
+		swIntf.Cable = nodeIntf.Cable
+		swIntf.ConnectedEndpoints = []*models.ConnectedEndpoint{{ID: int(nodeIntf.ID), Device: &models.ConnectedEndpointDevice{ID: int(dev.ID)}, Name: *nodeIntf.Name}}
+		m.Add(nodeIntf, swIntf, cable)
+	}
+	l := log.WithField("node", testNode)
+	n := NewWithClient(testNode, config.Config{}, clients.NewNetboxWithAPI(api, l), l)
+	_, err := n.GetData()
+	assert.NoError(t, err)
+	return n, diagnostics.CableResult{Interface: "PCI1-P1", ExpectedSwitch: "sw1-bb091", ExpectedPort: "Ethernet1/1",
+		ObservedSwitch: "sw1-bb091", ObservedPort: "Ethernet1/2", Reason: "wrong switch port: Ethernet1/2"}
+}
+
+// terminations returns the node and switch interface ids of the cables, regardless of their side
+func terminations(cables []*models.WritableCable) (l [][2]int64) {
+	for _, c := range cables {
+		a, b := *c.ATerminations[0].ObjectID, *c.BTerminations[0].ObjectID
+		if a > b {
+			a, b = b, a
+		}
+		l = append(l, [2]int64{a, b})
+	}
+	return
+}
+
+func TestReconcileCable(t *testing.T) {
+	api := mock.New("3.6.0")
+	n, r := newCabledNetbox(t, api, api)
+	assert.NoError(t, n.ReconcileCable(r))
+	assert.Equal(t, [][2]int64{{1, 12}}, terminations(api.Cables()))
+}
+
+func TestReconcileCableRestore(t *testing.T) {
+	api := mock.New("3.6.0")
+	n, r := newCabledNetbox(t, &failingCreate{Netbox: api}, api)
+	assert.EqualError(t, n.ReconcileCable(r), "cannot create cable PCI1-P1 -> sw1-bb091 Ethernet1/2: netbox unavailable")
+	assert.ElementsMatch(t, [][2]int64{{1, 11}, {2, 12}}, terminations(api.Cables()))
+	for i, c := range terminations(api.Cables()) {
+		assert.Equal(t, fmt.Sprintf("c%d", c[0]), api.Cables()[i].Label)
+	}
+}
@@ -0,0 +1,328 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	_redfish "github.com/sapcc/baremetal_temper/pkg/redfish"
+)
+
+// description of the discovered inventory items and node interfaces redfish no longer reports
+const staleDescription = "stale: not reported by redfish"
+
+// netbox names of the node's nics: L1 (integrated), NIC3-port1 or PCI3-port1 (slot)
+var nodeInterfaceRe = regexp.MustCompile(`^(L\d+|NIC\d+-port\d+|PCI\d+-port\d+)$`)
+
+var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// netbox interface types by negotiated speed
+var interfaceTypes = map[int]string{
+	1000:   "1000base-t",
+	10000:  "10gbase-x-sfpp",
+	25000:  "25gbase-x-sfp28",
+	40000:  "40gbase-x-qsfpp",
+	100000: "100gbase-x-qsfp28",
+}
+
+// SyncInventory reconciles the hardware record of the node with the components redfish reports. A component is
+// installed as module if the device has a module bay named like its location and a module type with its part number,
+// otherwise it is a discovered inventory item named "<type> <location>" with the role of its type (slug cpu, gpu, dimm,
+// drive, nic or psu) if the role exists. Discovered inventory items redfish no longer reports are flagged stale
+func (n *Netbox) SyncInventory(cs []_redfish.Component) (err error) {
+	bays, err := n.getModuleBays()
+	if err != nil {
+		return
+	}
+	items, err := n.getInventoryItems()
+	if err != nil {
+		return
+	}
+	byName := make(map[string]*models.InventoryItem)
+	for _, it := range items {
+		byName[*it.Name] = it
+	}
+	refs := inventoryRefs{manufacturers: make(map[string]*int64), roles: make(map[string]*int64)}
+	seen := make(map[string]bool)
+	for _, c := range cs {
+		if bay, ok := bays[strings.ToLower(c.Location)]; ok && c.PartNumber != "" {
+			installed, err := n.syncModule(bay, c)
+			if err != nil {
+				return err
+			}
+			if installed {
+				continue
+			}
+		}
+		name := inventoryItemName(c)
+		seen[name] = true
+		if err = n.syncInventoryItem(byName[name], name, c, refs); err != nil {
+			return
+		}
+	}
+	for _, it := range items {
+		if !it.Discovered || seen[*it.Name] || it.Description == staleDescription {
+			continue
+		}
+		n.log.Infof("inventory item %s not reported by redfish, flagging it stale", *it.Name)
+		err = n.client.API.UpdateInventoryItem(it.ID, &models.WritableInventoryItem{Device: &n.Data.Device.ID, Name: it.Name, Description: staleDescription})
+		if err != nil {
+			return fmt.Errorf("cannot flag inventory item %s: %s", *it.Name, err.Error())
+		}
+	}
+	return
+}
+
+// SyncInterfaces creates the node interfaces redfish reports which are missing in netbox and flags the
+// nic interfaces redfish no longer reports stale, the flag is removed when they are reported again.
+// Interfaces are matched by mac address, then by name
+func (n *Netbox) SyncInterfaces(intfs []_redfish.Interface) (err error) {
+	nbIntfs, err := n.getInterfaces()
+	if err != nil {
+		return
+	}
+	matched := make(map[int64]bool)
+	for _, ri := range intfs {
+		var in *models.Interface
+		for _, nb := range nbIntfs {
+			if nb.MacAddress != nil && strings.EqualFold(*nb.MacAddress, ri.MacAddress) {
+				in = nb
+				break
+			}
+		}
+		for _, nb := range nbIntfs {
+			if in == nil && strings.EqualFold(*nb.Name, ri.Name) {
+				in = nb
+			}
+		}
+		if in != nil {
+			matched[in.ID] = true
+			if in.Description != staleDescription {
+				continue
+			}
+			n.log.Infof("interface %s reported by redfish again, removing the stale flag", *in.Name)
+			if _, err = n.client.API.PatchInterface(in.ID, map[string]interface{}{"description": ""}); err != nil {
+				return fmt.Errorf("cannot unflag interface %s: %s", *in.Name, err.Error())
+			}
+			continue
+		}
+		t, ok := interfaceTypes[ri.SpeedMbps]
+		if !ok {
+			t = "other"
+		}
+		name := netboxInterfaceName(ri.Name)
+		mac := strings.ToUpper(ri.MacAddress)
+		n.log.Infof("creating missing netbox interface %s (%s)", name, mac)
+		_, err = n.client.API.CreateInterface(&models.WritableInterface{
+			WirelessLans: []int64{},
+			Vdcs:         []int64{},
+			TaggedVlans:  []int64{},
+			Device:       &n.Data.Device.ID,
+			Name:         &name,
+			Type:         &t,
+			MacAddress:   &mac,
+			Enabled:      true,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot create interface %s: %s", name, err.Error())
+		}
+	}
+	for _, in := range nbIntfs {
+		if matched[in.ID] || in.MgmtOnly || !nodeInterfaceRe.MatchString(*in.Name) || in.Description == staleDescription {
+			continue
+		}
+		n.log.Infof("interface %s not reported by redfish, flagging it stale", *in.Name)
+		if _, err = n.client.API.PatchInterface(in.ID, map[string]interface{}{"description": staleDescription}); err != nil {
+			return fmt.Errorf("cannot flag interface %s: %s", *in.Name, err.Error())
+		}
+	}
+	return
+}
+
+// inventoryRefs caches the manufacturer and role ids of a sync
+type inventoryRefs struct {
+	manufacturers map[string]*int64
+	roles         map[string]*int64
+}
+
+func (n *Netbox) syncInventoryItem(it *models.InventoryItem, name string, c _redfish.Component, refs inventoryRefs) (err error) {
+	partID := c.PartNumber
+	if partID == "" {
+		partID = c.Model
+	}
+	manufacturer, err := n.getManufacturer(c.Manufacturer, refs)
+	if err != nil {
+		return
+	}
+	role, err := n.getInventoryItemRole(c.Type, refs)
+	if err != nil {
+		return
+	}
+	data := &models.WritableInventoryItem{
+		Device:       &n.Data.Device.ID,
+		Name:         &name,
+		Manufacturer: manufacturer,
+		Role:         role,
+		PartID:       partID,
+		Serial:       c.Serial,
+		Description:  c.Model,
+		Discovered:   true,
+	}
+	if it == nil {
+		n.log.Debugf("creating inventory item %s", name)
+		if err = n.client.API.CreateInventoryItem(data); err != nil {
+			return fmt.Errorf("cannot create inventory item %s: %s", name, err.Error())
+		}
+		return
+	}
+	if it.Serial == c.Serial && it.PartID == partID && it.Description == c.Model && it.Discovered {
+		return
+	}
+	n.log.Debugf("updating inventory item %s", name)
+	if err = n.client.API.UpdateInventoryItem(it.ID, data); err != nil {
+		return fmt.Errorf("cannot update inventory item %s: %s", name, err.Error())
+	}
+	return
+}
+
+// syncModule installs the component in the module bay or updates the serial of the installed module.
+// installed is false if netbox has no module type with the component's part number
+func (n *Netbox) syncModule(bay *models.ModuleBay, c _redfish.Component) (installed bool, err error) {
+	ms, err := n.client.API.Modules(bay.ID)
+	if err != nil {
+		return
+	}
+	if len(ms) > 0 {
+		m := ms[0]
+		if m.Serial == c.Serial {
+			return true, nil
+		}
+		n.log.Debugf("updating serial of module in bay %s", *bay.Name)
+		err = n.client.API.UpdateModule(m.ID, &models.WritableModule{
+			Device:     &n.Data.Device.ID,
+			ModuleBay:  &bay.ID,
+			ModuleType: &m.ModuleType.ID,
+			Serial:     c.Serial,
+		})
+		if err != nil {
+			return false, fmt.Errorf("cannot update module in bay %s: %s", *bay.Name, err.Error())
+		}
+		return true, nil
+	}
+	ts, err := n.client.API.ModuleTypes(c.PartNumber)
+	if err != nil {
+		return
+	}
+	if len(ts) != 1 {
+		n.log.Debugf("no module type with part number %s, adding %s as inventory item", c.PartNumber, c.Location)
+		return
+	}
+	n.log.Debugf("installing module %s in bay %s", c.PartNumber, *bay.Name)
+	err = n.client.API.CreateModule(&models.WritableModule{
+		Device:     &n.Data.Device.ID,
+		ModuleBay:  &bay.ID,
+		ModuleType: &ts[0].ID,
+		Serial:     c.Serial,
+		Status:     models.ModuleStatusValueActive,
+	})
+	if err != nil {
+		return false, fmt.Errorf("cannot install module in bay %s: %s", *bay.Name, err.Error())
+	}
+	return true, nil
+}
+
+// getManufacturer returns the id of the manufacturer, which is created if missing. Nil for an empty name
+func (n *Netbox) getManufacturer(name string, refs inventoryRefs) (id *int64, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return
+	}
+	if id, ok := refs.manufacturers[name]; ok {
+		return id, nil
+	}
+	l, err := n.client.API.Manufacturers(name)
+	if err != nil {
+		return
+	}
+	if len(l) > 0 {
+		id = &l[0].ID
+	} else {
+		slug := strings.Trim(slugRe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+		n.log.Infof("creating manufacturer %s", name)
+		m, err := n.client.API.CreateManufacturer(name, slug)
+		if err != nil {
+			return id, fmt.Errorf("cannot create manufacturer %s: %s", name, err.Error())
+		}
+		id = &m.ID
+	}
+	refs.manufacturers[name] = id
+	return
+}
+
+// getInventoryItemRole returns the id of the role with the component type as slug, nil if there is none
+func (n *Netbox) getInventoryItemRole(slug string, refs inventoryRefs) (id *int64, err error) {
+	if id, ok := refs.roles[slug]; ok {
+		return id, nil
+	}
+	l, err := n.client.API.InventoryItemRoles(slug)
+	if err != nil {
+		return
+	}
+	if len(l) > 0 {
+		id = &l[0].ID
+	}
+	refs.roles[slug] = id
+	return
+}
+
+func (n *Netbox) getInventoryItems() (items []*models.InventoryItem, err error) {
+	return n.client.API.InventoryItems(n.Data.Device.ID)
+}
+
+// getModuleBays returns the module bays of the device by lower case name
+func (n *Netbox) getModuleBays() (bays map[string]*models.ModuleBay, err error) {
+	bays = make(map[string]*models.ModuleBay)
+	l, err := n.client.API.ModuleBays(n.Data.Device.ID)
+	if err != nil {
+		return
+	}
+	for _, b := range l {
+		bays[strings.ToLower(*b.Name)] = b
+	}
+	return
+}
+
+// inventoryItemName is "<type> <location>", truncated to the 64 characters netbox allows
+func inventoryItemName(c _redfish.Component) string {
+	name := c.Type + " " + c.Location
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// netboxInterfaceName returns the netbox spelling of the lower case redfish interface name, e.g. l1 => L1, nic3-port1 => NIC3-port1
+func netboxInterfaceName(name string) string {
+	i := strings.IndexAny(name, "0123456789")
+	if i < 0 {
+		return name
+	}
+	return strings.ToUpper(name[:i]) + name[i:]
+}
@@ -0,0 +1,80 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"testing"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	_redfish "github.com/sapcc/baremetal_temper/pkg/redfish"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncInterfaces(t *testing.T) {
+	n, api := newTestNetbox(t)
+	nd := &models.NestedDevice{ID: n.Data.Device.ID, Name: n.Data.Device.Name, Display: testNode}
+	api.Add(
+		&models.Interface{Device: nd, Name: strPtr("NIC1-port1"), MacAddress: strPtr("AA:BB:CC:DD:EE:01")},
+		&models.Interface{Device: nd, Name: strPtr("NIC1-port2"), MacAddress: strPtr("AA:BB:CC:DD:EE:02"), Description: staleDescription},
+		&models.Interface{Device: nd, Name: strPtr("NIC2-port1"), MacAddress: strPtr("AA:BB:CC:DD:EE:03")},
+	)
+	intfs := []_redfish.Interface{
+		// matched by name, L1 has no mac in netbox
+		{Name: "l1", MacAddress: "aa:bb:cc:dd:ee:10", Port: 1},
+		// matched by mac
+		{Name: "nic1-port1", MacAddress: "aa:bb:cc:dd:ee:01", Nic: 1, Port: 1},
+		{Name: "nic1-port2", MacAddress: "aa:bb:cc:dd:ee:02", Nic: 1, Port: 2},
+		{Name: "nic3-port1", MacAddress: "aa:bb:cc:dd:ee:04", Nic: 3, Port: 1, SpeedMbps: 25000},
+	}
+	assert.NoError(t, n.SyncInterfaces(intfs))
+
+	l, err := api.Interfaces(testNode)
+	assert.NoError(t, err)
+	byName := make(map[string]*models.Interface)
+	for _, in := range l {
+		byName[*in.Name] = in
+	}
+	assert.Len(t, byName, 6)
+	assert.Equal(t, "", byName["L1"].Description)
+	assert.Equal(t, "", byName["iDRAC"].Description)
+	assert.Equal(t, "", byName["NIC1-port1"].Description)
+	assert.Equal(t, "", byName["NIC1-port2"].Description, "reported again")
+	assert.Equal(t, staleDescription, byName["NIC2-port1"].Description)
+	if created := byName["NIC3-port1"]; assert.NotNil(t, created) {
+		assert.Equal(t, "AA:BB:CC:DD:EE:04", *created.MacAddress)
+		assert.Equal(t, "25gbase-x-sfp28", *created.Type.Value)
+	}
+	assert.Equal(t, 1, api.Calls("CreateInterface"))
+	assert.Equal(t, 2, api.Calls("PatchInterface"))
+	assert.Equal(t, 0, api.Calls("UpdateInterface"))
+
+	// a second sync changes nothing
+	assert.NoError(t, n.SyncInterfaces(intfs))
+	assert.Equal(t, 1, api.Calls("CreateInterface"))
+	assert.Equal(t, 2, api.Calls("PatchInterface"))
+}
+
+func TestNetboxInterfaceName(t *testing.T) {
+	for name, want := range map[string]string{
+		"l1":         "L1",
+		"nic3-port1": "NIC3-port1",
+		"pci2-port2": "PCI2-port2",
+		"":           "",
+	} {
+		assert.Equal(t, want, netboxInterfaceName(name), name)
+	}
+}
@@ -0,0 +1,245 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+)
+
+// AllocateAddresses reserves the primary and bmc (r suffixed) addresses of the node from the next available ips of
+// the prefixes of its rack or role (see config.Ipam), sets their dns names, assigns them to their interfaces and sets
+// the primary ip of the device. Addresses which already exist with the dns name are reused if they are unassigned
+// or assigned to the device, so it can be rerun. If a step fails, the changes made by the call are rolled back
+func (n *Netbox) AllocateAddresses() (err error) {
+	d, err := n.GetData()
+	if err != nil {
+		return
+	}
+	split := strings.Split(n.node, "-")
+	if len(split) != 2 {
+		return fmt.Errorf("wrong node name format: node[001]-[block_name]")
+	}
+	intfs, err := n.getInterfaces()
+	if err != nil {
+		return
+	}
+	own := make(map[int64]bool, len(intfs))
+	for _, in := range intfs {
+		own[in.ID] = true
+	}
+	undo := make([]func() error, 0)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil {
+				n.log.Errorf("cannot roll back ipam allocation: %s", uerr.Error())
+			}
+		}
+	}()
+
+	role := n.cfg.Ipam.PrimaryRole
+	if role == "" {
+		role = *d.Device.DeviceRole.Slug
+	}
+	intf, err := findInterface(intfs, n.cfg.Ipam.PrimaryInterface)
+	if err != nil {
+		return
+	}
+	primary, err := n.ensureAddress(n.dnsName(n.node), role, intf, own, &undo)
+	if err != nil {
+		return fmt.Errorf("cannot allocate primary address: %s", err.Error())
+	}
+	intf, err = findInterface(intfs, n.cfg.Ipam.BmcInterface)
+	if err != nil {
+		return
+	}
+	bmc, err := n.ensureAddress(n.dnsName(split[0]+"r-"+split[1]), n.cfg.Ipam.BmcRole, intf, own, &undo)
+	if err != nil {
+		return fmt.Errorf("cannot allocate bmc address: %s", err.Error())
+	}
+	if d.Device.PrimaryIp4 == nil || d.Device.PrimaryIp4.ID != primary.ID {
+		var prev interface{}
+		if d.Device.PrimaryIp4 != nil {
+			prev = d.Device.PrimaryIp4.ID
+		}
+		if err = n.setPrimaryIP(primary.ID); err != nil {
+			return
+		}
+		undo = append(undo, func() error { return n.setPrimaryIP(prev) })
+	}
+
+	for _, a := range []*models.IPAddress{primary, bmc} {
+		ip, _, err := net.ParseCIDR(*a.Address)
+		if err != nil {
+			return err
+		}
+		if a == primary {
+			n.Data.PrimaryIP = ip.String()
+		} else {
+			n.Data.RemoteIP = ip.String()
+			n.Data.DNSName = a.DNSName
+		}
+	}
+	n.Data.IpamAddresses = []models.IPAddress{*primary, *bmc}
+	n.log.Infof("allocated addresses %s and %s", *primary.Address, *bmc.Address)
+	return
+}
+
+// ensureAddress returns the address with the dns name assigned to the interface. An existing address is assigned if it
+// is unassigned or assigned to one of the device's interfaces (own), otherwise it is allocated from the prefixes of the role.
+// The changes are undone by the functions added to undo
+func (n *Netbox) ensureAddress(dnsName, role string, intf *models.Interface, own map[int64]bool, undo *[]func() error) (a *models.IPAddress, err error) {
+	l, err := n.client.API.IPAddresses(clients.IPAddressFilter{
+		DNSName: &dnsName,
+	})
+	if err != nil {
+		return
+	}
+	if len(l) > 1 {
+		return a, fmt.Errorf("found %d addresses with dns name %s", len(l), dnsName)
+	}
+	if len(l) == 1 {
+		a = l[0]
+		if a.AssignedObjectType != nil && *a.AssignedObjectType == interfaceType &&
+			a.AssignedObjectID != nil && *a.AssignedObjectID == intf.ID {
+			return
+		}
+		if a.AssignedObjectID != nil && (a.AssignedObjectType == nil || *a.AssignedObjectType != interfaceType || !own[*a.AssignedObjectID]) {
+			return a, fmt.Errorf("address %s with dns name %s is assigned to another device", *a.Address, dnsName)
+		}
+		n.log.Debugf("assigning address %s to interface %s", *a.Address, *intf.Name)
+		prev := map[string]interface{}{"address": *a.Address, "assigned_object_type": nil, "assigned_object_id": nil}
+		if a.AssignedObjectID != nil {
+			prev["assigned_object_type"] = a.AssignedObjectType
+			prev["assigned_object_id"] = a.AssignedObjectID
+		}
+		if a, err = n.updateAddress(a.ID, map[string]interface{}{
+			"address":              *a.Address,
+			"assigned_object_type": interfaceType,
+			"assigned_object_id":   intf.ID,
+		}); err != nil {
+			return
+		}
+		id := a.ID
+		*undo = append(*undo, func() (err error) {
+			_, err = n.updateAddress(id, prev)
+			return
+		})
+		return
+	}
+
+	prefixes, err := n.getPrefixes(role)
+	if err != nil {
+		return
+	}
+	body := map[string]interface{}{
+		"dns_name":             dnsName,
+		"status":               "active",
+		"assigned_object_type": interfaceType,
+		"assigned_object_id":   intf.ID,
+	}
+	for _, p := range prefixes {
+		c, cerr := n.client.API.CreateAvailableIP(p.ID, body)
+		if cerr != nil {
+			n.log.Debugf("no available ip in prefix %s: %s", *p.Prefix, cerr.Error())
+			continue
+		}
+		a = c
+		n.log.Debugf("allocated address %s from prefix %s", *a.Address, *p.Prefix)
+		id := a.ID
+		*undo = append(*undo, func() error {
+			return n.client.API.DeleteIPAddress(id)
+		})
+		return
+	}
+	return a, fmt.Errorf("no available ip in the prefixes with role %s", role)
+}
+
+// getPrefixes returns the prefixes of the role tagged with the rack tag of the device's rack (config.Ipam.RackTag)
+// or, if there are none, in its site
+func (n *Netbox) getPrefixes(role string) (prefixes []*models.Prefix, err error) {
+	d := n.Data.Device
+	f := clients.PrefixFilter{
+		Role: &role,
+		Site: d.Site.Slug,
+	}
+	if n.cfg.Ipam.RackTag != "" && d.Rack != nil && d.Rack.Name != nil {
+		tag := strings.ToLower(fmt.Sprintf(n.cfg.Ipam.RackTag, *d.Rack.Name))
+		f.Tag = &tag
+		prefixes, err = n.client.API.Prefixes(f)
+		if err != nil || len(prefixes) > 0 {
+			return
+		}
+		f.Tag = nil
+	}
+	prefixes, err = n.client.API.Prefixes(f)
+	if err != nil {
+		return
+	}
+	if len(prefixes) == 0 {
+		return prefixes, fmt.Errorf("no prefixes with role %s in site %s", role, *d.Site.Slug)
+	}
+	return
+}
+
+func (n *Netbox) updateAddress(id int64, body map[string]interface{}) (a *models.IPAddress, err error) {
+	a, err = n.client.API.UpdateIPAddress(id, body)
+	if err != nil {
+		return a, fmt.Errorf("cannot update address %d: %s", id, err.Error())
+	}
+	return
+}
+
+// setPrimaryIP sets the primary ipv4 address of the device, nil unsets it
+func (n *Netbox) setPrimaryIP(id interface{}) (err error) {
+	d, err := n.updateNodeInfo(map[string]interface{}{
+		"primary_ip4": id,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot set primary ip: %s", err.Error())
+	}
+	n.Data.Device.PrimaryIp4 = d.PrimaryIp4
+	return
+}
+
+// dnsName returns the fqdn of the host in the configured domain
+func (n *Netbox) dnsName(host string) string {
+	if n.cfg.Domain == "" {
+		return host
+	}
+	return host + "." + n.cfg.Domain
+}
+
+// findInterface returns the interface with the name or, without name, the management only interface
+func findInterface(intfs []*models.Interface, name string) (*models.Interface, error) {
+	for _, in := range intfs {
+		if (name == "" && in.MgmtOnly) || (name != "" && *in.Name == name) {
+			return in, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no management only interface found")
+	}
+	return nil, fmt.Errorf("interface %s not found", name)
+}
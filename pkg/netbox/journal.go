@@ -0,0 +1,96 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RunRecord is the outcome of a temper run of the node, written as journal entry on the device
+type RunRecord struct {
+	Start        time.Time
+	End          time.Time
+	Status       string
+	Tasks        []*Task
+	FailedStep   string
+	Error        string
+	Warnings     []string
+	NodeUUID     string
+	InstanceUUID string
+}
+
+// AddRunJournalEntry writes the journal entry of a run. The kind is danger for a failed run,
+// warning for a run with warnings and success otherwise
+func (n *Netbox) AddRunJournalEntry(r RunRecord) (err error) {
+	kind, comments := n.formatRun(r)
+	if err = n.AddJournalEntry(kind, comments); err != nil {
+		return fmt.Errorf("cannot write journal entry: %s", err.Error())
+	}
+	return
+}
+
+// formatRun returns the kind and markdown comments of the journal entry of a run
+func (n *Netbox) formatRun(r RunRecord) (kind, comments string) {
+	kind = "success"
+	switch {
+	case r.Status == "failed":
+		kind = "danger"
+	case len(r.Warnings) > 0:
+		kind = "warning"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "temper run %s\n\n", r.Status)
+	fmt.Fprintf(&b, "* start: %s\n", r.Start.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "* end: %s (%s)\n", r.End.UTC().Format(time.RFC3339), r.End.Sub(r.Start).Round(time.Second))
+	tasks := make([]string, 0, len(r.Tasks))
+	for _, t := range r.Tasks {
+		status := t.Status
+		if status == "" {
+			status = "not run"
+		}
+		tasks = append(tasks, fmt.Sprintf("%s.%s (%s)", t.Service, t.Task, status))
+	}
+	if len(tasks) > 0 {
+		fmt.Fprintf(&b, "* tasks: %s\n", strings.Join(tasks, ", "))
+	}
+	if r.FailedStep != "" {
+		fmt.Fprintf(&b, "* failed step: %s\n", r.FailedStep)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "* error: %s\n", r.Error)
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(&b, "* warning: %s\n", w)
+	}
+	if r.NodeUUID != "" {
+		fmt.Fprintf(&b, "* ironic node: %s\n", link(r.NodeUUID, n.cfg.Netbox.IronicNodeURL))
+	}
+	if r.InstanceUUID != "" {
+		fmt.Fprintf(&b, "* instance: %s\n", link(r.InstanceUUID, n.cfg.Netbox.InstanceURL))
+	}
+	return kind, b.String()
+}
+
+// link returns a markdown link of the uuid if the url template is set
+func link(uuid, tmpl string) string {
+	if tmpl == "" {
+		return uuid
+	}
+	return fmt.Sprintf("[%s](%s)", uuid, fmt.Sprintf(tmpl, uuid))
+}
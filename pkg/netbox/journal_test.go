@@ -0,0 +1,94 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatRun(t *testing.T) {
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(12*time.Minute + 30*time.Second + 400*time.Millisecond)
+	tasks := []*Task{
+		{Service: "dns", Task: "create", Status: "done"},
+		{Service: "diagnostics", Task: "hardwarecheck", Status: "failed"},
+		{Service: "ironic", Task: "create"},
+	}
+	for _, tc := range []struct {
+		name     string
+		record   RunRecord
+		kind     string
+		comments string
+	}{
+		{
+			name:   "failed",
+			record: RunRecord{Start: start, End: end, Status: "failed", Tasks: tasks, FailedStep: "diagnostics.hardwarecheck", Error: "epsa failed"},
+			kind:   "danger",
+			comments: "temper run failed\n\n" +
+				"* start: 2021-06-01T10:00:00Z\n" +
+				"* end: 2021-06-01T10:12:30Z (12m30s)\n" +
+				"* tasks: dns.create (done), diagnostics.hardwarecheck (failed), ironic.create (not run)\n" +
+				"* failed step: diagnostics.hardwarecheck\n" +
+				"* error: epsa failed\n",
+		},
+		{
+			name:   "warnings",
+			record: RunRecord{Start: start, End: end, Status: "done", Warnings: []string{"cable mismatch L1", "link down L2"}},
+			kind:   "warning",
+			comments: "temper run done\n\n" +
+				"* start: 2021-06-01T10:00:00Z\n" +
+				"* end: 2021-06-01T10:12:30Z (12m30s)\n" +
+				"* warning: cable mismatch L1\n" +
+				"* warning: link down L2\n",
+		},
+		{
+			name:   "linked",
+			record: RunRecord{Start: start, End: end, Status: "done", NodeUUID: "node-uuid", InstanceUUID: "instance-uuid"},
+			kind:   "success",
+			comments: "temper run done\n\n" +
+				"* start: 2021-06-01T10:00:00Z\n" +
+				"* end: 2021-06-01T10:12:30Z (12m30s)\n" +
+				"* ironic node: [node-uuid](https://ironic.example.com/nodes/node-uuid)\n" +
+				"* instance: instance-uuid\n",
+		},
+	} {
+		cfg := config.Config{Netbox: config.NetboxAuth{IronicNodeURL: "https://ironic.example.com/nodes/%s"}}
+		l := log.WithField("node", testNode)
+		n := NewWithClient(testNode, cfg, clients.NewNetboxWithAPI(nil, l), l)
+		kind, comments := n.formatRun(tc.record)
+		assert.Equal(t, tc.kind, kind, tc.name)
+		assert.Equal(t, tc.comments, comments, tc.name)
+	}
+}
+
+func TestAddRunJournalEntry(t *testing.T) {
+	n, api := newTestNetbox(t)
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, n.AddRunJournalEntry(RunRecord{Start: start, End: start.Add(time.Minute), Status: "failed", Error: "no power"}))
+	j := api.Journal()
+	if assert.Len(t, j, 1) {
+		assert.Equal(t, "danger", j[0].Kind)
+		assert.Equal(t, n.Data.Device.ID, *j[0].AssignedObjectID)
+		assert.Contains(t, *j[0].Comments, "* error: no power\n")
+	}
+}
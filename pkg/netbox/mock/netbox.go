@@ -0,0 +1,814 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mock provides an in-memory netbox implementing clients.NetboxAPI.
+// It filters by the fields temper queries, allocates available ips of prefixes and can fail single methods,
+// so the netbox workflows can be tested without a netbox instance.
+package mock
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+)
+
+// Netbox is an in-memory netbox. Objects are seeded with Add, Errors fails the methods by name,
+// e.g. "UpdateDevice", instead of calling them. Devices are returned as copies, like by a netbox
+type Netbox struct {
+	Errors map[string]error
+
+	mu            sync.Mutex
+	calls         map[string]int
+	version       string
+	nextID        int64
+	devices       []*models.DeviceWithConfigContext
+	racks         []*models.Rack
+	interfaces    []*models.Interface
+	cables        []*models.WritableCable
+	ips           []*models.IPAddress
+	prefixes      []*models.Prefix
+	tags          []*models.Tag
+	journal       []*models.WritableJournalEntry
+	items         []*models.InventoryItem
+	itemRoles     []*models.InventoryItemRole
+	manufacturers []*models.Manufacturer
+	bays          []*models.ModuleBay
+	modules       []*models.Module
+	moduleTypes   []*models.ModuleType
+}
+
+var _ clients.NetboxAPI = &Netbox{}
+
+// New creates an empty netbox of the version
+func New(version string) *Netbox {
+	return &Netbox{version: version, Errors: make(map[string]error), calls: make(map[string]int)}
+}
+
+// Add seeds the objects, objects without id get the next free id
+func (n *Netbox) Add(objs ...interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, o := range objs {
+		switch obj := o.(type) {
+		case *models.DeviceWithConfigContext:
+			n.setID(&obj.ID)
+			n.devices = append(n.devices, obj)
+		case *models.Rack:
+			n.setID(&obj.ID)
+			n.racks = append(n.racks, obj)
+		case *models.Interface:
+			n.setID(&obj.ID)
+			n.interfaces = append(n.interfaces, obj)
+		case *models.WritableCable:
+			n.setID(&obj.ID)
+			n.cables = append(n.cables, obj)
+		case *models.IPAddress:
+			n.setID(&obj.ID)
+			n.ips = append(n.ips, obj)
+		case *models.Prefix:
+			n.setID(&obj.ID)
+			n.prefixes = append(n.prefixes, obj)
+		case *models.Tag:
+			n.setID(&obj.ID)
+			n.tags = append(n.tags, obj)
+		case *models.InventoryItem:
+			n.setID(&obj.ID)
+			n.items = append(n.items, obj)
+		case *models.InventoryItemRole:
+			n.setID(&obj.ID)
+			n.itemRoles = append(n.itemRoles, obj)
+		case *models.Manufacturer:
+			n.setID(&obj.ID)
+			n.manufacturers = append(n.manufacturers, obj)
+		case *models.ModuleBay:
+			n.setID(&obj.ID)
+			n.bays = append(n.bays, obj)
+		case *models.Module:
+			n.setID(&obj.ID)
+			n.modules = append(n.modules, obj)
+		case *models.ModuleType:
+			n.setID(&obj.ID)
+			n.moduleTypes = append(n.moduleTypes, obj)
+		default:
+			panic(fmt.Sprintf("mock netbox: unsupported object %T", o))
+		}
+	}
+}
+
+// Journal returns the created journal entries
+func (n *Netbox) Journal() []*models.WritableJournalEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*models.WritableJournalEntry{}, n.journal...)
+}
+
+// Calls returns the number of calls of the method
+func (n *Netbox) Calls(method string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls[method]
+}
+
+// Cables returns the seeded and created cables
+func (n *Netbox) Cables() []*models.WritableCable {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*models.WritableCable{}, n.cables...)
+}
+
+func (n *Netbox) setID(id *int64) {
+	if *id == 0 {
+		n.nextID++
+		*id = n.nextID
+	} else if *id > n.nextID {
+		n.nextID = *id
+	}
+}
+
+// call locks the netbox, counts the call and returns the injected error of the method
+func (n *Netbox) call(method string) (unlock func(), err error) {
+	n.mu.Lock()
+	n.calls[method]++
+	return n.mu.Unlock, n.Errors[method]
+}
+
+func (n *Netbox) Version() string {
+	return n.version
+}
+
+func (n *Netbox) Devices(f clients.DeviceFilter) (l []*models.DeviceWithConfigContext, err error) {
+	unlock, err := n.call("Devices")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, d := range n.devices {
+		if (len(f.IDs) == 0 || containsID(f.IDs, d.ID)) && match(f.Name, str(d.Name)) && matchQ(f.Q, str(d.Name)) &&
+			(f.Site == nil || d.Site != nil && match(f.Site, str(d.Site.Slug))) &&
+			(f.Role == nil || d.DeviceRole != nil && match(f.Role, str(d.DeviceRole.Slug))) &&
+			(f.Status == nil || d.Status != nil && match(f.Status, str(d.Status.Value))) &&
+			(f.RackID == nil || d.Rack != nil && d.Rack.ID == *f.RackID) {
+			c := *d
+			l = append(l, &c)
+		}
+	}
+	return page(l, f.Limit, f.Offset), nil
+}
+
+func (n *Netbox) UpdateDevice(id int64, body map[string]interface{}) (d *models.DeviceWithConfigContext, err error) {
+	unlock, err := n.call("UpdateDevice")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, dev := range n.devices {
+		if dev.ID == id {
+			d = dev
+		}
+	}
+	if d == nil {
+		return d, notFound("device", id)
+	}
+	for k, v := range body {
+		switch k {
+		case "serial":
+			d.Serial = v.(string)
+		case "status":
+			s := v.(string)
+			d.Status = &models.DeviceWithConfigContextStatus{Value: &s}
+		case "tags":
+			d.Tags = v.([]*models.NestedTag)
+		case "local_context_data":
+			d.LocalContextData = v
+		case "custom_fields":
+			cf := make(map[string]interface{})
+			if old, ok := d.CustomFields.(map[string]interface{}); ok {
+				for name, value := range old {
+					cf[name] = value
+				}
+			}
+			for name, value := range v.(map[string]interface{}) {
+				cf[name] = value
+			}
+			d.CustomFields = cf
+		case "primary_ip4":
+			if v == nil {
+				d.PrimaryIp4 = nil
+				continue
+			}
+			ipID, ok := toInt64(v)
+			a := n.ip(ipID)
+			if !ok || a == nil {
+				return d, fmt.Errorf("invalid primary_ip4 %v", v)
+			}
+			d.PrimaryIp4 = &models.NestedIPAddress{ID: a.ID, Address: a.Address}
+		}
+	}
+	c := *d
+	return &c, nil
+}
+
+func (n *Netbox) Racks(q string) (l []*models.Rack, err error) {
+	unlock, err := n.call("Racks")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, r := range n.racks {
+		if matchQ(&q, str(r.Name)) {
+			l = append(l, r)
+		}
+	}
+	return
+}
+
+func (n *Netbox) Interfaces(device string) (l []*models.Interface, err error) {
+	unlock, err := n.call("Interfaces")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, in := range n.interfaces {
+		if in.Device != nil && (str(in.Device.Name) == device || in.Device.Display == device) {
+			l = append(l, in)
+		}
+	}
+	return
+}
+
+func (n *Netbox) CreateInterface(data *models.WritableInterface) (in *models.Interface, err error) {
+	unlock, err := n.call("CreateInterface")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	in = &models.Interface{Name: data.Name, MgmtOnly: data.MgmtOnly, MacAddress: data.MacAddress, Description: data.Description}
+	if data.Device != nil {
+		in.Device = n.nestedDevice(*data.Device)
+	}
+	if data.Type != nil {
+		in.Type = &models.InterfaceType{Value: data.Type}
+	}
+	n.setID(&in.ID)
+	n.interfaces = append(n.interfaces, in)
+	return
+}
+
+func (n *Netbox) UpdateInterface(id int64, data *models.WritableInterface) (in *models.Interface, err error) {
+	unlock, err := n.call("UpdateInterface")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, i := range n.interfaces {
+		if i.ID == id {
+			in = i
+		}
+	}
+	if in == nil {
+		return in, notFound("interface", id)
+	}
+	in.Name = data.Name
+	in.MgmtOnly = data.MgmtOnly
+	in.MacAddress = data.MacAddress
+	in.Description = data.Description
+	return
+}
+
+func (n *Netbox) PatchInterface(id int64, body map[string]interface{}) (in *models.Interface, err error) {
+	unlock, err := n.call("PatchInterface")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, i := range n.interfaces {
+		if i.ID == id {
+			in = i
+		}
+	}
+	if in == nil {
+		return in, notFound("interface", id)
+	}
+	for k, v := range body {
+		switch k {
+		case "name":
+			s := v.(string)
+			in.Name = &s
+		case "description":
+			in.Description = v.(string)
+		case "mac_address":
+			s := v.(string)
+			in.MacAddress = &s
+		case "mgmt_only":
+			in.MgmtOnly = v.(bool)
+		}
+	}
+	return
+}
+
+func (n *Netbox) CreateCable(data *models.WritableCable) (c *models.Cable, err error) {
+	unlock, err := n.call("CreateCable")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, t := range append(data.ATerminations, data.BTerminations...) {
+		if n.cabled(*t.ObjectID) {
+			return c, fmt.Errorf("interface %d already has a cable", *t.ObjectID)
+		}
+	}
+	n.setID(&data.ID)
+	n.cables = append(n.cables, data)
+	return &models.Cable{ID: data.ID}, nil
+}
+
+func (n *Netbox) DeleteCable(id int64) (err error) {
+	unlock, err := n.call("DeleteCable")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for i, c := range n.cables {
+		if c.ID == id {
+			n.cables = append(n.cables[:i], n.cables[i+1:]...)
+			return
+		}
+	}
+	return notFound("cable", id)
+}
+
+func (n *Netbox) cabled(id int64) bool {
+	for _, c := range n.cables {
+		for _, t := range append(c.ATerminations, c.BTerminations...) {
+			if *t.ObjectID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n *Netbox) IPAddresses(f clients.IPAddressFilter) (l []*models.IPAddress, err error) {
+	unlock, err := n.call("IPAddresses")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, a := range n.ips {
+		addr := str(a.Address)
+		if match(f.DNSName, a.DNSName) &&
+			(f.Address == nil || *f.Address == addr || strings.SplitN(addr, "/", 2)[0] == *f.Address) &&
+			(f.Q == nil || strings.Contains(addr, *f.Q) || strings.Contains(a.DNSName, *f.Q)) {
+			l = append(l, a)
+		}
+	}
+	if f.Limit != nil && *f.Limit > 0 && *f.Limit < int64(len(l)) {
+		l = l[:*f.Limit]
+	}
+	return
+}
+
+func (n *Netbox) UpdateIPAddress(id int64, body map[string]interface{}) (a *models.IPAddress, err error) {
+	unlock, err := n.call("UpdateIPAddress")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	if a = n.ip(id); a == nil {
+		return a, notFound("ip address", id)
+	}
+	setIPAddress(a, body)
+	return
+}
+
+func setIPAddress(a *models.IPAddress, body map[string]interface{}) {
+	for k, v := range body {
+		switch k {
+		case "address":
+			s := v.(string)
+			a.Address = &s
+		case "dns_name":
+			a.DNSName = v.(string)
+		case "status":
+			s := v.(string)
+			a.Status = &models.IPAddressStatus{Value: &s}
+		case "assigned_object_type":
+			a.AssignedObjectType = toStr(v)
+		case "assigned_object_id":
+			a.AssignedObjectID = nil
+			if i, ok := toInt64(v); ok {
+				a.AssignedObjectID = &i
+			}
+		}
+	}
+}
+
+func (n *Netbox) DeleteIPAddress(id int64) (err error) {
+	unlock, err := n.call("DeleteIPAddress")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for i, a := range n.ips {
+		if a.ID == id {
+			n.ips = append(n.ips[:i], n.ips[i+1:]...)
+			return
+		}
+	}
+	return notFound("ip address", id)
+}
+
+func (n *Netbox) Prefixes(f clients.PrefixFilter) (l []*models.Prefix, err error) {
+	unlock, err := n.call("Prefixes")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, p := range n.prefixes {
+		if (f.Role == nil || p.Role != nil && match(f.Role, str(p.Role.Slug))) &&
+			(f.Site == nil || p.Site != nil && match(f.Site, str(p.Site.Slug))) &&
+			(f.Tag == nil || hasTag(p.Tags, *f.Tag)) {
+			l = append(l, p)
+		}
+	}
+	return
+}
+
+func (n *Netbox) CreateAvailableIP(prefixID int64, body map[string]interface{}) (a *models.IPAddress, err error) {
+	unlock, err := n.call("CreateAvailableIP")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	var p *models.Prefix
+	for _, pr := range n.prefixes {
+		if pr.ID == prefixID {
+			p = pr
+		}
+	}
+	if p == nil {
+		return a, notFound("prefix", prefixID)
+	}
+	ip, ipNet, err := net.ParseCIDR(str(p.Prefix))
+	if err != nil {
+		return
+	}
+	ones, _ := ipNet.Mask.Size()
+	used := make(map[string]bool, len(n.ips))
+	for _, u := range n.ips {
+		used[strings.SplitN(str(u.Address), "/", 2)[0]] = true
+	}
+	ip = ip.Mask(ipNet.Mask).To4()
+	for next(ip); ipNet.Contains(ip); next(ip) {
+		if used[ip.String()] || !ipNet.Contains(nextIP(ip)) {
+			// skips used and broadcast addresses
+			continue
+		}
+		addr := fmt.Sprintf("%s/%d", ip.String(), ones)
+		a = &models.IPAddress{Address: &addr}
+		setIPAddress(a, body)
+		n.setID(&a.ID)
+		n.ips = append(n.ips, a)
+		return
+	}
+	return a, fmt.Errorf("no available ip in prefix %s", str(p.Prefix))
+}
+
+func (n *Netbox) Tags(slug string) (l []*models.Tag, err error) {
+	unlock, err := n.call("Tags")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, t := range n.tags {
+		if str(t.Slug) == slug {
+			l = append(l, t)
+		}
+	}
+	return
+}
+
+func (n *Netbox) CreateTag(name, slug string) (t *models.Tag, err error) {
+	unlock, err := n.call("CreateTag")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	t = &models.Tag{Name: &name, Slug: &slug}
+	n.setID(&t.ID)
+	n.tags = append(n.tags, t)
+	return
+}
+
+func (n *Netbox) CreateJournalEntry(data *models.WritableJournalEntry) (err error) {
+	unlock, err := n.call("CreateJournalEntry")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	n.setID(&data.ID)
+	n.journal = append(n.journal, data)
+	return
+}
+
+func (n *Netbox) InventoryItems(deviceID int64) (l []*models.InventoryItem, err error) {
+	unlock, err := n.call("InventoryItems")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, it := range n.items {
+		if it.Device != nil && it.Device.ID == deviceID {
+			l = append(l, it)
+		}
+	}
+	return
+}
+
+func (n *Netbox) CreateInventoryItem(data *models.WritableInventoryItem) (err error) {
+	unlock, err := n.call("CreateInventoryItem")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	it := &models.InventoryItem{}
+	n.setID(&it.ID)
+	n.setInventoryItem(it, data)
+	n.items = append(n.items, it)
+	return
+}
+
+func (n *Netbox) UpdateInventoryItem(id int64, data *models.WritableInventoryItem) (err error) {
+	unlock, err := n.call("UpdateInventoryItem")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, it := range n.items {
+		if it.ID == id {
+			n.setInventoryItem(it, data)
+			return
+		}
+	}
+	return notFound("inventory item", id)
+}
+
+func (n *Netbox) setInventoryItem(it *models.InventoryItem, data *models.WritableInventoryItem) {
+	it.Name = data.Name
+	it.Serial = data.Serial
+	it.PartID = data.PartID
+	it.Description = data.Description
+	if data.Device != nil {
+		it.Device = n.nestedDevice(*data.Device)
+	}
+}
+
+func (n *Netbox) InventoryItemRoles(slug string) (l []*models.InventoryItemRole, err error) {
+	unlock, err := n.call("InventoryItemRoles")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, r := range n.itemRoles {
+		if str(r.Slug) == slug {
+			l = append(l, r)
+		}
+	}
+	return
+}
+
+func (n *Netbox) Manufacturers(name string) (l []*models.Manufacturer, err error) {
+	unlock, err := n.call("Manufacturers")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, m := range n.manufacturers {
+		if str(m.Name) == name {
+			l = append(l, m)
+		}
+	}
+	return
+}
+
+func (n *Netbox) CreateManufacturer(name, slug string) (m *models.Manufacturer, err error) {
+	unlock, err := n.call("CreateManufacturer")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	m = &models.Manufacturer{Name: &name, Slug: &slug}
+	n.setID(&m.ID)
+	n.manufacturers = append(n.manufacturers, m)
+	return
+}
+
+func (n *Netbox) ModuleBays(deviceID int64) (l []*models.ModuleBay, err error) {
+	unlock, err := n.call("ModuleBays")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, b := range n.bays {
+		if b.Device != nil && b.Device.ID == deviceID {
+			l = append(l, b)
+		}
+	}
+	return
+}
+
+func (n *Netbox) Modules(moduleBayID int64) (l []*models.Module, err error) {
+	unlock, err := n.call("Modules")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, m := range n.modules {
+		if m.ModuleBay != nil && m.ModuleBay.ID == moduleBayID {
+			l = append(l, m)
+		}
+	}
+	return
+}
+
+func (n *Netbox) ModuleTypes(partNumber string) (l []*models.ModuleType, err error) {
+	unlock, err := n.call("ModuleTypes")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, t := range n.moduleTypes {
+		if t.PartNumber == partNumber {
+			l = append(l, t)
+		}
+	}
+	return
+}
+
+func (n *Netbox) CreateModule(data *models.WritableModule) (err error) {
+	unlock, err := n.call("CreateModule")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	m := &models.Module{}
+	n.setID(&m.ID)
+	n.setModule(m, data)
+	n.modules = append(n.modules, m)
+	return
+}
+
+func (n *Netbox) UpdateModule(id int64, data *models.WritableModule) (err error) {
+	unlock, err := n.call("UpdateModule")
+	defer unlock()
+	if err != nil {
+		return
+	}
+	for _, m := range n.modules {
+		if m.ID == id {
+			n.setModule(m, data)
+			return
+		}
+	}
+	return notFound("module", id)
+}
+
+func (n *Netbox) setModule(m *models.Module, data *models.WritableModule) {
+	m.Serial = data.Serial
+	m.Description = data.Description
+	if data.Device != nil {
+		m.Device = n.nestedDevice(*data.Device)
+	}
+	if data.ModuleBay != nil {
+		m.ModuleBay = &models.NestedModuleBay{ID: *data.ModuleBay}
+	}
+	if data.ModuleType != nil {
+		m.ModuleType = &models.NestedModuleType{ID: *data.ModuleType}
+	}
+}
+
+func (n *Netbox) ip(id int64) *models.IPAddress {
+	for _, a := range n.ips {
+		if a.ID == id {
+			return a
+		}
+	}
+	return nil
+}
+
+func (n *Netbox) nestedDevice(id int64) *models.NestedDevice {
+	for _, d := range n.devices {
+		if d.ID == id {
+			return &models.NestedDevice{ID: d.ID, Name: d.Name, Display: d.Display}
+		}
+	}
+	return &models.NestedDevice{ID: id}
+}
+
+func page(l []*models.DeviceWithConfigContext, limit, offset *int64) []*models.DeviceWithConfigContext {
+	if offset != nil {
+		if *offset >= int64(len(l)) {
+			return nil
+		}
+		l = l[*offset:]
+	}
+	if limit != nil && *limit > 0 && *limit < int64(len(l)) {
+		l = l[:*limit]
+	}
+	return l
+}
+
+func hasTag(tags []*models.NestedTag, slug string) bool {
+	for _, t := range tags {
+		if str(t.Slug) == slug {
+			return true
+		}
+	}
+	return false
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func match(f *string, v string) bool {
+	return f == nil || *f == v
+}
+
+func matchQ(q *string, v string) bool {
+	return q == nil || strings.Contains(strings.ToLower(v), strings.ToLower(*q))
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func toStr(v interface{}) *string {
+	switch s := v.(type) {
+	case string:
+		return &s
+	case *string:
+		return s
+	}
+	return nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+	case int64:
+		return i, true
+	case *int64:
+		if i != nil {
+			return *i, true
+		}
+	case int:
+		return int64(i), true
+	case float64:
+		return int64(i), true
+	}
+	return 0, false
+}
+
+func notFound(kind string, id int64) error {
+	return fmt.Errorf("%s %d not found", kind, id)
+}
+
+func next(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return
+		}
+	}
+}
+
+func nextIP(ip net.IP) net.IP {
+	n := append(net.IP{}, ip...)
+	next(n)
+	return n
+}
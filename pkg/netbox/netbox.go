@@ -17,15 +17,12 @@
 package netbox
 
 import (
-	"context"
 	"fmt"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
 
-	"github.com/netbox-community/go-netbox/v3/netbox/client/dcim"
-	"github.com/netbox-community/go-netbox/v3/netbox/client/ipam"
 	"github.com/netbox-community/go-netbox/v3/netbox/models"
 	"github.com/sapcc/baremetal_temper/pkg/clients"
 	"github.com/sapcc/baremetal_temper/pkg/config"
@@ -35,9 +32,13 @@ import (
 )
 
 type Netbox struct {
-	Data   *Data
+	Data *Data
+	// Source started the run: webhook, scheduler or empty, e.g. for cli runs
+	Source string
 	client *clients.Netbox
 	node   string
+	cfg    config.Config
+	flow   *config.StatusWorkflow
 	log    *log.Entry
 }
 
@@ -57,7 +58,9 @@ type NodeInterface struct {
 	ConnectionIP   string
 	Port           string
 	Mac            string
+	Type           string
 	PortLinkStatus redfish.PortLinkStatus
+	SpeedMbps      int
 	PortNumber     int
 	Nic            int
 }
@@ -67,14 +70,24 @@ func New(node string, cfg config.Config, ctxLogger *logrus.Entry) (*Netbox, erro
 	if err != nil {
 		return nil, err
 	}
-	return &Netbox{client: c, node: node, log: ctxLogger}, nil
+	return NewWithClient(node, cfg, c, ctxLogger), nil
+}
+
+// NewWithClient creates the netbox of the node using the client, e.g. backed by the mock netbox in tests
+func NewWithClient(node string, cfg config.Config, c *clients.Netbox, ctxLogger *logrus.Entry) *Netbox {
+	return &Netbox{client: c, node: node, cfg: cfg, log: ctxLogger}
+}
+
+// APICalls returns the number of netbox api requests made for the node
+func (n *Netbox) APICalls() int64 {
+	return n.client.Calls()
 }
 
 func (n *Netbox) GetData() (*Data, error) {
 	if n.Data != nil {
 		return n.Data, nil
 	}
-	d, err := n.getDeviceConfig(nil, &n.node)
+	d, err := n.getDeviceConfig(n.node)
 	n.Data = &Data{}
 	n.Data.Device = d
 	if err != nil {
@@ -98,17 +111,12 @@ func (n *Netbox) loadIpamAddresses(node string) (err error) {
 	}
 	block := strings.Split(node, "-")[1]
 	name := strings.Split(node, "-")[0]
-	var limit int64
-	limit = 200
-	al, err := n.client.Client.Ipam.IpamIPAddressesList(&ipam.IpamIPAddressesListParams{
-		Q:       &block,
-		Context: context.Background(),
-		Limit:   &limit,
-	}, nil)
+	addr, err := n.client.API.IPAddresses(clients.IPAddressFilter{
+		Q: &block,
+	})
 	if err != nil {
 		return
 	}
-	addr := al.Payload.Results
 	for _, a := range addr {
 		if strings.Contains(a.DNSName, node) {
 			ip, _, err := net.ParseCIDR(*a.Address)
@@ -133,45 +141,38 @@ func (n *Netbox) loadIpamAddresses(node string) (err error) {
 	return
 }
 
-func (n *Netbox) getDeviceConfig(id, name *string) (d *models.DeviceWithConfigContext, err error) {
-	param := dcim.DcimDevicesListParams{
-		Context: context.Background(),
-	}
-	if id != nil {
-		param.ID = id
-	} else {
-		param.Name = name
-	}
-	l, err := n.client.Client.Dcim.DcimDevicesList(&param, nil)
+func (n *Netbox) getDeviceConfig(name string) (d *models.DeviceWithConfigContext, err error) {
+	l, err := n.client.API.Devices(clients.DeviceFilter{
+		Name: &name,
+	})
 	if err != nil {
 		return
 	}
-	if len(l.Payload.Results) == 0 {
+	if len(l) == 0 {
 		return d, fmt.Errorf("no device found")
 	}
-	return l.Payload.Results[0], err
+	return l[0], err
 }
 
 // Update node serial and primaryIP. Does not return error to not trigger errorhandler and cleanup of node
 func (n *Netbox) Update(serialNumber string) error {
 	n.Data.Device.Serial = serialNumber
-	params := models.WritableDeviceWithConfigContext{
-		Serial: serialNumber,
+	params := map[string]interface{}{
+		"serial": serialNumber,
 	}
 	if n.Data.PrimaryIP == "" {
-		ips, err := n.client.Client.Ipam.IpamIPAddressesList(&ipam.IpamIPAddressesListParams{
+		ips, err := n.client.API.IPAddresses(clients.IPAddressFilter{
 			Address: &n.Data.PrimaryIP,
-			Context: context.Background(),
-		}, nil)
+		})
 		if err != nil {
 			n.log.Error(err)
 			return nil
 		}
-		if len(ips.Payload.Results) > 1 || len(ips.Payload.Results) == 0 {
+		if len(ips) > 1 || len(ips) == 0 {
 			n.log.Error("could not find primary ip")
 			return nil
 		}
-		params.PrimaryIp4 = &ips.Payload.Results[0].ID
+		params["primary_ip4"] = ips[0].ID
 	}
 
 	_, err := n.updateNodeInfo(params)
@@ -188,48 +189,6 @@ func (n *Netbox) Update(serialNumber string) error {
 	return nil
 }
 
-// SetStatus does not return error to not trigger errorhandler and cleanup of node
-func (n *Netbox) SetStatus(status string) (err error) {
-	if status == "failed" {
-		err = n.setStatusFailed()
-	} else {
-		err = n.setStatusStaged()
-	}
-	return
-}
-
-// SetStatusStaged does not return error to not trigger errorhandler and cleanup of node
-func (n *Netbox) setStatusStaged() error {
-	p, err := n.updateNodeInfo(models.WritableDeviceWithConfigContext{
-		Status:   models.DeviceWithConfigContextStatusValueStaged,
-		Comments: "temper successful",
-	})
-	if err != nil {
-		n.log.Error(err)
-		return nil
-	}
-	if *p.Payload.Status.Value != models.DeviceWithConfigContextStatusValueStaged {
-		n.log.Errorf("cannot update node status in netbox")
-	}
-	return nil
-}
-
-// SetStatusFailed sets status to failed in netbox
-func (n *Netbox) setStatusFailed() (err error) {
-	p, err := n.updateNodeInfo(models.WritableDeviceWithConfigContext{
-		Status:   models.DeviceWithConfigContextStatusValueFailed,
-		Comments: "temper failed: check config context",
-	})
-	if err != nil {
-		n.log.Error(err)
-		return nil
-	}
-	if *p.Payload.Status.Value != models.DeviceWithConfigContextStatusValueFailed {
-		return fmt.Errorf("cannot update node status in netbox")
-	}
-	return
-}
-
 // LoadInterfaces loads additional node interface info
 func (n *Netbox) loadInterfaces() (err error) {
 	n.log.Debug("calling netbox api to load node interfaces")
@@ -238,12 +197,10 @@ func (n *Netbox) loadInterfaces() (err error) {
 	if err != nil {
 		return
 	}
+	connected := make([]*models.Interface, 0)
+	switchIDs := make([]int64, 0)
+	seen := make(map[int64]bool)
 	for _, in := range intfs {
-		var (
-			ip net.IP
-			//devices []map[string]interface{}
-			conn map[string]interface{}
-		)
 		if !strings.Contains(*in.Name, "PCI") &&
 			!strings.Contains(*in.Name, "NIC") &&
 			!strings.Contains(*in.Name, "L") ||
@@ -251,16 +208,25 @@ func (n *Netbox) loadInterfaces() (err error) {
 			continue
 		}
 		//json.Unmarshal([]byte(*in.ConnectedEndpoints[0]), &devices)
-		if len(in.ConnectedEndpoints) == 0 {
+		if len(in.ConnectedEndpoints) == 0 || in.ConnectedEndpoints[0].Device == nil {
 			continue
 		}
-		d := in.ConnectedEndpoints[0].Device
-		if d == nil {
-			continue
+		connected = append(connected, in)
+		id := int64(in.ConnectedEndpoints[0].Device.ID)
+		if !seen[id] {
+			seen[id] = true
+			switchIDs = append(switchIDs, id)
 		}
-		ip, err = n.getInterfaceIP(fmt.Sprintf("%v", d.ID))
-		if err != nil {
-			n.log.Error(err)
+	}
+	switchIPs, err := n.getSwitchIPs(switchIDs)
+	if err != nil {
+		return
+	}
+	for _, in := range connected {
+		d := in.ConnectedEndpoints[0].Device
+		ip, ok := switchIPs[int64(d.ID)]
+		if !ok {
+			n.log.Errorf("no ip available for switch %d", d.ID)
 			continue
 		}
 		nic, port := n.getNicPort(*in.Name, intfs)
@@ -268,27 +234,29 @@ func (n *Netbox) loadInterfaces() (err error) {
 		intf := NodeInterface{}
 		intf.Nic = nic
 		intf.PortNumber = port
-		if ip != nil {
-			intf.Connection = fmt.Sprintf("%v", d.Name)
-			intf.ConnectionIP = ip.String()
-			intf.Port = fmt.Sprintf("%v", conn["name"])
-		}
+		intf.Connection = fmt.Sprintf("%v", d.Name)
+		intf.Port = in.ConnectedEndpoints[0].Name
+		intf.ConnectionIP = ip.String()
 		intf.Name = *in.Name
+		if in.Type != nil && in.Type.Value != nil {
+			intf.Type = *in.Type.Value
+		}
 		n.Data.Interfaces = append(n.Data.Interfaces, intf)
 	}
 	return
 }
 
-func (n *Netbox) updateNodeInfo(data models.WritableDeviceWithConfigContext) (p *dcim.DcimDevicesPartialUpdateOK, err error) {
-	data.DeviceType = &n.Data.Device.DeviceType.ID
-	data.DeviceRole = &n.Data.Device.DeviceRole.ID
-	data.Site = &n.Data.Device.Site.ID
-	p, err = n.client.Client.Dcim.DcimDevicesPartialUpdate(&dcim.DcimDevicesPartialUpdateParams{
-		ID:      n.Data.Device.ID,
-		Data:    &data,
-		Context: context.Background(),
-	}, nil)
+// updateNodeInfo partially updates the device with the fields of body
+func (n *Netbox) updateNodeInfo(body map[string]interface{}) (d *models.DeviceWithConfigContext, err error) {
+	body["device_type"] = n.Data.Device.DeviceType.ID
+	body["device_role"] = n.Data.Device.DeviceRole.ID
+	body["site"] = n.Data.Device.Site.ID
+	return n.client.API.UpdateDevice(n.Data.Device.ID, body)
+}
 
+// SetCustomFields updates the custom fields of the device, its other custom fields are kept
+func (n *Netbox) SetCustomFields(fields map[string]interface{}) (err error) {
+	_, err = n.client.API.UpdateDevice(n.Data.Device.ID, map[string]interface{}{"custom_fields": fields})
 	return
 }
 
@@ -300,63 +268,83 @@ func (n *Netbox) updateNodeInterfaces() (err error) {
 	for _, in := range intf {
 		for _, nIntf := range n.Data.Interfaces {
 			if nIntf.Name == *in.Name {
-				_, err = n.client.Client.Dcim.DcimInterfacesUpdate(&dcim.DcimInterfacesUpdateParams{
-					ID: in.ID,
-					Data: &models.WritableInterface{
-						WirelessLans: []int64{},
-						Vdcs:         []int64{},
-						Description:  nIntf.RedfishName,
-						MacAddress:   &nIntf.Mac,
-						Name:         in.Name,
-						Type:         in.Type.Value,
-						TaggedVlans:  []int64{},
-						Device:       &in.Device.ID,
-					},
-					Context: context.Background(),
-				}, nil)
+				_, err = n.client.API.UpdateInterface(in.ID, &models.WritableInterface{
+					WirelessLans: []int64{},
+					Vdcs:         []int64{},
+					Description:  nIntf.RedfishName,
+					MacAddress:   &nIntf.Mac,
+					Name:         in.Name,
+					Type:         in.Type.Value,
+					TaggedVlans:  []int64{},
+					Device:       &in.Device.ID,
+				})
 			}
 		}
 	}
 	return
 }
 
+// GetInterfaceMacs returns the mac addresses stored in netbox by interface name
+func (n *Netbox) GetInterfaceMacs() (macs map[string]string, err error) {
+	macs = make(map[string]string)
+	intfs, err := n.getInterfaces()
+	if err != nil {
+		return
+	}
+	for _, in := range intfs {
+		if in.MacAddress != nil && *in.MacAddress != "" {
+			macs[*in.Name] = *in.MacAddress
+		}
+	}
+	return
+}
+
 func (n *Netbox) getInterfaces() (in []*models.Interface, err error) {
-	l, err := n.client.Client.Dcim.DcimInterfacesList(&dcim.DcimInterfacesListParams{
-		Device:  &n.Data.Device.Display,
-		Context: context.Background(),
-	}, nil)
+	in, err = n.client.API.Interfaces(n.Data.Device.Display)
 	if err != nil {
 		return
 	}
-	in = l.Payload.Results
 	if len(in) == 0 {
 		return in, fmt.Errorf("could not find interfaces for node with name %s", n.Data.Device.Display)
 	}
 	return
 }
 
-func (n *Netbox) getInterfaceIP(id string) (ip net.IP, err error) {
-	d, err := n.getDeviceConfig(&id, nil)
-	if d.PrimaryIp4 == nil {
-		return ip, fmt.Errorf("no ip available for switch %s", id)
+// getSwitchIPs returns the primary ips of the switches by id, fetched in one query. Switches without primary ip are missing
+func (n *Netbox) getSwitchIPs(ids []int64) (ips map[int64]net.IP, err error) {
+	ips = make(map[int64]net.IP)
+	if len(ids) == 0 {
+		return
+	}
+	l, err := n.client.API.Devices(clients.DeviceFilter{
+		IDs: ids,
+	})
+	if err != nil {
+		return
+	}
+	for _, d := range l {
+		if d.PrimaryIp4 == nil {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(*d.PrimaryIp4.Address)
+		if err != nil {
+			return ips, err
+		}
+		ips[d.ID] = ip
 	}
-	ip, _, err = net.ParseCIDR(*d.PrimaryIp4.Address)
 	return
 }
 
 func (n *Netbox) GetAvailabilityZone(block string) (az string, err error) {
 	q := block + "-01"
-	d, err := n.client.Client.Dcim.DcimRacksList(&dcim.DcimRacksListParams{
-		Q:       &q,
-		Context: context.Background(),
-	}, nil)
+	d, err := n.client.API.Racks(q)
 	if err != nil {
 		return
 	}
-	if len(d.Payload.Results) != 1 {
+	if len(d) != 1 {
 		return az, fmt.Errorf("error finding az: could not get rack list")
 	}
-	az = *d.Payload.Results[0].Site.Slug
+	az = *d[0].Site.Slug
 	return
 }
 
@@ -0,0 +1,288 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/netbox/mock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testNode = "node001-bb091"
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// newTestNetbox seeds the mock with the node, its primary and management interfaces and a server and bmc prefix
+func newTestNetbox(t *testing.T) (*Netbox, *mock.Netbox) {
+	api := mock.New("3.6.0")
+	site := &models.NestedSite{ID: 1, Slug: strPtr("qa-de-1a")}
+	dev := &models.DeviceWithConfigContext{
+		Name:       strPtr(testNode),
+		Display:    testNode,
+		DeviceRole: &models.NestedDeviceRole{ID: 2, Slug: strPtr("server")},
+		DeviceType: &models.NestedDeviceType{ID: 3},
+		Site:       site,
+		Rack:       &models.NestedRack{ID: 4, Name: strPtr("bb091-01")},
+	}
+	api.Add(dev)
+	nd := &models.NestedDevice{ID: dev.ID, Name: dev.Name, Display: testNode}
+	api.Add(
+		&models.Interface{Device: nd, Name: strPtr("L1")},
+		&models.Interface{Device: nd, Name: strPtr("iDRAC"), MgmtOnly: true},
+		// the rack prefix is preferred over the other prefix of the site
+		&models.Prefix{Prefix: strPtr("10.0.1.0/29"), Role: &models.NestedRole{Slug: strPtr("server")}, Site: site},
+		&models.Prefix{Prefix: strPtr("10.0.0.0/29"), Role: &models.NestedRole{Slug: strPtr("server")}, Site: site,
+			Tags: []*models.NestedTag{{Slug: strPtr("rack-bb091-01")}}},
+		&models.Prefix{Prefix: strPtr("10.1.0.0/29"), Role: &models.NestedRole{Slug: strPtr("bmc")}, Site: site},
+	)
+	cfg := config.Config{
+		Domain: "cc.qa-de-1.cloud.sap",
+		Ipam:   config.Ipam{BmcRole: "bmc", PrimaryInterface: "L1", RackTag: "rack-%s"},
+	}
+	l := log.WithField("node", testNode)
+	n := NewWithClient(testNode, cfg, clients.NewNetboxWithAPI(api, l), l)
+	_, err := n.GetData()
+	assert.NoError(t, err)
+	return n, api
+}
+
+func TestAllocateAddresses(t *testing.T) {
+	n, api := newTestNetbox(t)
+	assert.NoError(t, n.AllocateAddresses())
+	assert.Equal(t, "10.0.0.1", n.Data.PrimaryIP)
+	assert.Equal(t, "10.1.0.1", n.Data.RemoteIP)
+	assert.Equal(t, "node001r-bb091.cc.qa-de-1.cloud.sap", n.Data.DNSName)
+	assert.Equal(t, "10.0.0.1/29", *n.Data.Device.PrimaryIp4.Address)
+
+	// a rerun reuses the addresses
+	assert.NoError(t, n.AllocateAddresses())
+	ips, err := api.IPAddresses(clients.IPAddressFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.Equal(t, "10.0.0.1", n.Data.PrimaryIP)
+}
+
+func TestAllocateAddressesRollback(t *testing.T) {
+	n, api := newTestNetbox(t)
+	api.Errors["UpdateDevice"] = fmt.Errorf("netbox unavailable")
+	assert.Error(t, n.AllocateAddresses())
+	ips, err := api.IPAddresses(clients.IPAddressFilter{})
+	assert.NoError(t, err)
+	assert.Empty(t, ips)
+	assert.Nil(t, n.Data.Device.PrimaryIp4)
+}
+
+func TestAllocateAddressesAssigned(t *testing.T) {
+	n, api := newTestNetbox(t)
+	other := int64(999)
+	api.Add(&models.IPAddress{Address: strPtr("10.0.0.5/29"), DNSName: "node001-bb091.cc.qa-de-1.cloud.sap",
+		AssignedObjectType: strPtr(interfaceType), AssignedObjectID: &other})
+	assert.EqualError(t, n.AllocateAddresses(), "cannot allocate primary address: address 10.0.0.5/29 with dns name node001-bb091.cc.qa-de-1.cloud.sap is assigned to another device")
+	ips, err := api.IPAddresses(clients.IPAddressFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, ips, 1)
+	assert.Equal(t, other, *ips[0].AssignedObjectID)
+}
+
+func TestNetboxV4(t *testing.T) {
+	var updated map[string]interface{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api/status/":
+			fmt.Fprint(w, `{"netbox-version": "4.1.0"}`)
+		case r.URL.Path == "/api/dcim/devices/":
+			fmt.Fprintf(w, `{"count": 1, "results": [{"id": 7, "name": "%s", "display": "%s", "role": {"id": 2, "slug": "server"},
+				"device_type": {"id": 3}, "site": {"id": 1, "slug": "qa-de-1a"}}]}`, testNode, testNode)
+		case r.URL.Path == "/api/dcim/devices/7/" && r.Method == http.MethodPatch:
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&updated))
+			fmt.Fprintf(w, `{"id": 7, "name": "%s", "serial": "abc123", "role": {"id": 2, "slug": "server"}}`, testNode)
+		default:
+			fmt.Fprint(w, `{"count": 0, "results": []}`)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.Config{Netbox: config.NetboxAuth{Host: strings.TrimPrefix(srv.URL, "https://")}}
+	n, err := New(testNode, cfg, log.WithField("node", testNode))
+	assert.NoError(t, err)
+	assert.Equal(t, "4.1.0", n.client.API.Version())
+	d, err := n.GetData()
+	assert.NoError(t, err)
+	assert.Equal(t, "server", *d.Device.DeviceRole.Slug)
+
+	_, err = n.updateNodeInfo(map[string]interface{}{"serial": "abc123"})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), updated["role"])
+	assert.NotContains(t, updated, "device_role")
+}
+
+func TestNetboxV4Interfaces(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		macs    bool
+	}{
+		{version: "4.1.0"},
+		{version: "4.2.1", macs: true},
+	} {
+		var update, primary, mac map[string]interface{}
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.URL.Path == "/api/status/":
+				fmt.Fprintf(w, `{"netbox-version": "%s"}`, tc.version)
+			case r.URL.Path == "/api/dcim/devices/":
+				fmt.Fprintf(w, `{"count": 1, "results": [{"id": 7, "name": "%s", "display": "%s", "role": {"id": 2, "slug": "server"}}]}`, testNode, testNode)
+			case r.URL.Path == "/api/dcim/interfaces/":
+				fmt.Fprintf(w, `{"count": 1, "results": [{"id": 5, "name": "L1", "device": {"id": 7, "name": "%s"}, "type": {"value": "1000base-t"}}]}`, testNode)
+			case r.URL.Path == "/api/dcim/interfaces/5/" && r.Method == http.MethodPut:
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&update))
+				fmt.Fprint(w, `{"id": 5, "name": "L1"}`)
+			case r.URL.Path == "/api/dcim/interfaces/5/" && r.Method == http.MethodPatch:
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&primary))
+				fmt.Fprint(w, `{"id": 5, "name": "L1"}`)
+			case r.URL.Path == "/api/dcim/mac-addresses/" && r.Method == http.MethodPost:
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&mac))
+				fmt.Fprint(w, `{"id": 9}`)
+			default:
+				fmt.Fprint(w, `{"count": 0, "results": []}`)
+			}
+		}))
+
+		cfg := config.Config{Netbox: config.NetboxAuth{Host: strings.TrimPrefix(srv.URL, "https://")}}
+		n, err := New(testNode, cfg, log.WithField("node", testNode))
+		assert.NoError(t, err, tc.version)
+		_, err = n.GetData()
+		assert.NoError(t, err, tc.version)
+		n.Data.Interfaces = []NodeInterface{{Name: "L1", Mac: "AA:BB:CC:DD:EE:FF"}}
+		assert.NoError(t, n.updateNodeInterfaces(), tc.version)
+		if tc.macs {
+			assert.NotContains(t, update, "mac_address", tc.version)
+			assert.Equal(t, map[string]interface{}{"mac_address": "AA:BB:CC:DD:EE:FF", "assigned_object_type": "dcim.interface", "assigned_object_id": float64(5)}, mac)
+			assert.Equal(t, map[string]interface{}{"primary_mac_address": float64(9)}, primary)
+		} else {
+			assert.Equal(t, "AA:BB:CC:DD:EE:FF", update["mac_address"], tc.version)
+			assert.Nil(t, mac, tc.version)
+			assert.Nil(t, primary, tc.version)
+		}
+		srv.Close()
+	}
+}
+
+func TestNetboxVersionProbeFailed(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	cfg := config.Config{Netbox: config.NetboxAuth{Host: strings.TrimPrefix(srv.URL, "https://")}}
+	_, err := New(testNode, cfg, log.WithField("node", testNode))
+	assert.EqualError(t, err, "cannot probe netbox version, set netbox.version: status api returned 503 Service Unavailable")
+}
+
+func TestLoadInterfacesCached(t *testing.T) {
+	api := mock.New("3.6.0")
+	cached := clients.NewNetboxCache(api, time.Minute)
+	var switches []*models.DeviceWithConfigContext
+	for i := 1; i <= 2; i++ {
+		sw := &models.DeviceWithConfigContext{
+			Name:       strPtr(fmt.Sprintf("sw%d-bb091", i)),
+			PrimaryIp4: &models.NestedIPAddress{Address: strPtr(fmt.Sprintf("10.2.0.%d/24", i))},
+		}
+		api.Add(sw)
+		switches = append(switches, sw)
+	}
+	api.Add(&models.Rack{Name: strPtr("bb091-01"), Site: &models.NestedSite{Slug: strPtr("qa-de-1a")}})
+	nodes := []string{"node001-bb091", "node002-bb091"}
+	for _, node := range nodes {
+		dev := &models.DeviceWithConfigContext{Name: strPtr(node), Display: node}
+		api.Add(dev)
+		nd := &models.NestedDevice{ID: dev.ID, Name: dev.Name, Display: node}
+		for i := 1; i <= 24; i++ {
+			sw := switches[i%2]
+			api.Add(&models.Interface{Device: nd, Name: strPtr(fmt.Sprintf("PCI%d-P%d", i/2+1, i%2+1)),
+				ConnectedEndpoints: []*models.ConnectedEndpoint{{
+					Device: &models.ConnectedEndpointDevice{ID: int(sw.ID), Name: *sw.Name},
+					Name:   fmt.Sprintf("Ethernet1/%d", i),
+				}},
+			})
+		}
+	}
+
+	for _, node := range nodes {
+		l := log.WithField("node", node)
+		n := NewWithClient(node, config.Config{}, clients.NewNetboxWithAPI(cached, l), l)
+		d, err := n.GetData()
+		assert.NoError(t, err)
+		assert.Len(t, d.Interfaces, 24)
+		assert.Equal(t, "10.2.0.1", d.Interfaces[1].ConnectionIP)
+		assert.Equal(t, "10.2.0.2", d.Interfaces[0].ConnectionIP)
+		az, err := n.GetAvailabilityZone("bb091")
+		assert.NoError(t, err)
+		assert.Equal(t, "qa-de-1a", az)
+	}
+	// one device query per node and one for the switches of both nodes
+	assert.Equal(t, 3, api.Calls("Devices"))
+	assert.Equal(t, 1, api.Calls("Racks"))
+}
+
+// deviceQueries records the ids of the device queries
+type deviceQueries struct {
+	*mock.Netbox
+	ids [][]int64
+}
+
+func (d *deviceQueries) Devices(f clients.DeviceFilter) ([]*models.DeviceWithConfigContext, error) {
+	if len(f.IDs) > 0 {
+		d.ids = append(d.ids, f.IDs)
+	}
+	return d.Netbox.Devices(f)
+}
+
+func TestLoadInterfacesSwitchIDs(t *testing.T) {
+	api := &deviceQueries{Netbox: mock.New("3.6.0")}
+	sw := &models.DeviceWithConfigContext{Name: strPtr("sw1-bb091"), PrimaryIp4: &models.NestedIPAddress{Address: strPtr("10.2.0.1/24")}}
+	dev := &models.DeviceWithConfigContext{Name: strPtr(testNode), Display: testNode}
+	api.Add(sw, dev)
+	nd := &models.NestedDevice{ID: dev.ID, Name: dev.Name, Display: testNode}
+	for i := 1; i <= 4; i++ {
+		api.Add(&models.Interface{Device: nd, Name: strPtr(fmt.Sprintf("NIC1-port%d", i)),
+			ConnectedEndpoints: []*models.ConnectedEndpoint{{
+				Device: &models.ConnectedEndpointDevice{ID: int(sw.ID), Name: *sw.Name},
+				Name:   fmt.Sprintf("Ethernet1/%d", i),
+			}},
+		})
+	}
+	l := log.WithField("node", testNode)
+	n := NewWithClient(testNode, config.Config{}, clients.NewNetboxWithAPI(api, l), l)
+	d, err := n.GetData()
+	assert.NoError(t, err)
+	assert.Len(t, d.Interfaces, 4)
+	assert.Equal(t, [][]int64{{sw.ID}}, api.ids)
+}
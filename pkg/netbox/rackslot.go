@@ -0,0 +1,155 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// poll interval of AcquireRackSlot. Tests shorten it
+var rackSlotPollInterval = 30 * time.Second
+
+// rackSlot is the value of the diagnostics.rackSlotField custom field of a device holding a rack slot
+type rackSlot struct {
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+type rackSlotHolder struct {
+	id   int64
+	slot rackSlot
+}
+
+// AcquireRackSlot waits until less than max devices of the node's rack hold a slot and takes one, e.g. to keep the
+// extended diagnostics of a rack within its power budget. The slots are the diagnostics.rackSlotField custom field
+// of the devices, so all temper processes share them. Of concurrently taken slots, the earliest max are kept.
+// A slot expires after ttl in case its run did not release it. A timeout of 0 waits without limit. release frees the slot
+func (n *Netbox) AcquireRackSlot(max int, ttl, timeout time.Duration) (release func(), err error) {
+	release = func() {}
+	if n.Data.Device.Rack == nil {
+		return release, fmt.Errorf("node has no rack")
+	}
+	field := n.cfg.Diagnostics.RackSlotField
+	take := func() (bool, error) {
+		hs, err := n.rackSlotHolders(field)
+		if err != nil {
+			n.log.Debugf("cannot load rack slots: %s", err.Error())
+			return false, nil
+		}
+		others := 0
+		for _, h := range hs {
+			if h.id != n.Data.Device.ID {
+				others++
+			}
+		}
+		if others >= max {
+			return false, nil
+		}
+		now := time.Now()
+		if err = n.setRackSlot(field, &rackSlot{Acquired: now, Expires: now.Add(ttl)}); err != nil {
+			return false, err
+		}
+		if hs, err = n.rackSlotHolders(field); err == nil {
+			for i := 0; i < len(hs) && i < max; i++ {
+				if hs[i].id == n.Data.Device.ID {
+					return true, nil
+				}
+			}
+		}
+		return false, n.setRackSlot(field, nil)
+	}
+	ok, err := take()
+	if err != nil {
+		return release, fmt.Errorf("cannot take slot in rack %s: %s", *n.Data.Device.Rack.Name, err.Error())
+	}
+	if !ok {
+		cf := wait.ConditionFunc(take)
+		if timeout == 0 {
+			err = wait.PollInfinite(rackSlotPollInterval, cf)
+		} else {
+			err = wait.Poll(rackSlotPollInterval, timeout, cf)
+		}
+		if err != nil {
+			return release, fmt.Errorf("no free slot in rack %s (max %d): %s", *n.Data.Device.Rack.Name, max, err.Error())
+		}
+	}
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			if err := n.setRackSlot(field, nil); err != nil {
+				n.log.Errorf("cannot release slot in rack %s: %s", *n.Data.Device.Rack.Name, err.Error())
+			}
+		})
+	}
+	return
+}
+
+// rackSlotHolders returns the devices of the rack holding an unexpired slot, ordered by the time the slots were taken
+func (n *Netbox) rackSlotHolders(field string) (hs []rackSlotHolder, err error) {
+	rackID := n.Data.Device.Rack.ID
+	l, err := n.client.API.Devices(clients.DeviceFilter{RackID: &rackID})
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, d := range l {
+		cf, _ := d.CustomFields.(map[string]interface{})
+		s, ok := parseRackSlot(cf[field])
+		if !ok || s.Expires.Before(now) {
+			continue
+		}
+		hs = append(hs, rackSlotHolder{id: d.ID, slot: s})
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		if hs[i].slot.Acquired.Equal(hs[j].slot.Acquired) {
+			return hs[i].id < hs[j].id
+		}
+		return hs[i].slot.Acquired.Before(hs[j].slot.Acquired)
+	})
+	return
+}
+
+func (n *Netbox) setRackSlot(field string, s *rackSlot) (err error) {
+	var v interface{}
+	if s != nil {
+		v = s
+	}
+	return n.SetCustomFields(map[string]interface{}{field: v})
+}
+
+// parseRackSlot reads the custom field, which is a json or a text field
+func parseRackSlot(v interface{}) (s rackSlot, ok bool) {
+	if v == nil {
+		return
+	}
+	b, isText := v.(string)
+	raw := []byte(b)
+	if !isText {
+		var err error
+		if raw, err = json.Marshal(v); err != nil {
+			return
+		}
+	}
+	return s, json.Unmarshal(raw, &s) == nil && !s.Acquired.IsZero()
+}
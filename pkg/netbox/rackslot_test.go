@@ -0,0 +1,105 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/netbox/mock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRackNodes seeds the nodes in one rack, each with its own netbox client like the runs of different temper processes
+func newRackNodes(t *testing.T, api *mock.Netbox, count int) (ns []*Netbox) {
+	interval := rackSlotPollInterval
+	rackSlotPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { rackSlotPollInterval = interval })
+	cfg := config.Config{Diagnostics: config.Diagnostics{RackSlotField: "temper_rack_slot"}}
+	for i := 1; i <= count; i++ {
+		name := fmt.Sprintf("node%03d-bb091", i)
+		api.Add(&models.DeviceWithConfigContext{Name: strPtr(name), Display: name, Rack: &models.NestedRack{ID: 4, Name: strPtr("bb091-01")}})
+		l := log.WithField("node", name)
+		n := NewWithClient(name, cfg, clients.NewNetboxWithAPI(api, l), l)
+		_, err := n.GetData()
+		assert.NoError(t, err)
+		ns = append(ns, n)
+	}
+	return
+}
+
+func heldSlot(t *testing.T, n *Netbox) interface{} {
+	d, err := n.client.API.Devices(clients.DeviceFilter{Name: &n.Data.Device.Display})
+	assert.NoError(t, err)
+	cf, _ := d[0].CustomFields.(map[string]interface{})
+	return cf["temper_rack_slot"]
+}
+
+func setSlot(t *testing.T, n *Netbox, s rackSlot) {
+	assert.NoError(t, n.setRackSlot("temper_rack_slot", &s))
+}
+
+func TestRackSlots(t *testing.T) {
+	api := mock.New("3.6.0")
+	ns := newRackNodes(t, api, 3)
+	r1, err := ns[0].AcquireRackSlot(1, time.Hour, time.Second)
+	assert.NoError(t, err)
+	_, err = ns[1].AcquireRackSlot(1, time.Hour, 50*time.Millisecond)
+	assert.EqualError(t, err, "no free slot in rack bb091-01 (max 1): timed out waiting for the condition")
+	// the waiting node did not keep a slot
+	assert.Nil(t, heldSlot(t, ns[1]))
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		r1()
+		r1()
+	}()
+	r2, err := ns[1].AcquireRackSlot(1, time.Hour, time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, heldSlot(t, ns[0]))
+	assert.NotNil(t, heldSlot(t, ns[1]))
+	r2()
+}
+
+func TestRackSlotsExpired(t *testing.T) {
+	api := mock.New("3.6.0")
+	ns := newRackNodes(t, api, 2)
+	// the slot of a run that did not release it
+	expired := rackSlot{Acquired: time.Now().Add(-2 * time.Hour), Expires: time.Now().Add(-time.Hour)}
+	setSlot(t, ns[0], expired)
+	r, err := ns[1].AcquireRackSlot(1, time.Hour, 50*time.Millisecond)
+	assert.NoError(t, err)
+	r()
+}
+
+func TestRackSlotsConcurrent(t *testing.T) {
+	api := mock.New("3.6.0")
+	ns := newRackNodes(t, api, 3)
+	// the slots taken at once are decided by the time taken: the later one is given back
+	earlier := rackSlot{Acquired: time.Now().Add(-time.Second), Expires: time.Now().Add(time.Hour)}
+	setSlot(t, ns[2], earlier)
+	r, err := ns[0].AcquireRackSlot(2, time.Hour, time.Second)
+	assert.NoError(t, err)
+	defer r()
+	_, err = ns[1].AcquireRackSlot(2, time.Hour, 50*time.Millisecond)
+	assert.Error(t, err)
+}
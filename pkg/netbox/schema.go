@@ -0,0 +1,199 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ContextVersion is the latest version of the baremetal.temper config context schema
+const ContextVersion = 1
+
+const contextPath = "baremetal.temper"
+
+//go:embed schema/*.json
+var schemaFiles embed.FS
+
+// ContextError is a violation of the config context schema at Path, e.g. baremetal.temper.tasks[1].service
+type ContextError struct {
+	Path string
+	Msg  string
+}
+
+func (e ContextError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ContextErrors are all violations of a config context
+type ContextErrors []ContextError
+
+func (e ContextErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ce := range e {
+		msgs[i] = ce.Error()
+	}
+	return "invalid config context: " + strings.Join(msgs, "; ")
+}
+
+// schema is the subset of json schema (draft-04) the config context schemas use
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Enum                 []interface{}      `json:"enum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinLength            int                `json:"minLength"`
+	Minimum              *float64           `json:"minimum"`
+	Pattern              string             `json:"pattern"`
+	Definitions          map[string]*schema `json:"definitions"`
+}
+
+// loadSchema loads the config context schema of version v
+func loadSchema(v int) (s *schema, err error) {
+	b, err := schemaFiles.ReadFile(fmt.Sprintf("schema/temper.v%d.json", v))
+	if err != nil {
+		return s, fmt.Errorf("unsupported config context version %d", v)
+	}
+	s = new(schema)
+	if err = json.Unmarshal(b, s); err != nil {
+		return s, fmt.Errorf("invalid config context schema v%d: %s", v, err.Error())
+	}
+	return
+}
+
+// validateContext validates the baremetal.temper config context against the schema of its version.
+// Contexts without version are validated against version 1
+func validateContext(temper interface{}) (err error) {
+	v := 1
+	if m, ok := temper.(map[string]interface{}); ok {
+		if f, ok := m["version"].(float64); ok && f == math.Trunc(f) {
+			v = int(f)
+		}
+	}
+	s, err := loadSchema(v)
+	if err != nil {
+		return ContextErrors{{Path: contextPath + ".version", Msg: err.Error()}}
+	}
+	if errs := s.validate(s, contextPath, temper); len(errs) > 0 {
+		return errs
+	}
+	return
+}
+
+func (s *schema) validate(root *schema, path string, v interface{}) (errs ContextErrors) {
+	if s.Ref != "" {
+		d, ok := root.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+		if !ok {
+			return ContextErrors{{Path: path, Msg: "unknown schema reference " + s.Ref}}
+		}
+		return d.validate(root, path, v)
+	}
+	if s.Type != "" && !isType(s.Type, v) {
+		return ContextErrors{{Path: path, Msg: fmt.Sprintf("must be of type %s", s.Type)}}
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		opts := make([]string, len(s.Enum))
+		for i, e := range s.Enum {
+			opts[i] = fmt.Sprint(e)
+		}
+		errs = append(errs, ContextError{Path: path, Msg: "must be one of " + strings.Join(opts, ", ")})
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := val[r]; !ok {
+				errs = append(errs, ContextError{Path: path + "." + r, Msg: "is required"})
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					errs = append(errs, ContextError{Path: path + "." + k, Msg: "unknown property"})
+				}
+				continue
+			}
+			errs = append(errs, p.validate(root, path+"."+k, val[k])...)
+		}
+	case []interface{}:
+		if s.Items == nil {
+			break
+		}
+		for i, item := range val {
+			errs = append(errs, s.Items.validate(root, fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+	case string:
+		if len(val) < s.MinLength {
+			errs = append(errs, ContextError{Path: path, Msg: "must not be empty"})
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(val) {
+			errs = append(errs, ContextError{Path: path, Msg: fmt.Sprintf("must match %s", s.Pattern)})
+		}
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			errs = append(errs, ContextError{Path: path, Msg: fmt.Sprintf("must be at least %v", *s.Minimum)})
+		}
+	}
+	return
+}
+
+func isType(t string, v interface{}) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return true
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
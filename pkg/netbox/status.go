@@ -0,0 +1,175 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+)
+
+// fallback workflow of devices whose status is no trigger, e.g. cli runs
+var defaultWorkflow = config.StatusWorkflow{Name: "default", Success: "staged", Failed: "failed"}
+
+// Workflow returns the status workflow named by the temper config context or else the one whose trigger is the
+// status of the device when first called and whose source is the Source of the run. Runs without Source match all sources
+func (n *Netbox) Workflow() (w config.StatusWorkflow, err error) {
+	if n.flow != nil {
+		return *n.flow, nil
+	}
+	d, err := n.GetData()
+	if err != nil {
+		return
+	}
+	tc, err := ParseTemperContext(d.Device.ConfigContext, n.cfg, nil)
+	if err != nil && err != ErrNoTemperContext {
+		return
+	}
+	err = nil
+	w = defaultWorkflow
+	for _, f := range n.cfg.Status.GetWorkflows() {
+		if tc.Workflow != "" && f.Name == tc.Workflow {
+			w = f
+			break
+		}
+		if tc.Workflow == "" && d.Device.Status != nil && d.Device.Status.Value != nil && f.Trigger == *d.Device.Status.Value &&
+			(n.Source == "" || f.Source == "" || f.Source == n.Source) {
+			w = f
+			break
+		}
+	}
+	n.log.Debugf("netbox status workflow %s", w.Name)
+	n.flow = &w
+	return
+}
+
+// SetTempering sets the tempering status of the workflow, if it has one
+func (n *Netbox) SetTempering() (err error) {
+	w, err := n.Workflow()
+	if err != nil || w.Tempering == "" {
+		return
+	}
+	return n.updateStatus(w.Tempering, nil)
+}
+
+// SetStatus sets the success or failed (status failed) status of the workflow and the tags of the failed steps.
+// The tags of the steps which passed are removed
+func (n *Netbox) SetStatus(status string, failedSteps []string) (err error) {
+	w, err := n.Workflow()
+	if err != nil {
+		return
+	}
+	s := w.Success
+	if status == "failed" {
+		s = w.Failed
+	}
+	tags, err := n.statusTags(failedSteps)
+	if err != nil {
+		return
+	}
+	return n.updateStatus(s, tags)
+}
+
+// updateStatus sets the device status and its tags, nil keeps the tags
+func (n *Netbox) updateStatus(status string, tags []*models.NestedTag) (err error) {
+	body := map[string]interface{}{
+		"status": status,
+	}
+	if tags != nil {
+		body["tags"] = tags
+	}
+	d, err := n.updateNodeInfo(body)
+	if err != nil {
+		return fmt.Errorf("cannot update node status in netbox: %s", err.Error())
+	}
+	if d.Status == nil || d.Status.Value == nil || *d.Status.Value != status {
+		return fmt.Errorf("cannot update node status in netbox")
+	}
+	n.Data.Device.Status = d.Status
+	n.Data.Device.Tags = d.Tags
+	return
+}
+
+// statusTags returns the device tags without the status tags, plus the status tags of the failed steps
+func (n *Netbox) statusTags(failedSteps []string) (tags []*models.NestedTag, err error) {
+	statusTags := n.cfg.Status.GetTags()
+	set := make(map[string]bool)
+	for _, step := range failedSteps {
+		if t := matchStatusTag(step, statusTags); t != "" {
+			set[t] = true
+		}
+	}
+	tags = make([]*models.NestedTag, 0)
+	for _, t := range n.Data.Device.Tags {
+		if isStatusTag(*t.Name, statusTags) {
+			continue
+		}
+		tags = append(tags, &models.NestedTag{Name: t.Name, Slug: t.Slug})
+	}
+	for _, st := range statusTags {
+		if !set[st.Tag] {
+			continue
+		}
+		delete(set, st.Tag)
+		t, err := n.getTag(st.Tag)
+		if err != nil {
+			return tags, err
+		}
+		tags = append(tags, t)
+	}
+	return
+}
+
+// getTag returns the tag with the name, which is created if missing
+func (n *Netbox) getTag(name string) (t *models.NestedTag, err error) {
+	slug := strings.Trim(slugRe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	l, err := n.client.API.Tags(slug)
+	if err != nil {
+		return
+	}
+	if len(l) > 0 {
+		return &models.NestedTag{Name: l[0].Name, Slug: l[0].Slug}, nil
+	}
+	n.log.Infof("creating tag %s", name)
+	c, err := n.client.API.CreateTag(name, slug)
+	if err != nil {
+		return t, fmt.Errorf("cannot create tag %s: %s", name, err.Error())
+	}
+	return &models.NestedTag{Name: c.Name, Slug: c.Slug}, nil
+}
+
+// matchStatusTag returns the tag of the longest step prefix matching the step
+func matchStatusTag(step string, tags []config.StatusTag) (tag string) {
+	match := -1
+	for _, t := range tags {
+		if (step == t.Step || strings.HasPrefix(step, t.Step+".")) && len(t.Step) > match {
+			tag, match = t.Tag, len(t.Step)
+		}
+	}
+	return
+}
+
+func isStatusTag(name string, tags []config.StatusTag) bool {
+	for _, t := range tags {
+		if t.Tag == name {
+			return true
+		}
+	}
+	return false
+}
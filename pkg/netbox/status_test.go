@@ -0,0 +1,52 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"testing"
+
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkflowSource(t *testing.T) {
+	_, api := newTestNetbox(t)
+	l, err := api.Devices(clients.DeviceFilter{Name: strPtr(testNode)})
+	assert.NoError(t, err)
+	_, err = api.UpdateDevice(l[0].ID, map[string]interface{}{"status": "planned"})
+	assert.NoError(t, err)
+	cfg := config.Config{Status: config.Status{Workflows: []config.StatusWorkflow{
+		{Name: "webhook", Trigger: "planned", Source: "webhook"},
+		{Name: "scheduler", Trigger: "planned", Source: "scheduler"},
+		{Name: "inventory", Trigger: "inventory"},
+	}}}
+	for source, want := range map[string]string{
+		"webhook":   "webhook",
+		"scheduler": "scheduler",
+		// cli runs take the first workflow of the trigger
+		"": "webhook",
+	} {
+		lg := log.WithField("node", testNode)
+		n := NewWithClient(testNode, cfg, clients.NewNetboxWithAPI(api, lg), lg)
+		n.Source = source
+		w, err := n.Workflow()
+		assert.NoError(t, err, source)
+		assert.Equal(t, want, w.Name, source)
+	}
+}
@@ -20,7 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/netbox-community/go-netbox/v3/netbox/models"
+	"github.com/sapcc/baremetal_temper/pkg/config"
 )
 
 type ConfigContext struct {
@@ -30,16 +30,54 @@ type ConfigContext struct {
 type TemperContext struct {
 	Temper TaskContext `json:"temper"`
 }
+
+// TaskContext is the baremetal.temper config context, see schema/temper.v1.json.
+// Workflow names a status workflow to use instead of the one triggered by the device status,
+// Rules are appended to the ironic rules and BmcCredentials restricts the bmc credentials to one configured source
 type TaskContext struct {
-	Tasks []*Task `json:"tasks"`
+	Version        int              `json:"version,omitempty"`
+	Workflow       string           `json:"workflow,omitempty"`
+	Tasks          []*Task          `json:"tasks"`
+	Rules          *config.Property `json:"rules,omitempty"`
+	BmcCredentials *CredentialRef   `json:"bmcCredentials,omitempty"`
+	Skip           Skip             `json:"skip,omitempty"`
+}
+
+// CredentialRef references a configured bmc credential source by its type. The paths of the sources are
+// only configured in temper, so a config context cannot point them at other files or secrets
+type CredentialRef struct {
+	Source string `json:"source"`
 }
 
+// Skip are the skip flags of a run. Steps are exec names, e.g. ironic.create.console
+type Skip struct {
+	Steps   []string `json:"steps,omitempty"`
+	Cleanup bool     `json:"cleanup,omitempty"`
+	Status  bool     `json:"status,omitempty"`
+}
+
+// Task is a task of the workflow in the temper config context
 type Task struct {
-	Service string  `json:"service"`
-	Task    string  `json:"task"`
-	Exec    []*Exec `json:"-"`
-	Error   string  `json:"error,omitempty"`
-	Status  string  `json:"status"`
+	Service string      `json:"service"`
+	Task    string      `json:"task"`
+	Params  *TaskParams `json:"params,omitempty"`
+	Exec    []*Exec     `json:"-"`
+	Error   string      `json:"error,omitempty"`
+	Status  string      `json:"status"`
+}
+
+// TaskParams are the parameters of a task. Each parameter applies to the tasks of taskParams only
+type TaskParams struct {
+	Epsa          *config.Epsa `json:"epsa,omitempty"`
+	BiosProfile   string       `json:"biosProfile,omitempty"`
+	StorageLayout string       `json:"storageLayout,omitempty"`
+}
+
+// taskParams are the tasks a parameter applies to
+var taskParams = map[string][]string{
+	"epsa":          {"diagnostics.hardwarecheck"},
+	"biosProfile":   {"bios.profile", "bios.update"},
+	"storageLayout": {"storage.configure"},
 }
 
 type Exec struct {
@@ -47,22 +85,108 @@ type Exec struct {
 	Name string
 }
 
+// ErrNoTemperContext is returned for config contexts without baremetal.temper
+var ErrNoTemperContext = fmt.Errorf("no baremetal.temper config context")
+
+// ParseTemperContext validates the baremetal.temper context of a device config context against its schema and the config
+// (workflows and credential sources) and decodes it. Tasks are the known tasks per service, without them task names are not checked
+func ParseTemperContext(configContext interface{}, cfg config.Config, tasks map[string][]string) (tc TaskContext, err error) {
+	ctx, ok := configContext.(map[string]interface{})
+	if !ok {
+		return tc, ErrNoTemperContext
+	}
+	bm, ok := ctx["baremetal"].(map[string]interface{})
+	if !ok {
+		return tc, ErrNoTemperContext
+	}
+	temper, ok := bm["temper"]
+	if !ok {
+		return tc, ErrNoTemperContext
+	}
+	if err = validateContext(temper); err != nil {
+		return
+	}
+	b, err := json.Marshal(temper)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &tc); err != nil {
+		return tc, fmt.Errorf("cannot decode config context: %s", err.Error())
+	}
+	if errs := checkContext(tc, cfg, tasks); len(errs) > 0 {
+		return tc, errs
+	}
+	return
+}
+
+// checkContext checks the references of the context which the schema cannot
+func checkContext(tc TaskContext, cfg config.Config, tasks map[string][]string) (errs ContextErrors) {
+	if tc.Workflow != "" {
+		found := false
+		for _, w := range cfg.Status.GetWorkflows() {
+			if w.Name == tc.Workflow {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, ContextError{Path: contextPath + ".workflow", Msg: fmt.Sprintf("unknown status workflow %s", tc.Workflow)})
+		}
+	}
+	if tc.BmcCredentials != nil {
+		found := len(cfg.Redfish.Credentials) == 0 && tc.BmcCredentials.Source == "static"
+		for _, s := range cfg.Redfish.Credentials {
+			if s.Type == tc.BmcCredentials.Source {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, ContextError{Path: contextPath + ".bmcCredentials.source", Msg: fmt.Sprintf("credential source %s is not configured", tc.BmcCredentials.Source)})
+		}
+	}
+	for i, t := range tc.Tasks {
+		path := fmt.Sprintf("%s.tasks[%d]", contextPath, i)
+		name := t.Service + "." + t.Task
+		if tasks != nil && !contains(tasks[t.Service], t.Task) {
+			errs = append(errs, ContextError{Path: path + ".task", Msg: fmt.Sprintf("unknown task %s", name)})
+		}
+		if t.Params == nil {
+			continue
+		}
+		set := map[string]bool{
+			"epsa":          t.Params.Epsa != nil,
+			"biosProfile":   t.Params.BiosProfile != "",
+			"storageLayout": t.Params.StorageLayout != "",
+		}
+		for p, ts := range taskParams {
+			if set[p] && !contains(ts, name) {
+				errs = append(errs, ContextError{Path: path + ".params." + p, Msg: fmt.Sprintf("does not apply to task %s", name)})
+			}
+		}
+	}
+	return
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// GetTemperConfigContext returns the validated baremetal.temper config context of the device
 func (n *Netbox) GetTemperConfigContext() (temperCtx ConfigContext, err error) {
 	d, err := n.GetData()
 	if err != nil {
 		return
 	}
-	ctx, ok := d.Device.ConfigContext.(map[string]interface{})
-	if !ok {
-		return temperCtx, fmt.Errorf("cannot cast interface to netbox ConfigContext")
-	}
-	bm, ok := ctx["baremetal"].(map[string]interface{})
-	if !ok {
-		return temperCtx, fmt.Errorf("cannot cast interface to netbox ConfigContext")
+	taskCtx, err := ParseTemperContext(d.Device.ConfigContext, n.cfg, nil)
+	if err != nil {
+		return
 	}
-	b, err := json.Marshal(bm["temper"])
-	taskCtx := TaskContext{}
-	json.Unmarshal(b, &taskCtx)
 	for _, t := range taskCtx.Tasks {
 		//remove old error logs
 		t.Error = ""
@@ -72,6 +196,7 @@ func (n *Netbox) GetTemperConfigContext() (temperCtx ConfigContext, err error) {
 	return
 }
 
+// WriteLocalContextData writes the tasks with their status to the local context data, keeping the rest of the temper context
 func (n *Netbox) WriteLocalContextData(t []*Task) (err error) {
 	d, err := n.GetData()
 	if err != nil {
@@ -81,19 +206,20 @@ func (n *Netbox) WriteLocalContextData(t []*Task) (err error) {
 	if !ok {
 		return fmt.Errorf("cannot cast interface to netbox ConfigContext")
 	}
-	ctx["baremetal"] = TemperContext{
-		Temper: TaskContext{
-			Tasks: t,
-		},
+	bm, ok := ctx["baremetal"].(map[string]interface{})
+	if !ok {
+		bm = make(map[string]interface{})
+		ctx["baremetal"] = bm
 	}
-	if err != nil {
-		return err
+	temper, ok := bm["temper"].(map[string]interface{})
+	if !ok {
+		temper = make(map[string]interface{})
+		bm["temper"] = temper
 	}
+	temper["tasks"] = t
 
-	_, err = n.updateNodeInfo(
-		models.WritableDeviceWithConfigContext{
-			LocalContextData: ctx,
-		},
-	)
+	_, err = n.updateNodeInfo(map[string]interface{}{
+		"local_context_data": ctx,
+	})
 	return
 }
@@ -0,0 +1,120 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netbox
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTemperContext(t *testing.T) {
+	cfg := config.Config{
+		Redfish: config.Redfish{Credentials: []config.CredentialSource{{Type: "vault"}}},
+	}
+	tasks := map[string][]string{
+		"bios":        {"update"},
+		"diagnostics": {"hardwarecheck"},
+		"ironic":      {"create"},
+	}
+	for _, tc := range []struct {
+		name    string
+		context string
+		errs    []string
+	}{
+		{
+			name: "valid",
+			context: `{"version": 1, "workflow": "inventory", "bmcCredentials": {"source": "vault"},
+				"tasks": [{"service": "diagnostics", "task": "hardwarecheck", "params": {"epsa": {"runMode": "Express", "maxRetries": 2}}}],
+				"rules": {"node": [{"op": "add", "path": "/properties/capabilities", "value": "boot_mode:uefi"}]},
+				"skip": {"steps": ["ironic.create.console"], "cleanup": true}}`,
+		},
+		{
+			name:    "without version",
+			context: `{"tasks": [{"service": "ironic", "task": "create"}]}`,
+		},
+		{
+			name:    "unsupported version",
+			context: `{"version": 2, "tasks": []}`,
+			errs:    []string{"baremetal.temper.version"},
+		},
+		{
+			name:    "type errors",
+			context: `{"tasks": [{"service": "ironic", "task": "create"}, {"service": "bios", "task": 1}], "skip": {"cleanup": "yes"}}`,
+			errs:    []string{"baremetal.temper.skip.cleanup", "baremetal.temper.tasks[1].task"},
+		},
+		{
+			name:    "enum and minimum",
+			context: `{"tasks": [{"service": "dhcp", "task": "create"}, {"service": "diagnostics", "task": "hardwarecheck", "params": {"epsa": {"runMode": "Quick", "maxRetries": 0}}}]}`,
+			errs:    []string{"baremetal.temper.tasks[0].service", "baremetal.temper.tasks[1].params.epsa.maxRetries", "baremetal.temper.tasks[1].params.epsa.runMode"},
+		},
+		{
+			name:    "unknown properties",
+			context: `{"tasks": [{"service": "ironic", "task": "create", "retries": 3}], "timeout": "1h"}`,
+			errs:    []string{"baremetal.temper.tasks[0].retries", "baremetal.temper.timeout"},
+		},
+		{
+			name:    "missing required",
+			context: `{"tasks": [{"service": "ironic"}], "rules": {"node": [{"path": "name"}]}}`,
+			errs:    []string{"baremetal.temper.rules.node[0].op", "baremetal.temper.rules.node[0].path", "baremetal.temper.tasks[0].task"},
+		},
+		{
+			name:    "credential path",
+			context: `{"tasks": [], "bmcCredentials": {"source": "vault", "path": "secret/data/other"}}`,
+			errs:    []string{"baremetal.temper.bmcCredentials.path"},
+		},
+		{
+			name:    "params on the wrong task",
+			context: `{"tasks": [{"service": "ironic", "task": "create", "params": {"biosProfile": "r640"}}, {"service": "bios", "task": "update", "params": {"epsa": {"runMode": "Express"}}}]}`,
+			errs:    []string{"baremetal.temper.tasks[0].params.biosProfile", "baremetal.temper.tasks[1].params.epsa"},
+		},
+		{
+			name:    "unknown references",
+			context: `{"workflow": "decom", "bmcCredentials": {"source": "file"}, "tasks": [{"service": "ironic", "task": "delete"}]}`,
+			errs:    []string{"baremetal.temper.workflow", "baremetal.temper.bmcCredentials.source", "baremetal.temper.tasks[0].task"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var temper interface{}
+			assert.NoError(t, json.Unmarshal([]byte(tc.context), &temper))
+			ctx := map[string]interface{}{"baremetal": map[string]interface{}{"temper": temper}}
+			_, err := ParseTemperContext(ctx, cfg, tasks)
+			if len(tc.errs) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			errs, ok := err.(ContextErrors)
+			if !assert.True(t, ok, "%v", err) {
+				return
+			}
+			paths := make([]string, len(errs))
+			for i, e := range errs {
+				paths[i] = e.Path
+			}
+			assert.ElementsMatch(t, tc.errs, paths)
+		})
+	}
+}
+
+func TestParseTemperContextMissing(t *testing.T) {
+	for _, ctx := range []interface{}{nil, map[string]interface{}{}, map[string]interface{}{"baremetal": map[string]interface{}{}}} {
+		_, err := ParseTemperContext(ctx, config.Config{}, nil)
+		assert.Equal(t, ErrNoTemperContext, err)
+	}
+}
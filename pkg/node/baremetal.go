@@ -62,6 +62,12 @@ type ErrorMessage struct {
 	Message string `json:"message"`
 }
 
+// portGroupMember reports if an interface becomes a port of the ironic port group. The L1...LN interfaces are
+// left out, as are the interfaces whose link is not up
+func portGroupMember(name string, status redfish.PortLinkStatus) bool {
+	return !strings.HasPrefix(strings.ToLower(name), "l") && status == redfish.UpPortLinkStatus
+}
+
 // Create creates a new ironic node based on the provided ironic model
 func (n *Node) create() (err error) {
 	data, err := n.Redfish.GetData()
@@ -69,9 +75,8 @@ func (n *Node) create() (err error) {
 		return
 	}
 	rfIntf := make([]_redfish.Interface, 0)
-	// remove the L1...LN interfaces for ironic
 	for _, intf := range data.Inventory.Interfaces {
-		if !strings.HasPrefix(intf.Name, "l") && intf.PortLinkStatus == redfish.UpPortLinkStatus {
+		if portGroupMember(intf.Name, intf.PortLinkStatus) {
 			rfIntf = append(rfIntf, intf)
 		}
 	}
@@ -509,7 +514,7 @@ func (n *Node) deployTestInstance() (err error) {
 	nets := make([]servers.Network, 0, 2)
 	nets = append(nets, net, net, net)
 
-	pr, err := clients.NewProviderClient(n.cfg.Deployment.Openstack)
+	pr, err := clients.NewProviderClient(n.cfg.Deployment.Openstack, n.cfg.Transport)
 	if err != nil {
 		return
 	}
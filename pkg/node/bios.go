@@ -0,0 +1,102 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func (n *Node) getBiosProfile() (p *config.BiosProfile, err error) {
+	d, err := n.Netbox.GetData()
+	if err != nil {
+		return
+	}
+	profiles, err := config.GetBiosProfiles(n.cfg.BiosProfilesPath)
+	if err != nil {
+		return
+	}
+	if n.biosProfileName != "" {
+		return profiles.Get(n.biosProfileName)
+	}
+	return profiles.Match(*d.Device.DeviceType.Slug, *d.Device.DeviceRole.Slug)
+}
+
+// biosProfile loads the diff between the node's bios settings and its bios profile
+func (n *Node) biosProfile() (err error) {
+	p, err := n.getBiosProfile()
+	if err != nil {
+		return
+	}
+	return n.biosDiff(p)
+}
+
+// biosDiff loads the diff between the node's bios settings and the profile
+func (n *Node) biosDiff(p *config.BiosProfile) (err error) {
+	n.BiosDiff, err = n.Redfish.GetBiosDiff(*p)
+	if err != nil {
+		return
+	}
+	for _, d := range n.BiosDiff {
+		n.log.Infof("bios attribute %s differs from profile %s: %v != %v", d.Attribute, p.Name, d.Current, d.Expected)
+	}
+	return
+}
+
+// biosUpdate applies the bios profile, reboots the node and verifies the final values
+func (n *Node) biosUpdate() (err error) {
+	p, err := n.getBiosProfile()
+	if err != nil {
+		return
+	}
+	if err = n.biosDiff(p); err != nil {
+		return
+	}
+	if len(n.BiosDiff) == 0 {
+		n.log.Debug("bios settings match profile, nothing to update")
+		return
+	}
+	if err = n.Redfish.UpdateBios(*p); err != nil {
+		return fmt.Errorf("cannot update bios settings: %s", err.Error())
+	}
+	if err = n.Redfish.Power(false, true); err != nil {
+		return
+	}
+	if err = n.Redfish.WaitPowerStateOn(); err != nil {
+		return
+	}
+	// pending settings (e.g. dell config jobs) may still be applied while the node is posting
+	cf := wait.ConditionFunc(func() (bool, error) {
+		n.BiosDiff, err = n.Redfish.GetBiosDiff(*p)
+		if err != nil {
+			n.log.Debugf("cannot load bios settings: %s", err.Error())
+			return false, nil
+		}
+		if len(n.BiosDiff) > 0 {
+			n.log.Debugf("waiting for bios settings to be applied. pending: %d", len(n.BiosDiff))
+			return false, nil
+		}
+		return true, nil
+	})
+	if err = wait.Poll(30*time.Second, 15*time.Minute, cf); err != nil {
+		return fmt.Errorf("bios settings not applied: %v", n.BiosDiff)
+	}
+	return
+}
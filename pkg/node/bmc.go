@@ -0,0 +1,52 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// bmcConfigure hardens the bmc (accounts, protocols, ntp, syslog, certificate) and rotates the onboarding password.
+// If a CA is configured, all further redfish calls verify the newly installed bmc certificate
+func (n *Node) bmcConfigure() (err error) {
+	d, err := n.Netbox.GetData()
+	if err != nil {
+		return
+	}
+	defer n.updateCredentialSource()
+	if err = n.Redfish.ConfigureBmc(d.DNSName); err != nil {
+		return fmt.Errorf("cannot configure bmc: %s", err.Error())
+	}
+	if n.cfg.Redfish.Bmc.Certificate.CACertPath == "" {
+		return
+	}
+	// the bmc web server restarts after the certificate was replaced
+	cf := wait.ConditionFunc(func() (bool, error) {
+		if err = n.Redfish.EnableVerification(); err != nil {
+			n.log.Debugf("waiting for bmc certificate: %s", err.Error())
+			return false, nil
+		}
+		return true, nil
+	})
+	if err = wait.Poll(30*time.Second, 10*time.Minute, cf); err != nil {
+		return fmt.Errorf("bmc certificate not verified: %s", err.Error())
+	}
+	return
+}
@@ -17,147 +17,463 @@
 package node
 
 import (
-	"encoding/json"
 	"fmt"
-	"regexp"
 	"strings"
+	"time"
 
-	"github.com/aristanetworks/goeapi"
-	"github.com/aristanetworks/goeapi/module"
-	"github.com/ciscoecosystem/aci-go-client/container"
+	"github.com/sapcc/baremetal_temper/pkg/config"
 	"github.com/sapcc/baremetal_temper/pkg/diagnostics"
 	"github.com/stmcginnis/gofish/redfish"
 )
 
+// runHardwareChecks runs the remote hardware diagnostics of the node's vendor and attaches the test results
 func (n *Node) runHardwareChecks() (err error) {
-	var dellRe = regexp.MustCompile(`R640|R740|R760|R840|XE9680`)
-
 	d, err := n.Redfish.GetData()
 	if err != nil {
 		return
 	}
-	if dellRe.MatchString(d.Inventory.SystemVendor.Model) {
-		c := diagnostics.NewDellClient(*n.Redfish.GetClientConfig(), n.log)
-		return c.Run()
+	cfg, err := n.Redfish.GetClientConfig()
+	if err != nil {
+		return
+	}
+	var c diagnostics.Diagnostics
+	vendor := strings.ToLower(d.Inventory.SystemVendor.Manufacturer)
+	switch {
+	case strings.Contains(vendor, "dell"):
+		opts := n.epsaOptions()
+		if opts.RunMode == diagnostics.EpsaExtended {
+			release, err := n.acquireRackSlot(opts.Timeout)
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+		c = diagnostics.NewDellClient(*cfg, opts, n.log)
+	default:
+		// iLO and XCC document no redfish action starting their diagnostics, the healthcheck task covers these nodes
+		n.log.Infof("no remote hardware diagnostics for vendor %s", d.Inventory.SystemVendor.Manufacturer)
+		return
 	}
+	rs, err := c.Run()
+	// appended after the evaluation, which marks the accepted warnings
+	err = n.evaluateResults("hardwarecheck", rs, err)
+	n.Diagnostics = append(n.Diagnostics, rs...)
+	return
+}
 
+// epsaOptions returns the ePSA options of diagnostics.epsa, overridden by the non-empty options of the hardwarecheck task
+// in the netbox config context
+func (n *Node) epsaOptions() (opts config.Epsa) {
+	opts = n.cfg.Diagnostics.Epsa
+	if n.epsa == nil {
+		return
+	}
+	if n.epsa.RunMode != "" {
+		opts.RunMode = n.epsa.RunMode
+	}
+	if n.epsa.RebootType != "" {
+		opts.RebootType = n.epsa.RebootType
+	}
+	if n.epsa.MaxRetries != 0 {
+		opts.MaxRetries = n.epsa.MaxRetries
+	}
 	return
 }
 
-func (n *Node) runACICheck() (err error) {
-	n.log.Debug("calling aci api for node cable check")
-	aci := diagnostics.NewACI(n.cfg, n.log)
-	noLldp := make([]string, 0)
+// acquireRackSlot waits for one of the diagnostics.maxExtendedPerRack slots of the node's rack. The slot
+// expires after the run's timeout and the time to export the results, if the run cannot release it
+func (n *Node) acquireRackSlot(timeout time.Duration) (release func(), err error) {
+	release = func() {}
+	if n.cfg.Diagnostics.MaxExtendedPerRack <= 0 {
+		return
+	}
 	d, err := n.Netbox.GetData()
 	if err != nil {
 		return
 	}
-	defer func() {
-		if len(noLldp) > 0 {
-			err = fmt.Errorf("cable check not successful for: %s", noLldp)
+	if d.Device.Rack == nil || d.Device.Rack.Name == nil {
+		n.log.Infof("node has no rack, extended diagnostics are not limited")
+		return
+	}
+	n.log.Debugf("waiting for extended diagnostics slot in rack %s", *d.Device.Rack.Name)
+	return n.Netbox.AcquireRackSlot(n.cfg.Diagnostics.MaxExtendedPerRack, timeout+15*time.Minute, timeout)
+}
+
+// runHealthCheck checks the component health and bmc logs of all vendors and attaches them to the node
+func (n *Node) runHealthCheck() (err error) {
+	cfg, err := n.Redfish.GetClientConfig()
+	if err != nil {
+		return
+	}
+	c := diagnostics.NewHealthClient(*cfg, n.runStart, n.log)
+	h, err := c.Run()
+	n.Health = &h
+	return n.evaluateResults("healthcheck", h.Results(), err)
+}
+
+// runBurnin boots the diagnostics image, which fetches the burn-in plan from the agent endpoint and uploads the results.
+// The redfish sensors and bmc logs are monitored until the results arrive
+func (n *Node) runBurnin() (err error) {
+	image := n.cfg.Burnin.Image
+	if image == "" {
+		image = *n.cfg.Redfish.BootImage
+	}
+	if image == "" {
+		return fmt.Errorf("no burn-in image configured")
+	}
+	serial, err := n.systemSerial()
+	if err != nil {
+		return
+	}
+	cfg, err := n.Redfish.GetClientConfig()
+	if err != nil {
+		return
+	}
+	m := diagnostics.NewSensorMonitor(*cfg, n.log)
+	if err = m.Start(); err != nil {
+		return
+	}
+	defer m.Stop()
+	diagnostics.AddBurninPlan(serial, n.cfg.Burnin.Plan)
+	defer diagnostics.RemoveBurninPlan(serial)
+	since := time.Now()
+	if err = n.Redfish.BootFromImage(image); err != nil {
+		return
+	}
+	n.log.Debugf("waiting for burn-in results of serial %s", serial)
+	r, err := diagnostics.WaitBurninResult(serial, since, n.cfg.Burnin.Timeout, m.Check)
+	rs := append(r.Results, m.Results()...)
+	err = n.evaluateResults("burnin", rs, err)
+	n.Diagnostics = append(n.Diagnostics, rs...)
+	return
+}
+
+// evaluateResults applies the diagnostics policy to the results of a check and persists them to diagnostics.resultsPath.
+// The error of the check takes precedence over the policy
+func (n *Node) evaluateResults(check string, rs []diagnostics.Result, checkErr error) (err error) {
+	p, err := diagnostics.LoadPolicy(n.cfg.Diagnostics.Policy)
+	if err != nil {
+		return
+	}
+	policyErr := p.Apply(rs)
+	if n.cfg.Diagnostics.ResultsPath != "" && len(rs) > 0 {
+		run := diagnostics.Run{Node: n.Name, Task: check, Time: time.Now(), Results: rs}
+		if d, err := n.Netbox.GetData(); err == nil && d.Device != nil {
+			if d.Device.Rack != nil && d.Device.Rack.Name != nil {
+				run.Rack = *d.Device.Rack.Name
+			}
+			if d.Device.Site != nil && d.Device.Site.Name != nil {
+				run.Site = *d.Device.Site.Name
+			}
 		}
-	}()
+		if err := diagnostics.SaveRun(n.cfg.Diagnostics.ResultsPath, run); err != nil {
+			n.log.Errorf("cannot persist %s results: %s", check, err.Error())
+		}
+	}
+	if checkErr != nil {
+		return checkErr
+	}
+	return policyErr
+}
 
-	for _, intf := range d.Interfaces {
-		if !strings.Contains(intf.Connection, "aci") {
-			continue
+// runCableCheck verifies with the lldp neighbor sources of cableCheck.sources that each cabled interface
+// is seen on exactly the switch port it is cabled to in netbox
+func (n *Node) runCableCheck() (err error) {
+	noLldp := make([]string, 0)
+	report, err := n.checkCables()
+	if err != nil {
+		return
+	}
+	for _, r := range report {
+		if r.Reason != "" {
+			noLldp = append(noLldp, r.Interface+"("+r.Reason+")")
 		}
-		if intf.PortLinkStatus == redfish.DownPortLinkStatus {
-			noLldp = append(noLldp, intf.Name+"(interface_down)")
-			continue
+	}
+	if len(noLldp) > 0 {
+		err = fmt.Errorf("cable check not successful for: %s", noLldp)
+	}
+	return
+}
+
+// reconcileCables reports the interfaces seen on another switch port than cabled in netbox.
+// The netbox cables are only updated with approval (cableCheck.approveReconcile), otherwise
+// the report waits for the approval via the api
+func (n *Node) reconcileCables() (err error) {
+	report, err := n.checkCables()
+	if err != nil {
+		return
+	}
+	mismatches := make([]string, 0)
+	failed := make([]string, 0)
+	for _, r := range report {
+		switch {
+		case r.Mismatch():
+			n.log.Warnf("cable mismatch %s: expected %s %s, observed %s %s (%s)", r.Interface, r.ExpectedSwitch, r.ExpectedPort, r.ObservedSwitch, r.ObservedPort, r.Source)
+			mismatches = append(mismatches, r.Interface)
+		case r.Reason != "":
+			failed = append(failed, r.Interface+"("+r.Reason+")")
 		}
-		var co *container.Container
-		if intf.ConnectionIP == "" {
-			noLldp = append(noLldp, intf.Name+"(no_aci_ip)")
-			continue
+	}
+	if len(mismatches) > 0 {
+		if !n.cfg.CableCheck.ApproveReconcile {
+			return fmt.Errorf("cable mismatches pending approval: %s", mismatches)
 		}
-		n.log.Debugf("checking interface: %s --> %s", intf.Name, intf.Connection)
-		co, err = aci.GetContainer(intf.ConnectionIP)
-		if err != nil {
-			noLldp = append(noLldp, intf.Name+"("+err.Error()+")")
-			continue
+		if err = n.ApproveCableReconcile(); err != nil {
+			return
 		}
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("cable check not successful for: %s", failed)
+	}
+	return
+}
 
-		l, _ := co.Search("imdata").Children()
-		foundNeighbor := false
+// CableResults returns the report of the last cable check
+func (n *Node) CableResults() []diagnostics.CableResult {
+	n.cableMu.Lock()
+	defer n.cableMu.Unlock()
+	return n.CableReport
+}
 
-	aciPortLoop:
-		for _, c := range l {
-			var l diagnostics.Lldp
-			if err = json.Unmarshal(c.Bytes(), &l); err != nil {
-				n.log.Errorf("cannot unmarshal aci lldp: %s", err.Error())
-				continue
-			}
-			for _, ch := range l.LldpIf.LldpIfChildren {
-				if ch.LldpAdjEp.LldpAdjEpAttributes.SysDesc != "" {
-					interCon := strings.Split(ch.LldpAdjEp.LldpAdjEpAttributes.SysDesc, "/")
-					if len(interCon) == 3 {
-						n.log.Debugf("intra aci: aci-%s", interCon[2])
-					}
-				}
-				n.log.Debugf("aci lldp: %s / node %s", prepareMac(ch.LldpAdjEp.LldpAdjEpAttributes.PortIdV), prepareMac(intf.Mac))
-				if prepareMac(intf.Mac) == prepareMac(ch.LldpAdjEp.LldpAdjEpAttributes.PortIdV) {
-					if l.LldpIf.LldpIfAttributes.ID != intf.Port {
-						errMsg := fmt.Sprintf("%s(wrong switch port: %s)", intf.Name, l.LldpIf.LldpIfAttributes.ID)
-						n.log.Debugf("%s(wrong switch port: %s)", intf.Name, l.LldpIf.LldpIfAttributes.ID)
-						noLldp = append(noLldp, errMsg)
-						break aciPortLoop
-					}
-					n.log.Debugf("found aci lldp neighbor: %s", intf.Mac)
-					foundNeighbor = true
-					break aciPortLoop
-				}
-			}
+// ApproveCableReconcile updates the netbox cables of the mismatches of the last cable check
+// to the observed lldp topology and writes a journal entry on the device
+func (n *Node) ApproveCableReconcile() (err error) {
+	n.cableMu.Lock()
+	defer n.cableMu.Unlock()
+	if n.Netbox == nil {
+		return fmt.Errorf("no cable check report")
+	}
+	changes := make([]string, 0)
+	errs := make([]string, 0)
+	// the report is replaced, not changed in place: a run may still read the previous one
+	report := append([]diagnostics.CableResult{}, n.CableReport...)
+	defer func() { n.CableReport = report }()
+	for i, r := range report {
+		if !r.Mismatch() {
+			continue
 		}
-		if !foundNeighbor {
-			noLldp = append(noLldp, intf.Name+"(lldp_missing)")
+		if err := n.Netbox.ReconcileCable(r); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s %s -> %s %s (%s lldp)", r.Interface, r.ExpectedSwitch, r.ExpectedPort, r.ObservedSwitch, r.ObservedPort, r.Source))
+		report[i] = diagnostics.CableResult{
+			Interface:      r.Interface,
+			ExpectedSwitch: r.ObservedSwitch,
+			ExpectedPort:   r.ObservedPort,
+			ObservedSwitch: r.ObservedSwitch,
+			ObservedPort:   r.ObservedPort,
+			Source:         r.Source,
 		}
 	}
-
+	if len(changes) > 0 {
+		comment := "temper cable check reconciled the cabling with the observed lldp neighbors:\n* " + strings.Join(changes, "\n* ")
+		if err := n.Netbox.AddJournalEntry("warning", comment); err != nil {
+			errs = append(errs, fmt.Sprintf("cannot write journal entry: %s", err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot reconcile cables: %s", strings.Join(errs, ", "))
+	}
 	return
 }
 
-func (n *Node) runAristaCheck() (err error) {
-	noLldp := make([]string, 0)
-	cfg := n.cfg.Arista
-	netboxData, err := n.Netbox.GetData()
+// checkCables checks all cabled interfaces and stores the results in the cable report.
+// Interfaces of switches without a neighbor source fail the check
+func (n *Node) checkCables() (report []diagnostics.CableResult, err error) {
+	c, err := n.newCableCheck()
+	if err != nil {
+		return
+	}
+	d, err := n.Netbox.GetData()
 	if err != nil {
 		return
 	}
+	report = make([]diagnostics.CableResult, 0)
 	defer func() {
-		if len(noLldp) > 0 {
-			err = fmt.Errorf("cable check not successful for: %s", noLldp)
-		}
+		n.cableMu.Lock()
+		n.CableReport = report
+		n.cableMu.Unlock()
 	}()
-	for _, intf := range netboxData.Interfaces {
-		if intf.Connection == "" || !strings.Contains(intf.Connection, "sw") {
+	down := make([]diagnostics.CableResult, 0)
+	intfs := make([]diagnostics.CableInterface, 0)
+	for _, intf := range d.Interfaces {
+		if intf.Connection == "" {
 			continue
 		}
-		n.log.Debug("calling arista api for node cable check")
-		host := fmt.Sprintf("%s.%s", intf.Connection, n.cfg.Domain)
-		c, err := goeapi.Connect(cfg.Transport, host, cfg.User, cfg.Password, cfg.Port)
+		if intf.PortLinkStatus == redfish.DownPortLinkStatus {
+			down = append(down, diagnostics.CableResult{
+				Interface:      intf.Name,
+				ExpectedSwitch: intf.Connection,
+				ExpectedPort:   intf.Port,
+				Reason:         "interface_down",
+			})
+			continue
+		}
+		n.log.Debugf("checking interface: %s --> %s %s", intf.Name, intf.Connection, intf.Port)
+		intfs = append(intfs, diagnostics.CableInterface{
+			Name:     intf.Name,
+			Mac:      intf.Mac,
+			Switch:   intf.Connection,
+			SwitchIP: intf.ConnectionIP,
+			Port:     intf.Port,
+		})
+	}
+	report = append(c.Check(intfs), down...)
+	return
+}
+
+func (n *Node) newCableCheck() (c *diagnostics.CableCheck, err error) {
+	c = diagnostics.NewCableCheck(n.log)
+	for _, s := range n.neighborSources() {
+		src, err := n.newNeighborSource(s)
+		if err != nil {
+			return c, err
+		}
+		if err = c.AddSource(s.Match, src); err != nil {
+			return c, err
+		}
+	}
+	return
+}
+
+// neighborSources returns cableCheck.sources, defaults to the boot image agent and aci
+func (n *Node) neighborSources() (sources []config.NeighborSource) {
+	sources = n.cfg.CableCheck.Sources
+	if len(sources) == 0 {
+		sources = []config.NeighborSource{{Type: "aci", Match: "aci"}}
+		if n.agentReport != nil {
+			sources = append([]config.NeighborSource{{Type: "agent"}}, sources...)
+		}
+	}
+	return
+}
+
+func (n *Node) newNeighborSource(s config.NeighborSource) (src diagnostics.NeighborSource, err error) {
+	switch s.Type {
+	case "aci":
+		src = diagnostics.NewACI(n.cfg, n.log)
+	case "arista":
+		auth := n.cfg.Arista
+		if s.User != "" {
+			auth.User, auth.Password = s.User, s.Password
+		}
+		if s.Port != 0 {
+			auth.Port = s.Port
+		}
+		src = diagnostics.NewAristaSource(auth, n.cfg.Domain)
+	case "nxapi":
+		src = diagnostics.NewNxapiSource(s, n.cfg.Domain)
+	case "snmp":
+		src = diagnostics.NewSnmpSource(s, n.cfg.Domain)
+	case "redfish":
+		src = diagnostics.NewNodeNeighbors("redfish", n.redfishNeighbors)
+	case "agent":
+		src = diagnostics.NewNodeNeighbors("agent", diagnostics.AgentNeighbors(n.agentReport))
+	default:
+		err = fmt.Errorf("unknown cable check source %s", s.Type)
+	}
+	return
+}
+
+// runLinkCheck compares the negotiated speed and duplex of the cabled interfaces of the ironic port group with their
+// netbox interface type and checks the mtu and port-channel membership of the switch ports. The switch side is read from
+// the cableCheck.sources supporting it (aci and arista), interfaces of switches without source are not checked
+func (n *Node) runLinkCheck() (err error) {
+	c := diagnostics.NewLinkCheck(n.cfg.LinkCheck.MTU, n.cfg.LinkCheck.Lacp, n.log)
+	for _, s := range n.neighborSources() {
+		src, err := n.newNeighborSource(s)
 		if err != nil {
 			return err
 		}
-		s := module.Show(c)
-		lldp := s.ShowLLDPNeighbors()
-		foundNeighbor := false
-		for _, ln := range lldp.LLDPNeighbors {
-			//244a.979a.b76b
-			//24:4a:97:9a:b7:6b
-			if strings.ToLower(strings.ReplaceAll(intf.Mac, ":", "")) == strings.ReplaceAll(ln.NeighborPort, ".", "") {
-				n.log.Debugf("found aci lldp neighbor: %s", intf.Mac)
-				foundNeighbor = true
-				break
-			}
+		ps, ok := src.(diagnostics.PortStatusSource)
+		if !ok {
+			continue
+		}
+		if err = c.AddSource(s.Match, ps); err != nil {
+			return err
+		}
+	}
+	d, err := n.Netbox.GetData()
+	if err != nil {
+		return
+	}
+	intfs := make([]diagnostics.LinkInterface, 0)
+	for _, intf := range d.Interfaces {
+		if intf.Connection == "" || !portGroupMember(intf.Name, intf.PortLinkStatus) {
+			continue
 		}
-		if !foundNeighbor {
-			noLldp = append(noLldp, intf.Name+"(lldp_missing)")
+		if !c.HasSource(intf.Connection) {
+			n.log.Debugf("no port status source for interface: %s --> %s", intf.Name, intf.Connection)
+			continue
+		}
+		intfs = append(intfs, diagnostics.LinkInterface{
+			CableInterface: diagnostics.CableInterface{
+				Name:     intf.Name,
+				Mac:      intf.Mac,
+				Switch:   intf.Connection,
+				SwitchIP: intf.ConnectionIP,
+				Port:     intf.Port,
+			},
+			Type:      intf.Type,
+			SpeedMbps: intf.SpeedMbps,
+		})
+	}
+	n.LinkReport = c.Check(intfs)
+	failed := make([]string, 0)
+	for _, r := range n.LinkReport {
+		if len(r.Reasons) > 0 {
+			failed = append(failed, r.Interface+"("+strings.Join(r.Reasons, ", ")+")")
 		}
 	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("link check not successful for: %s", failed)
+	}
+	return
+}
 
+// redfishNeighbors returns the lldp neighbors the bmc reports for the node's ports
+func (n *Node) redfishNeighbors() (nbs []diagnostics.Neighbor, err error) {
+	lldp, err := n.Redfish.GetLldpNeighbors()
+	if err != nil {
+		return
+	}
+	nbs = make([]diagnostics.Neighbor, 0)
+	for _, l := range lldp {
+		nbs = append(nbs, diagnostics.Neighbor{Mac: l.Mac, Switch: l.SystemName, Port: l.PortID})
+	}
 	return
 }
-func prepareMac(m string) string {
-	return strings.ToLower(strings.ReplaceAll(m, ":", ""))
+
+// waitAgentReport waits for the report of the boot image agent instead of a fixed time,
+// the report's lldp neighbors are a source of runCableCheck
+func (n *Node) waitAgentReport() (err error) {
+	serial, err := n.systemSerial()
+	if err != nil {
+		return
+	}
+	n.log.Debugf("waiting for boot image agent report of serial %s", serial)
+	r, err := diagnostics.WaitAgentReport(serial, n.agentSince, n.cfg.Agent.Timeout)
+	if err != nil {
+		return
+	}
+	n.agentReport = &r
+	n.AgentHealth = &r.Health
+	for _, e := range r.Health.Errors {
+		n.log.Warnf("boot image agent: %s", e)
+	}
+	return
+}
+
+// systemSerial returns the serial number of the system read via redfish, which the boot image reports.
+// The netbox serial is empty until netbox.sync ran
+func (n *Node) systemSerial() (serial string, err error) {
+	d, err := n.Redfish.GetData()
+	if err != nil {
+		return
+	}
+	if serial = d.Inventory.SystemVendor.SerialNumber; serial == "" {
+		return serial, fmt.Errorf("the bmc reports no system serial number")
+	}
+	return
 }
@@ -11,25 +11,34 @@ import (
 	"github.com/netbox-community/go-netbox/v3/netbox/models"
 	"github.com/sapcc/baremetal_temper/pkg/clients"
 	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/diagnostics"
 	"github.com/sapcc/baremetal_temper/pkg/netbox"
 	_redfish "github.com/sapcc/baremetal_temper/pkg/redfish"
 	log "github.com/sirupsen/logrus"
 )
 
 type Node struct {
-	Name           string             `json:"name"`
-	RemoteIP       string             `json:"remoteIP"`
-	PrimaryIP      string             `json:"primaryIP"`
-	UUID           string             `json:"uuid"`
-	ProvisionState string             `json:"provisionState"`
-	InstanceUUID   string             `json:"instanceUUID"`
-	InstanceIPv4   string             `json:"instanceIP"`
-	Host           string             `json:"host"`
-	Tasks          []*netbox.Task     `json:"tasks"`
-	Status         string             `json:"status"`
-	PortGroupUUID  string             `json:"portGroupUUID"`
-	ResourceClass  string             `json:"-"`
-	IpamAddresses  []models.IPAddress `json:"-"`
+	Name           string                    `json:"name"`
+	RemoteIP       string                    `json:"remoteIP"`
+	PrimaryIP      string                    `json:"primaryIP"`
+	UUID           string                    `json:"uuid"`
+	ProvisionState string                    `json:"provisionState"`
+	InstanceUUID   string                    `json:"instanceUUID"`
+	InstanceIPv4   string                    `json:"instanceIP"`
+	Host           string                    `json:"host"`
+	Tasks          []*netbox.Task            `json:"tasks"`
+	Status         string                    `json:"status"`
+	Source         string                    `json:"source,omitempty"`
+	PortGroupUUID  string                    `json:"portGroupUUID"`
+	ResourceClass  string                    `json:"-"`
+	IpamAddresses  []models.IPAddress        `json:"-"`
+	BiosDiff       []_redfish.BiosDiff       `json:"biosDiff,omitempty"`
+	Health         *diagnostics.Health       `json:"health,omitempty"`
+	Diagnostics    []diagnostics.Result      `json:"diagnostics,omitempty"`
+	BmcCredentials string                    `json:"bmcCredentials,omitempty"`
+	AgentHealth    *diagnostics.AgentHealth  `json:"agentHealth,omitempty"`
+	CableReport    []diagnostics.CableResult `json:"cableReport,omitempty"`
+	LinkReport     []diagnostics.LinkResult  `json:"linkReport,omitempty"`
 
 	tasksExecs map[string]map[string][]*netbox.Exec `json:"-"`
 	Updated    time.Time                            `json:"-"`
@@ -37,9 +46,30 @@ type Node struct {
 	Redfish _redfish.Redfish `json:"-"`
 	Netbox  *netbox.Netbox   `json:"-"`
 
-	log *log.Entry         `json:"-"`
-	cfg config.Config      `json:"-"`
-	oc  *clients.Openstack `json:"-"`
+	log      *log.Entry              `json:"-"`
+	cfg      config.Config           `json:"-"`
+	oc       *clients.Openstack      `json:"-"`
+	cassette *clients.Cassette       `json:"-"`
+	creds    *clients.BmcCredentials `json:"-"`
+
+	// cableMu guards CableReport, which the api approves while a run may check the cables
+	cableMu sync.Mutex `json:"-"`
+
+	agentSince  time.Time                `json:"-"`
+	agentReport *diagnostics.AgentReport `json:"-"`
+	epsa        *config.Epsa             `json:"-"`
+
+	// settings of the temper config context
+	skip              netbox.Skip           `json:"-"`
+	rules             *config.Property      `json:"-"`
+	credRef           *netbox.CredentialRef `json:"-"`
+	biosProfileName   string                `json:"-"`
+	storageLayoutName string                `json:"-"`
+
+	runStart    time.Time `json:"-"`
+	failedStep  string    `json:"-"`
+	failedErr   string    `json:"-"`
+	failedSteps []string  `json:"-"`
 }
 
 func New(name string, cfg config.Config) (n *Node, err error) {
@@ -49,6 +79,14 @@ func New(name string, cfg config.Config) (n *Node, err error) {
 	if len(strings.Split(name, "-")) != 2 {
 		return n, fmt.Errorf("wrong node name format. e.g. node001-ap001")
 	}
+	cassette, err := clients.NewCassette(cfg, name)
+	if err != nil {
+		return
+	}
+	if cassette != nil {
+		ctxLogger.Infof("%s mode, using cassette %s", cfg.Recorder.Mode, cfg.Recorder.Path)
+		cfg.Transport = cassette.Transport
+	}
 	n = &Node{
 		Name:       name,
 		Status:     "progress",
@@ -56,6 +94,7 @@ func New(name string, cfg config.Config) (n *Node, err error) {
 		Tasks:      make([]*netbox.Task, 0),
 		log:        ctxLogger,
 		oc:         clients.NewClient(cfg, ctxLogger),
+		cassette:   cassette,
 		tasksExecs: make(map[string]map[string][]*netbox.Exec),
 	}
 	if cfg.Netbox.Token == "" {
@@ -85,6 +124,16 @@ func (n *Node) setupClients() (err error) {
 	if err != nil {
 		return fmt.Errorf("cannot create netbox client: %s", err.Error())
 	}
+	n.Netbox.Source = n.Source
+	for _, t := range n.Tasks {
+		if !setupTasks[t.Service+"."+t.Task] {
+			continue
+		}
+		n.execTask(t)
+		if t.Status == "failed" {
+			return fmt.Errorf("setup task %s.%s failed: %s", t.Service, t.Task, t.Error)
+		}
+	}
 	if err = n.createRedfishClient(); err != nil {
 		err = fmt.Errorf("cannot create redfish client: %s", err.Error())
 		n.Status = "failed"
@@ -97,17 +146,27 @@ func (n *Node) Temper(netboxSts bool, wg *sync.WaitGroup, limiter chan bool) {
 	if limiter != nil {
 		limiter <- true
 	}
+	n.runStart = time.Now()
 	defer func() {
 		if r := recover(); r != nil {
 			n.log.Errorf("aborting node temper: %s", r)
 			n.Status = "failed"
+			n.recordFailure("", fmt.Errorf("aborted: %v", r))
 			if n.Netbox.Data.Device == nil {
 				n.log.Errorf("no cleanup needed, failed at getting netbox data")
+				n.saveCassette()
 				wg.Done()
 				return
 			}
 		}
 		n.cleanupHandler(netboxSts)
+		if n.Netbox != nil {
+			n.log.Infof("netbox api calls: %d", n.Netbox.APICalls())
+		}
+		if n.Redfish != nil {
+			n.Redfish.Logout()
+		}
+		n.saveCassette()
 		if limiter != nil {
 			<-limiter
 		}
@@ -116,54 +175,77 @@ func (n *Node) Temper(netboxSts bool, wg *sync.WaitGroup, limiter chan bool) {
 	if err := n.setupClients(); err != nil {
 		n.log.Error(err)
 		n.Status = "failed"
+		n.recordFailure("setup", err)
 		return
 	}
+	if netboxSts && !n.skip.Status {
+		if err := n.Netbox.SetTempering(); err != nil {
+			n.log.Errorf("cannot set tempering status in netbox: %s", err.Error())
+		}
+	}
 	if err := n.getNodeReady(); err != nil {
 		n.log.Error(err)
 		n.Status = "failed"
+		n.recordFailure("ready", err)
 		return
 	}
 	if err := n.mergeInterfaces(); err != nil {
 		n.log.Error(err)
 		n.Status = "failed"
+		n.recordFailure("interfaces", err)
 		return
 	}
-TasksLoop:
 	for _, t := range n.Tasks {
-		for i, exec := range t.Exec {
-			if t.Status == "success" || t.Status == "done" {
-				continue
-			}
-			n.log.Infof("executing temper task: %s", exec.Name)
-			if err := exec.Fn(); err != nil {
-				if _, ok := err.(*AlreadyExists); ok {
-					if err := n.loadBaremetalNodeInfo(); err != nil {
-						break TasksLoop
-					}
-					if n.ProvisionState != "enroll" {
-						n.log.Infof("node %s already exists, nothing to temper", n.Name)
-						break TasksLoop
-					}
-					n.log.Info("found existing node in enroll state. ")
-				} else {
-					t.Error = err.Error()
-					t.Status = "failed"
-					n.Status = "failed"
-				}
-
-			} else {
-				if i == len(t.Exec)-1 {
-					t.Status = "success"
-				}
-			}
+		if stop := n.execTask(t); stop {
+			break
 		}
 	}
+	if err := n.saveSnapshot(); err != nil {
+		n.log.Errorf("cannot save hardware snapshot: %s", err.Error())
+	}
 	if n.Status != "failed" {
 		n.Status = "staged"
 	}
 	return
 }
 
+// execTask executes the execs of the task unless it already succeeded and reports if the run should stop
+func (n *Node) execTask(t *netbox.Task) (stop bool) {
+	for i, exec := range t.Exec {
+		if t.Status == "success" || t.Status == "done" {
+			continue
+		}
+		if n.skipStep(exec.Name) {
+			n.log.Infof("skipping temper task: %s", exec.Name)
+			continue
+		}
+		n.log.Infof("executing temper task: %s", exec.Name)
+		if err := exec.Fn(); err != nil {
+			if _, ok := err.(*AlreadyExists); ok {
+				if err := n.loadBaremetalNodeInfo(); err != nil {
+					return true
+				}
+				if n.ProvisionState != "enroll" {
+					n.log.Infof("node %s already exists, nothing to temper", n.Name)
+					return true
+				}
+				n.log.Info("found existing node in enroll state. ")
+			} else {
+				t.Error = err.Error()
+				t.Status = "failed"
+				n.Status = "failed"
+				n.recordFailure(exec.Name, err)
+			}
+
+		} else {
+			if i == len(t.Exec)-1 {
+				t.Status = "success"
+			}
+		}
+	}
+	return
+}
+
 func (n *Node) cleanupHandler(netboxSts bool) {
 	n.log.Debugf("calling cleanupHandler, node status: %s", n.Status)
 	for _, t := range n.Tasks {
@@ -171,22 +253,54 @@ func (n *Node) cleanupHandler(netboxSts bool) {
 			n.log.Errorf("error tempering node %s. task: %s err: %s", n.Name, t.Task, t.Error)
 		}
 	}
+	record := netbox.RunRecord{Start: n.runStart, Tasks: n.Tasks, FailedStep: n.failedStep, Error: n.failedErr, NodeUUID: n.UUID, InstanceUUID: n.InstanceUUID}
 	if n.InstanceUUID != "" {
 		if err := n.DeleteTestInstance(); err != nil {
 			n.log.Errorf("cannot delete compute instance %s. err: %s", n.InstanceUUID, err.Error())
 		}
 	}
-	if n.Status == "failed" {
+	if n.Status == "failed" && !n.skip.Cleanup {
 		if err := n.DeleteNode(); err != nil {
 			n.log.Errorf("cannot delete node %s. err: %s", n.Name, err.Error())
 		}
 	}
-	if netboxSts {
-		if err := n.Netbox.SetStatus(n.Status); err != nil {
+	if netboxSts && !n.skip.Status {
+		if err := n.Netbox.SetStatus(n.Status, n.failedSteps); err != nil {
 			n.log.Errorf("cannot set node %s status in netbox. err: %s", n.Name, err.Error())
 		}
+		record.End = time.Now()
+		record.Status = n.Status
+		for _, r := range n.Diagnostics {
+			if r.Severity == diagnostics.SeverityWarning {
+				record.Warnings = append(record.Warnings, r.Component+" "+r.Test)
+			}
+		}
+		if err := n.Netbox.AddRunJournalEntry(record); err != nil {
+			n.log.Errorf("cannot journal run of node %s. err: %s", n.Name, err.Error())
+		}
+	}
+}
+
+// recordFailure collects the failed steps for the netbox status tags and keeps the first one and its error for the journal entry
+func (n *Node) recordFailure(step string, err error) {
+	if step != "" {
+		n.failedSteps = append(n.failedSteps, step)
+	}
+	if n.failedErr != "" {
+		return
 	}
+	n.failedStep = step
+	n.failedErr = err.Error()
+}
 
+// saveCassette writes the recorded http interactions of the run if recording is enabled
+func (n *Node) saveCassette() {
+	if n.cassette == nil {
+		return
+	}
+	if err := n.cassette.Save(); err != nil {
+		n.log.Errorf("cannot save cassette: %s", err.Error())
+	}
 }
 
 func recoverTaskExec(n *Node) {
@@ -199,8 +313,26 @@ func recoverTaskExec(n *Node) {
 func (n *Node) createRedfishClient() (err error) {
 	d, err := n.Netbox.GetData()
 	if err != nil {
-		panic("cannot get netbox data: " + err.Error())
+		return fmt.Errorf("cannot get netbox data: %s", err.Error())
+	}
+
+	cf, _ := d.Device.CustomFields.(map[string]interface{})
+	cfg := n.cfg
+	if n.credRef != nil {
+		if cfg.Redfish.Credentials, err = credentialSources(n.cfg.Redfish.Credentials, *n.credRef); err != nil {
+			return
+		}
+	}
+	n.creds, err = clients.NewCredentialProvider(cfg, clients.CredentialNode{
+		Name:            n.Name,
+		Serial:          d.Device.Serial,
+		CustomFields:    cf,
+		SetCustomFields: n.Netbox.SetCustomFields,
+	}, n.log)
+	if err != nil {
+		return
 	}
+	defer n.updateCredentialSource()
 
 	lenovo := regexp.MustCompile(`(?i)SR950|SR650|SR850P`)
 	dell := regexp.MustCompile(`(?i)R640|R730|R740|R760|R840|XE9680`)
@@ -209,20 +341,54 @@ func (n *Node) createRedfishClient() (err error) {
 	switch {
 	case lenovo.MatchString(*d.Device.DeviceType.Slug):
 		n.log.Info("loading LENOVO redfish client")
-		n.Redfish, err = _redfish.NewLenovo(d.RemoteIP, n.cfg, n.log)
+		n.Redfish, err = _redfish.NewLenovo(d.RemoteIP, n.cfg, n.creds, n.log)
 	case dell.MatchString(*d.Device.DeviceType.Slug):
 		n.log.Info("loading DELL redfish client")
-		n.Redfish, err = _redfish.NewDell(d.RemoteIP, n.cfg, n.log)
+		n.Redfish, err = _redfish.NewDell(d.RemoteIP, n.cfg, n.creds, n.log)
 	case hpe.MatchString(*d.Device.DeviceType.Slug):
 		n.log.Info("loading HPE redfish client")
-		n.Redfish, err = _redfish.NewHpe(d.RemoteIP, n.cfg, n.log)
+		n.Redfish, err = _redfish.NewHpe(d.RemoteIP, n.cfg, n.creds, n.log)
 	default:
 		n.log.Info("loading DEFAULT redfish client")
-		n.Redfish, err = _redfish.NewDefault(d.RemoteIP, n.cfg, n.log)
+		n.Redfish, err = _redfish.NewDefault(d.RemoteIP, n.cfg, n.creds, n.log)
+	}
+	return
+}
+
+// credentialSources returns the configured credential sources of the referenced type. Without configured sources
+// only static can be referenced
+func credentialSources(sources []config.CredentialSource, ref netbox.CredentialRef) (s []config.CredentialSource, err error) {
+	for _, cs := range sources {
+		if cs.Type == ref.Source {
+			s = append(s, cs)
+		}
+	}
+	if len(s) == 0 {
+		if len(sources) == 0 && ref.Source == "static" {
+			return []config.CredentialSource{{Type: "static"}}, nil
+		}
+		return s, fmt.Errorf("bmc credential source %s is not configured", ref.Source)
 	}
 	return
 }
 
+// skipStep reports if the exec is skipped by the temper config context
+func (n *Node) skipStep(name string) bool {
+	for _, s := range n.skip.Steps {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// updateCredentialSource records which source the bmc credentials in use were loaded from
+func (n *Node) updateCredentialSource() {
+	if c, ok := n.creds.Current(); ok {
+		n.BmcCredentials = c.Source
+	}
+}
+
 func (n *Node) mergeInterfaces() (err error) {
 	nd, err := n.Netbox.GetData()
 	if err != nil {
@@ -254,6 +420,7 @@ func (n *Node) mergeInterfaces() (err error) {
 		redfishIntf := rd.Inventory.Interfaces[i]
 		intf.Mac = redfishIntf.MacAddress
 		intf.PortLinkStatus = redfishIntf.PortLinkStatus
+		intf.SpeedMbps = redfishIntf.SpeedMbps
 		if intf.Nic == 0 {
 			if redfishIntf.Nic != 0 {
 				continue
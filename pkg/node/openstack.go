@@ -133,6 +133,11 @@ func (n *Node) getRules() (r config.Rule, err error) {
 		return
 	}
 	json.Unmarshal(out.Bytes(), &r)
+	if n.rules != nil {
+		r.Properties.Node = append(r.Properties.Node, n.rules.Node...)
+		r.Properties.Port = append(r.Properties.Port, n.rules.Port...)
+		r.Properties.PortGroup = append(r.Properties.PortGroup, n.rules.PortGroup...)
+	}
 	return
 }
 
@@ -427,7 +432,7 @@ func (n *Node) getConductorZone(name string) (id string, err error) {
 }
 
 func (n *Node) getNetwork(name string) (net servers.Network, err error) {
-	pr, err := clients.NewProviderClient(n.cfg.Deployment.Openstack)
+	pr, err := clients.NewProviderClient(n.cfg.Deployment.Openstack, n.cfg.Transport)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,169 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/baremetal/v1/ports"
+	_redfish "github.com/sapcc/baremetal_temper/pkg/redfish"
+)
+
+// getSnapshot loads the node's hardware snapshot including the mac addresses of its netbox interfaces
+func (n *Node) getSnapshot() (s _redfish.Snapshot, err error) {
+	if s, err = n.Redfish.GetSnapshot(); err != nil {
+		return
+	}
+	s.Node = n.Name
+	d, err := n.Netbox.GetData()
+	if err != nil {
+		return
+	}
+	for _, intf := range d.Interfaces {
+		if intf.Mac == "" {
+			continue
+		}
+		s.Components = append(s.Components, _redfish.Component{Type: "mac", Location: intf.Name, Mac: intf.Mac})
+	}
+	s.Sort()
+	return
+}
+
+// saveSnapshot stores the current hardware snapshot as a new version in the snapshots path
+func (n *Node) saveSnapshot() (err error) {
+	if n.cfg.SnapshotsPath == "" {
+		return
+	}
+	s, err := n.getSnapshot()
+	if err != nil {
+		return
+	}
+	prev, found, err := n.lastSnapshot()
+	if err != nil {
+		return
+	}
+	if found {
+		s.Version = prev.Version + 1
+	} else {
+		s.Version = 1
+	}
+	dir := filepath.Join(n.cfg.SnapshotsPath, n.Name)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return
+	}
+	n.log.Debugf("saving hardware snapshot version %d", s.Version)
+	return ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%06d.json", s.Version)), b, 0644)
+}
+
+func (n *Node) lastSnapshot() (s _redfish.Snapshot, found bool, err error) {
+	if n.cfg.SnapshotsPath == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(n.cfg.SnapshotsPath, n.Name, "*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+	b, err := ioutil.ReadFile(files[len(files)-1])
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &s); err != nil {
+		return s, found, fmt.Errorf("cannot parse snapshot %s: %s", files[len(files)-1], err.Error())
+	}
+	return s, true, nil
+}
+
+// Diff compares the current hardware state against the last snapshot, netbox and the node's ironic ports
+func (n *Node) Diff() (drift []_redfish.Drift, err error) {
+	if err = n.setupClients(); err != nil {
+		return
+	}
+	defer n.Redfish.Logout()
+	if err = n.mergeInterfaces(); err != nil {
+		return
+	}
+	cur, err := n.getSnapshot()
+	if err != nil {
+		return
+	}
+	drift = make([]_redfish.Drift, 0)
+	prev, found, err := n.lastSnapshot()
+	if err != nil {
+		return
+	}
+	if found {
+		drift = append(drift, cur.Diff(prev)...)
+	} else {
+		n.log.Infof("no previous snapshot found for node %s", n.Name)
+	}
+
+	d, err := n.Netbox.GetData()
+	if err != nil {
+		return
+	}
+	if d.Device.Serial != "" && d.Device.Serial != cur.Serial {
+		drift = append(drift, _redfish.Drift{Source: "netbox", Type: "system", Field: "serial", Expected: d.Device.Serial, Current: cur.Serial})
+	}
+	macs, err := n.Netbox.GetInterfaceMacs()
+	if err != nil {
+		return
+	}
+	curMacs := make(map[string]bool)
+	for _, c := range cur.Components {
+		if c.Type != "mac" {
+			continue
+		}
+		curMacs[strings.ToLower(c.Mac)] = true
+		if m, ok := macs[c.Location]; ok && !strings.EqualFold(m, c.Mac) {
+			drift = append(drift, _redfish.Drift{Source: "netbox", Type: c.Type, Location: c.Location, Field: "mac", Expected: m, Current: c.Mac})
+		}
+	}
+
+	if err = n.loadBaremetalNodeInfo(); err != nil {
+		n.log.Infof("skipping ironic ports diff: %s", err.Error())
+		return drift, nil
+	}
+	c, err := n.oc.GetServiceClient("baremetal")
+	if err != nil {
+		return
+	}
+	l, err := ports.List(c, ports.ListOpts{NodeUUID: n.UUID}).AllPages()
+	if err != nil {
+		return
+	}
+	ps, err := ports.ExtractPorts(l)
+	if err != nil {
+		return
+	}
+	for _, p := range ps {
+		if !curMacs[strings.ToLower(p.Address)] {
+			drift = append(drift, _redfish.Drift{Source: "ironic", Type: "port", Location: p.UUID, Field: "mac", Expected: p.Address})
+		}
+	}
+	return
+}
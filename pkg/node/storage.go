@@ -0,0 +1,91 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	_redfish "github.com/sapcc/baremetal_temper/pkg/redfish"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// reboots of the storage configuration: deleting volumes and creating them on the freed drives
+const maxStorageReboots = 2
+
+func (n *Node) getStorageLayout() (l *config.StorageLayout, err error) {
+	d, err := n.Netbox.GetData()
+	if err != nil {
+		return
+	}
+	layouts, err := config.GetStorageLayouts(n.cfg.StorageLayoutsPath)
+	if err != nil {
+		return
+	}
+	if n.storageLayoutName != "" {
+		return layouts.Get(n.storageLayoutName)
+	}
+	return layouts.Match(*d.Device.DeviceType.Slug, *d.Device.DeviceRole.Slug)
+}
+
+// storageConfigure applies the storage layout and sets the root volume as the node's root disk
+func (n *Node) storageConfigure() (err error) {
+	l, err := n.getStorageLayout()
+	if err != nil {
+		return
+	}
+	// volumes replacing deleted ones may only be created after a reboot, which needs another reboot
+	for i := 0; ; i++ {
+		pending, err := n.Redfish.ConfigureStorage(*l)
+		if err != nil {
+			return fmt.Errorf("cannot configure storage: %s", err.Error())
+		}
+		if !pending {
+			break
+		}
+		if i == maxStorageReboots {
+			return fmt.Errorf("storage layout %s not applied after %d reboots", l.Name, maxStorageReboots)
+		}
+		n.log.Infof("rebooting node to apply storage layout %s", l.Name)
+		if err = n.Redfish.Power(false, true); err != nil {
+			return err
+		}
+		if err = n.Redfish.WaitPowerStateOn(); err != nil {
+			return err
+		}
+	}
+	var root _redfish.RootDisk
+	cf := wait.ConditionFunc(func() (bool, error) {
+		root, err = n.Redfish.GetRootVolume(*l)
+		if err != nil {
+			n.log.Debugf("waiting for root volume: %s", err.Error())
+			return false, nil
+		}
+		return true, nil
+	})
+	if err = wait.Poll(30*time.Second, 20*time.Minute, cf); err != nil {
+		return fmt.Errorf("root volume not available: %s", err.Error())
+	}
+	data, err := n.Redfish.GetData()
+	if err != nil {
+		return
+	}
+	n.log.Debugf("using volume %s as root disk", root.Name)
+	data.RootDisk = root
+	return
+}
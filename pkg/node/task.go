@@ -18,12 +18,25 @@ package node
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/sapcc/baremetal_temper/pkg/config"
 	"github.com/sapcc/baremetal_temper/pkg/netbox"
 )
 
+// optInTasks are not part of a service's "all" tasks
+var optInTasks = map[string]bool{
+	"diagnostics.cablecheck.reconcile": true,
+	"diagnostics.burnin":               true,
+}
+
+// setupTasks run before the redfish client is created, e.g. to allocate the bmc address it connects to
+var setupTasks = map[string]bool{
+	"ipam.allocate": true,
+}
+
 func (n *Node) initTaskExecs() {
 	n.tasksExecs["dns"] = map[string][]*netbox.Exec{
 		"create": {
@@ -32,27 +45,37 @@ func (n *Node) initTaskExecs() {
 	}
 	if *n.cfg.Redfish.BootImage == "" {
 		n.tasksExecs["diagnostics"] = map[string][]*netbox.Exec{
-			"cablecheck": {
-				{Fn: n.runACICheck, Name: "diagnostics.cablecheck.aci"},
-				//{Exec: n.runAristaCheck, Name: "arista_cable_check"},
+			"cablecheck":           n.cableCheckExecs(&netbox.Exec{Fn: n.runCableCheck, Name: "diagnostics.cablecheck.lldp"}),
+			"cablecheck.reconcile": n.cableCheckExecs(&netbox.Exec{Fn: n.reconcileCables, Name: "diagnostics.cablecheck.reconcile"}),
+			"linkcheck":            n.cableCheckExecs(&netbox.Exec{Fn: n.runLinkCheck, Name: "diagnostics.linkcheck"}),
+			"burnin": {
+				{Fn: n.runBurnin, Name: "diagnostics.burnin"},
+				{Fn: func() error { return n.Redfish.EjectMedia() }, Name: "diagnostics.burnin.bootimage.eject"},
+				{Fn: func() error { return n.Redfish.Power(false, true) }, Name: "diagnostics.burnin.reboot"},
 			},
 			"hardwarecheck": {
 				{Fn: n.runHardwareChecks, Name: "diagnostics.hardwarecheck"},
 			},
+			"healthcheck": {
+				{Fn: n.runHealthCheck, Name: "diagnostics.healthcheck"},
+			},
 		}
 	} else {
 		n.tasksExecs["diagnostics"] = map[string][]*netbox.Exec{
-			"cablecheck": {
-				{Fn: func() error { return n.Redfish.BootFromImage(*n.cfg.Redfish.BootImage) }, Name: "diagnostics.cablecheck.bootimage"},
-				{Fn: TimeoutTask(10 * time.Minute), Name: "diagnostics.cablecheck.bootimage.wait"},
-				{Fn: n.runACICheck, Name: "diagnostics.cablecheck.aci"},
-				//{Exec: n.runAristaCheck, Name: "arista_cable_check"},
-				{Fn: n.Redfish.EjectMedia, Name: "diagnostics.cablecheck.bootimage.eject"},
-				{Fn: func() error { return n.Redfish.Power(false, true) }, Name: "diagnostics.cablecheck.reboot"},
+			"cablecheck":           n.cableCheckExecs(&netbox.Exec{Fn: n.runCableCheck, Name: "diagnostics.cablecheck.lldp"}),
+			"cablecheck.reconcile": n.cableCheckExecs(&netbox.Exec{Fn: n.reconcileCables, Name: "diagnostics.cablecheck.reconcile"}),
+			"linkcheck":            n.cableCheckExecs(&netbox.Exec{Fn: n.runLinkCheck, Name: "diagnostics.linkcheck"}),
+			"burnin": {
+				{Fn: n.runBurnin, Name: "diagnostics.burnin"},
+				{Fn: func() error { return n.Redfish.EjectMedia() }, Name: "diagnostics.burnin.bootimage.eject"},
+				{Fn: func() error { return n.Redfish.Power(false, true) }, Name: "diagnostics.burnin.reboot"},
 			},
 			"hardwarecheck": {
 				{Fn: n.runHardwareChecks, Name: "diagnostics.cablecheck.hardwarecheck"},
 			},
+			"healthcheck": {
+				{Fn: n.runHealthCheck, Name: "diagnostics.healthcheck"},
+			},
 		}
 	}
 	n.tasksExecs["ironic"] = map[string][]*netbox.Exec{
@@ -109,6 +132,20 @@ func (n *Node) initTaskExecs() {
 				}
 				return n.Netbox.Update(d.Inventory.SystemVendor.SerialNumber)
 			}, Name: "netbox.sync"},
+			{Fn: func() error {
+				cs, err := n.Redfish.GetInventory()
+				if err != nil {
+					return err
+				}
+				return n.Netbox.SyncInventory(cs)
+			}, Name: "netbox.sync.inventory"},
+			{Fn: func() error {
+				d, err := n.Redfish.GetData()
+				if err != nil {
+					return err
+				}
+				return n.Netbox.SyncInterfaces(d.Inventory.Interfaces)
+			}, Name: "netbox.sync.interfaces"},
 		},
 		"writeLocalContextData": {
 			{Fn: func() error {
@@ -116,13 +153,32 @@ func (n *Node) initTaskExecs() {
 			}, Name: "netbox.writeLocalContextData"},
 		},
 	}
+	n.tasksExecs["ipam"] = map[string][]*netbox.Exec{
+		"allocate": {
+			{Fn: func() error { return n.Netbox.AllocateAddresses() }, Name: "ipam.allocate"},
+		},
+	}
 	n.tasksExecs["firmware"] = map[string][]*netbox.Exec{
 		"profile": {},
 		"update":  {},
 	}
+	n.tasksExecs["storage"] = map[string][]*netbox.Exec{
+		"configure": {
+			{Fn: n.storageConfigure, Name: "storage.configure"},
+		},
+	}
 	n.tasksExecs["bios"] = map[string][]*netbox.Exec{
-		"profile": {},
-		"update":  {},
+		"profile": {
+			{Fn: n.biosProfile, Name: "bios.profile"},
+		},
+		"update": {
+			{Fn: n.biosUpdate, Name: "bios.update"},
+		},
+	}
+	n.tasksExecs["bmc"] = map[string][]*netbox.Exec{
+		"configure": {
+			{Fn: n.bmcConfigure, Name: "bmc.configure"},
+		},
 	}
 }
 
@@ -132,6 +188,9 @@ func (n *Node) AddTask(service, taskName string) error {
 	}
 	if taskName == "all" {
 		for t, e := range n.tasksExecs[service] {
+			if optInTasks[service+"."+t] {
+				continue
+			}
 			t := &netbox.Task{
 				Service: service,
 				Task:    t,
@@ -155,21 +214,77 @@ func (n *Node) AddTask(service, taskName string) error {
 	return nil
 }
 
+// MergeTaskWithContext adds the tasks of the temper config context and applies its settings
 func (n *Node) MergeTaskWithContext(cfgCtx netbox.ConfigContext) error {
 	if n.Tasks == nil {
 		n.Tasks = make([]*netbox.Task, 0)
 	}
-	for _, t := range cfgCtx.Baremetal.Temper.Tasks {
+	tc := cfgCtx.Baremetal.Temper
+	for i, t := range tc.Tasks {
 		execs, ok := n.tasksExecs[t.Service][t.Task]
 		if !ok {
-			return fmt.Errorf("unknown task")
+			return netbox.ContextError{Path: fmt.Sprintf("baremetal.temper.tasks[%d].task", i), Msg: fmt.Sprintf("unknown task %s.%s", t.Service, t.Task)}
 		}
 		t.Exec = execs
+		if t.Params != nil {
+			if t.Params.Epsa != nil {
+				n.epsa = t.Params.Epsa
+			}
+			if t.Params.BiosProfile != "" {
+				n.biosProfileName = t.Params.BiosProfile
+			}
+			if t.Params.StorageLayout != "" {
+				n.storageLayoutName = t.Params.StorageLayout
+			}
+		}
 		n.Tasks = append(n.Tasks, t)
 	}
+	n.skip = tc.Skip
+	n.rules = tc.Rules
+	n.credRef = tc.BmcCredentials
 	return nil
 }
 
+// TaskNames returns the tasks of each service, e.g. to validate config contexts without a node
+func TaskNames(cfg config.Config) (names map[string][]string) {
+	if cfg.Redfish.BootImage == nil {
+		img := ""
+		cfg.Redfish.BootImage = &img
+	}
+	n := &Node{cfg: cfg, tasksExecs: make(map[string]map[string][]*netbox.Exec)}
+	n.initTaskExecs()
+	names = make(map[string][]string)
+	for s, ts := range n.tasksExecs {
+		for t := range ts {
+			names[s] = append(names[s], t)
+		}
+		sort.Strings(names[s])
+	}
+	return
+}
+
+// cableCheckExecs boots the node from the boot image around the check if one is configured.
+// With the boot image agent its report is awaited instead of a fixed time
+func (n *Node) cableCheckExecs(check *netbox.Exec) []*netbox.Exec {
+	if *n.cfg.Redfish.BootImage == "" {
+		return []*netbox.Exec{check}
+	}
+	wait := &netbox.Exec{Fn: TimeoutTask(10 * time.Minute), Name: "diagnostics.cablecheck.bootimage.wait"}
+	if n.cfg.Agent.Secret != "" {
+		wait = &netbox.Exec{Fn: n.waitAgentReport, Name: "diagnostics.cablecheck.bootimage.wait"}
+	}
+	return []*netbox.Exec{
+		{Fn: func() error {
+			n.agentSince = time.Now()
+			return n.Redfish.BootFromImage(*n.cfg.Redfish.BootImage)
+		}, Name: "diagnostics.cablecheck.bootimage"},
+		wait,
+		check,
+		{Fn: func() error { return n.Redfish.EjectMedia() }, Name: "diagnostics.cablecheck.bootimage.eject"},
+		{Fn: func() error { return n.Redfish.Power(false, true) }, Name: "diagnostics.cablecheck.reboot"},
+	}
+}
+
 func TimeoutTask(d time.Duration) func() (err error) {
 	return func() (err error) {
 		time.Sleep(d)
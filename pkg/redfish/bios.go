@@ -0,0 +1,133 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+type BiosDiff struct {
+	Attribute string      `json:"attribute"`
+	Current   interface{} `json:"current"`
+	Expected  interface{} `json:"expected"`
+}
+
+// GetBiosDiff compares the current bios attributes and boot order with the profile
+func (p *Default) GetBiosDiff(profile config.BiosProfile) (diff []BiosDiff, err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	return p.biosDiff(profile)
+}
+
+// UpdateBios writes the differing bios settings as pending settings.
+// They are applied with the next reboot of the node
+func (p *Default) UpdateBios(profile config.BiosProfile) (err error) {
+	diff, err := p.GetBiosDiff(profile)
+	if err != nil || len(diff) == 0 {
+		return
+	}
+	return p.patchBios(diff)
+}
+
+func (p *Default) biosDiff(profile config.BiosProfile) (diff []BiosDiff, err error) {
+	diff = make([]BiosDiff, 0)
+	s, err := p.client.Client.Service.Systems()
+	if err != nil {
+		return
+	}
+	b, err := s[0].Bios()
+	if err != nil {
+		return
+	}
+	for k, v := range profile.Attributes {
+		cur, ok := b.Attributes[k]
+		if !ok {
+			return diff, fmt.Errorf("unknown bios attribute: %s", k)
+		}
+		if fmt.Sprintf("%v", cur) != fmt.Sprintf("%v", v) {
+			diff = append(diff, BiosDiff{Attribute: k, Current: cur, Expected: v})
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i].Attribute < diff[j].Attribute
+	})
+	if len(profile.BootOrder) > 0 {
+		order := sortBootOrder(s[0].Boot.BootOrder, profile.BootOrder)
+		if strings.Join(order, ",") != strings.Join(s[0].Boot.BootOrder, ",") {
+			diff = append(diff, BiosDiff{Attribute: "BootOrder", Current: s[0].Boot.BootOrder, Expected: order})
+		}
+	}
+	return
+}
+
+// patchBios writes the pending bios settings. Vendors apply them with the next reboot
+func (p *Default) patchBios(diff []BiosDiff) (err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	s, err := p.client.Client.Service.Systems()
+	if err != nil {
+		return
+	}
+	b, err := s[0].Bios()
+	if err != nil {
+		return
+	}
+	attrs := redfish.BiosAttributes{}
+	for _, d := range diff {
+		if d.Attribute == "BootOrder" {
+			p.log.Debugf("setting boot order: %v", d.Expected)
+			if err = s[0].SetBoot(redfish.Boot{BootOrder: d.Expected.([]string)}); err != nil {
+				return
+			}
+			continue
+		}
+		attrs[d.Attribute] = d.Expected
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	p.log.Debugf("patching bios attributes: %v", attrs)
+	return b.UpdateBiosAttributes(attrs)
+}
+
+// sortBootOrder moves the boot options matching the expected entries to the front.
+// Entries are matched by prefix, e.g. "NIC.PxeDevice" matches "NIC.PxeDevice.1-1"
+func sortBootOrder(current, expected []string) (order []string) {
+	order = make([]string, 0, len(current))
+	used := make(map[int]bool)
+	for _, e := range expected {
+		for i, c := range current {
+			if !used[i] && strings.HasPrefix(c, e) {
+				order = append(order, c)
+				used[i] = true
+			}
+		}
+	}
+	for i, c := range current {
+		if !used[i] {
+			order = append(order, c)
+		}
+	}
+	return
+}
@@ -0,0 +1,391 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+type certificateService struct {
+	Actions struct {
+		GenerateCSR struct {
+			Target string `json:"target"`
+		} `json:"#CertificateService.GenerateCSR"`
+		ReplaceCertificate struct {
+			Target string `json:"target"`
+		} `json:"#CertificateService.ReplaceCertificate"`
+	}
+}
+
+type generateCSR struct {
+	CertificateCollection odataID
+	CommonName            string
+	AlternativeNames      []string
+	Organization          string `json:",omitempty"`
+	Country               string `json:",omitempty"`
+	State                 string `json:",omitempty"`
+	City                  string `json:",omitempty"`
+	KeyPairAlgorithm      string
+	KeyBitLength          int
+}
+
+type replaceCertificate struct {
+	CertificateString string
+	CertificateType   string
+	CertificateURI    odataID `json:"CertificateUri"`
+}
+
+type protocol struct {
+	ProtocolEnabled bool
+	NTPServers      []string `json:",omitempty"`
+}
+
+// ConfigureBmc brings the bmc to the configured baseline: service accounts, network protocols, syslog,
+// a CA signed certificate for hostname and the bmc ip and finally rotates the onboarding password
+func (p *Default) ConfigureBmc(hostname string) (err error) {
+	return p.configureBmc(hostname, p.configureSyslog)
+}
+
+func (p *Default) configureBmc(hostname string, configureSyslog func(servers []string) error) (err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	cfg := p.cfg.Redfish.Bmc
+	m, err := p.client.Client.Service.Managers()
+	if err != nil || len(m) == 0 {
+		return fmt.Errorf("cannot load bmc manager")
+	}
+	for _, a := range cfg.Accounts {
+		if err = p.configureAccount(a); err != nil {
+			return fmt.Errorf("cannot configure bmc account %s: %s", a.User, err.Error())
+		}
+	}
+	if err = p.configureNetworkProtocol(m[0], cfg); err != nil {
+		return fmt.Errorf("cannot configure bmc network protocols: %s", err.Error())
+	}
+	if len(cfg.SyslogServers) > 0 {
+		if err = configureSyslog(cfg.SyslogServers); err != nil {
+			return fmt.Errorf("cannot configure bmc syslog: %s", err.Error())
+		}
+	}
+	if cfg.Certificate.CACertPath != "" {
+		if err = p.installCertificate(m[0], hostname, cfg.Certificate); err != nil {
+			return fmt.Errorf("cannot install bmc certificate: %s", err.Error())
+		}
+	}
+	if cfg.Password != "" {
+		if err = p.rotatePassword(cfg.Password); err != nil {
+			return fmt.Errorf("cannot rotate bmc password: %s", err.Error())
+		}
+	}
+	return
+}
+
+// EnableVerification verifies the bmc certificate for all further requests
+func (p *Default) EnableVerification() error {
+	return p.client.EnableVerification()
+}
+
+// configureSyslog: remote syslog is not part of the redfish standard and needs vendor specific settings
+func (p *Default) configureSyslog(servers []string) (err error) {
+	p.log.Warnf("remote syslog not supported for vendor, skipping servers %v", servers)
+	return
+}
+
+func (p *Default) getAccounts() (accounts []*redfish.ManagerAccount, err error) {
+	as, err := p.client.Client.Service.AccountService()
+	if err != nil {
+		return
+	}
+	return as.Accounts()
+}
+
+func (p *Default) configureAccount(a config.BmcAccount) (err error) {
+	accounts, err := p.getAccounts()
+	if err != nil {
+		return
+	}
+	type temp struct {
+		UserName string
+		Password string
+		RoleID   string `json:"RoleId"`
+		Enabled  bool
+	}
+	t := temp{UserName: a.User, Password: a.Password, RoleID: a.Role, Enabled: true}
+	for _, acc := range accounts {
+		if acc.UserName == a.User {
+			p.log.Debugf("updating bmc account %s", a.User)
+			return p.patch(acc.ODataID, t)
+		}
+	}
+	p.log.Debugf("creating bmc account %s", a.User)
+	err = p.post("/redfish/v1/AccountService/Accounts", t)
+	if rerr, ok := err.(*common.Error); ok && rerr.HTTPReturnedStatusCode == http.StatusMethodNotAllowed {
+		// some bmcs (e.g. idrac) have a fixed number of account slots, which need to be patched
+		for _, acc := range accounts {
+			if acc.UserName == "" && acc.ID != "1" {
+				return p.patch(acc.ODataID, t)
+			}
+		}
+		return fmt.Errorf("no free account slot")
+	}
+	return
+}
+
+// rotatePassword stores the new password in the credential source before it is set on the bmc,
+// so the next run can log in. If the bmc rejects it, the previous credential is stored again
+func (p *Default) rotatePassword(password string) (err error) {
+	creds := p.client.Credentials()
+	cur, ok := creds.Current()
+	if ok && cur.Password == password {
+		p.log.Debugf("bmc password of %s already rotated (credentials from %s)", cur.User, cur.Source)
+		return
+	}
+	accounts, err := p.getAccounts()
+	if err != nil {
+		return
+	}
+	type temp struct {
+		Password string
+	}
+	for _, acc := range accounts {
+		if acc.UserName != p.client.ClientConfig.Username {
+			continue
+		}
+		rotated := clients.Credential{User: acc.UserName, Password: password}
+		if rotated.Source, err = creds.Store(rotated); err != nil {
+			return fmt.Errorf("cannot store rotated password: %s", err.Error())
+		}
+		p.log.Infof("rotating password of bmc account %s, stored in %s", acc.UserName, rotated.Source)
+		if err = p.patch(acc.ODataID, temp{Password: password}); err != nil {
+			if !ok {
+				return
+			}
+			if _, serr := creds.Store(cur); serr != nil {
+				p.log.Errorf("cannot restore stored bmc credentials: %s", serr.Error())
+			}
+			return
+		}
+		p.client.ClientConfig.Password = password
+		creds.Succeeded(rotated)
+		return
+	}
+	return fmt.Errorf("cannot find bmc account %s", p.client.ClientConfig.Username)
+}
+
+func (p *Default) configureNetworkProtocol(m *redfish.Manager, cfg config.Bmc) (err error) {
+	protocols := make(map[string]protocol)
+	for _, pr := range cfg.DisabledProtocols {
+		protocols[pr] = protocol{ProtocolEnabled: false}
+	}
+	if len(cfg.NTPServers) > 0 {
+		protocols["NTP"] = protocol{ProtocolEnabled: true, NTPServers: cfg.NTPServers}
+	}
+	if len(protocols) == 0 {
+		return
+	}
+	p.log.Debugf("configuring bmc network protocols: %v", protocols)
+	return p.patch(m.ODataID+"/NetworkProtocol", protocols)
+}
+
+// installCertificate lets the bmc generate a CSR, signs it with the configured CA and replaces the https certificate
+func (p *Default) installCertificate(m *redfish.Manager, hostname string, cfg config.BmcCertificate) (err error) {
+	resp, err := p.client.Client.Get("/redfish/v1/CertificateService")
+	if err != nil {
+		return
+	}
+	var cs certificateService
+	err = json.NewDecoder(resp.Body).Decode(&cs)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	coll := m.ODataID + "/NetworkProtocol/HTTPS/Certificates"
+	certs, err := common.GetCollection(p.client.Client, coll)
+	if err != nil || len(certs.ItemLinks) == 0 {
+		return fmt.Errorf("cannot find https certificate")
+	}
+	// temper connects to the bmc by its ip, the certificate has to cover it too
+	names := []string{hostname}
+	ips := endpointIPs(p.client.ClientConfig.Endpoint)
+	for _, ip := range ips {
+		names = append(names, ip.String())
+	}
+	p.log.Debugf("generating bmc csr for %s", strings.Join(names, ", "))
+	resp, err = p.client.Client.Post(cs.Actions.GenerateCSR.Target, generateCSR{
+		CertificateCollection: odataID{ID: coll},
+		CommonName:            hostname,
+		AlternativeNames:      names,
+		Organization:          cfg.Organization,
+		Country:               cfg.Country,
+		State:                 cfg.State,
+		City:                  cfg.City,
+		KeyPairAlgorithm:      "TPM_ALG_RSA",
+		KeyBitLength:          2048,
+	})
+	if err != nil {
+		return
+	}
+	var csr struct {
+		CSRString string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&csr)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	cert, err := signCSR(csr.CSRString, ips, cfg)
+	if err != nil {
+		return
+	}
+	p.log.Infof("replacing bmc certificate %s", certs.ItemLinks[0])
+	resp, err = p.client.Client.Post(cs.Actions.ReplaceCertificate.Target, replaceCertificate{
+		CertificateString: cert,
+		CertificateType:   "PEM",
+		CertificateURI:    odataID{ID: certs.ItemLinks[0]},
+	})
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+// endpointIPs returns the ip of the endpoint url, none if it is a host name
+func endpointIPs(endpoint string) (ips []net.IP) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		ips = append(ips, ip)
+	}
+	return
+}
+
+// signCSR signs the csr with the CA. Alternative names which are ip addresses (bmcs put all of them into the
+// dns names) and ips are added as ip addresses, the common name is the dns name if the csr has none
+func signCSR(csrPEM string, ips []net.IP, cfg config.BmcCertificate) (cert string, err error) {
+	b, _ := pem.Decode([]byte(csrPEM))
+	if b == nil {
+		return cert, fmt.Errorf("cannot decode csr")
+	}
+	csr, err := x509.ParseCertificateRequest(b.Bytes)
+	if err != nil {
+		return
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return
+	}
+	caCert, caKey, err := loadCA(cfg)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	validity := cfg.ValidityDays
+	if validity == 0 {
+		validity = 365
+	}
+	dnsNames := make([]string, 0)
+	ipAddresses := append([]net.IP{}, csr.IPAddresses...)
+	for _, n := range csr.DNSNames {
+		if ip := net.ParseIP(n); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, n)
+		}
+	}
+	for _, ip := range ips {
+		if !containsIP(ipAddresses, ip) {
+			ipAddresses = append(ipAddresses, ip)
+		}
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		DNSNames:     dnsNames,
+		IPAddresses:  ipAddresses,
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().AddDate(0, 0, validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if len(tmpl.DNSNames) == 0 && csr.Subject.CommonName != "" {
+		tmpl.DNSNames = []string{csr.Subject.CommonName}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadCA(cfg config.BmcCertificate) (cert *x509.Certificate, key interface{}, err error) {
+	certPEM, err := ioutil.ReadFile(cfg.CACertPath)
+	if err != nil {
+		return
+	}
+	keyPEM, err := ioutil.ReadFile(cfg.CAKeyPath)
+	if err != nil {
+		return
+	}
+	cb, _ := pem.Decode(certPEM)
+	kb, _ := pem.Decode(keyPEM)
+	if cb == nil || kb == nil {
+		return cert, key, fmt.Errorf("cannot decode bmc ca")
+	}
+	if cert, err = x509.ParseCertificate(cb.Bytes); err != nil {
+		return
+	}
+	switch {
+	case strings.Contains(kb.Type, "RSA"):
+		key, err = x509.ParsePKCS1PrivateKey(kb.Bytes)
+	case strings.Contains(kb.Type, "EC"):
+		key, err = x509.ParseECPrivateKey(kb.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(kb.Bytes)
+	}
+	return
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/redfish/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+const bmcHostname = "node001-bb001r.cc.qa-de-1.cloud.sap"
+
+// newCA writes a self signed CA to the temp dir of the test
+func newCA(t *testing.T) (cfg config.BmcCertificate, ca *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "temper test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	must(t, err)
+	ca, err = x509.ParseCertificate(der)
+	must(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	must(t, err)
+	dir := t.TempDir()
+	cfg = config.BmcCertificate{CACertPath: filepath.Join(dir, "ca.pem"), CAKeyPath: filepath.Join(dir, "ca-key.pem")}
+	must(t, ioutil.WriteFile(cfg.CACertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	must(t, ioutil.WriteFile(cfg.CAKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return
+}
+
+func newCSR(t *testing.T, cn string, names ...string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}, DNSNames: names}, key)
+	must(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestSignCSR(t *testing.T) {
+	cfg, ca := newCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, tc := range []struct {
+		name  string
+		csr   string
+		ips   []net.IP
+		dns   []string
+		ipSAN []string
+	}{
+		{
+			name:  "ip alternative name",
+			csr:   newCSR(t, bmcHostname, bmcHostname, "10.0.0.5"),
+			ips:   []net.IP{net.ParseIP("10.0.0.5")},
+			dns:   []string{bmcHostname},
+			ipSAN: []string{"10.0.0.5"},
+		},
+		{
+			name:  "common name only",
+			csr:   newCSR(t, bmcHostname),
+			ips:   []net.IP{net.ParseIP("10.0.0.6")},
+			dns:   []string{bmcHostname},
+			ipSAN: []string{"10.0.0.6"},
+		},
+	} {
+		pemCert, err := signCSR(tc.csr, tc.ips, cfg)
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		b, _ := pem.Decode([]byte(pemCert))
+		cert, err := x509.ParseCertificate(b.Bytes)
+		must(t, err)
+		assert.Equal(t, tc.dns, cert.DNSNames, tc.name)
+		ips := make([]string, 0)
+		for _, ip := range cert.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		assert.Equal(t, tc.ipSAN, ips, tc.name)
+		for _, name := range append(tc.dns, tc.ipSAN...) {
+			_, err = cert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+			assert.NoError(t, err, tc.name+" "+name)
+		}
+	}
+
+	_, err := signCSR("no csr", nil, cfg)
+	assert.EqualError(t, err, "cannot decode csr")
+}
+
+func TestConfigureBmcCertificate(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	cfg.Redfish.Bmc.Certificate, _ = newCA(t)
+
+	// the httptest certificate is not signed by the CA
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+	assert.Error(t, r.EnableVerification())
+
+	r, err = NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+	must(t, r.ConfigureBmc(bmcHostname))
+	assert.Contains(t, s.Requests(), "POST /redfish/v1/CertificateService/Actions/CertificateService.ReplaceCertificate")
+	assert.NoError(t, r.EnableVerification(), "expects the certificate to cover the bmc ip")
+	_, err = r.GetData()
+	assert.NoError(t, err)
+}
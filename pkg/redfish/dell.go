@@ -17,18 +17,24 @@
 package redfish
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/sapcc/baremetal_temper/pkg/clients"
 	"github.com/sapcc/baremetal_temper/pkg/config"
 	log "github.com/sirupsen/logrus"
 	"github.com/stmcginnis/gofish/redfish"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 type Dell struct {
 	Default
 }
 
-func NewDell(remoteIP string, cfg config.Config, ctxLogger *log.Entry) (Redfish, error) {
-	c := clients.NewRedfish(cfg, ctxLogger)
+func NewDell(remoteIP string, cfg config.Config, creds clients.CredentialProvider, ctxLogger *log.Entry) (Redfish, error) {
+	c := clients.NewRedfish(cfg, creds, ctxLogger)
 	c.SetEndpoint(remoteIP)
 	r := &Dell{Default: Default{client: c, cfg: cfg, log: ctxLogger}}
 	return r, r.check()
@@ -41,7 +47,6 @@ func (d *Dell) GetData() (*Data, error) {
 	if err := d.client.Connect(); err != nil {
 		return d.Data, err
 	}
-	defer d.client.Logout()
 	d.Data = &Data{}
 	if err := d.getVendorData(); err != nil {
 		return d.Data, err
@@ -101,10 +106,268 @@ func (d *Dell) rebootFromVirtualMedia(boot redfish.Boot) (err error) {
 		ShareParameters: shareParameters{Target: "ALL"},
 		ImportBuffer:    "<SystemConfiguration><Component FQDD=\"iDRAC.Embedded.1\"><Attribute Name=\"ServerBoot.1#BootOnce\">Enabled</Attribute><Attribute Name=\"ServerBoot.1#FirstBootDevice\">VCD-DVD</Attribute></Component></SystemConfiguration>",
 	}
-	_, err = m[0].Client.Post("/redfish/v1/Managers/iDRAC.Embedded.1/Actions/Oem/EID_674_Manager.ImportSystemConfiguration", t)
+	resp, err := m[0].Client.Post("/redfish/v1/Managers/iDRAC.Embedded.1/Actions/Oem/EID_674_Manager.ImportSystemConfiguration", t)
 	if err != nil {
 		return
 	}
-
+	resp.Body.Close()
+	// the boot once setting is applied by an import job, which has to be finished before the reboot
+	if err = d.waitJob(resp.Header.Get("Location")); err != nil {
+		return
+	}
 	return d.Power(false, true)
 }
+
+// BootFromImage boots the node once from the image, the iDRAC boot once setting is imported as system configuration
+func (d *Dell) BootFromImage(path string) (err error) {
+	return d.bootFromImage(path, d.InsertMedia, d.rebootFromVirtualMedia, d.bootOnceConsumed)
+}
+
+// bootOnceConsumed reports if the node is powered on and the iDRAC reset the boot once setting
+func (d *Dell) bootOnceConsumed() (bool, error) {
+	sys, err := d.client.Client.Service.Systems()
+	if err != nil || len(sys) == 0 {
+		return false, fmt.Errorf("cannot load system")
+	}
+	resp, err := d.client.Client.Get("/redfish/v1/Managers/iDRAC.Embedded.1/Attributes")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var a struct {
+		Attributes map[string]interface{}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return false, err
+	}
+	d.log.Debugf("waiting for virtual media boot: power state %s, boot once %v", sys[0].PowerState, a.Attributes["ServerBoot.1.BootOnce"])
+	return sys[0].PowerState == redfish.OnPowerState && a.Attributes["ServerBoot.1.BootOnce"] != "Enabled", nil
+}
+
+const dellJobsPath = "/redfish/v1/Managers/iDRAC.Embedded.1/Jobs"
+
+type dellJob struct {
+	ID       string `json:"Id"`
+	JobType  string
+	JobState string
+	Message  string
+}
+
+// finished reports if the job is done, jobs in any other state block new config jobs for their target
+func (j dellJob) finished() bool {
+	switch j.JobState {
+	case "Completed", "CompletedWithErrors", "Failed", "RebootCompleted", "RebootFailed":
+		return true
+	}
+	return false
+}
+
+func (d *Dell) job(location string) (j dellJob, err error) {
+	resp, err := d.client.Client.Get(location)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&j)
+	return
+}
+
+// pendingJob returns the unfinished job of the type from the iDRAC job queue, nil if there is none
+func (d *Dell) pendingJob(jobType string) (pending *dellJob, err error) {
+	resp, err := d.client.Client.Get(dellJobsPath + "?$expand=*($levels=1)")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var c struct {
+		Members []dellJob
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return
+	}
+	for i, j := range c.Members {
+		if j.JobType == jobType && !j.finished() {
+			return &c.Members[i], nil
+		}
+	}
+	return
+}
+
+// waitJob waits until the iDRAC job at location is completed
+func (d *Dell) waitJob(location string) (err error) {
+	if location == "" {
+		return
+	}
+	cf := wait.ConditionFunc(func() (bool, error) {
+		j, err := d.job(location)
+		if err != nil {
+			return false, nil
+		}
+		d.log.Debugf("waiting for job %s: %s", location, j.JobState)
+		switch j.JobState {
+		case "Completed":
+			return true, nil
+		case "Failed", "CompletedWithErrors":
+			return false, fmt.Errorf("job %s failed: %s", location, j.Message)
+		}
+		return false, nil
+	})
+	return wait.Poll(mediaPollInterval, 5*time.Minute, cf)
+}
+
+// UpdateBios writes the pending bios settings and schedules an iDRAC config job,
+// which applies them with the next reboot. The iDRAC accepts no bios settings while
+// another bios config job is pending, so an existing one is reported as error
+func (d *Dell) UpdateBios(profile config.BiosProfile) (err error) {
+	diff, err := d.GetBiosDiff(profile)
+	if err != nil || len(diff) == 0 {
+		return
+	}
+	pending, err := d.pendingJob("BIOSConfiguration")
+	if err != nil {
+		return fmt.Errorf("cannot load idrac jobs: %s", err.Error())
+	}
+	if pending != nil {
+		return fmt.Errorf("bios config job %s is already pending (%s), it is applied with the next reboot", pending.ID, pending.JobState)
+	}
+	if err = d.patchBios(diff); err != nil {
+		return
+	}
+	type temp struct {
+		TargetSettingsURI string
+	}
+	d.log.Debug("creating bios config job")
+	resp, err := d.client.Client.Post(dellJobsPath, temp{TargetSettingsURI: "/redfish/v1/Systems/System.Embedded.1/Bios/Settings"})
+	if err != nil {
+		return fmt.Errorf("cannot create bios config job: %s", err.Error())
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return fmt.Errorf("idrac returned no location for the bios config job")
+	}
+	// the job stays scheduled until the reboot, it is only checked for being rejected
+	j, err := d.job(location)
+	if err != nil {
+		return
+	}
+	if j.JobState == "Failed" {
+		return fmt.Errorf("bios config job %s failed: %s", location, j.Message)
+	}
+	d.log.Debugf("bios config job %s: %s", location, j.JobState)
+	return
+}
+
+// ConfigureStorage creates the volumes with apply time OnReset, the iDRAC creates the needed jobs itself.
+// If the layout requests jbod, all remaining drives are converted to non raid drives
+func (d *Dell) ConfigureStorage(layout config.StorageLayout) (pending bool, err error) {
+	if err = d.client.Connect(); err != nil {
+		return
+	}
+	pending, used, err := d.configureStorage(layout, "OnReset")
+	if err != nil || !layout.Jbod {
+		return
+	}
+	converted, err := d.convertToNonRAID(used)
+	return pending || converted, err
+}
+
+type dellDrive struct {
+	Oem struct {
+		Dell struct {
+			DellPhysicalDisk struct {
+				RaidStatus string
+			}
+		}
+	}
+}
+
+// convertToNonRAID converts the ready drives of the raid controllers, which are not used by a volume of the layout.
+// Drives of volumes pending until the next reboot are still ready and are part of used.
+// Returns converted = true if a conversion job was created
+func (d *Dell) convertToNonRAID(used map[string]bool) (converted bool, err error) {
+	type temp struct {
+		PDArray []string
+	}
+	type job struct {
+		TargetSettingsURI string
+	}
+	s, err := d.client.Client.Service.Systems()
+	if err != nil {
+		return
+	}
+	st, err := s[0].Storage()
+	if err != nil {
+		return
+	}
+	for _, ctrl := range st {
+		if !strings.HasPrefix(ctrl.ID, "RAID") {
+			continue
+		}
+		ds, err := ctrl.Drives()
+		if err != nil {
+			return converted, err
+		}
+		pds := make([]string, 0)
+		for _, dr := range ds {
+			if used[dr.ODataID] {
+				continue
+			}
+			status, err := d.raidStatus(dr.ODataID)
+			if err != nil {
+				return converted, err
+			}
+			// non raid drives and drives of other volumes are not converted
+			if status != "Ready" {
+				d.log.Debugf("not converting drive %s with raid status %s", dr.ID, status)
+				continue
+			}
+			pds = append(pds, dr.ID)
+		}
+		if len(pds) == 0 {
+			continue
+		}
+		d.log.Infof("converting drives on controller %s to non raid: %v", ctrl.ID, pds)
+		if err = d.post("/redfish/v1/Systems/System.Embedded.1/Oem/Dell/DellRaidService/Actions/DellRaidService.ConvertToNonRAID", temp{PDArray: pds}); err != nil {
+			return converted, fmt.Errorf("cannot convert drives to non raid: %s", err.Error())
+		}
+		if err = d.post(dellJobsPath, job{TargetSettingsURI: ctrl.ODataID}); err != nil {
+			return converted, err
+		}
+		converted = true
+	}
+	return
+}
+
+func (d *Dell) raidStatus(drive string) (status string, err error) {
+	resp, err := d.client.Client.Get(drive)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var dr dellDrive
+	if err = json.NewDecoder(resp.Body).Decode(&dr); err != nil {
+		return
+	}
+	return dr.Oem.Dell.DellPhysicalDisk.RaidStatus, nil
+}
+
+// ConfigureBmc configures the iDRAC baseline, remote syslog is set via the iDRAC attributes
+func (d *Dell) ConfigureBmc(hostname string) (err error) {
+	return d.configureBmc(hostname, d.configureSyslog)
+}
+
+func (d *Dell) configureSyslog(servers []string) (err error) {
+	if len(servers) > 3 {
+		return fmt.Errorf("idrac supports at most 3 syslog servers")
+	}
+	type temp struct {
+		Attributes map[string]interface{}
+	}
+	attrs := map[string]interface{}{"SysLog.1.SysLogEnable": "Enabled"}
+	for i, s := range servers {
+		attrs[fmt.Sprintf("SysLog.1.Server%d", i+1)] = s
+	}
+	d.log.Debugf("configuring idrac syslog: %v", servers)
+	return d.patch("/redfish/v1/Managers/iDRAC.Embedded.1/Attributes", temp{Attributes: attrs})
+}
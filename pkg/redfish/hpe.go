@@ -19,6 +19,7 @@ package redfish
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -44,15 +45,22 @@ type hpeOem struct {
 	}
 }
 
-func NewHpe(remoteIP string, cfg config.Config, ctxLogger *log.Entry) (Redfish, error) {
-	c := clients.NewRedfish(cfg, ctxLogger)
+type hpeVirtualMediaOem struct {
+	Oem struct {
+		Hpe struct {
+			BootOnNextServerReset bool
+		}
+	}
+}
+
+func NewHpe(remoteIP string, cfg config.Config, creds clients.CredentialProvider, ctxLogger *log.Entry) (Redfish, error) {
+	c := clients.NewRedfish(cfg, creds, ctxLogger)
 	c.SetEndpoint(remoteIP)
 	r := &Hpe{Default: Default{client: c, cfg: cfg, log: ctxLogger}}
 	return r, r.check()
 }
 
 func (d *Hpe) WaitPowerStateOn() (err error) {
-	defer d.client.Logout()
 	if err = d.client.Connect(); err != nil {
 		return
 	}
@@ -76,8 +84,60 @@ func (d *Hpe) WaitPowerStateOn() (err error) {
 	return wait.Poll(10*time.Second, 30*time.Minute, cf)
 }
 
+// BootFromImage boots the node once from the image. iLO ignores the one time Cd boot override,
+// the virtual media itself is flagged to be booted with the next server reset
+func (p *Hpe) BootFromImage(path string) (err error) {
+	return p.bootFromImage(path, p.InsertMedia, p.rebootFromVirtualMedia, p.mediaBooted)
+}
+
+// InsertMedia inserts the image and sets BootOnNextServerReset, so the node boots from it with the next reset
+func (p *Hpe) InsertMedia(image string) (err error) {
+	if err = p.Default.InsertMedia(image); err != nil {
+		return
+	}
+	vm, err := p.getDVDMediaType()
+	if err != nil || vm == nil {
+		return fmt.Errorf("no virtual cd/dvd found")
+	}
+	var t hpeVirtualMediaOem
+	t.Oem.Hpe.BootOnNextServerReset = true
+	return p.patch(vm.ODataID, t)
+}
+
+func (p *Hpe) rebootFromVirtualMedia(boot redfish.Boot) (err error) {
+	p.log.Debug("boot from virtual media")
+	return p.Power(false, true)
+}
+
+// mediaBooted reports if the node finished post and the iLO reset BootOnNextServerReset
+func (p *Hpe) mediaBooted() (bool, error) {
+	resp, err := p.client.Client.Get("/redfish/v1/Systems/1/")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var r hpeOem
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return false, err
+	}
+	vm, err := p.getDVDMediaType()
+	if err != nil || vm == nil {
+		return false, fmt.Errorf("no virtual cd/dvd found")
+	}
+	resp, err = p.client.Client.Get(vm.ODataID)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var v hpeVirtualMediaOem
+	if err = json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return false, err
+	}
+	p.log.Debugf("waiting for virtual media boot: post state %s, boot on next reset %t", r.Oem.Hpe.PostState, v.Oem.Hpe.BootOnNextServerReset)
+	return r.Oem.Hpe.PostState == "FinishedPost" && !v.Oem.Hpe.BootOnNextServerReset, nil
+}
+
 func (d *Hpe) GetData() (*Data, error) {
-	defer d.client.Logout()
 	if err := d.client.Connect(); err != nil {
 		return d.Data, err
 	}
@@ -87,7 +147,6 @@ func (d *Hpe) GetData() (*Data, error) {
 	if err := d.client.Connect(); err != nil {
 		return d.Data, err
 	}
-	defer d.client.Logout()
 	d.Data = &Data{}
 	if err := d.getVendorData(); err != nil {
 		return d.Data, err
@@ -159,6 +218,7 @@ func (p *Hpe) getNetworkDevices() (err error) {
 				Nic:            nic,
 				Port:           port,
 				PortLinkStatus: ls,
+				SpeedMbps:      e.SpeedMbps,
 			})
 		}
 	}
@@ -277,3 +337,152 @@ func (p *Hpe) addDisk(d *redfish.Drive, storageName string) {
 		}
 	}
 }
+
+type hpeSmartStorageConfig struct {
+	LogicalDrives  []hpeLogicalDrive  `json:"LogicalDrives"`
+	PhysicalDrives []hpePhysicalDrive `json:"PhysicalDrives,omitempty"`
+	DataGuard      string             `json:"DataGuard,omitempty"`
+}
+
+type hpeLogicalDrive struct {
+	LogicalDriveName string   `json:"LogicalDriveName"`
+	Raid             string   `json:"Raid"`
+	DataDrives       []string `json:"DataDrives"`
+	CapacityGiB      int64    `json:"CapacityGiB,omitempty"`
+}
+
+type hpePhysicalDrive struct {
+	Location string `json:"Location"`
+}
+
+// ConfigureStorage uses the smart storage config of the iLO, which is applied with the next reboot.
+// For HPE the drives regex of a volume layout is matched against the drive location, e.g. 1I:1:1
+func (p *Hpe) ConfigureStorage(layout config.StorageLayout) (pending bool, err error) {
+	if layout.Jbod {
+		return pending, fmt.Errorf("storage layout %s: jbod is not supported for hpe", layout.Name)
+	}
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	sc, err := p.getSmartStorageConfig()
+	if err != nil {
+		return
+	}
+	existing := make(map[string]hpeLogicalDrive)
+	for _, ld := range sc.LogicalDrives {
+		existing[ld.LogicalDriveName] = ld
+	}
+	used := make(map[string]bool)
+	lds := make([]hpeLogicalDrive, 0)
+	for _, vl := range layout.Volumes {
+		ld, ok := existing[vl.Name]
+		if !ok || len(ld.DataDrives) != vl.DriveCount {
+			pending = true
+			continue
+		}
+		for _, d := range ld.DataDrives {
+			used[d] = true
+		}
+		lds = append(lds, hpeLogicalDrive{LogicalDriveName: ld.LogicalDriveName, Raid: ld.Raid, DataDrives: ld.DataDrives})
+	}
+	if !pending && len(lds) == len(sc.LogicalDrives) {
+		p.log.Debug("smart storage config matches layout")
+		return
+	}
+	for _, vl := range layout.Volumes {
+		if ld, ok := existing[vl.Name]; ok && len(ld.DataDrives) == vl.DriveCount {
+			continue
+		}
+		re, err := regexp.Compile(`(?i)` + vl.Drives)
+		if err != nil {
+			return pending, err
+		}
+		drives := make([]string, 0)
+		for _, pd := range sc.PhysicalDrives {
+			if len(drives) == vl.DriveCount {
+				break
+			}
+			if !used[pd.Location] && re.MatchString(pd.Location) {
+				drives = append(drives, pd.Location)
+				used[pd.Location] = true
+			}
+		}
+		if len(drives) != vl.DriveCount {
+			return pending, fmt.Errorf("cannot configure volume %s: found %d matching drives, expected %d", vl.Name, len(drives), vl.DriveCount)
+		}
+		lds = append(lds, hpeLogicalDrive{
+			LogicalDriveName: vl.Name,
+			Raid:             strings.Title(strings.ToLower(vl.RAIDType)),
+			DataDrives:       drives,
+		})
+	}
+	p.log.Infof("updating smart storage config: %v", lds)
+	// logical drives missing in the settings are deleted by the iLO
+	resp, err := p.client.Client.Put("/redfish/v1/Systems/1/smartstorageconfig/settings/", hpeSmartStorageConfig{
+		LogicalDrives: lds,
+		DataGuard:     "Disabled",
+	})
+	if err != nil {
+		return true, err
+	}
+	return true, resp.Body.Close()
+}
+
+// GetRootVolume returns the root logical drive of the smart storage config
+func (p *Hpe) GetRootVolume(layout config.StorageLayout) (root RootDisk, err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	vl, err := layout.RootVolume()
+	if err != nil {
+		return
+	}
+	sc, err := p.getSmartStorageConfig()
+	if err != nil {
+		return
+	}
+	for _, ld := range sc.LogicalDrives {
+		if ld.LogicalDriveName == vl.Name {
+			return RootDisk{
+				Name: ld.LogicalDriveName,
+				//inspector converts bytes to gibibyte
+				Size: int64(float64(ld.CapacityGiB*1024*1024*1024) * 1.074),
+			}, nil
+		}
+	}
+	return root, fmt.Errorf("root volume %s not found", vl.Name)
+}
+
+func (p *Hpe) getSmartStorageConfig() (sc hpeSmartStorageConfig, err error) {
+	resp, err := p.client.Client.Get("/redfish/v1/Systems/1/smartstorageconfig/")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&sc)
+	return
+}
+
+// ConfigureBmc configures the iLO baseline, remote syslog is set via the iLO network protocol oem settings
+func (p *Hpe) ConfigureBmc(hostname string) (err error) {
+	return p.configureBmc(hostname, p.configureSyslog)
+}
+
+func (p *Hpe) configureSyslog(servers []string) (err error) {
+	if len(servers) > 1 {
+		p.log.Warnf("ilo supports a single syslog server, using %s", servers[0])
+	}
+	type hpe struct {
+		RemoteSyslogEnabled bool
+		RemoteSyslogServer  string
+	}
+	type temp struct {
+		Oem struct {
+			Hpe hpe
+		}
+	}
+	t := temp{}
+	t.Oem.Hpe = hpe{RemoteSyslogEnabled: true, RemoteSyslogServer: servers[0]}
+	p.log.Debugf("configuring ilo syslog: %s", servers[0])
+	return p.patch("/redfish/v1/Managers/1/NetworkProtocol", t)
+}
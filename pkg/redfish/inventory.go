@@ -0,0 +1,124 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// GetInventory loads the node's cpus, gpus, dimms, drives, nics and power supplies with manufacturer, part number and serial.
+// Absent components (empty slots) are skipped
+func (p *Default) GetInventory() (cs []Component, err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	cs = make([]Component, 0)
+	sys, err := p.client.Client.Service.Systems()
+	if err != nil {
+		return
+	}
+	if len(sys) == 0 {
+		return cs, fmt.Errorf("redfish systems != 1")
+	}
+	procs, err := sys[0].Processors()
+	if err != nil {
+		return
+	}
+	for _, pr := range procs {
+		if pr.Status.State == common.AbsentState {
+			continue
+		}
+		t := "cpu"
+		if pr.ProcessorType == redfish.GPUProcessorType {
+			t = "gpu"
+		}
+		location := pr.Socket
+		if location == "" {
+			location = pr.ID
+		}
+		cs = append(cs, Component{Type: t, Location: location, Manufacturer: pr.Manufacturer, Model: pr.Model})
+	}
+	mem, err := sys[0].Memory()
+	if err != nil {
+		return
+	}
+	for _, m := range mem {
+		if m.SerialNumber == "" || m.Status.State == common.AbsentState {
+			continue
+		}
+		cs = append(cs, Component{Type: "dimm", Location: m.DeviceLocator, Manufacturer: m.Manufacturer, PartNumber: m.PartNumber, Serial: m.SerialNumber})
+	}
+	st, err := sys[0].Storage()
+	if err != nil {
+		return
+	}
+	for _, ctrl := range st {
+		ds, err := ctrl.Drives()
+		if err != nil {
+			return cs, err
+		}
+		for _, d := range ds {
+			if d.Status.State == common.AbsentState {
+				continue
+			}
+			// drive ids are per controller on hpe
+			location := d.ID
+			if !strings.Contains(location, ctrl.ID) {
+				location = ctrl.ID + "/" + d.ID
+			}
+			cs = append(cs, Component{Type: "drive", Location: location, Manufacturer: d.Manufacturer, Model: d.Model, PartNumber: d.PartNumber, Serial: d.SerialNumber})
+		}
+	}
+	ch, err := p.client.Client.Service.Chassis()
+	if err != nil {
+		return
+	}
+	for _, c := range ch {
+		nas, err := c.NetworkAdapters()
+		if err != nil {
+			return cs, err
+		}
+		for _, na := range nas {
+			cs = append(cs, Component{Type: "nic", Location: na.ID, Manufacturer: na.Manufacturer, Model: na.Model, PartNumber: na.PartNumber, Serial: na.SerialNumber})
+		}
+		pw, err := c.Power()
+		if err != nil {
+			p.log.Debugf("cannot load power supplies of chassis %s: %s", c.ID, err.Error())
+			continue
+		}
+		if pw == nil {
+			continue
+		}
+		for _, ps := range pw.PowerSupplies {
+			if ps.Status.State == common.AbsentState {
+				continue
+			}
+			location := ps.Name
+			if location == "" {
+				location = ps.MemberID
+			}
+			cs = append(cs, Component{Type: "psu", Location: location, Manufacturer: ps.Manufacturer, Model: ps.Model, PartNumber: ps.PartNumber, Serial: ps.SerialNumber})
+		}
+	}
+	s := Snapshot{Components: cs}
+	s.Sort()
+	return s.Components, nil
+}
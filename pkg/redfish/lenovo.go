@@ -18,6 +18,7 @@ package redfish
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -30,8 +31,8 @@ type Lenovo struct {
 	Default
 }
 
-func NewLenovo(remoteIP string, cfg config.Config, ctxLogger *log.Entry) (Redfish, error) {
-	c := clients.NewRedfish(cfg, ctxLogger)
+func NewLenovo(remoteIP string, cfg config.Config, creds clients.CredentialProvider, ctxLogger *log.Entry) (Redfish, error) {
+	c := clients.NewRedfish(cfg, creds, ctxLogger)
 	c.SetEndpoint(remoteIP)
 	r := &Lenovo{Default: Default{client: c, cfg: cfg, log: ctxLogger}}
 	return r, r.check()
@@ -44,7 +45,6 @@ func (d *Lenovo) GetData() (*Data, error) {
 	if err := d.client.Connect(); err != nil {
 		return d.Data, err
 	}
-	defer d.client.Logout()
 	d.Data = &Data{}
 	if err := d.getVendorData(); err != nil {
 		return d.Data, err
@@ -64,6 +64,13 @@ func (d *Lenovo) GetData() (*Data, error) {
 	return d.Data, nil
 }
 
+// BootFromImage mounts the image with the xcc flow and boots it with the one time Cd boot override
+func (p *Lenovo) BootFromImage(path string) (err error) {
+	return p.bootFromImage(path, p.InsertMedia, p.rebootFromVirtualMedia, p.overrideConsumed)
+}
+
+// InsertMedia mounts the image by patching the virtual media, the xcc does not implement the InsertMedia action
+// and needs the transfer protocol of the image
 func (p *Lenovo) InsertMedia(image string) (err error) {
 	p.log.Debug("insert virtual media")
 	vm, err := p.getDVDMediaType()
@@ -75,14 +82,16 @@ func (p *Lenovo) InsertMedia(image string) (err error) {
 			err = vm.EjectMedia()
 		}
 		type temp struct {
-			Image          string
-			Inserted       bool `json:"Inserted"`
-			WriteProtected bool `json:"WriteProtected"`
+			Image                string
+			Inserted             bool   `json:"Inserted"`
+			WriteProtected       bool   `json:"WriteProtected"`
+			TransferProtocolType string `json:"TransferProtocolType,omitempty"`
 		}
 		t := temp{
-			Image:          image,
-			Inserted:       true,
-			WriteProtected: false,
+			Image:                image,
+			Inserted:             true,
+			WriteProtected:       false,
+			TransferProtocolType: transferProtocol(image),
 		}
 		return vm.InsertMedia(image, "PATCH", t)
 	}
@@ -158,7 +167,8 @@ func (p *Lenovo) getDisks() (err error) {
 		}
 	}
 	if rootDisk.Size == 0 {
-		panic("unable to detect root disk")
+		// no volume configured yet. storage.configure sets the root disk after creating it
+		p.log.Warn("unable to detect root disk")
 	}
 	p.Data.RootDisk = rootDisk
 	return
@@ -210,6 +220,7 @@ func (p *Lenovo) getNetworkDevices() (err error) {
 				Nic:            nic,
 				Port:           port,
 				PortLinkStatus: np.LinkStatus,
+				SpeedMbps:      np.CurrentLinkSpeedMbps,
 			})
 		}
 	}
@@ -224,3 +235,12 @@ func (p *Lenovo) mapInterfaceToNetbox(id string, slot int) (name string, port, n
 	}
 	return fmt.Sprintf("NIC%d-port%s", slot, id), port, slot
 }
+
+// transferProtocol returns the redfish transfer protocol type of the image url, e.g. HTTPS
+func transferProtocol(image string) string {
+	u, err := url.Parse(image)
+	if err != nil || u.Scheme == "" {
+		return ""
+	}
+	return strings.ToUpper(u.Scheme)
+}
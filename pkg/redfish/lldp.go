@@ -0,0 +1,176 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/stmcginnis/gofish/common"
+)
+
+const dellSwitchConnectionsPath = "/redfish/v1/Systems/System.Embedded.1/NetworkPorts/Oem/Dell/DellSwitchConnections"
+
+// LldpNeighbor is the switch port a node interface is connected to, as received by the nic and reported by the bmc.
+// SystemName is empty if the bmc only knows the switch's chassis id
+type LldpNeighbor struct {
+	Mac        string
+	ChassisID  string
+	SystemName string
+	PortID     string
+}
+
+// port of a network adapter (Port schema v1.4+)
+type adapterPort struct {
+	Ethernet struct {
+		AssociatedMACAddresses []string
+		LLDPReceive            struct {
+			ChassisId  string
+			PortId     string
+			SystemName string
+		}
+	}
+}
+
+type dellSwitchConnection struct {
+	FQDD                   string
+	SwitchConnectionID     string
+	SwitchPortConnectionID string
+	StaleData              string
+}
+
+// GetLldpNeighbors returns the lldp data received by the network adapter ports
+func (p *Default) GetLldpNeighbors() (nbs []LldpNeighbor, err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	ch, err := p.client.Client.Service.Chassis()
+	if err != nil || len(ch) == 0 {
+		return nbs, fmt.Errorf("cannot load chassis")
+	}
+	na, err := ch[0].NetworkAdapters()
+	if err != nil {
+		return
+	}
+	nbs = make([]LldpNeighbor, 0)
+	for _, a := range na {
+		resp, err := p.client.Client.Get(a.ODataID + "/Ports")
+		if err != nil {
+			p.log.Debugf("no ports of network adapter %s: %s", a.ID, err.Error())
+			continue
+		}
+		var ports common.Collection
+		err = json.NewDecoder(resp.Body).Decode(&ports)
+		resp.Body.Close()
+		if err != nil {
+			return nbs, err
+		}
+		for _, l := range ports.ItemLinks {
+			resp, err := p.client.Client.Get(l)
+			if err != nil {
+				return nbs, err
+			}
+			var port adapterPort
+			err = json.NewDecoder(resp.Body).Decode(&port)
+			resp.Body.Close()
+			if err != nil {
+				return nbs, err
+			}
+			lldp := port.Ethernet.LLDPReceive
+			if lldp.PortId == "" || len(port.Ethernet.AssociatedMACAddresses) == 0 {
+				continue
+			}
+			nbs = append(nbs, LldpNeighbor{
+				Mac:        strings.ToLower(port.Ethernet.AssociatedMACAddresses[0]),
+				ChassisID:  lldp.ChassisId,
+				SystemName: lldp.SystemName,
+				PortID:     lldp.PortId,
+			})
+		}
+	}
+	return
+}
+
+// GetLldpNeighbors returns the switch connections the idrac collects via lldp
+func (p *Dell) GetLldpNeighbors() (nbs []LldpNeighbor, err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	macs, err := p.portMacs()
+	if err != nil {
+		return
+	}
+	resp, err := p.client.Client.Get(dellSwitchConnectionsPath)
+	if err != nil {
+		return
+	}
+	var conns struct {
+		Members []dellSwitchConnection
+	}
+	err = json.NewDecoder(resp.Body).Decode(&conns)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	nbs = make([]LldpNeighbor, 0)
+	for _, c := range conns.Members {
+		if c.SwitchPortConnectionID == "" || strings.EqualFold(c.SwitchPortConnectionID, "No Link") || c.StaleData == "StaleData" {
+			continue
+		}
+		// partition fqdd: NIC.Integrated.1-1-1 of port NIC.Integrated.1-1
+		mac, ok := macs[c.FQDD]
+		if i := strings.LastIndex(c.FQDD, "-"); !ok && i > 0 {
+			mac, ok = macs[c.FQDD[:i]]
+		}
+		if !ok {
+			continue
+		}
+		nbs = append(nbs, LldpNeighbor{Mac: mac, ChassisID: c.SwitchConnectionID, PortID: c.SwitchPortConnectionID})
+	}
+	return
+}
+
+// portMacs returns the mac addresses of the network ports by their id
+func (p *Dell) portMacs() (macs map[string]string, err error) {
+	macs = make(map[string]string)
+	ch, err := p.client.Client.Service.Chassis()
+	if err != nil || len(ch) == 0 {
+		return macs, fmt.Errorf("cannot load chassis")
+	}
+	na, err := ch[0].NetworkAdapters()
+	if err != nil {
+		return
+	}
+	for _, a := range na {
+		nps, err := a.NetworkPorts()
+		if err != nil {
+			return macs, err
+		}
+		for _, np := range nps {
+			if len(np.AssociatedNetworkAddresses) == 0 {
+				continue
+			}
+			mac, err := parseMac(np.AssociatedNetworkAddresses[0], ':')
+			if err != nil {
+				continue
+			}
+			macs[np.ID] = strings.ToLower(mac)
+		}
+	}
+	return
+}
@@ -0,0 +1,102 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mock
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+)
+
+const certificateServicePath = "/redfish/v1/CertificateService"
+
+// addCertificateService adds the certificate service and the https certificate of the manager
+func (s *Server) addCertificateService() {
+	s.resources[certificateServicePath] = map[string]interface{}{
+		"@odata.id": certificateServicePath,
+		"Id":        "CertificateService",
+		"Actions": map[string]interface{}{
+			"#CertificateService.GenerateCSR": map[string]interface{}{
+				"target": certificateServicePath + "/Actions/CertificateService.GenerateCSR",
+			},
+			"#CertificateService.ReplaceCertificate": map[string]interface{}{
+				"target": certificateServicePath + "/Actions/CertificateService.ReplaceCertificate",
+			},
+		},
+	}
+	m := s.resources["/redfish/v1/Managers"]["Members"].([]interface{})[0].(map[string]interface{})
+	s.addMember(fmt.Sprintf("%s/NetworkProtocol/HTTPS/Certificates", m["@odata.id"]), "1", map[string]interface{}{"CertificateType": "PEM"})
+}
+
+// serveCertificate serves the replaced certificate once there is one, else the httptest certificate
+func (s *Server) serveCertificate() {
+	def := s.TLS.Certificates[0]
+	s.TLS.Certificates = nil
+	s.TLS.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.cert != nil {
+			return s.cert, nil
+		}
+		return &def, nil
+	}
+}
+
+// generateCSR creates a key and its csr. Like the bmcs all alternative names are dns names
+func (s *Server) generateCSR(w http.ResponseWriter, body map[string]interface{}) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Base.1.8.InternalError", err.Error())
+		return
+	}
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: fmt.Sprintf("%v", body["CommonName"])}}
+	names, _ := body["AlternativeNames"].([]interface{})
+	for _, n := range names {
+		tmpl.DNSNames = append(tmpl.DNSNames, fmt.Sprintf("%v", n))
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Base.1.8.InternalError", err.Error())
+		return
+	}
+	s.csrKey = key
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"CSRString":             string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+		"CertificateCollection": body["CertificateCollection"],
+	})
+}
+
+// replaceCertificate serves the certificate of the last csr
+func (s *Server) replaceCertificate(w http.ResponseWriter, body map[string]interface{}) {
+	if s.csrKey == nil {
+		writeError(w, http.StatusBadRequest, "Base.1.8.ActionParameterValueError", "No certificate signing request was generated.")
+		return
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(s.csrKey)})
+	cert, err := tls.X509KeyPair([]byte(fmt.Sprintf("%v", body["CertificateString"])), key)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Base.1.8.ActionParameterValueError", err.Error())
+		return
+	}
+	s.cert = &cert
+	w.WriteHeader(http.StatusNoContent)
+}
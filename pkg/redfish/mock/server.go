@@ -0,0 +1,676 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mock provides a redfish emulator serving recorded resource trees of the supported vendor models.
+// It models power state transitions, virtual media, pending bios settings, the Dell job and ePSA endpoints
+// and the certificate service, so the vendor clients can be tested without real BMCs.
+package mock
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed fixtures/*.json
+var fixtures embed.FS
+
+// models with recorded fixtures
+const (
+	R640  = "r640"
+	DL360 = "dl360"
+	SR650 = "sr650"
+)
+
+const (
+	sessionsPath   = "/redfish/v1/SessionService/Sessions"
+	dellJobsPath   = "/redfish/v1/Managers/iDRAC.Embedded.1/Jobs"
+	epsaResultPath = "/redfish/v1/Dell/Managers/iDRAC.Embedded.1/DellLCService/ePSAResult"
+)
+
+// DefaultEPSAResult is a passing ePSA diagnostics export
+const DefaultEPSAResult = `** Memory Test **
+Test Results : Pass
+** Hard Drive Test **
+Test Results : Pass
+** Network Test **
+Test Results : Pass
+`
+
+// Server is a TLS httptest server emulating the BMC of a vendor model
+type Server struct {
+	*httptest.Server
+	Username string
+	// Password is changed by patching the account of Username
+	Password string
+	// EPSAResult is returned by the Dell ePSA result export
+	EPSAResult string
+	// JobState is the state new Dell jobs are created with, bios config jobs are scheduled until the next boot
+	JobState string
+
+	mu        sync.Mutex
+	resources map[string]map[string]interface{}
+	tokens    map[string]string
+	requests  []string
+	boots     []string
+	ids       int
+	// changes applied with the next boot, like the OnReset volumes and non raid conversions of the iDRAC
+	onReset []func()
+	// key of the last csr and the certificate replacing the httptest certificate
+	csrKey *rsa.PrivateKey
+	cert   *tls.Certificate
+}
+
+// New starts a server serving the fixture of the model. Requests need to be authenticated with root/calvin
+func New(model string) (s *Server, err error) {
+	b, err := fixtures.ReadFile("fixtures/" + model + ".json")
+	if err != nil {
+		return s, fmt.Errorf("no fixture found for model %s", model)
+	}
+	s = &Server{
+		Username:   "root",
+		Password:   "calvin",
+		EPSAResult: DefaultEPSAResult,
+		JobState:   "Completed",
+		tokens:     make(map[string]string),
+		requests:   make([]string, 0),
+		boots:      make([]string, 0),
+	}
+	if err = json.Unmarshal(b, &s.resources); err != nil {
+		return s, fmt.Errorf("cannot parse fixture %s: %s", model, err.Error())
+	}
+	s.addCertificateService()
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	s.StartTLS()
+	s.serveCertificate()
+	return
+}
+
+// Host returns host:port of the server, which is used as the node's remote ip
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "https://")
+}
+
+// Resource returns a copy of the resource at path
+func (s *Server) Resource(path string) (res map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.resources[strings.TrimSuffix(path, "/")]
+	if !ok {
+		return
+	}
+	b, _ := json.Marshal(r)
+	json.Unmarshal(b, &res)
+	return
+}
+
+// SetResource adds or replaces the resource at path
+func (s *Server) SetResource(path string, res map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resources[strings.TrimSuffix(path, "/")] = res
+}
+
+// PowerState returns the power state of the system
+func (s *Server) PowerState() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%v", s.system()["PowerState"])
+}
+
+// SetPowerState sets the power state of the system without a transition
+func (s *Server) SetPowerState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setPowerState(state)
+}
+
+// Boots returns the boot sources of all boots since the server was started
+func (s *Server) Boots() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.boots...)
+}
+
+// Sessions returns the number of open sessions
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokens)
+}
+
+// ExpireSessions invalidates all session tokens, like a bmc reset or session timeout
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]string)
+}
+
+// Requests returns all handled requests as "METHOD path"
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	s.requests = append(s.requests, r.Method+" "+path)
+
+	if !s.authorized(r, path) {
+		writeError(w, http.StatusUnauthorized, "Base.1.8.NoValidSession", "There is no valid session established with the implementation.")
+		return
+	}
+	body := make(map[string]interface{})
+	if r.Body != nil && (r.Method == http.MethodPost || r.Method == http.MethodPatch || r.Method == http.MethodPut) {
+		// empty bodies are valid for actions like EjectMedia
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if path == epsaResultPath {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, s.EPSAResult)
+			return
+		}
+		res, ok := s.resources[path]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Base.1.8.ResourceMissingAtURI", fmt.Sprintf("The resource at the URI %s was not found.", path))
+			return
+		}
+		if r.URL.Query().Get("$expand") != "" {
+			res = s.expand(res)
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPatch, http.MethodPut:
+		res, ok := s.resources[path]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Base.1.8.ResourceMissingAtURI", fmt.Sprintf("The resource at the URI %s was not found.", path))
+			return
+		}
+		merge(res, body)
+		if pw, ok := body["Password"].(string); ok && strings.HasPrefix(path, "/redfish/v1/AccountService/Accounts/") && res["UserName"] == s.Username {
+			s.Password = pw
+		}
+		// virtual media without actions (e.g. lenovo xcc) is mounted by patching the image
+		if _, ok := body["Image"]; ok && strings.Contains(path, "/VirtualMedia/") {
+			if res["Image"] != "" && res["Inserted"] == true {
+				res["ConnectedVia"] = "URI"
+			} else {
+				res["ConnectedVia"] = "NotConnected"
+			}
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPost:
+		s.post(w, path, body)
+	case http.MethodDelete:
+		s.delete(w, path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) authorized(r *http.Request, path string) bool {
+	if s.Username == "" || path == "/redfish/v1" || path == "/redfish" || (path == sessionsPath && r.Method == http.MethodPost) {
+		return true
+	}
+	if _, ok := s.tokens[r.Header.Get("X-Auth-Token")]; ok {
+		return true
+	}
+	u, p, ok := r.BasicAuth()
+	return ok && u == s.Username && p == s.Password
+}
+
+func (s *Server) post(w http.ResponseWriter, path string, body map[string]interface{}) {
+	switch {
+	case path == sessionsPath:
+		s.createSession(w, body)
+	case strings.HasSuffix(path, "/Actions/ComputerSystem.Reset"):
+		if err := s.reset(fmt.Sprintf("%v", body["ResetType"])); err != nil {
+			writeError(w, http.StatusBadRequest, "Base.1.8.ActionParameterNotSupported", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/Actions/VirtualMedia.InsertMedia"):
+		vm, ok := s.resources[strings.TrimSuffix(path, "/Actions/VirtualMedia.InsertMedia")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		vm["Image"] = body["Image"]
+		vm["Inserted"] = true
+		vm["ConnectedVia"] = "URI"
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/Actions/VirtualMedia.EjectMedia"):
+		vm, ok := s.resources[strings.TrimSuffix(path, "/Actions/VirtualMedia.EjectMedia")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		vm["Image"] = ""
+		vm["Inserted"] = false
+		vm["ConnectedVia"] = "NotConnected"
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "EID_674_Manager.ImportSystemConfiguration"):
+		if buf, ok := body["ImportBuffer"].(string); ok && strings.Contains(buf, "VCD-DVD") {
+			s.idracAttributes()["ServerBoot.1.BootOnce"] = "Enabled"
+			s.idracAttributes()["ServerBoot.1.FirstBootDevice"] = "VCD-DVD"
+		}
+		s.createJob(w, "ImportConfiguration", s.JobState, http.StatusAccepted)
+	case strings.HasSuffix(path, "DellLCService.RunePSADiagnostics"):
+		for _, j := range s.jobs() {
+			if j["JobType"] == "RemoteDiagnostics" && j["JobState"] == "Running" {
+				writeError(w, http.StatusBadRequest, "IDRAC.2.7.SYS098", "A Remote Diagnostic (ePSA) job already exists.")
+				return
+			}
+		}
+		s.createJob(w, "RemoteDiagnostics", s.JobState, http.StatusAccepted)
+	case strings.HasSuffix(path, "DellLCService.ExportePSADiagnosticsResult"):
+		w.Header().Set("Location", epsaResultPath)
+		w.WriteHeader(http.StatusAccepted)
+	case path == certificateServicePath+"/Actions/CertificateService.GenerateCSR":
+		s.generateCSR(w, body)
+	case path == certificateServicePath+"/Actions/CertificateService.ReplaceCertificate":
+		s.replaceCertificate(w, body)
+	case path == dellJobsPath && strings.HasSuffix(fmt.Sprintf("%v", body["TargetSettingsURI"]), "/Bios/Settings"):
+		s.createBiosJob(w, fmt.Sprintf("%v", body["TargetSettingsURI"]))
+	case path == dellJobsPath:
+		s.createJob(w, "ConfigJob", s.JobState, http.StatusOK)
+	case strings.HasSuffix(path, "DellRaidService.ConvertToNonRAID"):
+		s.convertToNonRAID(w, body)
+	default:
+		res, ok := s.resources[path]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Base.1.8.ResourceMissingAtURI", fmt.Sprintf("The resource at the URI %s was not found.", path))
+			return
+		}
+		if _, ok := res["Members"]; !ok {
+			writeError(w, http.StatusMethodNotAllowed, "Base.1.8.OperationNotAllowed", "The operation is not allowed for this resource.")
+			return
+		}
+		s.ids++
+		id := strconv.Itoa(s.ids)
+		if body["@Redfish.OperationApplyTime"] == "OnReset" {
+			delete(body, "@Redfish.OperationApplyTime")
+			s.onReset = append(s.onReset, func() { s.createMember(path, id, body) })
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		member := s.createMember(path, id, body)
+		w.Header().Set("Location", member)
+		writeJSON(w, http.StatusCreated, s.resources[member])
+	}
+}
+
+// createMember adds the member to the collection. The drives of a new volume are online
+func (s *Server) createMember(collection, id string, res map[string]interface{}) (p string) {
+	p = s.addMember(collection, id, res)
+	links, _ := res["Links"].(map[string]interface{})
+	drives, _ := links["Drives"].([]interface{})
+	for _, d := range drives {
+		dr, _ := d.(map[string]interface{})
+		s.setRaidStatus(fmt.Sprintf("%v", dr["@odata.id"]), "Online")
+	}
+	return
+}
+
+// convertToNonRAID converts the drives with the next boot. Like the iDRAC, it rejects drives which are not ready
+func (s *Server) convertToNonRAID(w http.ResponseWriter, body map[string]interface{}) {
+	pds, _ := body["PDArray"].([]interface{})
+	drives := make([]string, 0)
+	for _, pd := range pds {
+		for p, res := range s.resources {
+			if !strings.HasSuffix(p, fmt.Sprintf("/Drives/%v", pd)) {
+				continue
+			}
+			if raidStatus(res) != "Ready" {
+				writeError(w, http.StatusBadRequest, "IDRAC.2.7.STOR018", fmt.Sprintf("The command was not successful for %v because the physical disk is not ready.", pd))
+				return
+			}
+			drives = append(drives, p)
+		}
+	}
+	if len(drives) != len(pds) {
+		writeError(w, http.StatusBadRequest, "IDRAC.2.7.STOR043", "The physical disk was not found.")
+		return
+	}
+	s.onReset = append(s.onReset, func() {
+		for _, p := range drives {
+			s.setRaidStatus(p, "NonRAID")
+		}
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func raidStatus(drive map[string]interface{}) string {
+	oem, _ := drive["Oem"].(map[string]interface{})
+	dell, _ := oem["Dell"].(map[string]interface{})
+	pd, _ := dell["DellPhysicalDisk"].(map[string]interface{})
+	status, _ := pd["RaidStatus"].(string)
+	return status
+}
+
+// setRaidStatus sets the raid status of a Dell drive, drives of other vendors are not changed
+func (s *Server) setRaidStatus(drive, status string) {
+	oem, _ := s.resources[drive]["Oem"].(map[string]interface{})
+	dell, _ := oem["Dell"].(map[string]interface{})
+	if pd, ok := dell["DellPhysicalDisk"].(map[string]interface{}); ok {
+		pd["RaidStatus"] = status
+	}
+}
+
+// delete removes the resource. Like on the iDRAC the drives of a deleted volume are ready after the next boot
+func (s *Server) delete(w http.ResponseWriter, path string) {
+	res, ok := s.resources[path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	links, _ := res["Links"].(map[string]interface{})
+	drives, _ := links["Drives"].([]interface{})
+	for _, d := range drives {
+		dr, _ := d.(map[string]interface{})
+		drive := fmt.Sprintf("%v", dr["@odata.id"])
+		s.onReset = append(s.onReset, func() { s.setRaidStatus(drive, "Ready") })
+	}
+	delete(s.resources, path)
+	for t, p := range s.tokens {
+		if p == path {
+			delete(s.tokens, t)
+		}
+	}
+	parent := path[:strings.LastIndex(path, "/")]
+	if c, ok := s.resources[parent]; ok {
+		members := make([]interface{}, 0)
+		for _, m := range c["Members"].([]interface{}) {
+			if m.(map[string]interface{})["@odata.id"] != path {
+				members = append(members, m)
+			}
+		}
+		c["Members"] = members
+		c["Members@odata.count"] = len(members)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createSession(w http.ResponseWriter, body map[string]interface{}) {
+	if s.Username != "" && (body["UserName"] != s.Username || body["Password"] != s.Password) {
+		writeError(w, http.StatusUnauthorized, "Base.1.8.NoValidSession", "Invalid credentials.")
+		return
+	}
+	s.ids++
+	token := fmt.Sprintf("token-%d", s.ids)
+	p := s.addMember(sessionsPath, strconv.Itoa(s.ids), map[string]interface{}{"UserName": body["UserName"]})
+	s.tokens[token] = p
+	w.Header().Set("X-Auth-Token", token)
+	w.Header().Set("Location", p)
+	writeJSON(w, http.StatusCreated, s.resources[p])
+}
+
+func (s *Server) createJob(w http.ResponseWriter, jobType, state string, status int) (p string) {
+	s.ids++
+	id := fmt.Sprintf("JID_%012d", s.ids)
+	p = s.addMember(dellJobsPath, id, map[string]interface{}{
+		"@odata.type":     "#DellJob.v1_0_2.DellJob",
+		"Name":            jobType,
+		"JobType":         jobType,
+		"JobState":        state,
+		"PercentComplete": 100,
+		"Message":         "Job completed successfully.",
+		"CompletionTime":  "2021-01-01T00:00:00",
+	})
+	if state == "Scheduled" {
+		s.resources[p]["PercentComplete"] = 0
+		s.resources[p]["Message"] = "Task successfully scheduled."
+		s.resources[p]["CompletionTime"] = nil
+	}
+	w.Header().Set("Location", p)
+	w.WriteHeader(status)
+	return
+}
+
+// createBiosJob schedules the bios config job, which applies the pending bios settings with the next reboot.
+// Like the iDRAC only one bios config job can be pending
+func (s *Server) createBiosJob(w http.ResponseWriter, settings string) {
+	for _, j := range s.jobs() {
+		if j["JobType"] == "BIOSConfiguration" && j["JobState"] == "Scheduled" {
+			writeError(w, http.StatusBadRequest, "IDRAC.2.7.SYS011", "Pending configuration values are already committed, unable to perform another set operation.")
+			return
+		}
+	}
+	p := s.createJob(w, "BIOSConfiguration", "Scheduled", http.StatusOK)
+	s.onReset = append(s.onReset, func() {
+		s.applyBiosSettings(settings)
+		s.resources[p]["JobState"] = "Completed"
+		s.resources[p]["PercentComplete"] = 100
+		s.resources[p]["Message"] = "Job completed successfully."
+	})
+}
+
+// applyBiosSettings merges the pending attributes of the settings resource into the bios
+func (s *Server) applyBiosSettings(settings string) {
+	pending, _ := s.resources[settings]["Attributes"].(map[string]interface{})
+	if len(pending) == 0 {
+		return
+	}
+	if bios, ok := s.resources[strings.TrimSuffix(settings, "/Settings")]["Attributes"].(map[string]interface{}); ok {
+		for k, v := range pending {
+			bios[k] = v
+		}
+	}
+	s.resources[settings]["Attributes"] = map[string]interface{}{}
+}
+
+// expand returns a copy of the collection with its members inlined
+func (s *Server) expand(res map[string]interface{}) map[string]interface{} {
+	members, ok := res["Members"].([]interface{})
+	if !ok {
+		return res
+	}
+	c := make(map[string]interface{})
+	for k, v := range res {
+		c[k] = v
+	}
+	expanded := make([]interface{}, 0, len(members))
+	for _, m := range members {
+		ref, _ := m.(map[string]interface{})
+		if r, ok := s.resources[fmt.Sprintf("%v", ref["@odata.id"])]; ok {
+			expanded = append(expanded, r)
+			continue
+		}
+		expanded = append(expanded, m)
+	}
+	c["Members"] = expanded
+	return c
+}
+
+func (s *Server) jobs() (jobs []map[string]interface{}) {
+	jobs = make([]map[string]interface{}, 0)
+	for p, r := range s.resources {
+		if strings.HasPrefix(p, dellJobsPath+"/") {
+			jobs = append(jobs, r)
+		}
+	}
+	return
+}
+
+func (s *Server) addMember(collection, id string, res map[string]interface{}) (p string) {
+	p = collection + "/" + id
+	res["@odata.id"] = p
+	res["Id"] = id
+	s.resources[p] = res
+	c, ok := s.resources[collection]
+	if !ok {
+		c = map[string]interface{}{"@odata.id": collection, "Members": []interface{}{}}
+		s.resources[collection] = c
+	}
+	members, _ := c["Members"].([]interface{})
+	members = append(members, map[string]interface{}{"@odata.id": p})
+	c["Members"] = members
+	c["Members@odata.count"] = len(members)
+	return
+}
+
+func (s *Server) system() map[string]interface{} {
+	c := s.resources["/redfish/v1/Systems"]
+	m := c["Members"].([]interface{})[0].(map[string]interface{})
+	return s.resources[m["@odata.id"].(string)]
+}
+
+// reset models the power state transitions of the system.
+// Restarts and power ons boot from the one time boot override or the Dell boot once setting
+func (s *Server) reset(resetType string) (err error) {
+	on := s.system()["PowerState"] == "On"
+	switch resetType {
+	case "On", "ForceOn":
+		if !on {
+			s.boot()
+		}
+	case "ForceOff", "GracefulShutdown":
+		s.setPowerState("Off")
+	case "PushPowerButton":
+		if on {
+			s.setPowerState("Off")
+		} else {
+			s.boot()
+		}
+	case "ForceRestart", "GracefulRestart", "PowerCycle":
+		s.boot()
+	case "Nmi":
+	default:
+		return fmt.Errorf("the reset type %s is not supported", resetType)
+	}
+	return
+}
+
+func (s *Server) boot() {
+	source := "None"
+	if boot, ok := s.system()["Boot"].(map[string]interface{}); ok {
+		if boot["BootSourceOverrideEnabled"] != "Disabled" {
+			source = fmt.Sprintf("%v", boot["BootSourceOverrideTarget"])
+		}
+		if boot["BootSourceOverrideEnabled"] == "Once" {
+			boot["BootSourceOverrideEnabled"] = "Disabled"
+			boot["BootSourceOverrideTarget"] = "None"
+		}
+	}
+	// dell boot once setting
+	if attrs := s.idracAttributes(); attrs["ServerBoot.1.BootOnce"] == "Enabled" {
+		if attrs["ServerBoot.1.FirstBootDevice"] == "VCD-DVD" {
+			source = "Cd"
+		}
+		attrs["ServerBoot.1.BootOnce"] = "Disabled"
+	}
+	// hpe virtual media flagged to boot on the next server reset
+	for p, res := range s.resources {
+		if !strings.Contains(p, "/VirtualMedia/") {
+			continue
+		}
+		oem, _ := res["Oem"].(map[string]interface{})
+		hpe, _ := oem["Hpe"].(map[string]interface{})
+		if hpe["BootOnNextServerReset"] == true {
+			if res["Inserted"] == true {
+				source = "Cd"
+			}
+			hpe["BootOnNextServerReset"] = false
+		}
+	}
+	// the iDRAC applies pending bios settings only with a bios config job
+	if _, dell := s.resources[dellJobsPath]; !dell {
+		for p := range s.resources {
+			if strings.HasSuffix(p, "/Bios/Settings") {
+				s.applyBiosSettings(p)
+			}
+		}
+	}
+	for _, f := range s.onReset {
+		f()
+	}
+	s.onReset = nil
+	s.boots = append(s.boots, source)
+	s.setPowerState("On")
+}
+
+// idracAttributes returns the iDRAC manager attributes, empty if the model is no Dell
+func (s *Server) idracAttributes() map[string]interface{} {
+	res, ok := s.resources["/redfish/v1/Managers/iDRAC.Embedded.1/Attributes"]
+	if !ok {
+		return map[string]interface{}{}
+	}
+	attrs, ok := res["Attributes"].(map[string]interface{})
+	if !ok {
+		attrs = make(map[string]interface{})
+		res["Attributes"] = attrs
+	}
+	return attrs
+}
+
+func (s *Server) setPowerState(state string) {
+	sys := s.system()
+	sys["PowerState"] = state
+	// hpe reports the post state, which is used to wait for the node
+	if oem, ok := sys["Oem"].(map[string]interface{}); ok {
+		if hpe, ok := oem["Hpe"].(map[string]interface{}); ok {
+			if state == "On" {
+				hpe["PostState"] = "FinishedPost"
+			} else {
+				hpe["PostState"] = "PowerOff"
+			}
+		}
+	}
+}
+
+// merge patches the resource like a redfish service, nested objects are merged
+func merge(res, patch map[string]interface{}) {
+	for k, v := range patch {
+		pm, ok := v.(map[string]interface{})
+		rm, rok := res[k].(map[string]interface{})
+		if ok && rok {
+			merge(rm, pm)
+			continue
+		}
+		res[k] = v
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("OData-Version", "4.0")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, id, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    id,
+			"message": msg,
+			"@Message.ExtendedInfo": []map[string]interface{}{
+				{"MessageId": id, "Message": msg, "Severity": "Warning"},
+			},
+		},
+	})
+}
@@ -59,6 +59,7 @@ type Interface struct {
 	ClientID       *string                `json:"client_id"`
 	MacAddress     string                 `json:"mac_address"`
 	PortLinkStatus redfish.PortLinkStatus `json:"-"`
+	SpeedMbps      int                    `json:"-"`
 	Nic            int                    `json:"-"`
 	Port           int                    `json:"-"`
 }
@@ -112,7 +113,8 @@ type RootDisk struct {
 
 type Redfish interface {
 	GetData() (*Data, error)
-	GetClientConfig() *gofish.ClientConfig
+	GetClientConfig() (*gofish.ClientConfig, error)
+	Logout()
 	getVendorData() (err error)
 	getMemory() (err error)
 	getCPUs() (err error)
@@ -126,6 +128,15 @@ type Redfish interface {
 	BootFromImage(path string) (err error)
 	EjectMedia() (err error)
 	InsertMedia(image string) (err error)
+	GetBiosDiff(profile config.BiosProfile) (diff []BiosDiff, err error)
+	UpdateBios(profile config.BiosProfile) (err error)
+	ConfigureStorage(layout config.StorageLayout) (pending bool, err error)
+	GetRootVolume(layout config.StorageLayout) (root RootDisk, err error)
+	ConfigureBmc(hostname string) (err error)
+	EnableVerification() (err error)
+	GetSnapshot() (s Snapshot, err error)
+	GetInventory() (cs []Component, err error)
+	GetLldpNeighbors() (nbs []LldpNeighbor, err error)
 }
 
 type Default struct {
@@ -135,8 +146,8 @@ type Default struct {
 	Data   *Data
 }
 
-func NewDefault(remoteIP string, cfg config.Config, ctxLogger *log.Entry) (Redfish, error) {
-	c := clients.NewRedfish(cfg, ctxLogger)
+func NewDefault(remoteIP string, cfg config.Config, creds clients.CredentialProvider, ctxLogger *log.Entry) (Redfish, error) {
+	c := clients.NewRedfish(cfg, creds, ctxLogger)
 	c.SetEndpoint(remoteIP)
 	r := &Default{client: c, log: ctxLogger, cfg: cfg}
 	return r, r.check()
@@ -146,7 +157,6 @@ func (p Default) check() (err error) {
 	if err = p.client.Connect(); err != nil {
 		return err
 	}
-	defer p.client.Logout()
 	ch, err := p.client.Client.Service.Chassis()
 	if err != nil || len(ch) == 0 {
 		return fmt.Errorf("redfish chassis != 1")
@@ -159,8 +169,36 @@ func (p Default) check() (err error) {
 	return
 }
 
-func (p *Default) GetClientConfig() *gofish.ClientConfig {
-	return p.client.ClientConfig
+// GetClientConfig returns a gofish config sharing the node's redfish session
+func (p *Default) GetClientConfig() (*gofish.ClientConfig, error) {
+	if err := p.client.Connect(); err != nil {
+		return nil, err
+	}
+	cfg := p.client.SessionConfig()
+	return &cfg, nil
+}
+
+// Logout ends the node's redfish session
+func (p *Default) Logout() {
+	p.client.Logout()
+}
+
+// post sends the body to path and closes the response, for actions and creations whose response is not needed
+func (p *Default) post(path string, body interface{}) (err error) {
+	resp, err := p.client.Client.Post(path, body)
+	if err != nil {
+		return
+	}
+	return resp.Body.Close()
+}
+
+// patch updates the resource at path and closes the response
+func (p *Default) patch(path string, body interface{}) (err error) {
+	resp, err := p.client.Client.Patch(path, body)
+	if err != nil {
+		return
+	}
+	return resp.Body.Close()
 }
 
 func (p *Default) GetData() (*Data, error) {
@@ -170,7 +208,6 @@ func (p *Default) GetData() (*Data, error) {
 	if err := p.client.Connect(); err != nil {
 		return p.Data, err
 	}
-	defer p.client.Logout()
 	p.Data = &Data{}
 	if err := p.getVendorData(); err != nil {
 		return p.Data, err
@@ -191,7 +228,6 @@ func (p *Default) GetData() (*Data, error) {
 }
 
 func (p *Default) Power(forceOff bool, restart bool) (err error) {
-	defer p.client.Logout()
 	if err = p.client.Connect(); err != nil {
 		return
 	}
@@ -214,7 +250,6 @@ func (p *Default) Power(forceOff bool, restart bool) (err error) {
 }
 
 func (p *Default) WaitPowerStateOn() (err error) {
-	defer p.client.Logout()
 	if err = p.client.Connect(); err != nil {
 		return
 	}
@@ -357,6 +392,7 @@ func (p *Default) getNetworkDevices() (err error) {
 				Nic:            nic,
 				Port:           port,
 				PortLinkStatus: np.LinkStatus,
+				SpeedMbps:      np.CurrentLinkSpeedMbps,
 			})
 		}
 	}
@@ -377,20 +413,9 @@ func (p *Default) getMemory() (err error) {
 	return
 }
 
+// BootFromImage boots the node once from the image with the standard one time Cd boot override
 func (p *Default) BootFromImage(path string) (err error) {
-	defer p.client.Logout()
-	if err = p.client.Connect(); err != nil {
-		return
-	}
-	p.log.Debugf("booting image for cable check: %s", *p.cfg.Redfish.BootImage)
-	bootOverride := redfish.Boot{
-		BootSourceOverrideTarget:  redfish.CdBootSourceOverrideTarget,
-		BootSourceOverrideEnabled: redfish.OnceBootSourceOverrideEnabled,
-	}
-	if err = p.InsertMedia(path); err != nil {
-		return
-	}
-	return p.rebootFromVirtualMedia(bootOverride)
+	return p.bootFromImage(path, p.InsertMedia, p.rebootFromVirtualMedia, p.overrideConsumed)
 }
 
 func (p *Default) rebootFromVirtualMedia(boot redfish.Boot) (err error) {
@@ -424,7 +449,6 @@ func (p *Default) rebootFromVirtualMedia(boot redfish.Boot) (err error) {
 }
 
 func (p *Default) InsertMedia(image string) (err error) {
-	defer p.client.Logout()
 	if err = p.client.Connect(); err != nil {
 		return
 	}
@@ -453,7 +477,6 @@ func (p *Default) InsertMedia(image string) (err error) {
 }
 
 func (p *Default) EjectMedia() (err error) {
-	defer p.client.Logout()
 	if err = p.client.Connect(); err != nil {
 		return
 	}
@@ -0,0 +1,556 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/baremetal_temper/pkg/clients"
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/redfish/mock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const bootImage = "https://images.example.com/temper.iso"
+
+func newTestServer(t *testing.T, model string) (s *mock.Server, cfg config.Config, l *log.Entry) {
+	s, err := mock.New(model)
+	must(t, err)
+	t.Cleanup(s.Close)
+	mediaPollInterval, bootPollInterval = 10*time.Millisecond, 10*time.Millisecond
+	img := bootImage
+	cfg = config.Config{Redfish: config.Redfish{User: s.Username, Password: s.Password, BootImage: &img, Insecure: true}}
+	return s, cfg, log.WithFields(log.Fields{"node": model})
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func interfaceNames(d *Data) (names []string) {
+	for _, i := range d.Inventory.Interfaces {
+		names = append(names, i.Name)
+	}
+	return
+}
+
+func TestDellGetData(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	d, err := r.GetData()
+	must(t, err)
+	assert.Equal(t, "Dell Inc.", d.Inventory.SystemVendor.Manufacturer)
+	assert.Equal(t, "7XJ2Q13", d.Inventory.SystemVendor.SerialNumber, "expects the service tag as serial")
+	assert.Equal(t, "PowerEdge R640", d.Inventory.SystemVendor.Model)
+	assert.Equal(t, 32, d.Inventory.CPU.Count)
+	assert.Equal(t, "x86_64", d.Inventory.CPU.Architecture)
+	assert.Equal(t, 65536, d.Inventory.Memory.PhysicalMb)
+	assert.Len(t, d.Inventory.Disks, 2)
+	assert.Equal(t, "SSD 1", d.RootDisk.Name, "expects the last ssd as root disk")
+	assert.False(t, d.RootDisk.Rotational)
+	assert.Equal(t, []string{"l1", "l2", "nic3-port1", "nic3-port2"}, interfaceNames(d))
+	assert.Equal(t, "01-0c-42-a1-5e-00-10", d.BootInterface)
+}
+
+func TestHpeGetData(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.DL360)
+	r, err := NewHpe(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	d, err := r.GetData()
+	must(t, err)
+	assert.Equal(t, "HPE", d.Inventory.SystemVendor.Manufacturer)
+	assert.Equal(t, "CZJ0123ABC", d.Inventory.SystemVendor.SerialNumber)
+	assert.Equal(t, "ProLiant DL360 Gen10", d.Inventory.SystemVendor.Model)
+	assert.Equal(t, 40, d.Inventory.CPU.Count, "expects the sum of all cores")
+	assert.Len(t, d.Inventory.Disks, 3, "expects the mirrored boot volume to be reported once")
+	assert.Equal(t, "480GB 6G SATA SSD", d.RootDisk.Name)
+	assert.Equal(t, []string{"l1", "l2", "nic1-port1", "nic1-port2"}, interfaceNames(d))
+	assert.Equal(t, "01-98-03-9b-44-55-60", d.BootInterface)
+}
+
+func TestLenovoGetData(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.SR650)
+	r, err := NewLenovo(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	d, err := r.GetData()
+	must(t, err)
+	assert.Equal(t, "Lenovo", d.Inventory.SystemVendor.Manufacturer)
+	assert.Equal(t, "J30012AB", d.Inventory.SystemVendor.SerialNumber)
+	assert.Equal(t, 36, d.Inventory.CPU.Count)
+	assert.Equal(t, "Disk 0", d.RootDisk.Name, "expects the first drive of the volume as root disk")
+	assert.Equal(t, int64(515047377862), d.RootDisk.Size)
+	assert.Equal(t, []string{"l1", "l2", "nic1-port1", "nic1-port2"}, interfaceNames(d))
+}
+
+func TestPower(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDefault(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	must(t, r.Power(true, false))
+	assert.Equal(t, "Off", s.PowerState())
+
+	must(t, r.Power(false, false))
+	assert.Equal(t, "On", s.PowerState())
+
+	must(t, r.Power(false, false))
+	assert.Len(t, s.Boots(), 1, "expects no power on of a running node")
+
+	must(t, r.Power(false, true))
+	assert.Len(t, s.Boots(), 2)
+	must(t, r.WaitPowerStateOn())
+}
+
+func TestBootFromImage(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDefault(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	must(t, r.BootFromImage(bootImage))
+	vm := s.Resource("/redfish/v1/Managers/iDRAC.Embedded.1/VirtualMedia/CD")
+	assert.Equal(t, bootImage, vm["Image"])
+	assert.Equal(t, true, vm["Inserted"])
+	assert.Equal(t, []string{"Cd"}, s.Boots())
+
+	must(t, r.EjectMedia())
+	vm = s.Resource("/redfish/v1/Managers/iDRAC.Embedded.1/VirtualMedia/CD")
+	assert.Equal(t, "", vm["Image"])
+}
+
+func TestDellBootFromImage(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	must(t, r.BootFromImage(bootImage))
+	assert.Equal(t, []string{"Cd"}, s.Boots(), "expects the boot once setting to be imported")
+	assert.Contains(t, s.Requests(), "POST /redfish/v1/Managers/iDRAC.Embedded.1/Actions/Oem/EID_674_Manager.ImportSystemConfiguration")
+	attrs := s.Resource("/redfish/v1/Managers/iDRAC.Embedded.1/Attributes")["Attributes"].(map[string]interface{})
+	assert.Equal(t, "Disabled", attrs["ServerBoot.1.BootOnce"])
+}
+
+func TestHpeBootFromImage(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.DL360)
+	r, err := NewHpe(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	must(t, r.BootFromImage(bootImage))
+	assert.Equal(t, []string{"Cd"}, s.Boots(), "expects the media to be booted with the next server reset")
+	vm := s.Resource("/redfish/v1/Managers/1/VirtualMedia/2")
+	assert.Equal(t, bootImage, vm["Image"])
+	assert.Equal(t, false, vm["Oem"].(map[string]interface{})["Hpe"].(map[string]interface{})["BootOnNextServerReset"])
+}
+
+func TestLenovoBootFromImage(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.SR650)
+	r, err := NewLenovo(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	must(t, r.BootFromImage(bootImage))
+	assert.Equal(t, []string{"Cd"}, s.Boots())
+	vm := s.Resource("/redfish/v1/Managers/1/VirtualMedia/EXT1")
+	assert.Equal(t, "HTTPS", vm["TransferProtocolType"])
+	assert.Equal(t, "URI", vm["ConnectedVia"])
+}
+
+func TestLenovoInsertMedia(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.SR650)
+	r, err := NewLenovo(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	// the xcc does not expose virtual media actions, media is inserted by patching the resource
+	must(t, r.InsertMedia(bootImage))
+	vm := s.Resource("/redfish/v1/Managers/1/VirtualMedia/EXT1")
+	assert.Equal(t, bootImage, vm["Image"])
+	assert.Equal(t, true, vm["Inserted"])
+	assert.Contains(t, s.Requests(), "PATCH /redfish/v1/Managers/1/VirtualMedia/EXT1")
+}
+
+func TestRecordReplay(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	cfg.Recorder = config.Recorder{Mode: "record", Path: t.TempDir()}
+	c, err := clients.NewCassette(cfg, "node001-bb001")
+	must(t, err)
+	cfg.Transport = c.Transport
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+	recorded, err := r.GetData()
+	must(t, err)
+	must(t, c.Save())
+
+	b, err := ioutil.ReadFile(filepath.Join(cfg.Recorder.Path, "node001-bb001.json"))
+	must(t, err)
+	assert.NotContains(t, string(b), s.Password, "expects the credentials to be scrubbed")
+
+	// replay without reaching the bmc
+	host := s.Host()
+	s.Close()
+	cfg.Recorder.Mode = "replay"
+	c, err = clients.NewCassette(cfg, "node001-bb001")
+	must(t, err)
+	cfg.Transport = c.Transport
+	r, err = NewDell(host, cfg, nil, l)
+	must(t, err)
+	replayed, err := r.GetData()
+	must(t, err)
+	assert.Equal(t, recorded.Inventory, replayed.Inventory)
+	assert.Equal(t, recorded.RootDisk, replayed.RootDisk)
+}
+
+func TestRecordScrub(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"results": [{"name": "node001-bb001", "custom_fields": {"bmc_pw": "field-secret"}}]}`)
+	}))
+	t.Cleanup(srv.Close)
+	cfg := config.Config{
+		Recorder: config.Recorder{Mode: "record", Path: t.TempDir()},
+		Redfish:  config.Redfish{Credentials: []config.CredentialSource{{Type: "netbox", PasswordField: "bmc_pw"}}},
+	}
+	url := srv.URL + "/api/dcim/devices/?name=node001-bb001&api_token=query-secret"
+	c, err := clients.NewCassette(cfg, "node001-bb001")
+	must(t, err)
+	resp, err := (&http.Client{Transport: c.Transport(nil)}).Get(url)
+	must(t, err)
+	resp.Body.Close()
+	must(t, c.Save())
+
+	b, err := ioutil.ReadFile(filepath.Join(cfg.Recorder.Path, "node001-bb001.json"))
+	must(t, err)
+	assert.NotContains(t, string(b), "field-secret", "expects the configured password field to be scrubbed")
+	assert.NotContains(t, string(b), "query-secret", "expects sensitive query values to be scrubbed")
+	assert.Contains(t, string(b), "name=node001-bb001")
+
+	// the replayed request is matched by its scrubbed url
+	cfg.Recorder.Mode = "replay"
+	c, err = clients.NewCassette(cfg, "node001-bb001")
+	must(t, err)
+	resp, err = (&http.Client{Transport: c.Transport(nil)}).Get(url)
+	must(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func countRequests(s *mock.Server, req string) (n int) {
+	for _, r := range s.Requests() {
+		if r == req {
+			n++
+		}
+	}
+	return
+}
+
+func TestSession(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	_, err = r.GetData()
+	must(t, err)
+	must(t, r.Power(false, false))
+	must(t, r.BootFromImage(bootImage))
+	assert.Equal(t, 1, countRequests(s, "POST /redfish/v1/SessionService/Sessions"), "expects one session per node run")
+	assert.Equal(t, 1, s.Sessions())
+
+	s.ExpireSessions()
+	must(t, r.EjectMedia())
+	assert.Equal(t, 2, countRequests(s, "POST /redfish/v1/SessionService/Sessions"), "expects a new login after 401")
+
+	r.Logout()
+	assert.Equal(t, 0, s.Sessions(), "expects the session to be deleted on logout")
+}
+
+func TestSessionLimiter(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	cfg.Redfish.MaxConnections = 1
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+	d := r.(*Dell)
+	must(t, d.client.Connect())
+
+	// gofish drops the responses of actions without closing them, which must not hold the bmc's connection slot
+	for i := 0; i < 3; i++ {
+		_, err = d.client.Client.Get("/redfish/v1/Systems")
+		must(t, err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := r.GetData()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		must(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expects dropped responses to release the connection slot")
+	}
+
+	resp, err := d.client.Client.Get("/redfish/v1")
+	must(t, err)
+	defer resp.Body.Close()
+	var root map[string]interface{}
+	must(t, json.NewDecoder(resp.Body).Decode(&root))
+	assert.NotNil(t, root["Systems"], "expects the buffered body to be readable")
+}
+
+func TestCredentials(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/bmc/node001-bb001" || r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"data": {"data": {"username": "%s", "password": "%s"}, "metadata": {"version": 1}}}`, s.Username, s.Password)
+	}))
+	t.Cleanup(vault.Close)
+	cfg.Redfish.Credentials = []config.CredentialSource{
+		{Type: "factory", Defaults: []config.BmcCredential{{User: "root", Password: "wrong"}}},
+		{Type: "file", Path: filepath.Join(t.TempDir(), "{{.Name}}.yaml")},
+		{Type: "vault", Address: vault.URL, Token: "vault-token", Path: "secret/data/bmc/{{.Name}}"},
+	}
+	creds, err := clients.NewCredentialProvider(cfg, clients.CredentialNode{Name: "node001-bb001"}, l)
+	must(t, err)
+
+	r, err := NewDell(s.Host(), cfg, creds, l)
+	must(t, err)
+	_, err = r.GetData()
+	must(t, err)
+	c, ok := creds.Current()
+	assert.True(t, ok)
+	assert.Equal(t, "vault", c.Source)
+	assert.Equal(t, 1, countRequests(s, "POST /redfish/v1/SessionService/Sessions"), "expects no factory default for a node with stored credentials")
+}
+
+// newVault serves the kv v2 secret of node001-bb001, writes with the token allowWrite are stored
+func newVault(t *testing.T, allowWrite string) (vault *httptest.Server, secret map[string]string) {
+	secret = make(map[string]string)
+	var mu sync.Mutex
+	vault = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/v1/secret/data/bmc/node001-bb001" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			if r.Header.Get("X-Vault-Token") != allowWrite {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			var body struct {
+				Data map[string]string `json:"data"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			for k, v := range body.Data {
+				secret[k] = v
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			if len(secret) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": secret}})
+		}
+	}))
+	t.Cleanup(vault.Close)
+	return
+}
+
+func rotationConfig(cfg config.Config, s *mock.Server, vault *httptest.Server) config.Config {
+	cfg.Redfish.Bmc.Password = "rotated"
+	cfg.Redfish.Credentials = []config.CredentialSource{
+		{Type: "factory", Defaults: []config.BmcCredential{{User: s.Username, Password: s.Password}}},
+		{Type: "vault", Address: vault.URL, Token: "vault-token", Path: "secret/data/bmc/{{.Name}}"},
+	}
+	return cfg
+}
+
+func TestRotatePassword(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	vault, secret := newVault(t, "vault-token")
+	cfg = rotationConfig(cfg, s, vault)
+	creds, err := clients.NewCredentialProvider(cfg, clients.CredentialNode{Name: "node001-bb001"}, l)
+	must(t, err)
+	r, err := NewDell(s.Host(), cfg, creds, l)
+	must(t, err)
+
+	must(t, r.ConfigureBmc("node001-bb001"))
+	assert.Equal(t, map[string]string{"username": "root", "password": "rotated"}, secret)
+	c, _ := creds.Current()
+	assert.Equal(t, clients.Credential{User: "root", Password: "rotated", Source: "vault"}, c)
+
+	creds, err = clients.NewCredentialProvider(cfg, clients.CredentialNode{Name: "node001-bb001"}, l)
+	must(t, err)
+	r, err = NewDell(s.Host(), cfg, creds, l)
+	must(t, err)
+	_, err = r.GetData()
+	assert.NoError(t, err, "expects the next run to log in with the stored password")
+	c, _ = creds.Current()
+	assert.Equal(t, "vault", c.Source)
+}
+
+func TestRotatePasswordNotStored(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	vault, secret := newVault(t, "")
+	cfg = rotationConfig(cfg, s, vault)
+	creds, err := clients.NewCredentialProvider(cfg, clients.CredentialNode{Name: "node001-bb001"}, l)
+	must(t, err)
+	r, err := NewDell(s.Host(), cfg, creds, l)
+	must(t, err)
+
+	assert.Error(t, r.ConfigureBmc("node001-bb001"))
+	assert.Empty(t, secret)
+	assert.Equal(t, 0, countRequests(s, "PATCH /redfish/v1/AccountService/Accounts/2"), "expects the password not to be changed")
+}
+
+func TestDellGetLldpNeighbors(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	s.SetResource("/redfish/v1/Systems/System.Embedded.1/NetworkPorts/Oem/Dell/DellSwitchConnections", map[string]interface{}{
+		"Members": []interface{}{
+			map[string]interface{}{"FQDD": "NIC.Integrated.1-1-1", "SwitchConnectionID": "00:de:fb:aa:bb:cc", "SwitchPortConnectionID": "Ethernet1/10", "StaleData": "NotStaleData"},
+			map[string]interface{}{"FQDD": "NIC.Integrated.1-2-1", "SwitchConnectionID": "No Link", "SwitchPortConnectionID": "No Link", "StaleData": "NotStaleData"},
+			map[string]interface{}{"FQDD": "NIC.Slot.3-1-1", "SwitchConnectionID": "00:de:fb:aa:bb:cd", "SwitchPortConnectionID": "Ethernet1/11", "StaleData": "StaleData"},
+		},
+	})
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	nbs, err := r.GetLldpNeighbors()
+	must(t, err)
+	assert.Equal(t, []LldpNeighbor{{Mac: "f4:02:70:b8:a0:01", ChassisID: "00:de:fb:aa:bb:cc", PortID: "Ethernet1/10"}}, nbs)
+}
+
+func TestGetInventory(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	cs, err := r.GetInventory()
+	must(t, err)
+	types := make(map[string]int)
+	for _, c := range cs {
+		types[c.Type]++
+	}
+	assert.Equal(t, map[string]int{"cpu": 2, "dimm": 2, "drive": 2, "nic": 2, "psu": 2}, types)
+	assert.Contains(t, cs, Component{Type: "dimm", Location: "A1", Manufacturer: "Samsung", PartNumber: "M393A4K40CB2-CTD", Serial: "36F1A2B3"})
+
+	s, cfg, l = newTestServer(t, mock.DL360)
+	r, err = NewHpe(s.Host(), cfg, nil, l)
+	must(t, err)
+	cs, err = r.GetInventory()
+	must(t, err)
+	drives := make(map[string]bool)
+	for _, c := range cs {
+		if c.Type == "drive" {
+			drives[c.Location] = true
+		}
+	}
+	assert.Len(t, drives, 4, "expects drive locations unique across controllers")
+}
+
+func biosProfile() config.BiosProfile {
+	return config.BiosProfile{
+		Name:       "test",
+		Attributes: map[string]interface{}{"SysProfile": "PerfOptimized", "ProcVirtualization": "Disabled", "LogicalProc": "Disabled"},
+		BootOrder:  []string{"Disk.Bay"},
+	}
+}
+
+func TestGetBiosDiff(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	diff, err := r.GetBiosDiff(biosProfile())
+	must(t, err)
+	assert.Equal(t, []BiosDiff{
+		{Attribute: "LogicalProc", Current: "Enabled", Expected: "Disabled"},
+		{Attribute: "ProcVirtualization", Current: "Enabled", Expected: "Disabled"},
+		{Attribute: "BootOrder", Current: []string{"NIC.PxeDevice.1-1", "Disk.Bay.0:Enclosure.Internal.0-1:RAID.Integrated.1-1"}, Expected: []string{"Disk.Bay.0:Enclosure.Internal.0-1:RAID.Integrated.1-1", "NIC.PxeDevice.1-1"}},
+	}, diff, "expects the attributes sorted and the boot order last")
+
+	_, err = r.GetBiosDiff(config.BiosProfile{Attributes: map[string]interface{}{"NoSuchAttribute": "Enabled"}})
+	assert.Error(t, err)
+}
+
+func TestDellUpdateBios(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	must(t, r.UpdateBios(biosProfile()))
+	settings := s.Resource("/redfish/v1/Systems/System.Embedded.1/Bios/Settings")["Attributes"]
+	assert.Equal(t, map[string]interface{}{"LogicalProc": "Disabled", "ProcVirtualization": "Disabled"}, settings)
+	assert.Equal(t, 1, countRequests(s, "POST /redfish/v1/Managers/iDRAC.Embedded.1/Jobs"))
+	diff, err := r.GetBiosDiff(biosProfile())
+	must(t, err)
+	assert.Len(t, diff, 2, "expects the attributes to be pending until the reboot")
+
+	must(t, r.Power(false, true))
+	diff, err = r.GetBiosDiff(biosProfile())
+	must(t, err)
+	assert.Empty(t, diff)
+	must(t, r.UpdateBios(biosProfile()))
+	assert.Equal(t, 1, countRequests(s, "POST /redfish/v1/Managers/iDRAC.Embedded.1/Jobs"), "expects no job without a diff")
+}
+
+func TestDellUpdateBiosPendingJob(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	must(t, r.UpdateBios(config.BiosProfile{Attributes: map[string]interface{}{"LogicalProc": "Disabled"}}))
+	err = r.UpdateBios(config.BiosProfile{Attributes: map[string]interface{}{"ProcVirtualization": "Disabled"}})
+	assert.Error(t, err, "expects the pending bios config job to be reported")
+	assert.Contains(t, err.Error(), "already pending")
+	assert.Equal(t, 1, countRequests(s, "PATCH /redfish/v1/Systems/System.Embedded.1/Bios/Settings"), "expects no settings written while a job is pending")
+
+	must(t, r.Power(false, true))
+	must(t, r.UpdateBios(config.BiosProfile{Attributes: map[string]interface{}{"ProcVirtualization": "Disabled"}}))
+	assert.Equal(t, 2, countRequests(s, "POST /redfish/v1/Managers/iDRAC.Embedded.1/Jobs"))
+}
+
+func TestHpeUpdateBios(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.DL360)
+	r, err := NewHpe(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	profile := config.BiosProfile{Attributes: map[string]interface{}{"ProcHyperthreading": "Disabled"}}
+	must(t, r.UpdateBios(profile))
+	assert.Equal(t, 1, countRequests(s, "PATCH /redfish/v1/Systems/1/Bios/Settings"))
+	must(t, r.Power(false, true))
+	diff, err := r.GetBiosDiff(profile)
+	must(t, err)
+	assert.Empty(t, diff, "expects the pending settings applied with the reboot")
+}
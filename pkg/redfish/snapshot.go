@@ -0,0 +1,176 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is a versioned hardware inventory of a node
+type Snapshot struct {
+	Node       string      `json:"node"`
+	Version    int         `json:"version"`
+	Created    time.Time   `json:"created"`
+	Serial     string      `json:"serial"`
+	Components []Component `json:"components"`
+}
+
+// Component is identified by its type and location (slot, dimm locator, interface name...).
+// Manufacturer and PartNumber are only loaded by GetInventory
+type Component struct {
+	Type         string `json:"type"`
+	Location     string `json:"location"`
+	Model        string `json:"model,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Firmware     string `json:"firmware,omitempty"`
+	Mac          string `json:"mac,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	PartNumber   string `json:"partNumber,omitempty"`
+}
+
+type Drift struct {
+	Source   string `json:"source"`
+	Type     string `json:"type"`
+	Location string `json:"location"`
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Current  string `json:"current"`
+}
+
+// GetSnapshot loads serials, firmware and slot positions of the node's dimms, drives, nics and firmware inventory
+func (p *Default) GetSnapshot() (s Snapshot, err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	s = Snapshot{Created: time.Now(), Components: make([]Component, 0)}
+	sys, err := p.client.Client.Service.Systems()
+	if err != nil {
+		return
+	}
+	s.Serial = sys[0].SerialNumber
+	mem, err := sys[0].Memory()
+	if err != nil {
+		return
+	}
+	for _, m := range mem {
+		if m.SerialNumber == "" {
+			// empty dimm slot
+			continue
+		}
+		s.Components = append(s.Components, Component{Type: "dimm", Location: m.DeviceLocator, Model: m.PartNumber, Serial: m.SerialNumber, Firmware: m.FirmwareRevision})
+	}
+	st, err := sys[0].Storage()
+	if err != nil {
+		return
+	}
+	for _, ctrl := range st {
+		ds, err := ctrl.Drives()
+		if err != nil {
+			return s, err
+		}
+		for _, d := range ds {
+			s.Components = append(s.Components, Component{Type: "drive", Location: d.ID, Model: d.Model, Serial: d.SerialNumber, Firmware: d.Revision})
+		}
+	}
+	ch, err := p.client.Client.Service.Chassis()
+	if err != nil {
+		return
+	}
+	for _, c := range ch {
+		nas, err := c.NetworkAdapters()
+		if err != nil {
+			return s, err
+		}
+		for _, na := range nas {
+			nic := Component{Type: "nic", Location: na.ID, Model: na.Model, Serial: na.SerialNumber}
+			if len(na.Controllers) > 0 {
+				nic.Firmware = na.Controllers[0].FirmwarePackageVersion
+			}
+			s.Components = append(s.Components, nic)
+		}
+	}
+	us, err := p.client.Client.Service.UpdateService()
+	if err != nil {
+		return
+	}
+	fw, err := us.FirmwareInventories()
+	if err != nil {
+		p.log.Debugf("cannot load firmware inventory: %s", err.Error())
+		return s, nil
+	}
+	for _, f := range fw {
+		// dell lists previous and available firmware versions as well
+		if strings.HasPrefix(f.ID, "Previous") || strings.HasPrefix(f.ID, "Available") {
+			continue
+		}
+		s.Components = append(s.Components, Component{Type: "firmware", Location: f.Name, Firmware: f.Version})
+	}
+	s.Sort()
+	return
+}
+
+// Sort sorts the components by type and location
+func (s *Snapshot) Sort() {
+	sort.Slice(s.Components, func(i, j int) bool {
+		if s.Components[i].Type != s.Components[j].Type {
+			return s.Components[i].Type < s.Components[j].Type
+		}
+		return s.Components[i].Location < s.Components[j].Location
+	})
+}
+
+// Diff returns the drift of the snapshot against a previous snapshot
+func (s Snapshot) Diff(prev Snapshot) (drift []Drift) {
+	drift = make([]Drift, 0)
+	if s.Serial != prev.Serial {
+		drift = append(drift, Drift{Source: "snapshot", Type: "system", Field: "serial", Expected: prev.Serial, Current: s.Serial})
+	}
+	key := func(c Component) string {
+		return c.Type + "/" + c.Location
+	}
+	cur := make(map[string]Component)
+	for _, c := range s.Components {
+		cur[key(c)] = c
+	}
+	for _, pc := range prev.Components {
+		c, ok := cur[key(pc)]
+		delete(cur, key(pc))
+		if !ok {
+			drift = append(drift, Drift{Source: "snapshot", Type: pc.Type, Location: pc.Location, Field: "present", Expected: "true", Current: "false"})
+			continue
+		}
+		fields := [][3]string{
+			{"model", pc.Model, c.Model},
+			{"serial", pc.Serial, c.Serial},
+			{"firmware", pc.Firmware, c.Firmware},
+			{"mac", pc.Mac, c.Mac},
+		}
+		for _, f := range fields {
+			if !strings.EqualFold(f[1], f[2]) {
+				drift = append(drift, Drift{Source: "snapshot", Type: pc.Type, Location: pc.Location, Field: f[0], Expected: f[1], Current: f[2]})
+			}
+		}
+	}
+	for _, c := range s.Components {
+		if _, ok := cur[key(c)]; ok {
+			drift = append(drift, Drift{Source: "snapshot", Type: c.Type, Location: c.Location, Field: "present", Expected: "false", Current: "true"})
+		}
+	}
+	return
+}
@@ -0,0 +1,82 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	dimm := Component{Type: "dimm", Location: "A1", Model: "M393A4K40DB3", Serial: "1234"}
+	nic := Component{Type: "nic", Location: "nic1-port1", Firmware: "22.31.6", Mac: "aa:bb:cc:dd:ee:01"}
+	for _, tc := range []struct {
+		name  string
+		prev  Snapshot
+		cur   Snapshot
+		drift []Drift
+	}{
+		{
+			name:  "unchanged",
+			prev:  Snapshot{Serial: "S1", Components: []Component{dimm, nic}},
+			cur:   Snapshot{Serial: "S1", Components: []Component{nic, dimm}},
+			drift: []Drift{},
+		},
+		{
+			name: "added",
+			prev: Snapshot{Serial: "S1", Components: []Component{nic}},
+			cur:  Snapshot{Serial: "S1", Components: []Component{nic, dimm}},
+			drift: []Drift{
+				{Source: "snapshot", Type: "dimm", Location: "A1", Field: "present", Expected: "false", Current: "true"},
+			},
+		},
+		{
+			name: "removed",
+			prev: Snapshot{Serial: "S1", Components: []Component{dimm, nic}},
+			cur:  Snapshot{Serial: "S1", Components: []Component{nic}},
+			drift: []Drift{
+				{Source: "snapshot", Type: "dimm", Location: "A1", Field: "present", Expected: "true", Current: "false"},
+			},
+		},
+		{
+			name: "changed",
+			prev: Snapshot{Serial: "S1", Components: []Component{dimm, nic}},
+			cur: Snapshot{Serial: "S2", Components: []Component{
+				{Type: "dimm", Location: "A1", Model: "M393A4K40DB3", Serial: "5678"},
+				{Type: "nic", Location: "nic1-port1", Firmware: "22.36.1", Mac: "AA:BB:CC:DD:EE:01"},
+			}},
+			drift: []Drift{
+				{Source: "snapshot", Type: "system", Field: "serial", Expected: "S1", Current: "S2"},
+				{Source: "snapshot", Type: "dimm", Location: "A1", Field: "serial", Expected: "1234", Current: "5678"},
+				// the mac differs in case only
+				{Source: "snapshot", Type: "nic", Location: "nic1-port1", Field: "firmware", Expected: "22.31.6", Current: "22.36.1"},
+			},
+		},
+		{
+			name: "moved",
+			prev: Snapshot{Serial: "S1", Components: []Component{dimm}},
+			cur:  Snapshot{Serial: "S1", Components: []Component{{Type: "dimm", Location: "B1", Model: "M393A4K40DB3", Serial: "1234"}}},
+			drift: []Drift{
+				{Source: "snapshot", Type: "dimm", Location: "A1", Field: "present", Expected: "true", Current: "false"},
+				{Source: "snapshot", Type: "dimm", Location: "B1", Field: "present", Expected: "false", Current: "true"},
+			},
+		},
+	} {
+		assert.Equal(t, tc.drift, tc.cur.Diff(tc.prev), tc.name)
+	}
+}
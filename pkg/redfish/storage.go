@@ -0,0 +1,248 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+type odataID struct {
+	ID string `json:"@odata.id"`
+}
+
+type volumeCreate struct {
+	Name      string
+	RAIDType  string
+	Links     volumeLinks
+	ApplyTime string `json:"@Redfish.OperationApplyTime,omitempty"`
+}
+
+type volumeLinks struct {
+	Drives []odataID
+}
+
+// ConfigureStorage applies the storage layout. Existing volumes with the same name and drive count are kept,
+// all other volumes of the layout's controllers are deleted.
+// Returns pending = true if the changes need a reboot to be applied, the layout is then applied again after
+// the reboot: volumes created on reset are only created once the drives of the deleted volumes are free.
+// Jbod is only supported for Dell
+func (p *Default) ConfigureStorage(layout config.StorageLayout) (pending bool, err error) {
+	if layout.Jbod {
+		return pending, fmt.Errorf("storage layout %s: jbod is not supported for this vendor", layout.Name)
+	}
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	pending, _, err = p.configureStorage(layout, "")
+	return
+}
+
+// configureStorage returns the drives of the layout's volumes, including volumes not created before the next reboot
+func (p *Default) configureStorage(layout config.StorageLayout, applyTime string) (pending bool, used map[string]bool, err error) {
+	used = make(map[string]bool)
+	s, err := p.client.Client.Service.Systems()
+	if err != nil {
+		return
+	}
+	st, err := s[0].Storage()
+	if err != nil {
+		return
+	}
+	for _, vl := range layout.Volumes {
+		var changed bool
+		var drives []odataID
+		ctrl, err := findController(st, vl.Controller)
+		if err != nil {
+			return pending, used, err
+		}
+		changed, drives, err = p.configureVolume(ctrl, vl, layout, applyTime)
+		if err != nil {
+			return pending, used, fmt.Errorf("cannot configure volume %s: %s", vl.Name, err.Error())
+		}
+		for _, d := range drives {
+			used[d.ID] = true
+		}
+		pending = pending || changed
+	}
+	return
+}
+
+// GetRootVolume returns the root volume of the storage layout as root disk
+func (p *Default) GetRootVolume(layout config.StorageLayout) (root RootDisk, err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	vl, err := layout.RootVolume()
+	if err != nil {
+		return
+	}
+	s, err := p.client.Client.Service.Systems()
+	if err != nil {
+		return
+	}
+	st, err := s[0].Storage()
+	if err != nil {
+		return
+	}
+	ctrl, err := findController(st, vl.Controller)
+	if err != nil {
+		return
+	}
+	vols, err := ctrl.Volumes()
+	if err != nil {
+		return
+	}
+	for _, v := range vols {
+		if v.Name != vl.Name {
+			continue
+		}
+		ds, err := v.Drives()
+		if err != nil || len(ds) == 0 {
+			return root, fmt.Errorf("cannot load drives of root volume %s", v.Name)
+		}
+		root = RootDisk{
+			//inspector converts bytes to gibibyte
+			Size:       int64(float64(v.CapacityBytes) * 1.074),
+			Name:       v.Name,
+			Model:      ds[0].Model,
+			Vendor:     ds[0].Manufacturer,
+			Serial:     ds[0].SerialNumber,
+			Rotational: ds[0].RotationSpeedRPM != 0,
+		}
+		return root, nil
+	}
+	return root, fmt.Errorf("root volume %s not found", vl.Name)
+}
+
+func (p *Default) configureVolume(ctrl *redfish.Storage, vl config.VolumeLayout, layout config.StorageLayout, applyTime string) (changed bool, links []odataID, err error) {
+	vols, err := ctrl.Volumes()
+	if err != nil {
+		return
+	}
+	inLayout := make(map[string]bool)
+	for _, l := range layout.Volumes {
+		inLayout[l.Name] = true
+	}
+	volDrives := make(map[string][]*redfish.Drive)
+	for _, v := range vols {
+		ds, err := v.Drives()
+		if err != nil {
+			return changed, links, err
+		}
+		if v.Name == vl.Name && len(ds) == vl.DriveCount {
+			p.log.Debugf("volume %s already exists", v.Name)
+			for _, d := range ds {
+				links = append(links, odataID{ID: d.ODataID})
+			}
+			return false, links, nil
+		}
+		volDrives[v.ODataID] = ds
+	}
+	usedDrives := make(map[string]bool)
+	deleted := false
+	for _, v := range vols {
+		if inLayout[v.Name] && v.Name != vl.Name {
+			for _, d := range volDrives[v.ODataID] {
+				usedDrives[d.ODataID] = true
+			}
+			continue
+		}
+		p.log.Infof("deleting volume %s on controller %s", v.Name, ctrl.ID)
+		resp, err := p.client.Client.Delete(v.ODataID)
+		if err != nil {
+			return changed, links, err
+		}
+		resp.Body.Close()
+		changed = true
+		// volumes created on reset must not use the drives of deleted volumes, which may be busy until the reset
+		if applyTime != "" {
+			deleted = true
+			for _, d := range volDrives[v.ODataID] {
+				usedDrives[d.ODataID] = true
+			}
+		}
+	}
+
+	if links, err = selectDrives(ctrl, vl, usedDrives); err != nil {
+		if !deleted {
+			return
+		}
+		p.log.Infof("volume %s is created after the reset frees the drives of the deleted volumes", vl.Name)
+		// the matching drives are kept for the volume
+		links, err = matchingDrives(ctrl, vl, nil)
+		return true, links, err
+	}
+	p.log.Infof("creating %s volume %s on controller %s", vl.RAIDType, vl.Name, ctrl.ID)
+	resp, err := p.client.Client.Post(ctrl.ODataID+"/Volumes", volumeCreate{
+		Name:      vl.Name,
+		RAIDType:  vl.RAIDType,
+		Links:     volumeLinks{Drives: links},
+		ApplyTime: applyTime,
+	})
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return true, links, nil
+}
+
+func selectDrives(ctrl *redfish.Storage, vl config.VolumeLayout, usedDrives map[string]bool) (links []odataID, err error) {
+	if links, err = matchingDrives(ctrl, vl, usedDrives); err != nil {
+		return
+	}
+	if len(links) < vl.DriveCount {
+		return links, fmt.Errorf("found %d matching drives, expected %d", len(links), vl.DriveCount)
+	}
+	return links[:vl.DriveCount], nil
+}
+
+// matchingDrives returns the drives of the controller matching the volume's drives, which are not used
+func matchingDrives(ctrl *redfish.Storage, vl config.VolumeLayout, usedDrives map[string]bool) (links []odataID, err error) {
+	re, err := regexp.Compile(`(?i)` + vl.Drives)
+	if err != nil {
+		return
+	}
+	ds, err := ctrl.Drives()
+	if err != nil {
+		return
+	}
+	links = make([]odataID, 0)
+	for _, d := range ds {
+		if usedDrives[d.ODataID] || !(re.MatchString(d.Name) || re.MatchString(d.Model)) {
+			continue
+		}
+		links = append(links, odataID{ID: d.ODataID})
+	}
+	return
+}
+
+func findController(st []*redfish.Storage, controller string) (ctrl *redfish.Storage, err error) {
+	re, err := regexp.Compile(`(?i)` + controller)
+	if err != nil {
+		return
+	}
+	for _, s := range st {
+		if re.MatchString(s.ID) || re.MatchString(s.Name) {
+			return s, nil
+		}
+	}
+	return ctrl, fmt.Errorf("no storage controller found matching %s", controller)
+}
@@ -0,0 +1,171 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/redfish/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+const dellDrivePath = "/redfish/v1/Systems/System.Embedded.1/Storage/RAID.Integrated.1-1/Drives/Disk.Bay.%d:Enclosure.Internal.0-1:RAID.Integrated.1-1"
+
+func rootLayout(controller string, driveCount int, jbod bool) config.StorageLayout {
+	return config.StorageLayout{
+		Name: "test",
+		Volumes: []config.VolumeLayout{
+			{Name: "root", RAIDType: "RAID1", Controller: controller, Drives: ".*", DriveCount: driveCount, Root: true},
+		},
+		Jbod: jbod,
+	}
+}
+
+func driveRaidStatus(s *mock.Server, bay int) string {
+	oem, _ := s.Resource(fmt.Sprintf(dellDrivePath, bay))["Oem"].(map[string]interface{})
+	dell, _ := oem["Dell"].(map[string]interface{})
+	pd, _ := dell["DellPhysicalDisk"].(map[string]interface{})
+	status, _ := pd["RaidStatus"].(string)
+	return status
+}
+
+func posts(s *mock.Server) (n int) {
+	for _, r := range s.Requests() {
+		if strings.HasPrefix(r, "POST ") && !strings.HasSuffix(r, "/Sessions") {
+			n++
+		}
+	}
+	return
+}
+
+func TestDellConfigureStorageJbod(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+	layout := rootLayout("RAID.Integrated", 1, true)
+	layout.Volumes[0].RAIDType = "RAID0"
+
+	pending, err := r.ConfigureStorage(layout)
+	must(t, err)
+	assert.True(t, pending)
+	assert.Equal(t, "Ready", driveRaidStatus(s, 0), "expects the changes to be applied with the reboot")
+	assert.Equal(t, "Ready", driveRaidStatus(s, 1))
+
+	must(t, r.Power(false, true))
+	assert.Equal(t, "Online", driveRaidStatus(s, 0), "expects the drive of the pending volume not to be converted")
+	assert.Equal(t, "NonRAID", driveRaidStatus(s, 1))
+	root, err := r.GetRootVolume(layout)
+	must(t, err)
+	assert.Equal(t, "root", root.Name)
+	assert.Equal(t, "S45PNA0M500120", root.Serial)
+
+	n := posts(s)
+	pending, err = r.ConfigureStorage(layout)
+	must(t, err)
+	assert.False(t, pending, "expects no reboot for a configured layout")
+	assert.Equal(t, n, posts(s), "expects no changes for a configured layout")
+}
+
+func TestDellConfigureStorage(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+	layout := rootLayout("RAID.Integrated", 2, false)
+
+	pending, err := r.ConfigureStorage(layout)
+	must(t, err)
+	assert.True(t, pending)
+	must(t, r.Power(false, true))
+	assert.Equal(t, "Online", driveRaidStatus(s, 0))
+	assert.Equal(t, "Online", driveRaidStatus(s, 1))
+
+	pending, err = r.ConfigureStorage(layout)
+	must(t, err)
+	assert.False(t, pending)
+}
+
+func TestDellConfigureStorageReplace(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.R640)
+	r, err := NewDell(s.Host(), cfg, nil, l)
+	must(t, err)
+	_, err = r.ConfigureStorage(rootLayout("RAID.Integrated", 2, false))
+	must(t, err)
+	must(t, r.Power(false, true))
+
+	layout := rootLayout("RAID.Integrated", 1, false)
+	layout.Volumes[0].RAIDType = "RAID0"
+	volumes := "POST /redfish/v1/Systems/System.Embedded.1/Storage/RAID.Integrated.1-1/Volumes"
+	pending, err := r.ConfigureStorage(layout)
+	must(t, err)
+	assert.True(t, pending)
+	assert.Equal(t, 1, countRequests(s, volumes), "expects the volume not to be created on the drives of the deleted volume")
+	assert.Equal(t, "Online", driveRaidStatus(s, 0))
+
+	must(t, r.Power(false, true))
+	assert.Equal(t, "Ready", driveRaidStatus(s, 0))
+	pending, err = r.ConfigureStorage(layout)
+	must(t, err)
+	assert.True(t, pending)
+	assert.Equal(t, 2, countRequests(s, volumes))
+
+	must(t, r.Power(false, true))
+	pending, err = r.ConfigureStorage(layout)
+	must(t, err)
+	assert.False(t, pending)
+	root, err := r.GetRootVolume(layout)
+	must(t, err)
+	assert.Equal(t, "root", root.Name)
+}
+
+func TestLenovoConfigureStorage(t *testing.T) {
+	s, cfg, l := newTestServer(t, mock.SR650)
+	r, err := NewLenovo(s.Host(), cfg, nil, l)
+	must(t, err)
+
+	pending, err := r.ConfigureStorage(rootLayout("RAID_Slot1", 2, false))
+	must(t, err)
+	assert.False(t, pending, "expects the existing root volume to be kept")
+
+	layout := rootLayout("RAID_Slot1", 1, false)
+	layout.Volumes[0].RAIDType = "RAID0"
+	pending, err = r.ConfigureStorage(layout)
+	must(t, err)
+	assert.True(t, pending)
+	vols := s.Resource("/redfish/v1/Systems/1/Storage/RAID_Slot1/Volumes")["Members"].([]interface{})
+	assert.Len(t, vols, 1, "expects the root volume to be replaced")
+	assert.NotEqual(t, "/redfish/v1/Systems/1/Storage/RAID_Slot1/Volumes/Volume0", vols[0].(map[string]interface{})["@odata.id"])
+}
+
+func TestConfigureStorageJbodNotSupported(t *testing.T) {
+	for _, model := range []string{mock.DL360, mock.SR650} {
+		s, cfg, l := newTestServer(t, model)
+		var r Redfish
+		var err error
+		if model == mock.DL360 {
+			r, err = NewHpe(s.Host(), cfg, nil, l)
+		} else {
+			r, err = NewLenovo(s.Host(), cfg, nil, l)
+		}
+		must(t, err)
+		_, err = r.ConfigureStorage(rootLayout(".*", 2, true))
+		assert.Error(t, err, model)
+		assert.Equal(t, 0, posts(s), model)
+	}
+}
@@ -0,0 +1,95 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redfish
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stmcginnis/gofish/redfish"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// poll intervals of the virtual media boot. Tests against the redfish mock shorten them
+var (
+	mediaPollInterval = 5 * time.Second
+	bootPollInterval  = 15 * time.Second
+)
+
+// bootFromImage inserts the image and reboots the node with the vendor specific one time boot from virtual media.
+// The media has to be connected before the reboot, afterwards booted reports if the node booted from it
+func (p *Default) bootFromImage(path string, insertMedia func(image string) error, reboot func(boot redfish.Boot) error, booted func() (bool, error)) (err error) {
+	if err = p.client.Connect(); err != nil {
+		return
+	}
+	p.log.Debugf("booting image: %s", path)
+	if err = insertMedia(path); err != nil {
+		return fmt.Errorf("cannot insert virtual media: %s", err.Error())
+	}
+	if err = p.waitMediaConnected(path); err != nil {
+		return
+	}
+	bootOverride := redfish.Boot{
+		BootSourceOverrideTarget:  redfish.CdBootSourceOverrideTarget,
+		BootSourceOverrideEnabled: redfish.OnceBootSourceOverrideEnabled,
+	}
+	if err = reboot(bootOverride); err != nil {
+		return fmt.Errorf("cannot reboot from virtual media: %s", err.Error())
+	}
+	cf := wait.ConditionFunc(func() (bool, error) {
+		ok, err := booted()
+		if err != nil {
+			p.log.Debugf("waiting for virtual media boot: %s", err.Error())
+			return false, nil
+		}
+		return ok, nil
+	})
+	if err = wait.Poll(bootPollInterval, 10*time.Minute, cf); err != nil {
+		return fmt.Errorf("node did not boot from virtual media: %s", err.Error())
+	}
+	p.log.Info("node booted from virtual media")
+	return
+}
+
+// waitMediaConnected waits until the bmc reports the image as inserted and connected
+func (p *Default) waitMediaConnected(path string) (err error) {
+	cf := wait.ConditionFunc(func() (bool, error) {
+		vm, err := p.getDVDMediaType()
+		if err != nil {
+			return false, nil
+		}
+		if vm == nil {
+			return false, fmt.Errorf("no virtual cd/dvd found")
+		}
+		p.log.Debugf("waiting for virtual media: inserted %t, image %s, connected via %s", vm.Inserted, vm.Image, vm.ConnectedVia)
+		return vm.Inserted && vm.Image == path && vm.ConnectedVia != redfish.NotConnectedConnectedVia, nil
+	})
+	if err = wait.Poll(mediaPollInterval, 2*time.Minute, cf); err != nil {
+		return fmt.Errorf("virtual media not connected: %s", err.Error())
+	}
+	return
+}
+
+// overrideConsumed reports if the node is powered on and the one time boot override was used by the last boot
+func (p *Default) overrideConsumed() (bool, error) {
+	sys, err := p.client.Client.Service.Systems()
+	if err != nil || len(sys) == 0 {
+		return false, fmt.Errorf("cannot load system")
+	}
+	p.log.Debugf("waiting for virtual media boot: power state %s, boot override %s", sys[0].PowerState, sys[0].Boot.BootSourceOverrideEnabled)
+	return sys[0].PowerState == redfish.OnPowerState && sys[0].Boot.BootSourceOverrideEnabled != redfish.OnceBootSourceOverrideEnabled, nil
+}
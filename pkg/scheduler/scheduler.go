@@ -108,6 +108,7 @@ func (r *Scheduler) temper(n string) {
 		r.log.Error(err)
 		return
 	}
+	ni.Source = "scheduler"
 	ni.AddTask("dns", "create")
 	ni.Temper(true, &wg, nil)
 	r.log.Infof("finished tempering node: %s", n)
@@ -120,9 +121,20 @@ func (r *Scheduler) loadNodes() (nodes []string, err error) {
 	targets := make([]NetboxDiscovery, 0)
 	nodes = make([]string, 0)
 	if r.cfg.NetboxNodesPath == "" {
-		nodes, err = r.nc.LoadNodes(r.cfg.NetboxQuery, nil, &r.cfg.Region)
-		if err != nil {
-			return
+		// workflows may share a trigger status
+		seen := make(map[string]bool)
+		for _, status := range r.cfg.Status.Triggers("scheduler") {
+			status := status
+			ns, err := r.nc.LoadNodes(r.cfg.NetboxQuery, &status, &r.cfg.Region)
+			if err != nil {
+				return nodes, err
+			}
+			for _, n := range ns {
+				if !seen[n] {
+					seen[n] = true
+					nodes = append(nodes, n)
+				}
+			}
 		}
 		return
 	}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/sapcc/baremetal_temper/pkg/config"
+	"github.com/sapcc/baremetal_temper/pkg/diagnostics"
 	"github.com/sapcc/baremetal_temper/pkg/node"
 	"github.com/sapcc/baremetal_temper/pkg/temper"
 	log "github.com/sirupsen/logrus"
@@ -20,14 +23,14 @@ import (
 type Handler struct {
 	Router *mux.Router
 	cfg    config.Config
-	Events chan node.Node
+	Events chan *node.Node
 	t      *temper.Temper
 	l      *log.Entry
 }
 
 // New http handler
 func New(cfg config.Config, l *log.Entry, t *temper.Temper) *Handler {
-	e := make(chan node.Node)
+	e := make(chan *node.Node)
 	h := Handler{mux.NewRouter(), cfg, e, t, l}
 	return &h
 }
@@ -41,8 +44,100 @@ func (h *Handler) RegisterEventRoute() {
 func (h *Handler) RegisterAPIRoutes() {
 	h.Router.HandleFunc("/api/nodes/{node}/tasks/{task}", h.temperHandler).Methods("POST")
 	h.Router.HandleFunc("/api/nodes", h.nodeListHandler).Methods("GET")
+	h.Router.HandleFunc("/api/nodes/{node}/diff", h.diffHandler).Methods("GET")
+	h.RegisterAgentRoute()
+	if h.cfg.Diagnostics.ResultsPath != "" {
+		h.Router.HandleFunc("/api/diagnostics/trends", h.trendsHandler).Methods("GET")
+	}
 	if h.t != nil {
 		h.Router.HandleFunc("/api/nodes/webhook", h.webhookHandler).Methods("POST")
+		h.Router.HandleFunc("/api/nodes/{node}/cablecheck/approve", h.cableApproveHandler).Methods("POST")
+	}
+}
+
+// RegisterAgentRoute for the reports of the boot image agent and the burn-in plans and results
+func (h *Handler) RegisterAgentRoute() {
+	h.Router.HandleFunc("/api/agent/report", h.agentHandler).Methods("POST")
+	h.Router.HandleFunc("/api/agent/burnin/plan", h.burninPlanHandler).Methods("GET")
+	h.Router.HandleFunc("/api/agent/burnin", h.burninResultHandler).Methods("POST")
+}
+
+// burninPlanHandler returns the burn-in plan of the node with the serial number.
+// The agent signs the serial number
+func (h *Handler) burninPlanHandler(w http.ResponseWriter, r *http.Request) {
+	serial := r.URL.Query().Get("serial")
+	if err := diagnostics.VerifyAgentSignature([]byte(serial), r.Header.Get(diagnostics.AgentSignatureHeader), h.cfg.Agent.Secret); err != nil {
+		h.l.Warnf("rejected burn-in plan request from %s: %s", r.RemoteAddr, err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p, ok := diagnostics.GetBurninPlan(serial)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) burninResultHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	res, err := diagnostics.VerifyBurninResult(b, r.Header.Get(diagnostics.AgentSignatureHeader), h.cfg.Agent.Secret)
+	if err != nil {
+		h.l.Warnf("rejected burn-in result from %s: %s", r.RemoteAddr, err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.l.Debugf("burn-in result of serial %s", res.Serial)
+	diagnostics.AddBurninResult(res)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) agentHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	report, err := diagnostics.VerifyAgentReport(b, r.Header.Get(diagnostics.AgentSignatureHeader), h.cfg.Agent.Secret)
+	if err != nil {
+		h.l.Warnf("rejected boot image agent report from %s: %s", r.RemoteAddr, err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.l.Debugf("boot image agent report of node %s, serial %s", report.Node, report.Serial)
+	diagnostics.AddAgentReport(report)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// trendsHandler returns the component tests warning or failing on at least min (default 2) nodes of a rack
+func (h *Handler) trendsHandler(w http.ResponseWriter, r *http.Request) {
+	min := 2
+	if m := r.URL.Query().Get("min"); m != "" {
+		i, err := strconv.Atoi(m)
+		if err != nil || i < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		min = i
+	}
+	runs, err := diagnostics.LoadRuns(h.cfg.Diagnostics.ResultsPath)
+	if err != nil {
+		h.l.Errorf("cannot load diagnostics results: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(diagnostics.Trends(runs, min)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 }
 
@@ -53,6 +148,42 @@ func (h *Handler) nodeListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) diffHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := node.New(mux.Vars(r)["node"], h.cfg)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	drift, err := n.Diff()
+	if err != nil {
+		h.l.Errorf("cannot diff node %s: %s", n.Name, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(drift); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// cableApproveHandler updates the netbox cables of a node to the lldp topology observed by its last cablecheck.reconcile
+func (h *Handler) cableApproveHandler(w http.ResponseWriter, r *http.Request) {
+	n, ok := h.t.GetNodes()[mux.Vars(r)["node"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := n.ApproveCableReconcile(); err != nil {
+		h.l.Errorf("cannot reconcile cables of node %s: %s", n.Name, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(n.CableResults()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
 func (h *Handler) temperHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	n, ok := vars["node"]
@@ -84,28 +215,36 @@ func (h *Handler) webhookHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if wb.Data.Status.Value != "inventory" || wb.Data.Role.Slug != "server" {
+	triggers := h.cfg.Status.Triggers("webhook")
+	if !contains(triggers, wb.Data.Status.Value) || wb.Data.Role.Slug != "server" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 	// older nebtbox version does not provide snapshots
 	if wb.Snapshots == (webhookBody{}.Snapshots) {
-		if wb.Data.Status.Value == "inventory" {
-			h.l.Debugf("--->temper node: %s", wb.Data.Name)
-			n, _ := node.New(wb.Data.Name, h.cfg)
-			h.t.AddNode(n)
-		}
+		h.l.Debugf("--->temper node: %s", wb.Data.Name)
+		h.addWebhookNode(wb.Data.Name)
 	} else {
 		h.l.Debugf("webhook event. snapshots", wb.Snapshots)
-		if wb.Snapshots.PreChange.Status != "inventory" && wb.Snapshots.PostChange.Status == "inventory" {
+		if wb.Snapshots.PreChange.Status != wb.Snapshots.PostChange.Status && contains(triggers, wb.Snapshots.PostChange.Status) {
 			h.l.Debugf("--->temper node: %s", wb.Data.Name)
-			n, _ := node.New(wb.Data.Name, h.cfg)
-			h.t.AddNode(n)
+			h.addWebhookNode(wb.Data.Name)
 		}
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// addWebhookNode tempers the node with the workflows started by webhooks
+func (h *Handler) addWebhookNode(name string) {
+	n, err := node.New(name, h.cfg)
+	if err != nil {
+		h.l.Errorf("cannot temper node %s: %s", name, err.Error())
+		return
+	}
+	n.Source = "webhook"
+	h.t.AddNode(n)
+}
+
 func (h *Handler) eventHandler(w http.ResponseWriter, r *http.Request) {
 	p := strings.Split(r.URL.Path, "/")
 	defer r.Body.Close()
@@ -131,3 +270,12 @@ func (h *Handler) execTasks(n string, u *url.URL, ctx context.Context) (err erro
 	}
 	return
 }
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}